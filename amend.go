@@ -0,0 +1,170 @@
+package libpack
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+// ErrPublished is returned by Amend when the commit to amend was already
+// pushed or pulled, so other repositories may depend on it.
+var ErrPublished = errors.New("the last commit was already pushed or pulled")
+
+// publishedRefPrefix is the prefix of the references recording the last
+// commit exchanged with a remote by Push or Pull.
+const publishedRefPrefix = "refs/libpack/published/"
+
+func (db *DB) publishedRef() string {
+	return publishedRefPrefix + strings.TrimPrefix(db.ref, "refs/")
+}
+
+// markPublished records that the commit currently pointed to by the
+// database's reference was exchanged with a remote.
+func (db *DB) markPublished() error {
+	target := db.refTarget()
+	if target == "" {
+		return nil
+	}
+	id, err := git.NewOid(target)
+	if err != nil {
+		return err
+	}
+	ref, err := db.repo.CreateReference(db.publishedRef(), id, true, db.signature(), "libpack.published")
+	if err != nil {
+		return err
+	}
+	ref.Free()
+	return nil
+}
+
+// isPublished returns true if commit id is contained in the last commit
+// exchanged with a remote, or in the last fetched head.
+func (db *DB) isPublished(id *git.Oid) (bool, error) {
+	for _, name := range []string{db.publishedRef(), db.fetchedRef()} {
+		ref, err := db.repo.LookupReference(name)
+		if err != nil {
+			continue
+		}
+		target := ref.Target()
+		ref.Free()
+		if target.Equal(id) {
+			return true, nil
+		}
+		base, err := db.repo.MergeBase(id, target)
+		if err != nil {
+			// No common history
+			continue
+		}
+		if base.Equal(id) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Amend replaces the latest commit with a new commit of the uncommitted
+// tree, with the same parents. If msg is empty, the message of the
+// replaced commit is kept.
+// Amend refuses to replace a commit which was already pushed or pulled,
+// and returns ErrPublished: see ForceAmend. If the parents of the commit
+// were not downloaded (see WithDepth), ErrShallowHistory is returned.
+func (db *DB) Amend(msg string) error {
+	return db.amend(msg, false)
+}
+
+// ForceAmend is like Amend, but also replaces commits which were
+// already pushed or pulled.
+func (db *DB) ForceAmend(msg string) error {
+	return db.amend(msg, true)
+}
+
+func (db *DB) amend(msg string, force bool) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("amend", "", &err)
+	if db.parent != nil {
+		return db.parent.amend(msg, force)
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	commit, err := db.amendLocked(msg, db.signature(), force)
+	if err != nil {
+		return err
+	}
+	defer commit.Free()
+	db.runPostCommitHooks(commit)
+	return nil
+}
+
+func (db *DB) amendLocked(msg string, sig *git.Signature, force bool) (*git.Commit, error) {
+	db.l.Lock()
+	defer db.l.Unlock()
+	if err := db.flushLocked(); err != nil {
+		return nil, err
+	}
+	old := db.commit
+	if old == nil {
+		return nil, fmt.Errorf("no commit to amend")
+	}
+	if !force {
+		if published, err := db.isPublished(old.Id()); err != nil {
+			return nil, err
+		} else if published {
+			return nil, ErrPublished
+		}
+	}
+	if msg == "" {
+		msg = old.Message()
+	}
+	tree := db.tree
+	if tree == nil {
+		var err error
+		if tree, err = old.Tree(); err != nil {
+			return nil, err
+		}
+		defer tree.Free()
+	}
+	var parents []*git.Commit
+	for i := uint(0); i < old.ParentCount(); i++ {
+		p := old.Parent(i)
+		if p == nil {
+			return nil, ErrShallowHistory
+		}
+		defer p.Free()
+		parents = append(parents, p)
+	}
+	var first *git.Commit
+	if len(parents) > 0 {
+		first = parents[0]
+	}
+	if err := db.runCommitHooks(first, tree); err != nil {
+		return nil, err
+	}
+	if db.locking {
+		unlock, err := lockRepo(db.repo.Path(), db.lockTimeout)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+	var extra []*git.Commit
+	if len(parents) > 1 {
+		extra = parents[1:]
+	}
+	commit, err := mkCommit(db.repo, "", msg, sig, db.signer, tree, first, extra...)
+	if err != nil {
+		return nil, err
+	}
+	// Only move the reference if nobody else did
+	if err := updateRef(db.repo, db.ref, commit.Id(), old.Id().String(), "libpack.amend"); err != nil {
+		commit.Free()
+		return nil, fmt.Errorf("amend: %w", err)
+	}
+	old.Free()
+	db.commit = commit
+	return db.ownCommit(commit, nil)
+}
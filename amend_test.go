@@ -0,0 +1,68 @@
+package libpack
+
+import (
+	"testing"
+)
+
+func TestAmend(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	if err := db.Amend("nothing"); err == nil {
+		t.Fatalf("amending an empty ref should fail")
+	}
+	db.Set("foo", "A")
+	if err := db.Commit("first"); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := db.Head()
+	db.Set("tpyo", "B")
+	if err := db.Commit("second"); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := db.Head()
+	db.Delete("tpyo")
+	db.Set("typo", "B")
+	if err := db.Amend(""); err != nil {
+		t.Fatal(err)
+	}
+	amended, _ := db.Head()
+	if amended == second {
+		t.Fatalf("head should have changed")
+	}
+	log, err := db.Log("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 2 || log[0].Message != "second" || log[0].Parents[0] != first {
+		t.Fatalf("%#v", log)
+	}
+	assertGet(t, db, "typo", "B")
+	assertNotExist(t, db, "tpyo")
+	if err := db.Amend("second, fixed"); err != nil {
+		t.Fatal(err)
+	}
+	if log, _ := db.Log("", 1); log[0].Message != "second, fixed" {
+		t.Fatalf("%#v", log)
+	}
+
+	// Published commits can only be amended by force
+	remote := tmpDB(t, "")
+	defer nukeDB(remote)
+	if err := db.Push(remote.Repo().Path(), remote.ref); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Amend("again"); err != ErrPublished {
+		t.Fatalf("%v", err)
+	}
+	if err := db.ForceAmend("again"); err != nil {
+		t.Fatal(err)
+	}
+	// Commits made after the push can be amended
+	db.Set("bar", "C")
+	if err := db.Commit("third"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Amend("third, fixed"); err != nil {
+		t.Fatal(err)
+	}
+}
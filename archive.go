@@ -0,0 +1,66 @@
+package libpack
+
+import (
+	"fmt"
+
+	git "github.com/libgit2/git2go"
+)
+
+// Archive moves the subtree at prefix to the reference archiveRef, in
+// the same repository: the subtree is committed at the same path on top
+// of archiveRef, which is created if it doesn't exist, and then deleted
+// from the uncommitted tree of the database. Commit finishes the move.
+// If archiveRef already contains data at prefix, the subtree is merged
+// into it, with archived values winning. Otherwise the subtree is reused
+// as it is, so no content is copied.
+// The archive is a regular database, which can be opened with Open.
+func (db *DB) Archive(prefix, archiveRef, msg string) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("archive", prefix, &err)
+	key := TreePath(db.fullKey(prefix))
+	if key == "/" {
+		return fmt.Errorf("can't archive the root of the tree")
+	}
+	root := db.root()
+	if archiveRef == root.ref {
+		return fmt.Errorf("can't archive to the database's own reference")
+	}
+	sig := root.signature()
+	root.l.Lock()
+	defer root.l.Unlock()
+	if err := root.flushLocked(); err != nil {
+		return err
+	}
+	if root.tree == nil {
+		return ErrNotExist
+	}
+	e, err := root.tree.EntryByPath(key)
+	if err != nil {
+		if git.IsErrorCode(err, git.ErrNotFound) {
+			return ErrNotExist
+		}
+		return err
+	}
+	tip := lookupTip(root.repo, archiveRef)
+	var base *git.Tree
+	if tip != nil {
+		defer tip.Free()
+		if base, err = tip.Tree(); err != nil {
+			return err
+		}
+		defer base.Free()
+	}
+	tree, err := treeAdd(root.repo, base, key, e.Id, true)
+	if err != nil {
+		return err
+	}
+	defer tree.Free()
+	commit, err := commitToRef(root.repo, tree, tip, archiveRef, msg, sig, root.signer)
+	if err != nil {
+		return err
+	}
+	commit.Free()
+	return root.stage(key, nil, 0)
+}
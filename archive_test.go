@@ -0,0 +1,50 @@
+package libpack
+
+import (
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("jobs/2019/a", "A")
+	db.Set("jobs/2019/b", "B")
+	db.Set("jobs/2020/c", "C")
+	if err := db.Commit("jobs"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := db.Stat("jobs/2019")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Archive("jobs/2019", "refs/heads/archive", "archive 2019"); err != nil {
+		t.Fatal(err)
+	}
+	assertNotExist(t, db, "jobs/2019/a")
+	assertGet(t, db, "jobs/2020/c", "C")
+	if err := db.Commit("archived 2019"); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := Open(db.Repo().Path(), "refs/heads/archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Free()
+	assertGet(t, archive, "jobs/2019/a", "A")
+	assertGet(t, archive, "jobs/2019/b", "B")
+	assertNotExist(t, archive, "jobs/2020/c")
+	// The subtree was not copied
+	if after, err := archive.Stat("jobs/2019"); err != nil || after.Id != before.Id {
+		t.Fatalf("%v %v != %v", err, after.Id, before.Id)
+	}
+	// Archiving more data adds to the archive
+	if err := db.Scope("jobs").Archive("2020", "refs/heads/archive", "archive 2020"); err != nil {
+		t.Fatal(err)
+	}
+	archive.Update()
+	assertGet(t, archive, "jobs/2019/a", "A")
+	assertGet(t, archive, "jobs/2020/c", "C")
+	if err := db.Archive("missing", "refs/heads/archive", ""); err != ErrNotExist {
+		t.Fatalf("%v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package libpack
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultAutoCommitKeys is the number of keys named in the messages of
+// automatic commits, if AutoCommitOpt.MaxKeys is not set.
+const DefaultAutoCommitKeys = 5
+
+// AutoCommitOpt are the settings of SetAutoCommit. The zero value
+// disables automatic commits.
+type AutoCommitOpt struct {
+	// If set, each write is committed before the method which made it
+	// returns.
+	Immediate bool
+	// Otherwise, changes are committed in the background in batches:
+	// every Interval, and as soon as MaxChanges keys are changed. At
+	// least one of them must be set.
+	Interval   time.Duration
+	MaxChanges int
+	// Maximum number of keys named in the message of each commit
+	MaxKeys int
+	// Called with the errors of background commits. If nil, errors are
+	// logged, see SetLogger.
+	OnError func(error)
+}
+
+// autoCommitter is the state of the automatic commits of a database.
+type autoCommitter struct {
+	opt AutoCommitOpt
+	// Keys changed since the last commit, and whether they were deleted
+	changed map[string]bool
+	// Wakes up the background flusher when MaxChanges is reached
+	kick chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// SetAutoCommit makes the database commit its changes automatically, with
+// messages generated from the changed keys, such as "set foo".
+// Only the changes made through the Set and Delete families of methods,
+// and those that change the tree in a single operation like Mkdir, are
+// tracked. Commit can still be called at any time, and commits the
+// current batch. Close commits the last batch.
+// Calling SetAutoCommit again replaces the previous settings, after
+// committing the current batch.
+func (db *DB) SetAutoCommit(opt AutoCommitOpt) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("auto-commit", "", &err)
+	if db.parent != nil {
+		return db.parent.SetAutoCommit(opt)
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	enabled := opt.Immediate || opt.Interval > 0 || opt.MaxChanges > 0
+	if opt.Interval < 0 || opt.MaxChanges < 0 {
+		return fmt.Errorf("invalid auto-commit settings: %+v", opt)
+	}
+	if err := db.stopAutoCommit(); err != nil {
+		return err
+	}
+	if !enabled {
+		return nil
+	}
+	if opt.MaxKeys <= 0 {
+		opt.MaxKeys = DefaultAutoCommitKeys
+	}
+	a := &autoCommitter{
+		opt:     opt,
+		changed: make(map[string]bool),
+	}
+	if !opt.Immediate {
+		a.kick = make(chan struct{}, 1)
+		a.stop = make(chan struct{})
+		a.done = make(chan struct{})
+		go db.autoCommitLoop(a)
+	}
+	db.l.Lock()
+	db.autoCommit = a
+	db.l.Unlock()
+	return nil
+}
+
+// stopAutoCommit disables automatic commits, and commits the current
+// batch.
+func (db *DB) stopAutoCommit() error {
+	db.l.Lock()
+	a := db.autoCommit
+	db.autoCommit = nil
+	db.l.Unlock()
+	if a == nil {
+		return nil
+	}
+	if a.stop != nil {
+		close(a.stop)
+		<-a.done
+	}
+	return db.commitAuto(a)
+}
+
+func (db *DB) autoCommitLoop(a *autoCommitter) {
+	defer close(a.done)
+	var tick <-chan time.Time
+	if a.opt.Interval > 0 {
+		ticker := time.NewTicker(a.opt.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-tick:
+		case <-a.kick:
+		}
+		if err := db.commitAuto(a); err != nil {
+			if a.opt.OnError != nil {
+				a.opt.OnError(err)
+			} else {
+				db.logf(LogInfo, "auto-commit: %v", err)
+			}
+		}
+	}
+}
+
+// recordAutoCommit records a change of key for the next automatic
+// commit. The caller must hold the lock.
+func (db *DB) recordAutoCommit(key string, deleted bool) {
+	if db.autoCommit == nil || isInternal(key) {
+		return
+	}
+	db.autoCommit.changed[key] = deleted
+}
+
+// resetAutoCommit starts a new batch of automatic commits after a commit.
+// The caller must hold the lock.
+func (db *DB) resetAutoCommit() {
+	if db.autoCommit != nil {
+		db.autoCommit.changed = make(map[string]bool)
+	}
+}
+
+// afterWrite commits the changes made by a write if auto-commit is
+// immediate, or wakes up the background flusher if the batch is full.
+// It is deferred by write methods before they lock the database, with
+// their error: nothing is committed if the write failed.
+func (db *DB) afterWrite(err *error) {
+	if *err != nil {
+		return
+	}
+	root := db.root()
+	root.l.RLock()
+	a := root.autoCommit
+	full := a != nil && a.opt.MaxChanges > 0 && len(a.changed) >= a.opt.MaxChanges
+	root.l.RUnlock()
+	switch {
+	case a == nil:
+	case a.opt.Immediate:
+		*err = root.commitAuto(a)
+	case full:
+		select {
+		case a.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// commitAuto commits the uncommitted changes with a message listing the
+// keys changed since the last commit.
+func (db *DB) commitAuto(a *autoCommitter) error {
+	db.l.RLock()
+	msg := autoCommitMessage(a.changed, a.opt.MaxKeys)
+	db.l.RUnlock()
+	return db.Commit(msg)
+}
+
+// autoCommitMessage returns a commit message naming at most max of the
+// changed keys, such as "set a, b; delete c and 2 more".
+func autoCommitMessage(changed map[string]bool, max int) string {
+	if len(changed) == 0 {
+		return "auto-commit"
+	}
+	keys := make([]string, 0, len(changed))
+	for k := range changed {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var set, deleted []string
+	for _, k := range keys {
+		if len(set)+len(deleted) == max {
+			break
+		}
+		if changed[k] {
+			deleted = append(deleted, k)
+		} else {
+			set = append(set, k)
+		}
+	}
+	var parts []string
+	if len(set) > 0 {
+		parts = append(parts, "set "+strings.Join(set, ", "))
+	}
+	if len(deleted) > 0 {
+		parts = append(parts, "delete "+strings.Join(deleted, ", "))
+	}
+	msg := strings.Join(parts, "; ")
+	if more := len(keys) - len(set) - len(deleted); more > 0 {
+		msg += fmt.Sprintf(" and %d more", more)
+	}
+	return msg
+}
@@ -0,0 +1,154 @@
+package libpack
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lastMessage returns the message of the latest commit of db.
+func lastMessage(t *testing.T, db *DB) string {
+	commits, err := db.Log("", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(commits[0].Message)
+}
+
+func TestAutoCommitImmediate(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	if err := db.SetAutoCommit(AutoCommitOpt{Immediate: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := lastMessage(t, db); msg != "set foo" {
+		t.Fatalf("%q", msg)
+	}
+	if err := db.Scope("a").SetMany(map[string]string{"x": "1", "y": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := lastMessage(t, db); msg != "set a/x, a/y" {
+		t.Fatalf("%q", msg)
+	}
+	if err := db.Delete("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := lastMessage(t, db); msg != "delete foo" {
+		t.Fatalf("%q", msg)
+	}
+	// Failed writes don't commit
+	head := db.headId().String()
+	if err := db.Delete("missing"); err != ErrNotExist {
+		t.Fatal(err)
+	}
+	if db.headId().String() != head {
+		t.Fatalf("failed write was committed")
+	}
+	// Disabling
+	if err := db.SetAutoCommit(AutoCommitOpt{}); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("foo", "baz")
+	if db.headId().String() != head {
+		t.Fatalf("auto-commit is still enabled")
+	}
+}
+
+func TestAutoCommitBatch(t *testing.T) {
+	db := tmpDB(t, "")
+	dir := db.Repo().Path()
+	defer os.RemoveAll(dir)
+	if err := db.SetAutoCommit(AutoCommitOpt{MaxChanges: 3}); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("a", "1")
+	db.Set("b", "2")
+	if db.headId() != nil {
+		t.Fatalf("batch committed too early")
+	}
+	db.Set("c", "3")
+	deadline := time.Now().Add(5 * time.Second)
+	for db.headId() == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("batch was not committed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if msg := lastMessage(t, db); msg != "set a, b, c" {
+		t.Fatalf("%q", msg)
+	}
+	// Explicit commits flush the batch
+	db.Set("d", "4")
+	if err := db.Commit("explicit"); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("e", "5")
+	db.Delete("a")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(dir, "refs/heads/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Free()
+	assertGet(t, reopened, "e", "5")
+	if msg := lastMessage(t, reopened); msg != "set e; delete a" {
+		t.Fatalf("%q", msg)
+	}
+}
+
+func TestAutoCommitInterval(t *testing.T) {
+	db := tmpDB(t, "")
+	defer os.RemoveAll(db.Repo().Path())
+	if err := db.SetAutoCommit(AutoCommitOpt{Interval: 10 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	db.Set("foo", "bar")
+	deadline := time.Now().Add(5 * time.Second)
+	for db.headId() == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("batch was not committed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAutoCommitError(t *testing.T) {
+	db := tmpDB(t, "")
+	defer os.RemoveAll(db.Repo().Path())
+	logger := &testLogger{}
+	db.SetLogger(logger)
+	db.AddCommitHook(func([]Change) error { return fmt.Errorf("refused") })
+	if err := db.SetAutoCommit(AutoCommitOpt{Interval: 10 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	db.Set("foo", "bar")
+	deadline := time.Now().Add(5 * time.Second)
+	for !logger.logged("info: auto-commit: ") {
+		if time.Now().After(deadline) {
+			t.Fatalf("the error was not logged: %q", logger.messages)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAutoCommitMessage(t *testing.T) {
+	changed := make(map[string]bool)
+	for i := 0; i < 8; i++ {
+		changed[fmt.Sprintf("k%d", i)] = i%2 == 1
+	}
+	if msg := autoCommitMessage(changed, 4); msg != "set k0, k2; delete k1, k3 and 4 more" {
+		t.Fatalf("%q", msg)
+	}
+	if msg := autoCommitMessage(nil, 4); msg != "auto-commit" {
+		t.Fatalf("%q", msg)
+	}
+}
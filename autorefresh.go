@@ -0,0 +1,74 @@
+package libpack
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// AutoRefresh makes the read methods of the database (Get, List, Walk,
+// Dump and Stat) check whether its reference has moved, at most once per
+// maxStaleness, and update the uncommitted tree when it has, as Update
+// would. If there are uncommitted changes, the tree is left unchanged,
+// and Stale returns true until they are committed or discarded.
+// Readers are only blocked while the new tree is swapped in: the
+// reference is looked up without holding the lock, and only one reader
+// at a time checks it.
+func AutoRefresh(maxStaleness time.Duration) Option {
+	return func(db *DB) {
+		db.refresh = &refresher{every: maxStaleness}
+	}
+}
+
+// refresher is the state of the automatic refreshes of a database.
+type refresher struct {
+	// Time of the last check, in nanoseconds since the epoch. Accessed
+	// atomically.
+	last  int64
+	every time.Duration
+}
+
+// autoRefresh updates db if its reference has moved, and the last check
+// is older than the delay set with AutoRefresh. Errors are logged, and
+// the current tree is kept.
+func (db *DB) autoRefresh() {
+	root := db.root()
+	rf := root.refresh
+	if rf == nil {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&rf.last)
+	if now-last < int64(rf.every) || !atomic.CompareAndSwapInt64(&rf.last, last, now) {
+		// Checked recently, or being checked by another reader
+		return
+	}
+	tip := refTarget(root.repo, root.ref)
+	root.l.RLock()
+	current := commitName(root.commit)
+	dirty := root.dirtyLocked()
+	root.l.RUnlock()
+	if tip == "" || tip == current {
+		return
+	}
+	if dirty {
+		root.logf(LogDebug, "%s: moved to %s, keeping uncommitted changes on top of %s", root.ref, tip, current)
+		return
+	}
+	if err := root.UpdateWith(UpdateOpt{OnDirty: DirtyFail}); err != nil && err != ErrDirty {
+		root.logf(LogInfo, "%s: refresh failed: %v", root.ref, err)
+	}
+}
+
+// Stale returns true if the reference of the database has moved since
+// the uncommitted tree was last updated: by Update, Commit, or an
+// automatic refresh (see AutoRefresh).
+func (db *DB) Stale() bool {
+	if db.checkClosed() != nil {
+		return false
+	}
+	root := db.root()
+	tip := refTarget(root.repo, root.ref)
+	root.l.RLock()
+	defer root.l.RUnlock()
+	return tip != "" && tip != commitName(root.commit)
+}
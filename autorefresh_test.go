@@ -0,0 +1,96 @@
+package libpack
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAutoRefresh(t *testing.T) {
+	writer := tmpDB(t, "")
+	defer nukeDB(writer)
+	writer.Set("foo", "A")
+	writer.Commit("A")
+
+	reader, err := Open(writer.Repo().Path(), writer.ref, AutoRefresh(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Free()
+	assertGet(t, reader, "foo", "A")
+
+	writer.Set("foo", "B")
+	writer.Commit("B")
+	if !reader.Stale() {
+		t.Fatalf("reader should be stale")
+	}
+	assertGet(t, reader, "foo", "B")
+	if reader.Stale() {
+		t.Fatalf("reader should not be stale")
+	}
+	// Scoped databases refresh their root
+	writer.Set("dir/bar", "C")
+	writer.Commit("C")
+	if names, err := reader.Scope("dir").List("/"); err != nil || len(names) != 1 || names[0] != "bar" {
+		t.Fatalf("%v %v", names, err)
+	}
+
+	// Uncommitted changes are kept
+	reader.Set("local", "1")
+	writer.Set("foo", "D")
+	writer.Commit("D")
+	assertGet(t, reader, "foo", "B")
+	assertGet(t, reader, "local", "1")
+	if !reader.Stale() {
+		t.Fatalf("reader should be stale")
+	}
+	if err := reader.Update(); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, reader, "foo", "D")
+	assertNotExist(t, reader, "local")
+	if reader.Stale() {
+		t.Fatalf("reader should not be stale")
+	}
+}
+
+func TestAutoRefreshDelay(t *testing.T) {
+	writer := tmpDB(t, "")
+	defer nukeDB(writer)
+	writer.Set("foo", "A")
+	writer.Commit("A")
+
+	reader, err := Open(writer.Repo().Path(), writer.ref, AutoRefresh(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Free()
+	// The first read checks the reference
+	writer.Set("foo", "B")
+	writer.Commit("B")
+	assertGet(t, reader, "foo", "B")
+	// Later reads don't, until the delay has passed
+	writer.Set("foo", "C")
+	writer.Commit("C")
+	assertGet(t, reader, "foo", "B")
+	reader.refresh.last -= int64(time.Hour)
+	assertGet(t, reader, "foo", "C")
+}
+
+func TestNoAutoRefresh(t *testing.T) {
+	writer := tmpDB(t, "")
+	defer nukeDB(writer)
+	writer.Set("foo", "A")
+	writer.Commit("A")
+
+	reader, err := Open(writer.Repo().Path(), writer.ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Free()
+	writer.Set("foo", "B")
+	writer.Commit("B")
+	assertGet(t, reader, "foo", "A")
+	if !reader.Stale() {
+		t.Fatalf("reader should be stale")
+	}
+}
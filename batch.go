@@ -0,0 +1,263 @@
+package libpack
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+// BatchTrailer is the trailer which Batch adds to the message of its
+// commits, with the label of the batch as value, for example
+// "Libpack-Op: rotate-credentials". See CommitInfo.Op.
+const BatchTrailer = "Libpack-Op"
+
+// ErrNestedBatch is returned by Batch when another batch is running on
+// the database, for example when Batch is called from the function of
+// a batch: batches can't be nested.
+var ErrNestedBatch = errors.New("a batch is already running")
+
+// A Batch records changes in a private overlay of the tree of a database,
+// so that they can be committed together, see DB.Batch. Keys are
+// relative to the scope of the database.
+type Batch struct {
+	db *DB
+	// Tree and head of the database when the batch started
+	base *git.Tree
+	head string
+	// Tree of the batch, with its changes
+	tree *git.Tree
+}
+
+// Batch calls f with a new Batch, and if f returns nil, applies the
+// changes made through the batch and commits them in a single commit,
+// whose id is returned. The message of the commit is label, followed by
+// a BatchTrailer line. If f returns an error, or if the commit fails,
+// nothing is changed and the error is returned. If the batch doesn't
+// change anything, nothing is committed and the id is empty.
+// Changes made directly to the database while f runs are not part of
+// the batch: the database must have no uncommitted changes when the batch
+// starts and when it is applied, otherwise ErrDirty is returned. If the
+// database was updated to another commit in the meantime, a
+// *StaleHeadError is returned.
+func (db *DB) Batch(label string, f func(b *Batch) error) (commitID string, err error) {
+	if err := db.checkClosed(); err != nil {
+		return "", err
+	}
+	defer db.wrapError("batch", "", &err)
+	root := db.root()
+	if root.readOnly {
+		return "", ErrReadOnly
+	}
+	if label == "" || strings.ContainsAny(label, "\r\n") {
+		return "", fmt.Errorf("invalid batch label: %q", label)
+	}
+	if !atomic.CompareAndSwapInt32(&root.batching, 0, 1) {
+		return "", ErrNestedBatch
+	}
+	defer atomic.StoreInt32(&root.batching, 0)
+	start := time.Now()
+	m := root.metricsSink()
+	if m != nil {
+		defer observeOp(m, "batch", start, &err)
+	}
+	root.l.Lock()
+	if err := root.flushLocked(); err != nil {
+		root.l.Unlock()
+		return "", err
+	}
+	dirty := root.dirtyLocked()
+	b := &Batch{db: db, base: root.tree, head: headName(root.commit), tree: root.tree}
+	root.l.Unlock()
+	if dirty {
+		return "", ErrDirty
+	}
+	if err := f(b); err != nil {
+		return "", err
+	}
+	commit, err := root.applyBatch(b, label)
+	if err != nil || commit == nil {
+		return "", err
+	}
+	defer commit.Free()
+	if m != nil {
+		root.observeCommit(m, commit, time.Since(start))
+	}
+	root.runPostCommitHooks(commit)
+	return commit.Id().String(), nil
+}
+
+// applyBatch replaces the uncommitted tree with the tree of b, and
+// commits it with the label of the batch. If the commit fails, the
+// uncommitted tree is restored.
+func (db *DB) applyBatch(b *Batch, label string) (*git.Commit, error) {
+	db.l.Lock()
+	defer db.l.Unlock()
+	if err := db.flushLocked(); err != nil {
+		return nil, err
+	}
+	if head := headName(db.commit); head != b.head {
+		return nil, &StaleHeadError{Expected: b.head, Actual: head}
+	}
+	if db.dirtyLocked() {
+		return nil, ErrDirty
+	}
+	if b.tree == nil || b.base != nil && b.tree.Id().Equal(b.base.Id()) {
+		// Nothing to commit
+		return nil, nil
+	}
+	old := db.tree
+	db.tree = b.tree
+	commit, err := db.commitTreeLocked(label, db.signature(), CommitOpt{Meta: map[string]string{BatchTrailer: label}})
+	if err != nil {
+		db.tree = old
+		return nil, err
+	}
+	return db.ownCommit(commit, nil)
+}
+
+func headName(c *git.Commit) string {
+	if c == nil {
+		return ""
+	}
+	return c.Id().String()
+}
+
+// Get returns the value at key in the tree of the batch, including the
+// changes made by the batch.
+func (b *Batch) Get(key string) (string, error) {
+	db := b.db
+	if err := db.checkKey(key, false); err != nil {
+		return "", err
+	}
+	full := TreePath(db.fullKey(key))
+	if b.tree == nil {
+		return "", ErrNotExist
+	}
+	if full == "/" {
+		return "", db.keyError(full, ErrIsDirectory)
+	}
+	e, err := lookupEntry(b.tree, full)
+	if err != nil {
+		if err = db.lookupError(b.tree, full, err); git.IsErrorCode(err, git.ErrNotFound) {
+			return "", ErrNotExist
+		}
+		return "", err
+	}
+	if e.mode == 040000 {
+		return "", db.keyError(full, ErrIsDirectory)
+	}
+	data, err := blobContents(db.root().repo, e.id)
+	if err != nil {
+		return "", err
+	}
+	return db.root().decodeValue(data, e.mode)
+}
+
+// Set writes value at key in the batch. Values are checked as by
+// DB.Set.
+func (b *Batch) Set(key, value string) error {
+	db := b.db
+	if err := db.checkReserved(key); err != nil {
+		return err
+	}
+	full := TreePath(db.fullKey(key))
+	if err := db.checkValue(full, value); err != nil {
+		return err
+	}
+	root := db.root()
+	data, mode, err := root.encodeValue(value)
+	if err != nil {
+		return err
+	}
+	id, err := createBlob(root.repo, data)
+	if err != nil {
+		return err
+	}
+	changes := map[string]blobEntry{full: {id, mode}}
+	if root.modTime {
+		annot, err := annotationKey(full, ModTimeAnnotation)
+		if err != nil {
+			return err
+		}
+		data, mode, err := root.encodeValue(root.now().UTC().Format(time.RFC3339Nano))
+		if err != nil {
+			return err
+		}
+		id, err := createBlob(root.repo, data)
+		if err != nil {
+			return err
+		}
+		changes[TreePath(annot)] = blobEntry{id, mode}
+	}
+	// Like Set, clear the content type of key
+	annot, err := annotationKey(full, ContentTypeAnnotation)
+	if err != nil {
+		return err
+	}
+	if b.has(annot) {
+		changes[TreePath(annot)] = blobEntry{}
+	}
+	return b.apply(changes)
+}
+
+// Delete removes the value or subtree at key, along with the annotations
+// of key, from the batch. If there is nothing at key, ErrNotExist is
+// returned.
+func (b *Batch) Delete(key string) error {
+	full := TreePath(b.db.fullKey(key))
+	if full == "/" {
+		return fmt.Errorf("can't delete the root of the tree")
+	}
+	if !b.has(full) {
+		return ErrNotExist
+	}
+	changes := map[string]blobEntry{full: {}}
+	if annot := path.Join(AnnotationTree, MkAnnotation(full)); b.has(annot) {
+		changes[TreePath(annot)] = blobEntry{}
+	}
+	return b.apply(changes)
+}
+
+// Mkdir adds an empty subtree at key in the batch if it doesn't exist,
+// like DB.Mkdir.
+func (b *Batch) Mkdir(key string) error {
+	db := b.db
+	if err := db.checkKey(key, false); err != nil {
+		return err
+	}
+	if err := db.checkKeyLimits(db.fullKey(key)); err != nil {
+		return err
+	}
+	tree, err := NewPipeline(db.root().repo).Base(b.tree).Mkdir(db.fullKey(key)).Run()
+	if err != nil {
+		return err
+	}
+	b.tree = tree
+	return nil
+}
+
+// has returns true if there is an entry at key, relative to the root of
+// the database, in the tree of the batch.
+func (b *Batch) has(key string) bool {
+	if b.tree == nil {
+		return false
+	}
+	_, err := b.tree.EntryByPath(TreePath(key))
+	return err == nil
+}
+
+// apply applies changes, as staged in the overlay of a database, to the
+// tree of the batch.
+func (b *Batch) apply(changes map[string]blobEntry) error {
+	tree, err := treeApply(b.db.root().repo, b.tree, changes)
+	if err != nil {
+		return err
+	}
+	b.tree = tree
+	return nil
+}
@@ -0,0 +1,156 @@
+package libpack
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("creds/old", "secret")
+	db.Set("creds/user", "alice")
+	if err := db.Commit("init"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.Batch("rotate-credentials", func(b *Batch) error {
+		if err := b.Set("creds/new", "s3cret"); err != nil {
+			return err
+		}
+		if err := b.Delete("creds/old"); err != nil {
+			return err
+		}
+		if err := b.Mkdir("creds/archive"); err != nil {
+			return err
+		}
+		// The batch sees its own changes, the database doesn't
+		if v, err := b.Get("creds/new"); err != nil || v != "s3cret" {
+			t.Fatalf("%q %v", v, err)
+		}
+		if _, err := b.Get("creds/old"); err != ErrNotExist {
+			t.Fatalf("%v", err)
+		}
+		assertGet(t, db, "creds/old", "secret")
+		assertNotExist(t, db, "creds/new")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head, _ := db.Head(); head != id {
+		t.Fatalf("%q != %q", head, id)
+	}
+	assertGet(t, db, "creds/new", "s3cret")
+	assertGet(t, db, "creds/user", "alice")
+	assertNotExist(t, db, "creds/old")
+	assertList(t, db, "creds", "archive", "new", "user")
+	commits, err := db.Log("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 2 {
+		t.Fatalf("%d commits", len(commits))
+	}
+	if c := commits[0]; c.Op != "rotate-credentials" || !strings.Contains(c.Message, "\nLibpack-Op: rotate-credentials") {
+		t.Fatalf("%#v", c)
+	}
+	if c := commits[1]; c.Op != "" {
+		t.Fatalf("%#v", c)
+	}
+}
+
+func TestBatchError(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("foo", "bar")
+	db.Commit("init")
+	head, _ := db.Head()
+	fail := errors.New("fail")
+	_, err := db.Batch("fail", func(b *Batch) error {
+		b.Set("foo", "baz")
+		b.Set("other", "value")
+		return fail
+	})
+	if err != fail {
+		t.Fatalf("%v", err)
+	}
+	if h, _ := db.Head(); h != head {
+		t.Fatalf("head moved")
+	}
+	assertGet(t, db, "foo", "bar")
+	assertNotExist(t, db, "other")
+	// A batch which changes nothing doesn't commit
+	id, err := db.Batch("noop", func(b *Batch) error { return nil })
+	if err != nil || id != "" {
+		t.Fatalf("%q %v", id, err)
+	}
+	// Commit hooks can abort the batch
+	db.AddCommitHook(func([]Change) error { return fail })
+	if _, err := db.Batch("hooked", func(b *Batch) error { return b.Set("foo", "baz") }); err != fail {
+		t.Fatalf("%v", err)
+	}
+	assertGet(t, db, "foo", "bar")
+	db.l.RLock()
+	dirty := db.dirtyLocked()
+	db.l.RUnlock()
+	if dirty {
+		t.Fatalf("failed batch left changes")
+	}
+}
+
+func TestBatchNested(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	_, err := db.Batch("outer", func(b *Batch) error {
+		_, err := db.Scope("sub").Batch("inner", func(b *Batch) error { return nil })
+		return err
+	})
+	if err != ErrNestedBatch {
+		t.Fatalf("%v", err)
+	}
+	// The failed batch doesn't block the next ones
+	if _, err := db.Batch("next", func(b *Batch) error { return b.Set("foo", "bar") }); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db, "foo", "bar")
+}
+
+func TestBatchDirty(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("foo", "bar")
+	if _, err := db.Batch("dirty", func(b *Batch) error { return nil }); err != ErrDirty {
+		t.Fatalf("%v", err)
+	}
+	db.Commit("init")
+	// Changes made outside of the batch while it runs
+	_, err := db.Batch("dirty", func(b *Batch) error {
+		b.Set("a", "1")
+		return db.Set("b", "2")
+	})
+	if err != ErrDirty {
+		t.Fatalf("%v", err)
+	}
+	assertNotExist(t, db, "a")
+	assertGet(t, db, "b", "2")
+}
+
+func TestBatchScope(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	scope := db.Scope("services", "web")
+	_, err := scope.Batch("scale web", func(b *Batch) error {
+		return b.Set("replicas", "3")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db, "services/web/replicas", "3")
+	if _, err := db.Batch("bad\nlabel", func(b *Batch) error { return nil }); err == nil {
+		t.Fatalf("multi-line label should be rejected")
+	}
+	if _, err := db.Batch("reserved", func(b *Batch) error { return b.Set(InternalTree+"/x", "1") }); err != ErrReservedPath {
+		t.Fatalf("%v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package libpack
+
+import (
+	"errors"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+// ErrUncommitted is returned by Blame for keys which only exist in the
+// uncommitted tree.
+var ErrUncommitted = errors.New("key is not committed")
+
+// Blame returns the most recent commit which changed the value at key,
+// following the first parent of merge commits. If key was deleted and
+// set again, the commit which set it again is returned.
+// If the key only exists in the uncommitted tree, ErrUncommitted is
+// returned. If the history was truncated by a shallow fetch before the
+// change was found, the oldest available commit is returned along with
+// ErrShallowHistory.
+func (db *DB) Blame(key string) (info CommitInfo, err error) {
+	if err := db.checkClosed(); err != nil {
+		return CommitInfo{}, err
+	}
+	defer db.wrapError("blame", key, &err)
+	key = TreePath(db.fullKey(key))
+	head := db.headId()
+	if head == nil {
+		if _, err := db.root().Stat(key); err == nil {
+			return CommitInfo{}, ErrUncommitted
+		}
+		return CommitInfo{}, ErrNotExist
+	}
+	commit, err := lookupCommit(db.repo, head)
+	if err != nil {
+		return CommitInfo{}, err
+	}
+	defer func() { commit.Free() }()
+	tree, err := commit.Tree()
+	if err != nil {
+		return CommitInfo{}, err
+	}
+	defer func() { tree.Free() }()
+	if _, err := tree.EntryByPath(key); err != nil {
+		if _, err := db.root().Stat(key); err == nil {
+			return CommitInfo{}, ErrUncommitted
+		}
+		return CommitInfo{}, ErrNotExist
+	}
+	shallow, err := shallowCommits(db.repo)
+	if err != nil {
+		return CommitInfo{}, err
+	}
+	for {
+		if commit.ParentCount() == 0 {
+			return commitInfo(commit), nil
+		}
+		if shallow[commit.Id().String()] {
+			return commitInfo(commit), ErrShallowHistory
+		}
+		parent := commit.Parent(0)
+		parentTree, err := parent.Tree()
+		if err != nil {
+			parent.Free()
+			return CommitInfo{}, err
+		}
+		if !sameEntry(tree, parentTree, key) {
+			parentTree.Free()
+			parent.Free()
+			return commitInfo(commit), nil
+		}
+		tree.Free()
+		commit.Free()
+		tree, commit = parentTree, parent
+	}
+}
+
+// sameEntry returns true if key has the same entry in trees a and b.
+// Parent subtrees are compared first, so that unchanged subtrees are
+// not looked into.
+func sameEntry(a, b *git.Tree, key string) bool {
+	parts := strings.Split(key, "/")
+	for i := range parts {
+		p := strings.Join(parts[:i+1], "/")
+		ea, errA := a.EntryByPath(p)
+		eb, errB := b.EntryByPath(p)
+		if errA != nil || errB != nil {
+			return errA != nil && errB != nil
+		}
+		if ea.Id.Equal(eb.Id) && ea.Filemode == eb.Filemode {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package libpack
+
+import (
+	"testing"
+)
+
+func TestBlame(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	if _, err := db.Blame("foo"); err != ErrNotExist {
+		t.Fatalf("%v", err)
+	}
+	db.Set("a/b/c", "1")
+	db.Set("a/b/d", "1")
+	if _, err := db.Blame("a/b/c"); err != ErrUncommitted {
+		t.Fatalf("%v", err)
+	}
+	if err := db.Commit("root"); err != nil {
+		t.Fatal(err)
+	}
+	root, _ := db.Head()
+	if info, err := db.Blame("a/b/c"); err != nil || info.Id != root {
+		t.Fatalf("%v %v", info.Id, err)
+	}
+	db.Set("a/b/c", "2")
+	if err := db.Commit("change c"); err != nil {
+		t.Fatal(err)
+	}
+	changeC, _ := db.Head()
+	db.Set("a/b/d", "2")
+	if err := db.Commit("change d"); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("other", "x")
+	if err := db.Commit("unrelated"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := db.Blame("a/b/c"); err != nil || info.Id != changeC || info.Message != "change c" {
+		t.Fatalf("%#v %v", info, err)
+	}
+	if info, err := db.Scope("a", "b").Blame("d"); err != nil || info.Message != "change d" {
+		t.Fatalf("%#v %v", info, err)
+	}
+	db.Set("new", "uncommitted")
+	if _, err := db.Blame("new"); err != ErrUncommitted {
+		t.Fatalf("%v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package libpack
+
+import (
+	"fmt"
+
+	git "github.com/libgit2/git2go"
+)
+
+// SetBlob sets key, in the uncommitted tree, to the existing blob `oid`
+// of the repository, without copying it. Several keys, or databases
+// sharing the repository, can reference the same blob: for example, to
+// promote values from a staging database without writing them again.
+// The blob is stored as is: it is decoded like values written by Set,
+// and must be compressed or encrypted accordingly. Once committed, the
+// blob is reachable from the commit, so it is never pruned.
+func (db *DB) SetBlob(key string, oid *git.Oid) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("set", key, &err)
+	if err := db.checkReserved(key); err != nil {
+		return err
+	}
+	if oid == nil {
+		return fmt.Errorf("nil blob id")
+	}
+	data, err := blobContents(db.repo, oid)
+	if err != nil {
+		return err
+	}
+	// Validators and limits apply to the decoded value
+	value, err := db.root().decodeValue(data, modeBlob)
+	if err != nil {
+		return err
+	}
+	if err := db.checkValue(db.fullKey(key), value); err != nil {
+		return err
+	}
+	return db.setBlobID(key, oid, modeBlob)
+}
+
+// GetBlobOID returns the id of the blob at key in the uncommitted tree,
+// which can be passed to SetBlob.
+func (db *DB) GetBlobOID(key string) (oid *git.Oid, err error) {
+	if err := db.checkClosed(); err != nil {
+		return nil, err
+	}
+	defer db.wrapError("get", key, &err)
+	if err := db.checkKey(key, false); err != nil {
+		return nil, err
+	}
+	db.autoRefresh()
+	key = db.fullKey(key)
+	tree, e, err := db.lookupPending(key)
+	if err != nil {
+		return nil, err
+	}
+	if e != nil && e.id == nil {
+		// Deleted since the tree was last updated
+		return nil, ErrNotExist
+	}
+	if e == nil {
+		if tree == nil {
+			return nil, ErrNotExist
+		}
+		if TreePath(key) == "/" {
+			return nil, db.keyError(key, ErrIsDirectory)
+		}
+		if e, err = lookupEntry(tree, key); err != nil {
+			return nil, db.lookupError(tree, key, err)
+		}
+	}
+	if e.mode == 040000 {
+		return nil, db.keyError(key, ErrIsDirectory)
+	}
+	return e.id.Copy(), nil
+}
@@ -0,0 +1,89 @@
+package libpack
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSetBlob(t *testing.T) {
+	staging := tmpDB(t, "refs/heads/staging")
+	defer nukeDB(staging)
+	prod, err := Init(staging.Repo().Path(), "refs/heads/prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	staging.Set("config/app", "value")
+	id, err := staging.GetBlobOID("config/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := prod.SetBlob("app", id); err != nil {
+		t.Fatal(err)
+	}
+	if err := prod.SetBlob("copy/app", id); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, prod, "app", "value")
+	assertGet(t, prod, "copy/app", "value")
+	if other, err := prod.GetBlobOID("copy/app"); err != nil || !other.Equal(id) {
+		t.Fatalf("%v %v", other, err)
+	}
+	if err := prod.Commit("promote"); err != nil {
+		t.Fatal(err)
+	}
+	// The staged blob is kept by the commit of prod
+	staging.Delete("config/app")
+	staging.Commit("")
+	if err := prod.GC(GCOpt{PruneAge: -1}); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, prod, "app", "value")
+	// Errors
+	if _, err := prod.GetBlobOID("missing"); err == nil {
+		t.Fatalf("%v", err)
+	}
+	_, err = prod.GetBlobOID("copy")
+	assertKeyError(t, err, ErrIsDirectory, "copy")
+	tree, err := prod.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := prod.SetBlob("tree", tree.Id()); err == nil {
+		t.Fatalf("a tree should be rejected")
+	}
+	missing := *id
+	missing[0]++
+	if err := prod.SetBlob("missing", &missing); err == nil {
+		t.Fatalf("a missing blob should be rejected")
+	}
+	if err := prod.SetBlob("/"+InternalTree+"/x", id); err != ErrReservedPath {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestSetBlobCodec(t *testing.T) {
+	db, err := Init(tmpdir(t), "refs/heads/test", WithCompression(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(db)
+	value := strings.Repeat("compressed ", 10)
+	var validated []string
+	db.AddValidator("copy", func(key string, v []byte) error {
+		validated = append(validated, string(v))
+		return nil
+	})
+	db.Set("orig", value)
+	id, err := db.GetBlobOID("orig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetBlob("copy", id); err != nil {
+		t.Fatal(err)
+	}
+	// Validators are given the decoded value, not the stored blob
+	if len(validated) != 1 || validated[0] != value {
+		t.Fatalf("%q", validated)
+	}
+	assertGet(t, db, "copy", value)
+}
@@ -0,0 +1,226 @@
+package libpack
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+
+	git "github.com/libgit2/git2go"
+)
+
+// A MissingPrerequisiteError is returned by ImportBundle when the bundle
+// is incremental, and the commits it is based on are not in the
+// repository.
+type MissingPrerequisiteError struct {
+	Commits []string
+}
+
+func (e *MissingPrerequisiteError) Error() string {
+	return fmt.Sprintf("bundle requires missing commits: %s", strings.Join(e.Commits, ", "))
+}
+
+// bundleRefPrefix is the namespace of the temporary references in which
+// ImportBundle fetches the head of bundles.
+const bundleRefPrefix = "refs/libpack/bundle/"
+
+// bundleCount numbers the calls to ImportBundle in this process.
+// Accessed atomically.
+var bundleCount uint64
+
+// ExportBundle writes a git bundle of the database's reference to w.
+// If sinceCommit is empty, the bundle contains the entire history.
+// Otherwise it only contains the commits since sinceCommit, and can only
+// be imported in a database which already has sinceCommit.
+// Uncommitted changes are not exported.
+func (db *DB) ExportBundle(w io.Writer, sinceCommit string) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("export-bundle", "", &err)
+	if db.headId() == nil {
+		return ErrNoCommits
+	}
+	f, err := ioutil.TempFile("", "libpack-bundle-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	rev := db.ref
+	if sinceCommit != "" {
+		rev = sinceCommit + ".." + db.ref
+	}
+	if err := runGit(db.repo, "bundle", "create", f.Name(), rev); err != nil {
+		return err
+	}
+	f, err = os.Open(f.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// ImportBundle reads a git bundle created by ExportBundle from r, and
+// applies its head to the database's reference like ApplyFetched: the
+// reference is locked, the incoming validators are run, and the
+// uncommitted tree is updated.
+// If the bundle is incremental and the commits it is based on are
+// missing, a *MissingPrerequisiteError is returned.
+func (db *DB) ImportBundle(r io.Reader) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("import-bundle", "", &err)
+	if db.parent != nil {
+		return db.parent.ImportBundle(r)
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	f, err := ioutil.TempFile("", "libpack-bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, r)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	prerequisites, heads, err := readBundleHeader(f.Name())
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, id := range prerequisites {
+		oid, err := git.NewOid(id)
+		if err != nil {
+			return err
+		}
+		if obj, err := db.repo.Lookup(oid); err != nil {
+			missing = append(missing, id)
+		} else {
+			obj.Free()
+		}
+	}
+	if len(missing) > 0 {
+		return &MissingPrerequisiteError{missing}
+	}
+	if len(heads) != 1 {
+		return fmt.Errorf("bundle must have exactly 1 head, not %d", len(heads))
+	}
+	// The reference of the database is only moved by ApplyFetched
+	tmp := fmt.Sprintf("%s%d-%d", bundleRefPrefix, os.Getpid(), atomic.AddUint64(&bundleCount, 1))
+	refspec := fmt.Sprintf("+%s:%s", heads[0], tmp)
+	if err := runGit(db.repo, "fetch", "--quiet", f.Name(), refspec); err != nil {
+		return err
+	}
+	ref, err := db.repo.LookupReference(tmp)
+	if err != nil {
+		return err
+	}
+	defer ref.Free()
+	defer ref.Delete()
+	return db.ApplyFetched(ref.Target().String())
+}
+
+// readBundleHeader returns the ids of the prerequisite commits and the
+// names of the heads listed in the header of the bundle file at p.
+func readBundleHeader(p string) (prerequisites, heads []string, err error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	signature, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(signature, "# v2 git bundle") {
+		return nil, nil, fmt.Errorf("not a git bundle")
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid bundle header: %w", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		if line == "" {
+			return prerequisites, heads, nil
+		}
+		if strings.HasPrefix(line, "-") {
+			prerequisites = append(prerequisites, strings.Fields(line[1:])[0])
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) == 2 {
+			heads = append(heads, fields[1])
+		}
+	}
+}
+
+// runGit runs a git command on repository r.
+func runGit(r *git.Repository, args ...string) error {
+	stderr := new(bytes.Buffer)
+	cmd := exec.Command("git", append([]string{"--git-dir", r.Path()}, args...)...)
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git %s: %s", args[0], stderr.String())
+	}
+	return nil
+}
+
+// OpenBundle returns a read-only snapshot of the head `ref` of the git
+// bundle file at p, as created by ExportBundle. If ref is empty, the
+// bundle must have exactly 1 head.
+// The bundle is unpacked in a temporary repository, like InitMemory,
+// which is removed when the snapshot is freed: call Free when done.
+// Incremental bundles can't be opened: a *MissingPrerequisiteError
+// listing the commits they are based on is returned.
+func OpenBundle(p, ref string) (*Snapshot, error) {
+	prerequisites, heads, err := readBundleHeader(p)
+	if err != nil {
+		return nil, err
+	}
+	if len(prerequisites) > 0 {
+		return nil, &MissingPrerequisiteError{prerequisites}
+	}
+	if ref == "" {
+		if len(heads) != 1 {
+			return nil, fmt.Errorf("bundle must have exactly 1 head, not %d", len(heads))
+		}
+		ref = heads[0]
+	}
+	found := false
+	for _, head := range heads {
+		found = found || head == ref
+	}
+	if !found {
+		return nil, fmt.Errorf("no head %s in bundle, heads: %s", ref, strings.Join(heads, ", "))
+	}
+	db, err := InitMemory(ref)
+	if err != nil {
+		return nil, err
+	}
+	if err := runGit(db.repo, "fetch", "--quiet", p, fmt.Sprintf("%s:%s", ref, ref)); err != nil {
+		db.Free()
+		return nil, err
+	}
+	if err := db.Update(); err != nil {
+		db.Free()
+		return nil, err
+	}
+	db.readOnly = true
+	s, err := db.Snapshot()
+	if err != nil {
+		db.Free()
+		return nil, err
+	}
+	s.ownDB = true
+	return s, nil
+}
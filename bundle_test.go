@@ -0,0 +1,148 @@
+package libpack
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestBundle(t *testing.T) {
+	src := tmpDB(t, "")
+	defer nukeDB(src)
+	for _, v := range []string{"1", "2", "3"} {
+		src.Set("key"+v, v)
+		if err := src.Commit(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base, err := src.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var full bytes.Buffer
+	if err := src.ExportBundle(&full, ""); err != nil {
+		t.Fatal(err)
+	}
+	dst := tmpDB(t, "refs/heads/other")
+	defer nukeDB(dst)
+	if err := dst.ImportBundle(&full); err != nil {
+		t.Fatal(err)
+	}
+	if head, _ := dst.Head(); head != base {
+		t.Fatalf("%s != %s", head, base)
+	}
+	assertGet(t, dst, "key1", "1")
+	assertGet(t, dst, "key3", "3")
+
+	src.Set("key4", "4")
+	if err := src.Commit("4"); err != nil {
+		t.Fatal(err)
+	}
+	var incr bytes.Buffer
+	if err := src.ExportBundle(&incr, base); err != nil {
+		t.Fatal(err)
+	}
+	// Without the base commit, the bundle can't be imported
+	empty := tmpDB(t, "")
+	defer nukeDB(empty)
+	err = empty.ImportBundle(bytes.NewReader(incr.Bytes()))
+	if perr, ok := err.(*MissingPrerequisiteError); !ok || len(perr.Commits) != 1 || perr.Commits[0] != base {
+		t.Fatalf("%#v", err)
+	}
+	if err := dst.ImportBundle(&incr); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, dst, "key4", "4")
+	srcHead, _ := src.Head()
+	if head, _ := dst.Head(); head != srcHead {
+		t.Fatalf("%s != %s", head, srcHead)
+	}
+}
+
+func TestImportBundleValidators(t *testing.T) {
+	src := tmpDB(t, "")
+	defer nukeDB(src)
+	src.Set("flags/debug", "yes")
+	if err := src.Commit("invalid"); err != nil {
+		t.Fatal(err)
+	}
+	var bundle bytes.Buffer
+	if err := src.ExportBundle(&bundle, ""); err != nil {
+		t.Fatal(err)
+	}
+	dst := tmpDB(t, "")
+	defer nukeDB(dst)
+	dst.AddValidatorPolicy("flags", IncomingReject, validFlag)
+	err := dst.ImportBundle(bytes.NewReader(bundle.Bytes()))
+	if verr, ok := err.(*ValidationError); !ok || verr.Key != "flags/debug" {
+		t.Fatalf("%v", err)
+	}
+	if dst.headId() != nil {
+		t.Fatalf("ref was moved")
+	}
+	assertNotExist(t, dst, "flags/debug")
+	// The temporary reference is deleted
+	if _, err := dst.repo.LookupReference(bundleRefPrefix + fmt.Sprintf("%d-%d", os.Getpid(), bundleCount)); err == nil {
+		t.Fatalf("temporary reference was not deleted")
+	}
+}
+
+func TestOpenBundle(t *testing.T) {
+	src := tmpDB(t, "")
+	defer nukeDB(src)
+	src.Set("config/app", "v1")
+	src.Set("config/db", "v1")
+	commitKey(t, src, "version", "1")
+	base, _ := src.Head()
+	commitKey(t, src, "version", "2")
+	dir := tmpdir(t)
+	defer os.RemoveAll(dir)
+	writeBundle := func(name, since string) string {
+		var buf bytes.Buffer
+		if err := src.ExportBundle(&buf, since); err != nil {
+			t.Fatal(err)
+		}
+		p := path.Join(dir, name)
+		if err := ioutil.WriteFile(p, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	full := writeBundle("full.bundle", "")
+	s, err := OpenBundle(full, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.Get("version"); err != nil || v != "2" {
+		t.Fatalf("%q %v", v, err)
+	}
+	if names, err := s.List("config"); err != nil || len(names) != 2 {
+		t.Fatalf("%v %v", names, err)
+	}
+	if err := s.db.Commit(""); err != ErrReadOnly {
+		t.Fatalf("the database of a bundle should be read-only")
+	}
+	out := path.Join(dir, "checkout")
+	if err := s.Checkout(out); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(path.Join(out, "config/app")); err != nil || string(data) != "v1" {
+		t.Fatalf("%q %v", data, err)
+	}
+	repo := s.db.Repo().Path()
+	s.Free()
+	if _, err := os.Stat(repo); !os.IsNotExist(err) {
+		t.Fatalf("the temporary repository should be removed: %v", err)
+	}
+	if _, err := OpenBundle(full, "refs/heads/missing"); err == nil {
+		t.Fatalf("a missing head should fail")
+	}
+	// Incremental bundles need their base
+	_, err = OpenBundle(writeBundle("incremental.bundle", base), "")
+	if e, ok := err.(*MissingPrerequisiteError); !ok || len(e.Commits) != 1 || e.Commits[0] != base {
+		t.Fatalf("%v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package libpack
+
+import (
+	"container/list"
+	"sync"
+
+	git "github.com/libgit2/git2go"
+)
+
+const (
+	// DefaultCacheEntries is the default maximum number of paths whose
+	// lookup result is cached by Get.
+	DefaultCacheEntries = 10000
+	// DefaultCacheBytes is the default maximum total size of the blob
+	// contents cached by Get.
+	DefaultCacheBytes = 8 << 20
+)
+
+// WithCache sets the size of the cache used by Get: the maximum number
+// of cached path lookups, and the maximum total size in bytes of
+// cached blob contents.
+func WithCache(entries int, bytes int64) Option {
+	return func(db *DB) {
+		db.cache = newCache(entries, bytes)
+	}
+}
+
+// WithoutCache disables the cache used by Get, for memory-constrained
+// callers.
+func WithoutCache() Option {
+	return func(db *DB) {
+		db.cache = nil
+	}
+}
+
+// A cache speeds up repeated calls to Get.
+// Path lookups are only cached for a single tree: they are dropped
+// as soon as the uncommitted tree changes. Blob contents are cached by
+// id, so they never need to be invalidated.
+type cache struct {
+	l     sync.Mutex
+	tree  git.Oid
+	paths *lru
+	blobs *lru
+	// Logs cache invalidations, see SetLogger
+	logf func(LogLevel, string, ...interface{})
+}
+
+func newCache(entries int, bytes int64) *cache {
+	return &cache{
+		paths: newLRU(int64(entries)),
+		blobs: newLRU(bytes),
+	}
+}
+
+// entry returns the entry at key in tree t.
+func (c *cache) entry(t *git.Tree, key string) (*blobEntry, error) {
+	key = TreePath(key)
+	c.l.Lock()
+	if !c.tree.Equal(t.Id()) {
+		if c.logf != nil && len(c.paths.items) > 0 {
+			c.logf(LogDebug, "cache: dropping %d paths of tree %s", len(c.paths.items), c.tree.String())
+		}
+		c.tree = *t.Id()
+		c.paths.purge()
+	}
+	v, ok := c.paths.get(key)
+	c.l.Unlock()
+	if ok {
+		return v.(*blobEntry), nil
+	}
+	e, err := t.EntryByPath(key)
+	if err != nil {
+		return nil, err
+	}
+	entry := &blobEntry{e.Id, e.Filemode}
+	c.l.Lock()
+	if c.tree.Equal(t.Id()) {
+		c.paths.add(key, entry, 1)
+	}
+	c.l.Unlock()
+	return entry, nil
+}
+
+// blob returns the content of the blob with the specified id.
+func (c *cache) blob(r *git.Repository, id *git.Oid) (string, error) {
+	c.l.Lock()
+	v, ok := c.blobs.get(id.String())
+	c.l.Unlock()
+	if ok {
+		return v.(string), nil
+	}
+	content, err := blobContents(r, id)
+	if err != nil {
+		return "", err
+	}
+	c.l.Lock()
+	c.blobs.add(id.String(), content, int64(len(content)))
+	c.l.Unlock()
+	return content, nil
+}
+
+// lru is a least-recently-used cache whose total cost is kept under max.
+// It is not safe for concurrent use.
+type lru struct {
+	max   int64
+	used  int64
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type lruItem struct {
+	key   string
+	value interface{}
+	cost  int64
+}
+
+func newLRU(max int64) *lru {
+	return &lru{
+		max:   max,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (c *lru) get(key string) (interface{}, bool) {
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*lruItem).value, true
+}
+
+func (c *lru) add(key string, value interface{}, cost int64) {
+	if cost > c.max {
+		// Never cache an item which would evict everything else
+		return
+	}
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&lruItem{key, value, cost})
+	c.used += cost
+	for c.used > c.max {
+		oldest := c.ll.Back()
+		item := oldest.Value.(*lruItem)
+		c.ll.Remove(oldest)
+		delete(c.items, item.key)
+		c.used -= item.cost
+	}
+}
+
+func (c *lru) purge() {
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.used = 0
+}
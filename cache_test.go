@@ -0,0 +1,169 @@
+package libpack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestLRU(t *testing.T) {
+	c := newLRU(10)
+	c.add("a", "a", 4)
+	c.add("b", "b", 4)
+	c.get("a")
+	c.add("c", "c", 4)
+	if _, ok := c.get("b"); ok {
+		t.Fatalf("b should have been evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if v, ok := c.get(k); !ok || v != k {
+			t.Fatalf("%s: %#v %v", k, v, ok)
+		}
+	}
+	c.add("big", "big", 11)
+	if _, ok := c.get("big"); ok {
+		t.Fatalf("items bigger than the cache should not be cached")
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("foo", "A")
+	assertGet(t, db, "foo", "A")
+	db.Set("foo", "B")
+	assertGet(t, db, "foo", "B")
+	if err := db.Commit("B"); err != nil {
+		t.Fatal(err)
+	}
+	db2, err := Open(db.Repo().Path(), db.ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Free()
+	db2.Set("foo", "C")
+	if err := db2.Commit("C"); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db, "foo", "B")
+	if err := db.Update(); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db, "foo", "C")
+}
+
+func TestWithoutCache(t *testing.T) {
+	db, err := Init(tmpdir(t), "refs/heads/test", WithoutCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(db)
+	db.Set("foo", "A")
+	assertGet(t, db, "foo", "A")
+}
+
+// benchDB returns a database with 100k keys spread across 100 directories,
+// and a list of 10k of those keys.
+func benchDB(b *testing.B, opts ...Option) (*DB, []string) {
+	dir, err := ioutil.TempDir("", "libpack-bench-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	db, err := Init(dir, "refs/heads/test", opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	r := db.Repo()
+	root, err := r.TreeBuilder()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer root.Free()
+	for i := 0; i < 100; i++ {
+		sub, err := r.TreeBuilder()
+		if err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < 1000; j++ {
+			id, err := r.CreateBlobFromBuffer([]byte(fmt.Sprintf("value %d %d", i, j)))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := sub.Insert(fmt.Sprintf("%d", j), id, 0100644); err != nil {
+				b.Fatal(err)
+			}
+		}
+		id, err := sub.Write()
+		sub.Free()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := root.Insert(fmt.Sprintf("%d", i), id, 040000); err != nil {
+			b.Fatal(err)
+		}
+	}
+	id, err := root.Write()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := db.Add("/", id); err != nil {
+		b.Fatal(err)
+	}
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%d/%d", rand.Intn(100), rand.Intn(1000))
+	}
+	return db, keys
+}
+
+func benchmarkGet(b *testing.B, opts ...Option) {
+	db, keys := benchDB(b, opts...)
+	defer os.RemoveAll(db.Repo().Path())
+	defer db.Free()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Get(keys[i%len(keys)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetCached(b *testing.B) {
+	benchmarkGet(b)
+}
+
+func BenchmarkGetUncached(b *testing.B) {
+	benchmarkGet(b, WithoutCache())
+}
+
+func BenchmarkGetManyLoop(b *testing.B) {
+	db, keys := benchDB(b)
+	defer os.RemoveAll(db.Repo().Path())
+	defer db.Free()
+	keys = keys[:200]
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, key := range keys {
+			if _, err := db.Get(key); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkGetMany(b *testing.B) {
+	db, keys := benchDB(b)
+	defer os.RemoveAll(db.Repo().Path())
+	defer db.Free()
+	keys = keys[:200]
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, missing, err := db.GetMany(keys); err != nil {
+			b.Fatal(err)
+		} else if len(missing) != 0 {
+			b.Fatalf("%v", missing)
+		}
+	}
+}
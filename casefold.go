@@ -0,0 +1,27 @@
+package libpack
+
+import (
+	"strings"
+)
+
+// CaseInsensitive makes keys case-insensitive: each key component is
+// converted to lower case before being looked up or written, so that
+// Get("Foo") returns the value set with Set("foo"), and Set("Foo")
+// replaces it. List, Walk and the other methods which return keys
+// return them in lower case.
+//
+// Since the keys written in the tree only differ by case if they were
+// written without this option, a checkout can't produce names which
+// collide on a case-insensitive filesystem. Keys which contain upper
+// case letters, written without this option, can't be read.
+func CaseInsensitive() Option {
+	return func(db *DB) {
+		db.caseInsensitive = true
+	}
+}
+
+// foldKey returns the canonical form of key, for case-insensitive
+// databases.
+func foldKey(key string) string {
+	return strings.ToLower(key)
+}
@@ -0,0 +1,53 @@
+package libpack
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCaseInsensitive(t *testing.T) {
+	db, err := Init(tmpdir(t), "refs/heads/test", CaseInsensitive())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(db)
+	if err := db.Set("Users/Alice", "1"); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db, "users/alice", "1")
+	assertGet(t, db, "USERS/ALICE", "1")
+	assertGet(t, db.Scope("USERS"), "Alice", "1")
+	// The existing entry is updated
+	if err := db.Set("users/ALICE", "2"); err != nil {
+		t.Fatal(err)
+	}
+	names, err := db.List("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"alice"}) {
+		t.Fatalf("%#v", names)
+	}
+	assertGet(t, db, "Users/Alice", "2")
+	if err := db.Delete("USERS/alice"); err != nil {
+		t.Fatal(err)
+	}
+	assertNotExist(t, db, "users/alice")
+}
+
+func TestCaseInsensitiveEscaping(t *testing.T) {
+	db, err := Init(tmpdir(t), "refs/heads/test", CaseInsensitive(), WithKeyEscaping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(db)
+	db.Set(".Git/Config", "1")
+	assertGet(t, db, ".git/config", "1")
+	tree, err := db.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lookupEntry(tree, "%2Egit/config"); err != nil {
+		t.Fatal(err)
+	}
+}
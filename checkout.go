@@ -0,0 +1,340 @@
+package libpack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+// An UnsafePathError is returned by Checkout and its variants when a tree
+// contains an entry which could be written outside of the destination
+// directory, or over another entry. Nothing is written in that case.
+type UnsafePathError struct {
+	// Path of the offending entry in the tree
+	Path   string
+	Reason string
+}
+
+func (e *UnsafePathError) Error() string {
+	return fmt.Sprintf("unsafe path in tree: %q: %s", e.Path, e.Reason)
+}
+
+// checkTreePaths returns an *UnsafePathError if tree contains an entry
+// whose name is not a plain file name, or names which only differ by
+// case in the same directory, which collide on case-insensitive
+// filesystems.
+func checkTreePaths(r *git.Repository, tree *git.Tree) error {
+	return checkSubtreePaths(r, tree, "")
+}
+
+func checkSubtreePaths(r *git.Repository, tree *git.Tree, dir string) error {
+	names := make(map[string]string, tree.EntryCount())
+	for i := uint64(0); i < tree.EntryCount(); i++ {
+		e := tree.EntryByIndex(i)
+		p := path.Join(dir, e.Name)
+		if reason := unsafeName(e.Name); reason != "" {
+			return &UnsafePathError{Path: p, Reason: reason}
+		}
+		folded := strings.ToLower(e.Name)
+		if other, exists := names[folded]; exists {
+			return &UnsafePathError{Path: p, Reason: fmt.Sprintf("collides with %q", path.Join(dir, other))}
+		}
+		names[folded] = e.Name
+		if e.Type != git.ObjectTree {
+			continue
+		}
+		subtree, err := lookupTree(r, e.Id)
+		if err != nil {
+			return err
+		}
+		err = checkSubtreePaths(r, subtree, p)
+		subtree.Free()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unsafeName returns the reason why a tree entry named name can't be
+// checked out, or an empty string.
+func unsafeName(name string) string {
+	switch {
+	case name == "" || name == "." || name == "..":
+		return "invalid name"
+	case strings.ContainsAny(name, "/\\\x00"):
+		return "name contains a path separator"
+	case strings.EqualFold(name, ".git"):
+		return "reserved name"
+	case filepath.IsAbs(name) || filepath.VolumeName(name) != "":
+		return "absolute name"
+	}
+	return ""
+}
+
+// checkoutPath returns the path at which the entry at key of a tree is
+// checked out in dir. An *UnsafePathError is returned if key would be
+// written outside of dir, or through a symbolic link.
+func checkoutPath(dir, key string) (string, error) {
+	p := filepath.Join(dir, filepath.FromSlash(key))
+	rel, err := filepath.Rel(dir, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &UnsafePathError{Path: key, Reason: "outside of the destination directory"}
+	}
+	parent := dir
+	components := strings.Split(rel, string(filepath.Separator))
+	for _, c := range components[:len(components)-1] {
+		parent = filepath.Join(parent, c)
+		st, err := os.Lstat(parent)
+		if err != nil {
+			return "", err
+		}
+		if st.Mode()&os.ModeSymlink != 0 {
+			return "", &UnsafePathError{Path: key, Reason: "parent directory is a symbolic link"}
+		}
+	}
+	return p, nil
+}
+
+// CheckoutOpt are the settings of CheckoutInto.
+type CheckoutOpt struct {
+	// Subtree to check out, relative to the scope of the database.
+	// The default is the whole scope.
+	Scope string
+	// If set, files and directories of dir which are not in the tree
+	// are removed.
+	Delete bool
+	// If set, files are considered up to date if their size and
+	// executable bit match, without comparing their contents.
+	Quick bool
+	// If not nil, OnChange is called for each path of dir which is
+	// created, modified or removed. Paths are relative to dir, with
+	// slashes as separators.
+	OnChange func(Change)
+}
+
+// CheckoutInto updates the directory at dir to match the committed
+// contents of the database, creating it if needed. Only the files which
+// differ from the tree are written, so that calling CheckoutInto
+// periodically is cheap. Files are replaced atomically.
+// Uncommitted changes are ignored.
+func (db *DB) CheckoutInto(dir string, opt CheckoutOpt) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("checkout", "", &err)
+	head := db.headId()
+	if head == nil {
+		return fmt.Errorf("no head to checkout")
+	}
+	commit, err := lookupCommit(db.repo, head)
+	if err != nil {
+		return err
+	}
+	defer commit.Free()
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	defer tree.Free()
+	key := db.fullKey(opt.Scope)
+	subtree, err := TreeScope(db.repo, tree, key)
+	if err != nil {
+		if git.IsErrorCode(err, git.ErrNotFound) {
+			return ErrNotExist
+		}
+		return err
+	}
+	defer subtree.Free()
+	if err := checkTreePaths(db.repo, subtree); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	c := &incrementalCheckout{
+		db:       db.root(),
+		dir:      dir,
+		opt:      opt,
+		expected: make(map[string]bool),
+	}
+	h := c.update
+	if db.hidesInternal(key) {
+		h = hideInternal(h)
+	}
+	h = db.hideKeepEntries(h)
+	if err := treeWalk(db.repo, subtree, "/", h); err != nil {
+		return err
+	}
+	if opt.Delete {
+		return c.prune()
+	}
+	return nil
+}
+
+type incrementalCheckout struct {
+	db  *DB
+	dir string
+	opt CheckoutOpt
+	// Paths of the tree, relative to dir
+	expected map[string]bool
+}
+
+func (c *incrementalCheckout) report(key string, kind ChangeKind, id *git.Oid) {
+	if c.opt.OnChange != nil {
+		c.opt.OnChange(Change{Key: key, Kind: kind, NewId: id})
+	}
+}
+
+// update brings the path of dir at key up to date with the entry e of
+// the tree.
+func (c *incrementalCheckout) update(key string, e *git.TreeEntry, obj git.Object) error {
+	c.expected[key] = true
+	p, err := checkoutPath(c.dir, key)
+	if err != nil {
+		return err
+	}
+	st, err := os.Lstat(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	exists := err == nil
+	if _, isTree := obj.(*git.Tree); isTree {
+		if exists && st.IsDir() {
+			return nil
+		}
+		if exists {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+		}
+		if err := os.Mkdir(p, 0755); err != nil {
+			return err
+		}
+		kind := Added
+		if exists {
+			kind = Modified
+		}
+		c.report(key, kind, e.Id)
+		return nil
+	}
+	blob, isBlob := obj.(*git.Blob)
+	if !isBlob {
+		return nil
+	}
+	if exists && st.IsDir() {
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+		exists = false
+	}
+	var upToDate bool
+	if e.Filemode == modeLink {
+		target := string(blob.Contents())
+		if exists && st.Mode()&os.ModeSymlink != 0 {
+			current, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			upToDate = current == target
+		}
+		if !upToDate {
+			if err := replaceFile(p, func(tmp string) error { return os.Symlink(target, tmp) }); err != nil {
+				return err
+			}
+		}
+	} else {
+		perm := os.FileMode(0644)
+		value, err := c.db.decodeValue(string(blob.Contents()), e.Filemode)
+		if err != nil {
+			return err
+		}
+		if e.Filemode == modeExecutable {
+			perm = 0755
+		}
+		if exists && st.Mode().IsRegular() && st.Mode().Perm()&0111 == perm&0111 && st.Size() == int64(len(value)) {
+			upToDate = c.opt.Quick
+			if !upToDate {
+				data, err := ioutil.ReadFile(p)
+				if err != nil {
+					return err
+				}
+				upToDate = string(data) == value
+			}
+		}
+		if !upToDate {
+			err := replaceFile(p, func(tmp string) error {
+				if err := ioutil.WriteFile(tmp, []byte(value), perm); err != nil {
+					return err
+				}
+				return os.Chmod(tmp, perm)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if upToDate {
+		return nil
+	}
+	kind := Added
+	if exists {
+		kind = Modified
+	}
+	c.report(key, kind, e.Id)
+	return nil
+}
+
+// prune removes the paths of dir which are not in the tree.
+func (c *incrementalCheckout) prune() error {
+	var removed []string
+	err := filepath.Walk(c.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(c.dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if c.expected[key] {
+			return nil
+		}
+		removed = append(removed, key)
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range removed {
+		if err := os.RemoveAll(filepath.Join(c.dir, filepath.FromSlash(key))); err != nil {
+			return err
+		}
+		c.report(key, Deleted, nil)
+	}
+	return nil
+}
+
+// replaceFile atomically replaces the file at p with a file created by
+// create at a temporary path.
+func replaceFile(p string, create func(tmp string) error) error {
+	tmp := filepath.Join(filepath.Dir(p), fmt.Sprintf(".%s.libpack-tmp", filepath.Base(p)))
+	os.Remove(tmp)
+	if err := create(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
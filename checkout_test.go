@@ -0,0 +1,189 @@
+package libpack
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	git "github.com/libgit2/git2go"
+)
+
+// writeRawTree writes a tree object with the specified entries,
+// bypassing the checks of the tree builder.
+func writeRawTree(t *testing.T, r *git.Repository, entries ...rawEntry) *git.Oid {
+	var data bytes.Buffer
+	for _, e := range entries {
+		fmt.Fprintf(&data, "%o %s\x00", e.mode, e.name)
+		data.Write(e.id[:])
+	}
+	odb, err := r.Odb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer odb.Free()
+	id, err := odb.Write(data.Bytes(), git.ObjectTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+type rawEntry struct {
+	mode int
+	name string
+	id   *git.Oid
+}
+
+func TestCheckoutUnsafePaths(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	r := db.Repo()
+	blob, err := createBlob(r, "evil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := writeRawTree(t, r, rawEntry{modeBlob, "x", blob})
+	for _, tc := range []struct {
+		entries []rawEntry
+		path    string
+	}{
+		{[]rawEntry{{040000, "..", sub}}, ".."},
+		{[]rawEntry{{040000, "a", writeRawTree(t, r, rawEntry{040000, "..", sub})}}, "a/.."},
+		{[]rawEntry{{040000, ".GIT", sub}}, ".GIT"},
+		{[]rawEntry{{modeBlob, "README", blob}, {modeBlob, "readme", blob}}, "readme"},
+	} {
+		id := writeRawTree(t, r, tc.entries...)
+		tree, err := lookupTree(r, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var parent *git.Commit
+		if head := db.headId(); head != nil {
+			if parent, err = lookupCommit(r, head); err != nil {
+				t.Fatal(err)
+			}
+		}
+		commit, err := mkCommit(r, db.ref, "malicious", defaultSignature(), nil, tree, parent)
+		tree.Free()
+		if parent != nil {
+			parent.Free()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		commit.Free()
+		if err := db.Update(); err != nil {
+			t.Fatal(err)
+		}
+		tmp := tmpdir(t)
+		defer os.RemoveAll(tmp)
+		dir := path.Join(tmp, "checkout")
+		os.Mkdir(dir, 0700)
+		_, err = db.Checkout(dir)
+		perr, ok := err.(*UnsafePathError)
+		if !ok {
+			t.Fatalf("%v: %v", tc.path, err)
+		}
+		if perr.Path != tc.path {
+			t.Fatalf("%s != %s", perr.Path, tc.path)
+		}
+		if _, err := os.Stat(path.Join(tmp, "x")); !os.IsNotExist(err) {
+			t.Fatalf("file written outside of the checkout: %v", err)
+		}
+	}
+}
+
+func TestCheckoutPathSymlink(t *testing.T) {
+	dir := tmpdir(t)
+	defer os.RemoveAll(dir)
+	outside := tmpdir(t)
+	defer os.RemoveAll(outside)
+	if err := os.Symlink(outside, path.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkoutPath(dir, "link/x"); err == nil {
+		t.Fatalf("writing through a symbolic link should fail")
+	}
+	if _, err := checkoutPath(dir, "../x"); err == nil {
+		t.Fatalf("writing outside of the directory should fail")
+	}
+	if p, err := checkoutPath(dir, "x"); err != nil || p != path.Join(dir, "x") {
+		t.Fatalf("%v %v", p, err)
+	}
+}
+
+func TestCheckoutInto(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("conf/a", "A")
+	db.Set("conf/b", "B")
+	db.SetWithMode("bin/run", "#!/bin/sh\n", 0755)
+	if err := db.Commit("first"); err != nil {
+		t.Fatal(err)
+	}
+	dir := tmpdir(t)
+	defer os.RemoveAll(dir)
+	var changes []string
+	opt := CheckoutOpt{
+		Delete: true,
+		OnChange: func(c Change) {
+			changes = append(changes, fmt.Sprintf("%s %s", c.Kind, c.Key))
+		},
+	}
+	if err := db.CheckoutInto(dir, opt); err != nil {
+		t.Fatal(err)
+	}
+	if s := fmt.Sprint(changes); s != "[added bin added bin/run added conf added conf/a added conf/b]" {
+		t.Fatalf("%v", s)
+	}
+	if st, err := os.Stat(path.Join(dir, "bin/run")); err != nil || st.Mode().Perm() != 0755 {
+		t.Fatalf("%v %v", st, err)
+	}
+
+	// Nothing is written if nothing changed
+	changes = nil
+	if err := db.CheckoutInto(dir, opt); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Fatalf("%v", changes)
+	}
+
+	db.Set("conf/a", "AA")
+	db.Delete("conf/b")
+	if err := db.Commit("second"); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path.Join(dir, "stray"), []byte("x"), 0644)
+	changes = nil
+	if err := db.CheckoutInto(dir, opt); err != nil {
+		t.Fatal(err)
+	}
+	if s := fmt.Sprint(changes); s != "[modified conf/a deleted conf/b deleted stray]" {
+		t.Fatalf("%v", s)
+	}
+	if data, err := ioutil.ReadFile(path.Join(dir, "conf/a")); err != nil || string(data) != "AA" {
+		t.Fatalf("%q %v", data, err)
+	}
+	// Local changes of the same size are only detected by comparing
+	// contents
+	ioutil.WriteFile(path.Join(dir, "conf/a"), []byte("XX"), 0644)
+	changes = nil
+	opt.Quick = true
+	if err := db.CheckoutInto(dir, opt); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Fatalf("%v", changes)
+	}
+	opt.Quick = false
+	if err := db.CheckoutInto(dir, opt); err != nil {
+		t.Fatal(err)
+	}
+	if s := fmt.Sprint(changes); s != "[modified conf/a]" {
+		t.Fatalf("%v", s)
+	}
+}
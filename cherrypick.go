@@ -0,0 +1,134 @@
+package libpack
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+// A CherryPickConflictError is returned by CherryPick when keys changed
+// by the picked commit were also changed locally.
+type CherryPickConflictError struct {
+	Commit string
+	Keys   []string
+}
+
+func (e *CherryPickConflictError) Error() string {
+	return fmt.Sprintf("cherry-pick %s: %d conflicting keys: %s", e.Commit, len(e.Keys), strings.Join(e.Keys, ", "))
+}
+
+// CherryPick applies the changes introduced by commit `commitID`, relative
+// to its parent, to the uncommitted tree. The commit must be in the
+// repository of the database, for example on another reference.
+// If a key changed by the commit doesn't have the value of the parent of
+// the commit in the uncommitted tree, nothing is changed and a
+// *CherryPickConflictError listing all such keys is returned. Keys which
+// already have their new value are not conflicts.
+// Merge commits are refused: see CherryPickParent. If the parent was not
+// downloaded (see WithDepth), ErrShallowHistory is returned.
+// The changes are not committed.
+func (db *DB) CherryPick(commitID string) error {
+	return db.CherryPickParent(commitID, 0)
+}
+
+// CherryPickParent is like CherryPick, but computes the changes introduced
+// by a merge commit relative to its parent number `parent`, starting
+// from 1. If parent is 0, merge commits are refused.
+func (db *DB) CherryPickParent(commitID string, parent int) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("cherry-pick", "", &err)
+	if db.parent != nil {
+		return db.parent.CherryPickParent(commitID, parent)
+	}
+	id, err := git.NewOid(commitID)
+	if err != nil {
+		return err
+	}
+	commit, err := lookupCommit(db.repo, id)
+	if err != nil {
+		return err
+	}
+	defer commit.Free()
+	n := int(commit.ParentCount())
+	switch {
+	case parent == 0 && n > 1:
+		return fmt.Errorf("cherry-pick %s: merge commit, a parent must be selected", commitID)
+	case parent == 0:
+		parent = 1
+	case parent > n:
+		return fmt.Errorf("cherry-pick %s: no parent %d", commitID, parent)
+	}
+	var base *git.Commit
+	if n > 0 {
+		if base = commit.Parent(uint(parent - 1)); base == nil {
+			return ErrShallowHistory
+		}
+		defer base.Free()
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	defer tree.Free()
+	changes, err := commitDiff(db.repo, base, tree)
+	if err != nil {
+		return err
+	}
+	db.l.Lock()
+	defer db.l.Unlock()
+	if err := db.flushLocked(); err != nil {
+		return err
+	}
+	var (
+		conflicts []string
+		apply     []Change
+	)
+	for _, c := range changes {
+		var local *git.Oid
+		if db.tree != nil {
+			if e, err := lookupEntry(db.tree, c.Key); err == nil {
+				local = e.id
+			}
+		}
+		switch {
+		case sameOid(local, c.NewId):
+			// Already applied
+		case sameOid(local, c.OldId):
+			apply = append(apply, c)
+		default:
+			conflicts = append(conflicts, c.Key)
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return &CherryPickConflictError{Commit: commitID, Keys: conflicts}
+	}
+	for _, c := range apply {
+		if c.Kind == Deleted {
+			if err := db.stage(c.Key, nil, 0); err != nil {
+				return err
+			}
+			continue
+		}
+		e, err := lookupEntry(tree, c.Key)
+		if err != nil {
+			return err
+		}
+		if err := db.stage(c.Key, e.id, e.mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameOid returns true if a and b are the same id, or are both nil.
+func sameOid(a, b *git.Oid) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equal(b)
+}
@@ -0,0 +1,63 @@
+package libpack
+
+import (
+	"testing"
+)
+
+func TestCherryPick(t *testing.T) {
+	staging := tmpDB(t, "refs/heads/staging")
+	defer nukeDB(staging)
+	staging.Set("app/version", "1")
+	staging.Set("app/old", "x")
+	if err := staging.Commit("base"); err != nil {
+		t.Fatal(err)
+	}
+	prod, err := Open(staging.Repo().Path(), "refs/heads/production")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prod.Free()
+	if err := prod.AddDB("/", staging); err != nil {
+		t.Fatal(err)
+	}
+	prod.Set("app/local", "prod only")
+	if err := prod.Commit("base"); err != nil {
+		t.Fatal(err)
+	}
+
+	staging.Set("app/version", "2")
+	staging.Set("app/new", "y")
+	staging.Delete("app/old")
+	if err := staging.Commit("promote me"); err != nil {
+		t.Fatal(err)
+	}
+	promote, _ := staging.Head()
+	if err := prod.CherryPick(promote); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, prod, "app/version", "2")
+	assertGet(t, prod, "app/new", "y")
+	assertGet(t, prod, "app/local", "prod only")
+	assertNotExist(t, prod, "app/old")
+	// Picking again is a no-op
+	if err := prod.CherryPick(promote); err != nil {
+		t.Fatal(err)
+	}
+	if err := prod.Commit("promoted"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Conflicts
+	staging.Set("app/version", "3")
+	if err := staging.Commit("conflict"); err != nil {
+		t.Fatal(err)
+	}
+	conflict, _ := staging.Head()
+	prod.Set("app/version", "hotfix")
+	err = prod.CherryPick(conflict)
+	cerr, ok := err.(*CherryPickConflictError)
+	if !ok || len(cerr.Keys) != 1 || cerr.Keys[0] != "app/version" {
+		t.Fatalf("%#v", err)
+	}
+	assertGet(t, prod, "app/version", "hotfix")
+}
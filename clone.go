@@ -0,0 +1,62 @@
+package libpack
+
+import (
+	"fmt"
+	"os"
+
+	git "github.com/libgit2/git2go"
+)
+
+// Clone creates a new database at dir from the reference `ref` of the
+// remote repository at url, and returns it ready to use.
+// The remote is recorded as "origin" in the new repository.
+// If dir already contains a clone of the same url, it is opened and
+// updated from the remote instead. If the clone fails, the partially
+// created directory is removed.
+// Use WithDepth to download only the latest commits, for example for a
+// read-only replica.
+func Clone(dir, url, ref string, opts ...Option) (db *DB, err error) {
+	if r, err := git.OpenRepository(dir); err == nil {
+		defer r.Free()
+		origin, err := r.LoadRemote("origin")
+		if err != nil {
+			return nil, fmt.Errorf("%s: not a clone: %w", dir, err)
+		}
+		defer origin.Free()
+		if origin.Url() != url {
+			return nil, fmt.Errorf("%s: already a clone of %s", dir, origin.Url())
+		}
+		db, err := Open(dir, ref, opts...)
+		if err != nil {
+			return nil, err
+		}
+		if err := db.Pull(url, ref); err != nil {
+			db.Free()
+			return nil, err
+		}
+		return db, nil
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return nil, fmt.Errorf("%s already exists", dir)
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	db, err = Init(dir, ref, opts...)
+	if err != nil {
+		return nil, err
+	}
+	origin, err := db.repo.CreateRemote("origin", url)
+	if err != nil {
+		db.Free()
+		return nil, err
+	}
+	origin.Free()
+	if err := db.Pull(url, ref); err != nil {
+		db.Free()
+		return nil, err
+	}
+	return db, nil
+}
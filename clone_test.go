@@ -0,0 +1,53 @@
+package libpack
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestClone(t *testing.T) {
+	src := tmpDB(t, "")
+	defer nukeDB(src)
+	src.Set("foo/bar", "hello")
+	if err := src.Commit("hello"); err != nil {
+		t.Fatal(err)
+	}
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	dir := path.Join(tmp, "clone")
+	db, err := Clone(dir, src.Repo().Path(), src.ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db, "foo/bar", "hello")
+	db.Free()
+
+	// Cloning again updates the existing clone
+	src.Set("foo/bar", "world")
+	if err := src.Commit("world"); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Clone(dir, src.Repo().Path(), src.ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db, "foo/bar", "world")
+	db.Free()
+
+	// A clone of another url is refused
+	other := tmpDB(t, "")
+	defer nukeDB(other)
+	if _, err := Clone(dir, other.Repo().Path(), src.ref); err == nil {
+		t.Fatalf("cloning a different url should fail")
+	}
+
+	// Failed clones are cleaned up
+	failed := path.Join(tmp, "failed")
+	if _, err := Clone(failed, path.Join(tmp, "does-not-exist"), src.ref); err == nil {
+		t.Fatalf("cloning a missing repository should fail")
+	}
+	if _, err := os.Stat(failed); !os.IsNotExist(err) {
+		t.Fatalf("%s should have been removed: %v", failed, err)
+	}
+}
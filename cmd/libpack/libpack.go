@@ -0,0 +1,300 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/docker/libpack"
+	git "github.com/libgit2/git2go"
+)
+
+const (
+	DefaultRef string = "refs/heads/master"
+)
+
+// Exit codes
+const (
+	exitError    = 1
+	exitNotFound = 2
+)
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "libpack"
+	app.Usage = "A simple command-line interface to libpack databases"
+	app.Version = "0.0.1"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{Name: "repo", Value: ".git", Usage: "path of the git repository"},
+		cli.StringFlag{Name: "ref", Value: DefaultRef, Usage: "git reference of the database"},
+	}
+	msgFlag := cli.StringFlag{Name: "m", Usage: "commit message"}
+	app.Commands = []cli.Command{
+		{
+			Name:   "init",
+			Usage:  "create a new database",
+			Action: cmdInit,
+		},
+		{
+			Name:   "get",
+			Usage:  "print the value of KEY",
+			Action: cmdGet,
+		},
+		{
+			Name:   "set",
+			Usage:  "set KEY to VALUE, or to the standard input if VALUE is '-' or missing, and commit",
+			Flags:  []cli.Flag{msgFlag},
+			Action: cmdSet,
+		},
+		{
+			Name:   "del",
+			Usage:  "delete KEY and commit",
+			Flags:  []cli.Flag{msgFlag},
+			Action: cmdDel,
+		},
+		{
+			Name:   "ls",
+			Usage:  "list the entries of KEY",
+			Flags:  []cli.Flag{cli.BoolFlag{Name: "r", Usage: "list recursively"}},
+			Action: cmdLs,
+		},
+		{
+			Name:   "dump",
+			Usage:  "print all keys and values",
+			Action: cmdDump,
+		},
+		{
+			Name:   "commit",
+			Usage:  "set each KEY to VALUE in a single commit",
+			Flags:  []cli.Flag{msgFlag},
+			Action: cmdCommit,
+		},
+		{
+			Name:   "log",
+			Usage:  "show the history of the database",
+			Flags:  []cli.Flag{cli.IntFlag{Name: "n", Usage: "maximum number of commits to show"}},
+			Action: cmdLog,
+		},
+		{
+			Name:   "push",
+			Usage:  "push the database to URL",
+			Action: cmdPush,
+		},
+		{
+			Name:   "pull",
+			Usage:  "pull the database from URL",
+			Action: cmdPull,
+		},
+	}
+	app.Run(os.Args)
+}
+
+func openDB(c *cli.Context) *libpack.DB {
+	db, err := libpack.Open(c.GlobalString("repo"), c.GlobalString("ref"))
+	if err != nil {
+		Fatalf("open: %v", err)
+	}
+	return db
+}
+
+func cmdInit(c *cli.Context) {
+	db, err := libpack.Init(c.GlobalString("repo"), c.GlobalString("ref"))
+	if err != nil {
+		Fatalf("init: %v", err)
+	}
+	db.Free()
+}
+
+func cmdGet(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		Fatalf("usage: get KEY")
+	}
+	db := openDB(c)
+	defer db.Free()
+	val, err := db.Get(c.Args()[0])
+	if err != nil {
+		check("get", err)
+	}
+	os.Stdout.WriteString(val)
+}
+
+func cmdSet(c *cli.Context) {
+	if len(c.Args()) < 1 || len(c.Args()) > 2 {
+		Fatalf("usage: set KEY [VALUE|-]")
+	}
+	key := c.Args()[0]
+	var val string
+	if len(c.Args()) == 2 && c.Args()[1] != "-" {
+		val = c.Args()[1]
+	} else {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			Fatalf("read: %v", err)
+		}
+		val = string(data)
+	}
+	db := openDB(c)
+	defer db.Free()
+	if err := db.Set(key, val); err != nil {
+		Fatalf("set: %v", err)
+	}
+	commit(c, db, fmt.Sprintf("set %s", key))
+}
+
+func cmdDel(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		Fatalf("usage: del KEY")
+	}
+	db := openDB(c)
+	defer db.Free()
+	if err := db.Delete(c.Args()[0]); err != nil {
+		check("del", err)
+	}
+	commit(c, db, fmt.Sprintf("del %s", c.Args()[0]))
+}
+
+func cmdLs(c *cli.Context) {
+	key := "/"
+	if len(c.Args()) > 1 {
+		Fatalf("usage: ls [-r] [KEY]")
+	} else if len(c.Args()) == 1 {
+		key = c.Args()[0]
+	}
+	db := openDB(c)
+	defer db.Free()
+	if c.Bool("r") {
+		err := db.Walk(key, func(name string, obj git.Object) error {
+			if _, isTree := obj.(*git.Tree); isTree {
+				name += "/"
+			}
+			fmt.Println(name)
+			return nil
+		})
+		if err != nil {
+			check("ls", err)
+		}
+		return
+	}
+	entries, err := db.ListEntries(key)
+	if err != nil {
+		check("ls", err)
+	}
+	for _, e := range entries {
+		if e.Kind == libpack.KindTree {
+			fmt.Printf("%s/\n", e.Name)
+		} else {
+			fmt.Println(e.Name)
+		}
+	}
+}
+
+func cmdDump(c *cli.Context) {
+	db := openDB(c)
+	defer db.Free()
+	if err := db.Dump(os.Stdout); err != nil {
+		Fatalf("dump: %v", err)
+	}
+}
+
+func cmdCommit(c *cli.Context) {
+	if !c.Args().Present() {
+		Fatalf("usage: commit [-m MSG] KEY=VALUE...")
+	}
+	db := openDB(c)
+	defer db.Free()
+	kv := make(map[string]string)
+	for _, arg := range c.Args() {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			Fatalf("usage: commit [-m MSG] KEY=VALUE...")
+		}
+		kv[parts[0]] = parts[1]
+	}
+	if err := db.SetMany(kv); err != nil {
+		Fatalf("set: %v", err)
+	}
+	commit(c, db, fmt.Sprintf("set %s", strings.Join(c.Args(), " ")))
+}
+
+func cmdLog(c *cli.Context) {
+	db := openDB(c)
+	defer db.Free()
+	commits, err := db.Log("", c.Int("n"))
+	if err == libpack.ErrNoCommits {
+		return
+	} else if err != nil && err != libpack.ErrShallowHistory {
+		Fatalf("log: %v", err)
+	}
+	for _, ci := range commits {
+		fmt.Printf("commit %s\nAuthor: %s <%s>\nDate:   %s\n\n", ci.Id, ci.Author, ci.Email, ci.When.Format("Mon Jan 2 15:04:05 2006 -0700"))
+		for _, line := range strings.Split(strings.TrimRight(ci.Message, "\n"), "\n") {
+			fmt.Printf("    %s\n", line)
+		}
+		fmt.Println()
+	}
+	if err == libpack.ErrShallowHistory {
+		fmt.Println("(history truncated by a shallow fetch)")
+	}
+}
+
+func cmdPush(c *cli.Context) {
+	url, ref := remoteArgs(c, "push")
+	db := openDB(c)
+	defer db.Free()
+	if err := db.Push(url, ref); err != nil {
+		Fatalf("push: %v", err)
+	}
+}
+
+func cmdPull(c *cli.Context) {
+	url, ref := remoteArgs(c, "pull")
+	db := openDB(c)
+	defer db.Free()
+	if err := db.Pull(url, ref); err != nil {
+		Fatalf("pull: %v", err)
+	}
+}
+
+func remoteArgs(c *cli.Context, cmd string) (url, ref string) {
+	if len(c.Args()) < 1 || len(c.Args()) > 2 {
+		Fatalf("usage: %s URL [REF]", cmd)
+	}
+	url = c.Args()[0]
+	if len(c.Args()) == 2 {
+		ref = c.Args()[1]
+	}
+	return url, ref
+}
+
+func commit(c *cli.Context, db *libpack.DB, defaultMsg string) {
+	msg := c.String("m")
+	if msg == "" {
+		msg = defaultMsg
+	}
+	if err := db.Commit(msg); err != nil {
+		Fatalf("commit: %v", err)
+	}
+}
+
+// check exits with exitNotFound if err reports a missing key, and
+// exitError otherwise.
+func check(cmd string, err error) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", cmd, err)
+	// The errors of libpack wrap the errors of libgit2, see libpack.OpError
+	var gerr *git.GitError
+	if errors.Is(err, os.ErrNotExist) || errors.As(err, &gerr) && gerr.Code == git.ErrNotFound {
+		os.Exit(exitNotFound)
+	}
+	os.Exit(exitError)
+}
+
+func Fatalf(msg string, args ...interface{}) {
+	if !strings.HasSuffix(msg, "\n") {
+		msg = msg + "\n"
+	}
+	fmt.Fprintf(os.Stderr, msg, args...)
+	os.Exit(exitError)
+}
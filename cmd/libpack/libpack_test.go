@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// buildBinary builds the command in a temporary directory, and returns
+// the path of the binary.
+func buildBinary(t *testing.T, tmp string) string {
+	bin := path.Join(tmp, "libpack")
+	if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("build: %v: %s", err, out)
+	}
+	return bin
+}
+
+func run(t *testing.T, bin, repo, stdin string, args ...string) (string, int) {
+	cmd := exec.Command(bin, append([]string{"--repo", repo}, args...)...)
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return string(out), exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), 0
+}
+
+func TestCommands(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "libpack-cmd-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	bin := buildBinary(t, tmp)
+	repo := path.Join(tmp, "repo")
+	expect := func(stdin string, code int, expected string, args ...string) {
+		out, c := run(t, bin, repo, stdin, args...)
+		if c != code {
+			t.Fatalf("%v: exit code %d instead of %d", args, c, code)
+		}
+		if code == 0 && out != expected {
+			t.Fatalf("%v: %q != %q", args, out, expected)
+		}
+	}
+	expect("", 0, "", "init")
+	expect("", 0, "", "set", "foo/bar", "hello")
+	expect("\x00binary\xff", 0, "", "set", "foo/bin", "-")
+	expect("", 0, "hello", "get", "foo/bar")
+	expect("", 0, "\x00binary\xff", "get", "foo/bin")
+	expect("", exitNotFound, "", "get", "foo/missing")
+	expect("", 0, "foo/\n", "ls")
+	expect("", 0, "foo/\nfoo/bar\nfoo/bin\n", "ls", "-r")
+	expect("", 0, "", "commit", "-m", "batch", "a=1", "b=2")
+	expect("", 0, "2", "get", "b")
+	expect("", 0, "", "del", "a")
+	expect("", exitNotFound, "", "get", "a")
+	expect("", exitNotFound, "", "del", "a")
+	expect("", exitNotFound, "", "ls", "missing")
+	expect("", exitNotFound, "", "ls", "-r", "missing")
+	out, _ := run(t, bin, repo, "", "log", "-n", "2")
+	if strings.Count(out, "\ncommit ") != 1 || !strings.Contains(out, "batch") {
+		t.Fatalf("%s", out)
+	}
+	other := path.Join(tmp, "other")
+	if _, code := run(t, bin, other, "", "init"); code != 0 {
+		t.Fatalf("init: exit code %d", code)
+	}
+	expect("", 0, "", "push", other)
+	if out, code := run(t, bin, other, "", "get", "b"); code != 0 || out != "2" {
+		t.Fatalf("%q %d", out, code)
+	}
+	expect("", 0, "", "pull", other)
+}
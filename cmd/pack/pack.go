@@ -76,10 +76,7 @@ func Pack(repo, dir, branch string) (hash string, err error) {
 	if err := db.Commit("imported tar filesystem tree"); err != nil {
 		return "", err
 	}
-	head := db.Head()
-	if head != nil {
-		hash = head.String()
-	}
+	hash, err = db.Head()
 	return
 }
 
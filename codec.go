@@ -0,0 +1,201 @@
+package libpack
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+const (
+	// modeBlob is the git filemode of regular values.
+	modeBlob = 0100644
+	// modeExecutable is the git filemode of executable values, see
+	// SetWithMode.
+	modeExecutable = 0100755
+	// modeLink is the git filemode of symbolic links, see SetLink.
+	modeLink = 0120000
+)
+
+// compressedPrefix marks the blobs whose contents are compressed.
+const compressedPrefix = "libpack-compressed\x00"
+
+// escapedPrefix is prepended to the values which start with one of the
+// prefixes of this file, so that they are not mistaken for encoded
+// values.
+const escapedPrefix = "libpack-escaped\x00"
+
+// isEncoded returns true if data starts with one of the prefixes which
+// mark encoded values.
+func isEncoded(data string) bool {
+	for _, prefix := range []string{compressedPrefix, encryptedPrefix, escapedPrefix} {
+		if strings.HasPrefix(data, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithCompression makes Set compress values larger than `threshold`
+// bytes with zlib before storing them. Get, Dump and Checkout decompress
+// them transparently.
+// Compressed values are recognizable, so databases mixing compressed and
+// uncompressed values can always be read, with or without this option.
+func WithCompression(threshold int) Option {
+	return func(db *DB) {
+		db.compressThreshold = threshold
+	}
+}
+
+// encryptedPrefix marks the blobs whose contents are encrypted.
+const encryptedPrefix = "libpack-encrypted\x00"
+
+// ErrEncrypted is returned when reading an encrypted value from a
+// database opened without WithEncryption.
+var ErrEncrypted = errors.New("value is encrypted, and no decryption key was set")
+
+// WithEncryption makes Set encrypt values with enc before storing them,
+// and Get, Dump and Checkout decrypt them with dec. Keys and the
+// structure of the tree are not encrypted. Push and Pull transfer
+// encrypted values as is.
+// Encrypted values are recognizable, so reading them from a database
+// opened without this option returns ErrEncrypted.
+func WithEncryption(enc, dec func([]byte) ([]byte, error)) Option {
+	return func(db *DB) {
+		db.encrypt = enc
+		db.decrypt = dec
+	}
+}
+
+// WithAESKey is like WithEncryption, with values encrypted using
+// AES-GCM and `key`, which must be 16, 24 or 32 bytes long.
+func WithAESKey(key []byte) Option {
+	gcm := func() (cipher.AEAD, error) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	enc := func(plain []byte) ([]byte, error) {
+		aead, err := gcm()
+		if err != nil {
+			return nil, err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+		return aead.Seal(nonce, nonce, plain, nil), nil
+	}
+	dec := func(data []byte) ([]byte, error) {
+		aead, err := gcm()
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < aead.NonceSize() {
+			return nil, fmt.Errorf("ciphertext too short")
+		}
+		return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	}
+	return WithEncryption(enc, dec)
+}
+
+// encodeValue returns the data to store in a blob for value, and the
+// filemode of the blob.
+// Values are escaped first, then compressed, then encrypted.
+func (db *DB) encodeValue(value string) (string, int, error) {
+	if isEncoded(value) {
+		value = escapedPrefix + value
+	}
+	if db.compressThreshold > 0 && len(value) > db.compressThreshold {
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		if _, err := w.Write([]byte(value)); err != nil {
+			return "", 0, err
+		}
+		if err := w.Close(); err != nil {
+			return "", 0, err
+		}
+		value = compressedPrefix + buf.String()
+	}
+	if db.encrypt != nil {
+		data, err := db.encrypt([]byte(value))
+		if err != nil {
+			return "", 0, fmt.Errorf("encrypt: %w", err)
+		}
+		value = encryptedPrefix + string(data)
+	}
+	return value, modeBlob, nil
+}
+
+// decodeValue returns the value stored in a blob with the specified
+// content and filemode.
+func (db *DB) decodeValue(data string, mode int) (string, error) {
+	if strings.HasPrefix(data, encryptedPrefix) {
+		if db.decrypt == nil {
+			return "", ErrEncrypted
+		}
+		plain, err := db.decrypt([]byte(data[len(encryptedPrefix):]))
+		if err != nil {
+			return "", fmt.Errorf("decrypt: %w", err)
+		}
+		data = string(plain)
+	}
+	if strings.HasPrefix(data, compressedPrefix) {
+		r, err := zlib.NewReader(bytes.NewReader([]byte(data[len(compressedPrefix):])))
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+		value, err := ioutil.ReadAll(r)
+		if err != nil {
+			return "", err
+		}
+		data = string(value)
+	}
+	return strings.TrimPrefix(data, escapedPrefix), nil
+}
+
+// decodeCheckout replaces the files of a checkout of tree in dir with
+// their decoded values.
+func (db *DB) decodeCheckout(tree *git.Tree, dir string) error {
+	return treeWalk(db.repo, tree, "/", func(key string, e *git.TreeEntry, obj git.Object) error {
+		blob, isBlob := obj.(*git.Blob)
+		if !isBlob {
+			return nil
+		}
+		if e.Filemode == modeLink {
+			return nil
+		}
+		data := string(blob.Contents())
+		value, err := db.decodeValue(data, e.Filemode)
+		if err != nil {
+			return err
+		}
+		if value == data {
+			return nil
+		}
+		perm := os.FileMode(0644)
+		if e.Filemode == modeExecutable {
+			perm = 0755
+		}
+		p, err := checkoutPath(dir, key)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, []byte(value), perm); err != nil {
+			return err
+		}
+		return os.Chmod(p, perm)
+	})
+}
@@ -0,0 +1,273 @@
+package libpack
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	db, err := Init(tmpdir(t), "refs/heads/test", WithCompression(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(db)
+	large := strings.Repeat("hello world ", 100)
+	db.Set("small", "hello")
+	db.Set("dir/large", large)
+	assertGet(t, db, "small", "hello")
+	assertGet(t, db, "dir/large", large)
+	if info, err := db.Stat("dir/large"); err != nil {
+		t.Fatal(err)
+	} else if info.Mode != modeBlob || info.Size >= int64(len(large)) {
+		t.Fatalf("%#v", info)
+	}
+	if info, err := db.Stat("small"); err != nil {
+		t.Fatal(err)
+	} else if info.Mode != modeBlob {
+		t.Fatalf("%#v", info)
+	}
+	var dump bytes.Buffer
+	if err := db.Dump(&dump); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "dir/\ndir/large = " + large + "\nsmall = hello\n"; dump.String() != expected {
+		t.Fatalf("%v", dump.String())
+	}
+	if err := db.Commit("compressed"); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := db.Checkout("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if data, err := ioutil.ReadFile(path.Join(dir, "dir/large")); err != nil {
+		t.Fatal(err)
+	} else if string(data) != large {
+		t.Fatalf("%v", string(data))
+	}
+	// Compressed values can be read without the option
+	db2, err := Open(db.Repo().Path(), db.ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Free()
+	assertGet(t, db2, "dir/large", large)
+	db2.Set("dir/large2", large)
+	assertGet(t, db2, "dir/large2", large)
+	if info, err := db2.Stat("dir/large2"); err != nil {
+		t.Fatal(err)
+	} else if info.Mode != modeBlob {
+		t.Fatalf("%#v", info)
+	}
+}
+
+func xor(data []byte) ([]byte, error) {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = b ^ 0x42
+	}
+	return out, nil
+}
+
+func TestEncryption(t *testing.T) {
+	db, err := Init(tmpdir(t), "refs/heads/test", WithEncryption(xor, xor), WithCompression(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(db)
+	large := strings.Repeat("secret ", 100)
+	db.Set("foo/bar", "secret")
+	db.Set("large", large)
+	assertGet(t, db, "foo/bar", "secret")
+	assertGet(t, db, "large", large)
+	if err := db.Commit("encrypted"); err != nil {
+		t.Fatal(err)
+	}
+	// Blobs don't contain the plain text
+	tree, err := db.Tree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw, err := TreeGet(db.Repo(), tree, "foo/bar"); err != nil {
+		t.Fatal(err)
+	} else if strings.Contains(raw, "secret") {
+		t.Fatalf("%q", raw)
+	}
+	var dump bytes.Buffer
+	if err := db.Dump(&dump); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dump.String(), "foo/bar = secret\n") {
+		t.Fatalf("%v", dump.String())
+	}
+	dir, err := db.Checkout("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if data, err := ioutil.ReadFile(path.Join(dir, "large")); err != nil {
+		t.Fatal(err)
+	} else if string(data) != large {
+		t.Fatalf("%v", string(data))
+	}
+	// Without the key, Get fails
+	db2, err := Open(db.Repo().Path(), db.ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Free()
+	if _, err := db2.Get("foo/bar"); err != ErrEncrypted {
+		t.Fatalf("%#v", err)
+	}
+}
+
+func TestAESKey(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	db, err := Init(tmpdir(t), "refs/heads/test", WithAESKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(db)
+	db.Set("foo", "secret")
+	assertGet(t, db, "foo", "secret")
+	if err := db.Commit("encrypted"); err != nil {
+		t.Fatal(err)
+	}
+	db2, err := Open(db.Repo().Path(), db.ref, WithAESKey([]byte("fedcba9876543210")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Free()
+	if _, err := db2.Get("foo"); err == nil {
+		t.Fatalf("decrypting with the wrong key should fail")
+	}
+}
+
+func TestEscapedValues(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	for _, opts := range [][]Option{nil, {WithCompression(10), WithAESKey(key)}} {
+		db, err := Init(tmpdir(t), "refs/heads/test", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer nukeDB(db)
+		values := map[string]string{
+			"compressed": compressedPrefix + "not compressed",
+			"encrypted":  encryptedPrefix + "not encrypted",
+			"escaped":    escapedPrefix + "not escaped",
+		}
+		for k, v := range values {
+			if err := db.Set(k, v); err != nil {
+				t.Fatal(err)
+			}
+			assertGet(t, db, k, v)
+		}
+		if err := db.Commit("prefixes"); err != nil {
+			t.Fatal(err)
+		}
+		dir, err := db.Checkout("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		for k, v := range values {
+			if data, err := ioutil.ReadFile(path.Join(dir, k)); err != nil || string(data) != v {
+				t.Fatalf("%q %v", data, err)
+			}
+		}
+	}
+}
+
+func TestFileModes(t *testing.T) {
+	db, err := Init(tmpdir(t), "refs/heads/test", WithCompression(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(db)
+	script := "#!/bin/sh\necho hello world, hello world\n"
+	if err := db.SetWithMode("bin/script", script, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetWithMode("bin/small", "#!/bin/sh\n", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetWithMode("conf", "x", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetLink("bin/link", "script"); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db, "bin/script", script)
+	assertGet(t, db, "bin/link", "script")
+	for key, mode := range map[string]int{"bin/script": modeExecutable, "bin/small": modeExecutable, "conf": modeBlob, "bin/link": modeLink} {
+		if info, err := db.Stat(key); err != nil {
+			t.Fatal(err)
+		} else if info.Mode != mode {
+			t.Fatalf("%s: %o", key, info.Mode)
+		}
+	}
+	if err := db.Append("bin/small", "true\n"); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := db.Stat("bin/small"); info.Mode != modeExecutable {
+		t.Fatalf("%o", info.Mode)
+	}
+	if err := db.Commit("modes"); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := db.Checkout("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for file, perm := range map[string]os.FileMode{"bin/script": 0755, "bin/small": 0755, "conf": 0644} {
+		st, err := os.Stat(path.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Mode().Perm() != perm {
+			t.Fatalf("%s: %v", file, st.Mode())
+		}
+	}
+	if data, err := ioutil.ReadFile(path.Join(dir, "bin/script")); err != nil || string(data) != script {
+		t.Fatalf("%q %v", data, err)
+	}
+	if target, err := os.Readlink(path.Join(dir, "bin/link")); err != nil || target != "script" {
+		t.Fatalf("%q %v", target, err)
+	}
+}
+
+func TestExecutableZlib(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	// An executable value which happens to be a zlib stream is user data
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write([]byte(strings.Repeat("hello world ", 100)))
+	w.Close()
+	payload := buf.String()
+	if err := db.SetWithMode("payload", payload, 0755); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db, "payload", payload)
+	if err := db.Commit("payload"); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := db.Checkout("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if st, err := os.Stat(path.Join(dir, "payload")); err != nil || st.Mode().Perm() != 0755 {
+		t.Fatalf("%v %v", st, err)
+	}
+	if data, err := ioutil.ReadFile(path.Join(dir, "payload")); err != nil || string(data) != payload {
+		t.Fatalf("%q %v", data, err)
+	}
+}
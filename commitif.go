@@ -0,0 +1,156 @@
+package libpack
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+// A StaleHeadError is returned by CommitIf when the reference of the
+// database doesn't point to the expected commit.
+type StaleHeadError struct {
+	// Expected and actual ids of the head. An empty string means that
+	// the reference doesn't exist.
+	Expected string
+	Actual   string
+}
+
+func (e *StaleHeadError) Error() string {
+	return fmt.Sprintf("stale head: expected %q, found %q", e.Expected, e.Actual)
+}
+
+// CommitIf is like Commit, but only if the reference of the database
+// points to commit `expectedHead`, or doesn't exist if expectedHead is
+// empty. Otherwise, nothing is committed and a *StaleHeadError is
+// returned. Uncommitted changes are kept, so that the caller can Update
+// with DirtyMerge and try again.
+// The check and the update of the reference are atomic, even across
+// processes. The database itself must be at expectedHead: unlike Commit,
+// CommitIf never merges.
+func (db *DB) CommitIf(msg, expectedHead string) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("commit", "", &err)
+	if db.parent != nil {
+		return db.parent.CommitIf(msg, expectedHead)
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	commit, err := db.commitIfLocked(msg, expectedHead, db.signature())
+	if err != nil || commit == nil {
+		return err
+	}
+	defer commit.Free()
+	db.runPostCommitHooks(commit)
+	return nil
+}
+
+// commitIfLocked does the work of CommitIf with the database locked,
+// and returns the new commit, which the caller must free, or nil if
+// nothing was committed.
+func (db *DB) commitIfLocked(msg, expectedHead string, sig *git.Signature) (*git.Commit, error) {
+	db.l.Lock()
+	defer db.l.Unlock()
+	if err := db.flushLocked(); err != nil {
+		return nil, err
+	}
+	var head string
+	if db.commit != nil {
+		head = db.commit.Id().String()
+	}
+	if head != expectedHead {
+		if stale := db.staleHead(expectedHead); stale != nil {
+			return nil, stale
+		}
+		return nil, fmt.Errorf("database is at %q, not %q: it must be updated first", head, expectedHead)
+	}
+	if db.tree == nil || db.commit != nil && db.commit.TreeId().Equal(db.tree.Id()) {
+		// Nothing to commit, but the precondition must still hold
+		return nil, db.staleHead(expectedHead)
+	}
+	if err := db.runCommitHooks(db.commit, db.tree); err != nil {
+		return nil, err
+	}
+	if db.locking {
+		unlock, err := lockRepo(db.repo.Path(), db.lockTimeout)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+	commit, err := mkCommit(db.repo, "", msg, sig, db.signer, db.tree, db.commit)
+	if err != nil {
+		return nil, err
+	}
+	firstLine := strings.SplitN(msg, "\n", 2)[0]
+	if err := updateRef(db.repo, db.ref, commit.Id(), expectedHead, "commit: "+firstLine); err != nil {
+		commit.Free()
+		if err == errConcurrentUpdate {
+			if stale := db.staleHead(expectedHead); stale != nil {
+				return nil, stale
+			}
+		}
+		return nil, err
+	}
+	db.logf(LogInfo, "%s: %s -> %s (commit if)", db.ref, commitName(db.commit), commit.Id())
+	if db.commit != nil {
+		db.commit.Free()
+	}
+	db.commit = commit
+	return db.ownCommit(commit, nil)
+}
+
+// Number of attempts of updateRef to update a locked reference.
+const updateRefAttempts = 10
+
+// updateRef points refname to id if it currently points to old, or
+// doesn't exist if old is empty. Otherwise, errConcurrentUpdate is
+// returned.
+// git2go doesn't expose git_reference_create_matching: git update-ref
+// does the same compare-and-swap, under the lock file of the reference.
+func updateRef(r *git.Repository, refname string, id *git.Oid, old, msg string) error {
+	expected := old
+	if old == "" {
+		old = strings.Repeat("0", 40)
+	}
+	for attempt := 1; ; attempt++ {
+		err := runGit(r, "update-ref", "-m", msg, refname, id.String(), old)
+		if err == nil {
+			return nil
+		}
+		if refTarget(r, refname) != expected {
+			return errConcurrentUpdate
+		}
+		// The reference is still at old: it may be locked by a
+		// concurrent update which is not done yet.
+		if attempt == updateRefAttempts {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// staleHead returns a *StaleHeadError if the reference of db doesn't
+// point to expected, and nil otherwise.
+func (db *DB) staleHead(expected string) error {
+	actual := refTarget(db.repo, db.ref)
+	if actual == expected {
+		return nil
+	}
+	return &StaleHeadError{Expected: expected, Actual: actual}
+}
+
+// refTarget returns the id of the commit refname points to, or an empty
+// string if it doesn't exist.
+func refTarget(r *git.Repository, refname string) string {
+	tip := lookupTip(r, refname)
+	if tip == nil {
+		return ""
+	}
+	defer tip.Free()
+	return tip.Id().String()
+}
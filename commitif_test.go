@@ -0,0 +1,116 @@
+package libpack
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestCommitIf(t *testing.T) {
+	db := tmpDB(t, "refs/heads/test")
+	defer nukeDB(db)
+	db.Set("foo", "bar")
+	if err := db.CommitIf("first", "deadbeef"); err == nil {
+		t.Fatalf("commit with a wrong head should fail")
+	}
+	if err := db.CommitIf("first", ""); err != nil {
+		t.Fatal(err)
+	}
+	head := db.headId().String()
+	// Committing on a ref which exists, expecting none
+	db.Set("foo", "baz")
+	err := db.CommitIf("second", "")
+	if serr, ok := err.(*StaleHeadError); !ok || serr.Actual != head {
+		t.Fatalf("%v", err)
+	}
+	assertGet(t, db, "foo", "baz")
+	if err := db.CommitIf("second", head); err != nil {
+		t.Fatal(err)
+	}
+	if db.headId().String() == head {
+		t.Fatalf("head didn't change")
+	}
+}
+
+func TestCommitIfRace(t *testing.T) {
+	db := tmpDB(t, "refs/heads/test")
+	defer nukeDB(db)
+	db.Set("foo", "bar")
+	if err := db.Commit("base"); err != nil {
+		t.Fatal(err)
+	}
+	base := db.headId().String()
+	const n = 4
+	var (
+		dbs  []*DB
+		errs = make([]error, n)
+		wg   sync.WaitGroup
+	)
+	for i := 0; i < n; i++ {
+		other, err := Open(db.Repo().Path(), "refs/heads/test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer other.Free()
+		other.Set("foo", fmt.Sprintf("writer%d", i))
+		dbs = append(dbs, other)
+	}
+	for i := range dbs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = dbs[i].CommitIf(fmt.Sprintf("writer %d", i), base)
+		}(i)
+	}
+	wg.Wait()
+	winner := -1
+	for i, err := range errs {
+		if err == nil {
+			if winner >= 0 {
+				t.Fatalf("writers %d and %d both committed", winner, i)
+			}
+			winner = i
+		}
+	}
+	if winner < 0 {
+		t.Fatalf("no writer committed: %v", errs)
+	}
+	head := dbs[winner].headId().String()
+	for i, err := range errs {
+		if i == winner {
+			continue
+		}
+		serr, ok := err.(*StaleHeadError)
+		if !ok || serr.Expected != base || serr.Actual != head {
+			t.Fatalf("writer %d: %v", i, err)
+		}
+	}
+	if err := db.Update(); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db, "foo", fmt.Sprintf("writer%d", winner))
+}
+
+func TestUpdateRef(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	commitKey(t, db, "foo", "A")
+	a := db.headId()
+	commitKey(t, db, "foo", "B")
+	b := db.headId()
+	if err := updateRef(db.repo, db.ref, a, "", "test"); err != errConcurrentUpdate {
+		t.Fatalf("%v", err)
+	}
+	if err := updateRef(db.repo, db.ref, a, a.String(), "test"); err != errConcurrentUpdate {
+		t.Fatalf("%v", err)
+	}
+	if err := updateRef(db.repo, db.ref, a, b.String(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if target := db.refTarget(); target != a.String() {
+		t.Fatalf("%s != %s", target, a)
+	}
+	if err := updateRef(db.repo, "refs/heads/new", a, "", "test"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,148 @@
+package libpack
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+// ErrHasRemote is returned by Compact and EnforceRetention when the
+// history may be shared with other repositories, and they are not forced.
+var ErrHasRemote = errors.New("history is shared with a remote")
+
+// Compact rewrites the history of the database, to drop the commits made
+// before keepSince. The oldest commit made since keepSince is replaced
+// with a new root commit of the same tree, with message msg, and the
+// following commits are replayed on top of it, keeping their trees,
+// messages and authors. If all commits are older than keepSince, only the
+// latest is kept. The history is linearized: only first parents are
+// followed. In a shallow history (see WithDepth), the oldest downloaded
+// commit is the oldest one kept.
+// The dropped commits are no longer reachable from the database's
+// reference, and are deleted by the next GC once they are old enough.
+// Compact is destructive: if the repository has a configured remote, or
+// the database was pushed or pulled, it fails with ErrHasRemote unless
+// force is true.
+// The id of the new head is returned.
+func (db *DB) Compact(keepSince time.Time, msg string, force bool) (commitID string, err error) {
+	if err := db.checkClosed(); err != nil {
+		return "", err
+	}
+	defer db.wrapError("compact", "", &err)
+	if db.parent != nil {
+		return db.parent.Compact(keepSince, msg, force)
+	}
+	if db.readOnly {
+		return "", ErrReadOnly
+	}
+	if !force {
+		if shared, err := db.hasRemote(); err != nil {
+			return "", err
+		} else if shared {
+			return "", ErrHasRemote
+		}
+	}
+	db.l.Lock()
+	defer db.l.Unlock()
+	head := db.commit
+	if head == nil {
+		return "", fmt.Errorf("no history to compact")
+	}
+	// Commits to keep, most recent first
+	keep := []*git.Commit{head}
+	defer func() {
+		for _, c := range keep[1:] {
+			c.Free()
+		}
+	}()
+	for c := head; c.ParentCount() > 0; {
+		p := c.Parent(0)
+		if p == nil {
+			// Boundary of a shallow fetch
+			break
+		}
+		if p.Committer().When.Before(keepSince) {
+			p.Free()
+			break
+		}
+		keep = append(keep, p)
+		c = p
+	}
+	newHead, err := db.rewriteHistoryLocked(keep, msg, "libpack.compact")
+	if err == errConcurrentUpdate {
+		err = fmt.Errorf("compact: %w", err)
+	}
+	return newHead, err
+}
+
+// rewriteHistoryLocked replaces the history of the database with copies
+// of the commits of keep, most recent first, the last of which becomes a
+// root commit with message msg. keep[0] must be the head of the database.
+// The reference is updated with reflog message logMsg, only if it still
+// points to keep[0], see updateRef. The caller must hold the lock.
+func (db *DB) rewriteHistoryLocked(keep []*git.Commit, msg string, logMsg string) (string, error) {
+	head := keep[0]
+	if db.locking {
+		unlock, err := lockRepo(db.repo.Path(), db.lockTimeout)
+		if err != nil {
+			return "", err
+		}
+		defer unlock()
+	}
+	var newHead *git.Commit
+	for i := len(keep) - 1; i >= 0; i-- {
+		c := keep[i]
+		tree, err := c.Tree()
+		if err != nil {
+			return "", err
+		}
+		m := c.Message()
+		if i == len(keep)-1 {
+			m = msg
+		}
+		commit, err := mkCommit(db.repo, "", m, c.Author(), db.signer, tree, newHead)
+		tree.Free()
+		if newHead != nil {
+			newHead.Free()
+		}
+		if err != nil {
+			return "", err
+		}
+		newHead = commit
+	}
+	if err := updateRef(db.repo, db.ref, newHead.Id(), head.Id().String(), logMsg); err != nil {
+		newHead.Free()
+		return "", err
+	}
+	// Don't keep the old history alive through tracking references
+	for _, name := range []string{db.publishedRef(), db.fetchedRef()} {
+		if ref, err := db.repo.LookupReference(name); err == nil {
+			ref.Delete()
+			ref.Free()
+		}
+	}
+	head.Free()
+	db.commit = newHead
+	return newHead.Id().String(), nil
+}
+
+// hasRemote returns true if the repository has a configured remote, or
+// if the database was pushed or pulled.
+func (db *DB) hasRemote() (bool, error) {
+	remotes, err := db.repo.ListRemotes()
+	if err != nil {
+		return false, err
+	}
+	if len(remotes) > 0 {
+		return true, nil
+	}
+	for _, name := range []string{db.publishedRef(), db.fetchedRef()} {
+		if ref, err := db.repo.LookupReference(name); err == nil {
+			ref.Free()
+			return true, nil
+		}
+	}
+	return false, nil
+}
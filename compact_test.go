@@ -0,0 +1,87 @@
+package libpack
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCompact(t *testing.T) {
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	db, err := Init(tmpdir(t), "refs/heads/test", WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(db)
+	if _, err := db.Compact(now, "compact", false); err == nil {
+		t.Fatalf("compacting an empty history should fail")
+	}
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Hour)
+		db.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("%d", i))
+		if err := db.Commit(fmt.Sprintf("commit %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log, _ := db.Log("", 0)
+	treeBefore, _ := db.TreeHash()
+	// Keep the last 2 commits
+	head, err := db.Compact(log[1].When, "compacted", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := db.Head(); h != head {
+		t.Fatalf("%v != %v", h, head)
+	}
+	newLog, err := db.Log("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(newLog) != 2 || newLog[0].Message != "commit 4" || newLog[1].Message != "compacted" || len(newLog[1].Parents) != 0 {
+		t.Fatalf("%#v", newLog)
+	}
+	for i := 0; i < 5; i++ {
+		assertGet(t, db, fmt.Sprintf("key%d", i), fmt.Sprintf("%d", i))
+	}
+	// The content is unchanged
+	if tree, _ := db.TreeHash(); tree != treeBefore {
+		t.Fatalf("%v != %v", tree, treeBefore)
+	}
+
+	// Shared histories are only compacted by force
+	remote := tmpDB(t, "")
+	defer nukeDB(remote)
+	if err := db.Push(remote.Repo().Path(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Compact(now.Add(time.Hour), "again", false); err != ErrHasRemote {
+		t.Fatalf("%v", err)
+	}
+	if _, err := db.Compact(now.Add(time.Hour), "again", true); err != nil {
+		t.Fatal(err)
+	}
+	if log, _ := db.Log("", 0); len(log) != 1 || log[0].Message != "again" {
+		t.Fatalf("%#v", log)
+	}
+}
+
+func TestCompactConcurrent(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	commitKey(t, db, "foo", "A")
+	commitKey(t, db, "foo", "B")
+	other, err := Open(db.Repo().Path(), db.ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Free()
+	commitKey(t, other, "foo", "C")
+	head, _ := other.Head()
+	// The commit of the other handle must not be discarded
+	if _, err := db.Compact(time.Now().Add(time.Hour), "compacted", false); err == nil {
+		t.Fatalf("compacting a stale history should fail")
+	}
+	if target := db.refTarget(); target != head {
+		t.Fatalf("%s != %s", target, head)
+	}
+}
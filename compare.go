@@ -0,0 +1,228 @@
+package libpack
+
+import (
+	"sort"
+
+	git "github.com/libgit2/git2go"
+)
+
+// MaxDifferences is the maximum number of keys returned by Equal and
+// Contains.
+const MaxDifferences = 100
+
+// Equal returns true if the stores a and b have the same values at the
+// same keys. Otherwise, it returns false and up to MaxDifferences keys at
+// which they differ, sorted: keys which have different values, and keys
+// of values or subtrees which are only in one store. Empty subtrees are
+// ignored.
+// Databases and snapshots backed by the same repository are equal if
+// their trees have the same id, without reading them. Otherwise, the
+// stores are listed and read side by side.
+func Equal(a, b ReadStore) (bool, []string, error) {
+	return compareStores(a, b, false)
+}
+
+// Contains returns true if each value of the store sub is in the store
+// super, at the same key. Otherwise, it returns false and up to
+// MaxDifferences keys of sub which are missing or have a different value
+// in super, sorted. See Equal.
+func Contains(super, sub ReadStore) (bool, []string, error) {
+	return compareStores(super, sub, true)
+}
+
+// A treeStore is a store backed by a git tree.
+type treeStore interface {
+	// storeTree returns the path of the repository of the store, and
+	// the id of its tree.
+	storeTree() (string, *git.Oid, error)
+}
+
+func (db *DB) storeTree() (string, *git.Oid, error) {
+	h, err := db.TreeHash()
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := git.NewOid(h)
+	return db.repo.Path(), id, err
+}
+
+func (s *Snapshot) storeTree() (string, *git.Oid, error) {
+	if err := s.db.checkClosed(); err != nil {
+		return "", nil, err
+	}
+	var (
+		id  *git.Oid
+		err error
+	)
+	if s.tree == nil {
+		id, err = emptyTree(s.db.repo)
+	} else {
+		var tree *git.Tree
+		if tree, err = TreeScope(s.db.repo, s.tree, s.db.scope); err == nil {
+			id = tree.Id()
+			tree.Free()
+		}
+	}
+	return s.db.repo.Path(), id, err
+}
+
+// sameTree returns true if a and b are backed by the same tree of the
+// same repository.
+func sameTree(a, b ReadStore) (bool, error) {
+	ta, ok := a.(treeStore)
+	if !ok {
+		return false, nil
+	}
+	tb, ok := b.(treeStore)
+	if !ok {
+		return false, nil
+	}
+	repoA, idA, err := ta.storeTree()
+	if err != nil {
+		return false, err
+	}
+	repoB, idB, err := tb.storeTree()
+	if err != nil {
+		return false, err
+	}
+	return repoA == repoB && idA.Equal(idB), nil
+}
+
+func compareStores(a, b ReadStore, subset bool) (bool, []string, error) {
+	if same, err := sameTree(a, b); err != nil || same {
+		return same, nil, err
+	}
+	c := &comparer{a: a, b: b, subset: subset}
+	if err := c.dir("/"); err != nil && err != ErrStopWalk {
+		return false, nil, err
+	}
+	sort.Strings(c.diffs)
+	return len(c.diffs) == 0, c.diffs, nil
+}
+
+// A comparer walks two stores side by side, in the order of their keys.
+// If subset is set, the entries which are only in a are ignored.
+type comparer struct {
+	a, b   ReadStore
+	subset bool
+	diffs  []string
+}
+
+// differ records key as a difference, and returns ErrStopWalk once
+// MaxDifferences keys are recorded.
+func (c *comparer) differ(key string) error {
+	c.diffs = append(c.diffs, key)
+	if len(c.diffs) >= MaxDifferences {
+		return ErrStopWalk
+	}
+	return nil
+}
+
+// dir compares the subtrees at key.
+func (c *comparer) dir(key string) error {
+	namesA, err := sortedList(c.a, key)
+	if err != nil {
+		return err
+	}
+	namesB, err := sortedList(c.b, key)
+	if err != nil {
+		return err
+	}
+	for len(namesA) > 0 || len(namesB) > 0 {
+		var err error
+		switch {
+		case len(namesB) == 0 || len(namesA) > 0 && namesA[0] < namesB[0]:
+			if !c.subset {
+				err = c.only(c.a, childKey(key, namesA[0]))
+			}
+			namesA = namesA[1:]
+		case len(namesA) == 0 || namesB[0] < namesA[0]:
+			err = c.only(c.b, childKey(key, namesB[0]))
+			namesB = namesB[1:]
+		default:
+			err = c.entry(childKey(key, namesA[0]))
+			namesA, namesB = namesA[1:], namesB[1:]
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// only records key, which is only in the store s, as a difference,
+// unless it is an empty subtree.
+func (c *comparer) only(s ReadStore, key string) error {
+	empty, err := isEmptyTree(s, key)
+	if err != nil || empty {
+		return err
+	}
+	return c.differ(key)
+}
+
+// isEmptyTree returns true if the entry at key in s is a subtree without
+// values.
+func isEmptyTree(s ReadStore, key string) (bool, error) {
+	_, dir, err := readEntry(s, key)
+	if err != nil || !dir {
+		return false, err
+	}
+	names, err := s.List(key)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		if empty, err := isEmptyTree(s, childKey(key, name)); err != nil || !empty {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// entry compares the entries at key, which is in both stores.
+func (c *comparer) entry(key string) error {
+	valueA, dirA, err := readEntry(c.a, key)
+	if err != nil {
+		return err
+	}
+	valueB, dirB, err := readEntry(c.b, key)
+	if err != nil {
+		return err
+	}
+	switch {
+	case dirA && dirB:
+		return c.dir(key)
+	case dirA || dirB || valueA != valueB:
+		return c.differ(key)
+	}
+	return nil
+}
+
+// readEntry returns the value at key in s, or true if it is a subtree.
+func readEntry(s ReadStore, key string) (string, bool, error) {
+	value, err := s.Get(key)
+	if err == nil {
+		return value, false, nil
+	}
+	if _, lerr := s.List(key); lerr == nil {
+		return "", true, nil
+	}
+	return "", false, err
+}
+
+func sortedList(s ReadStore, key string) ([]string, error) {
+	names, err := s.List(key)
+	if err != nil {
+		return nil, err
+	}
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+	return names, nil
+}
+
+func childKey(dir, name string) string {
+	if dir == "/" {
+		return name
+	}
+	return dir + "/" + name
+}
@@ -0,0 +1,83 @@
+package libpack
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func assertCompare(t *testing.T, f func(a, b ReadStore) (bool, []string, error), a, b ReadStore, diffs ...string) {
+	equal, keys, err := f(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if equal != (len(diffs) == 0) || !reflect.DeepEqual(keys, diffs) {
+		t.Fatalf("%v %#v != %#v", equal, keys, diffs)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	a := tmpDB(t, "")
+	defer nukeDB(a)
+	b := tmpDB(t, "")
+	defer nukeDB(b)
+	assertCompare(t, Equal, a, b)
+	kv := map[string]string{"foo": "1", "dir/a": "2", "dir/sub/b": "3"}
+	a.SetMany(kv)
+	b.SetMany(kv)
+	b.Commit("different history")
+	assertCompare(t, Equal, a, b)
+	// Annotations and empty directories are ignored
+	b.SetAnnotation("foo", "note", "x")
+	b.Mkdir("empty")
+	assertCompare(t, Equal, a, b)
+
+	a.Set("foo", "changed")
+	a.Set("dir/sub/only-a", "4")
+	b.Set("only-b/x", "5")
+	b.Delete("dir/a")
+	b.Set("dir/a/nested", "6")
+	assertCompare(t, Equal, a, b, "dir/a", "dir/sub/only-a", "foo", "only-b")
+	assertCompare(t, Equal, b, a, "dir/a", "dir/sub/only-a", "foo", "only-b")
+
+	// Scoped databases and snapshots
+	assertCompare(t, Equal, a.Scope("dir", "sub"), b.Scope("dir", "sub"), "only-a")
+	snap, err := a.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCompare(t, Equal, a, snap)
+	a.Set("foo", "after snapshot")
+	assertCompare(t, Equal, snap, a, "foo")
+}
+
+func TestContains(t *testing.T) {
+	super := tmpDB(t, "")
+	defer nukeDB(super)
+	sub := tmpDB(t, "")
+	defer nukeDB(sub)
+	super.SetMany(map[string]string{"a": "1", "b/c": "2", "b/d": "3"})
+	sub.SetMany(map[string]string{"a": "1", "b/c": "2"})
+	assertCompare(t, Contains, super, sub)
+	assertCompare(t, Contains, sub, super, "b/d")
+	sub.Set("a", "changed")
+	sub.Set("e", "4")
+	assertCompare(t, Contains, super, sub, "a", "e")
+	// A subtree of super contains itself
+	assertCompare(t, Contains, super.Scope("b"), super.Scope("b"))
+}
+
+func TestEqualMaxDifferences(t *testing.T) {
+	a := tmpDB(t, "")
+	defer nukeDB(a)
+	b := tmpDB(t, "")
+	defer nukeDB(b)
+	for i := 0; i < MaxDifferences+50; i++ {
+		a.Set(fmt.Sprintf("key%03d", i), "a")
+		b.Set(fmt.Sprintf("key%03d", i), "b")
+	}
+	equal, keys, err := Equal(a, b)
+	if err != nil || equal || len(keys) != MaxDifferences || keys[0] != "key000" {
+		t.Fatalf("%v %d %v", equal, len(keys), err)
+	}
+}
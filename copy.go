@@ -0,0 +1,243 @@
+package libpack
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+// A CopyConflictError is returned by CopyScope when keys of the source
+// would overwrite different values in the destination.
+type CopyConflictError struct {
+	// Conflicting keys, relative to the destination prefix
+	Keys []string
+}
+
+func (e *CopyConflictError) Error() string {
+	return fmt.Sprintf("%d conflicting keys: %s", len(e.Keys), strings.Join(e.Keys, ", "))
+}
+
+// CopyScope copies the subtree at srcPrefix in the uncommitted tree of
+// src into the uncommitted tree of dst, at dstPrefix. Keys of dst which
+// are not overwritten by the copy are left untouched.
+// If replace is false and some keys of src already exist in dst with a
+// different value, nothing is copied and a *CopyConflictError is
+// returned. Otherwise, the values of src win.
+// If both databases share the same repository, git objects are reused as
+// they are, without copying data. Otherwise values are read from src and
+// written in dst, so they are converted between the compression and
+// encryption settings of both databases.
+// The changes are not committed.
+func CopyScope(dst *DB, dstPrefix string, src *DB, srcPrefix string, replace bool) error {
+	if err := dst.checkClosed(); err != nil {
+		return err
+	}
+	if err := src.checkClosed(); err != nil {
+		return err
+	}
+	tree, err := src.snapshot()
+	if err != nil {
+		return err
+	}
+	if tree == nil {
+		return ErrNotExist
+	}
+	srcKey := TreePath(src.fullKey(srcPrefix))
+	info, err := TreeStat(src.repo, tree, srcKey)
+	if err != nil {
+		return err
+	}
+	if info.Kind != KindTree {
+		return fmt.Errorf("%s is not a subtree", srcPrefix)
+	}
+	blobs := make(map[string]blobEntry)
+	err = src.walk(tree, srcPrefix, func(key string, e *git.TreeEntry, obj git.Object) error {
+		if _, isBlob := obj.(*git.Blob); isBlob {
+			blobs[key] = blobEntry{e.Id, e.Filemode}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sameRepo := src.repo.Path() == dst.repo.Path()
+	if !replace {
+		if err := checkCopyConflicts(dst, dstPrefix, blobs, sameRepo, src); err != nil {
+			return err
+		}
+	}
+	if sameRepo {
+		if srcKey != "/" {
+			// Graft the whole subtree
+			id, err := git.NewOid(info.Id)
+			if err != nil {
+				return err
+			}
+			return dst.Add(dstPrefix, id)
+		}
+		root := dst.root()
+		root.l.Lock()
+		defer root.l.Unlock()
+		for key, blob := range blobs {
+			if err := root.stage(dst.fullKey(path.Join(dstPrefix, key)), blob.id, blob.mode); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	kv := make(map[string]string, len(blobs))
+	for key, blob := range blobs {
+		value, err := src.blobValue(blob)
+		if err != nil {
+			return err
+		}
+		kv[path.Join(dstPrefix, key)] = value
+	}
+	return dst.SetMany(kv)
+}
+
+// blobValue returns the decoded value stored in blob.
+func (db *DB) blobValue(blob blobEntry) (string, error) {
+	data, err := blobContents(db.repo, blob.id)
+	if err != nil {
+		return "", err
+	}
+	return db.root().decodeValue(data, blob.mode)
+}
+
+// checkCopyConflicts returns a *CopyConflictError if copying blobs into
+// dst at prefix would overwrite different values.
+func checkCopyConflicts(dst *DB, prefix string, blobs map[string]blobEntry, sameRepo bool, src *DB) error {
+	tree, err := dst.snapshot()
+	if err != nil || tree == nil {
+		return err
+	}
+	var conflicts []string
+	for key, blob := range blobs {
+		dstKey := path.Join(dst.scope, prefix, key)
+		e, err := lookupEntry(tree, dstKey)
+		if isNotExist(err) {
+			// A value at a parent path would be replaced by a subtree
+			for dir := path.Dir(key); dir != "."; dir = path.Dir(dir) {
+				if e, err := tree.EntryByPath(TreePath(path.Join(dst.scope, prefix, dir))); err == nil && e.Type == git.ObjectBlob {
+					conflicts = append(conflicts, key)
+					break
+				}
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if sameRepo && e.id.Equal(blob.id) {
+			continue
+		}
+		if !sameRepo {
+			srcValue, err := src.blobValue(blob)
+			if err != nil {
+				return err
+			}
+			if dstValue, err := dst.blobValue(*e); err == nil && dstValue == srcValue {
+				continue
+			}
+		}
+		conflicts = append(conflicts, key)
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return &CopyConflictError{Keys: conflicts}
+	}
+	return nil
+}
+
+// ExtractOpt are the settings of ExtractWith.
+type ExtractOpt struct {
+	// If set, the uncommitted tree of src is read, instead of its
+	// committed tree.
+	Uncommitted bool
+}
+
+// Extract copies the values of the committed tree of src whose key
+// satisfies pred into the uncommitted tree of dst, at the same keys, and
+// returns the number of values copied. See ExtractWith.
+func Extract(dst *DB, src *DB, pred func(key string) bool) (int, error) {
+	return ExtractWith(dst, src, pred, ExtractOpt{})
+}
+
+// ExtractWith is like Extract, with more settings.
+// Keys are relative to the scopes of both databases. Internal keys, such
+// as annotations, are not copied. If both databases share the same
+// repository, blobs are reused as they are. Otherwise values are read and
+// written one at a time, and checked against the limits and validators
+// of dst. Nothing is written if a value is rejected. The changes are not
+// committed.
+func ExtractWith(dst *DB, src *DB, pred func(key string) bool, opt ExtractOpt) (n int, err error) {
+	if err := dst.checkClosed(); err != nil {
+		return 0, err
+	}
+	if err := src.checkClosed(); err != nil {
+		return 0, err
+	}
+	var tree *git.Tree
+	if opt.Uncommitted {
+		tree, err = src.snapshot()
+	} else {
+		tree, err = src.committedTree()
+		if tree != nil {
+			defer tree.Free()
+		}
+	}
+	if err != nil || tree == nil {
+		return 0, err
+	}
+	sameRepo := src.repo.Path() == dst.repo.Path()
+	root := dst.root()
+	var (
+		keys  []string
+		blobs []blobEntry
+	)
+	err = src.walk(tree, "/", func(key string, e *git.TreeEntry, obj git.Object) error {
+		if _, isBlob := obj.(*git.Blob); !isBlob || !pred(key) {
+			return nil
+		}
+		if err := dst.checkReserved(key); err != nil {
+			return err
+		}
+		blob := blobEntry{e.Id, e.Filemode}
+		if !sameRepo {
+			value, err := src.blobValue(blob)
+			if err != nil {
+				return err
+			}
+			if err := dst.checkValue(dst.fullKey(key), value); err != nil {
+				return err
+			}
+			data, mode, err := root.encodeValue(value)
+			if err != nil {
+				return err
+			}
+			id, err := createBlob(root.repo, data)
+			if err != nil {
+				return err
+			}
+			blob = blobEntry{id, mode}
+		}
+		keys = append(keys, dst.fullKey(key))
+		blobs = append(blobs, blob)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer root.afterWrite(&err)
+	root.l.Lock()
+	defer root.l.Unlock()
+	for i, key := range keys {
+		if err := root.stage(key, blobs[i].id, blobs[i].mode); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
@@ -0,0 +1,133 @@
+package libpack
+
+import (
+	"strings"
+	"testing"
+)
+
+func testCopyScope(t *testing.T, src, dst *DB) {
+	src.Set("apps/web/port", "80")
+	src.Set("apps/web/host", "example.com")
+	src.Set("other", "ignored")
+	dst.Set("config/web/port", "8080")
+	dst.Set("config/web/extra", "kept")
+	dst.Set("outside", "untouched")
+
+	err := CopyScope(dst, "config", src, "apps", false)
+	cerr, ok := err.(*CopyConflictError)
+	if !ok || len(cerr.Keys) != 1 || cerr.Keys[0] != "web/port" {
+		t.Fatalf("%#v", err)
+	}
+	assertNotExist(t, dst, "config/web/host")
+
+	if err := CopyScope(dst, "config", src, "apps", true); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, dst, "config/web/port", "80")
+	assertGet(t, dst, "config/web/host", "example.com")
+	assertGet(t, dst, "config/web/extra", "kept")
+	assertGet(t, dst, "outside", "untouched")
+	assertNotExist(t, dst, "config/other")
+
+	// Copying identical values is not a conflict
+	if err := CopyScope(dst, "config", src, "apps", false); err != nil {
+		t.Fatal(err)
+	}
+	// Scopes are honored
+	if err := CopyScope(dst.Scope("copy"), "", src.Scope("apps"), "web", false); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, dst, "copy/port", "80")
+	if err := CopyScope(dst, "x", src, "missing", false); err == nil {
+		t.Fatalf("copying a missing scope should fail")
+	}
+	if err := dst.Commit("copy"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyScopeSameRepo(t *testing.T) {
+	src := tmpDB(t, "refs/heads/src")
+	defer nukeDB(src)
+	dst, err := Open(src.Repo().Path(), "refs/heads/dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Free()
+	testCopyScope(t, src, dst)
+}
+
+func TestCopyScopeAcrossRepos(t *testing.T) {
+	src := tmpDB(t, "")
+	defer nukeDB(src)
+	dst, err := Init(tmpdir(t), "refs/heads/test", WithCompression(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(dst)
+	testCopyScope(t, src, dst)
+}
+
+func testExtract(t *testing.T, src, dst *DB) {
+	src.Set("tenants/acme/users/1", "alice")
+	src.Set("tenants/acme/plan", "gold")
+	src.Set("tenants/other/users/1", "bob")
+	src.SetAnnotation("tenants/acme/plan", "note", "internal")
+	if err := src.Commit("tenants"); err != nil {
+		t.Fatal(err)
+	}
+	src.Set("tenants/acme/uncommitted", "x")
+	acme := func(key string) bool {
+		return strings.HasPrefix(key, "tenants/acme/")
+	}
+	n, err := Extract(dst, src, acme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("%d", n)
+	}
+	assertGet(t, dst, "tenants/acme/users/1", "alice")
+	assertGet(t, dst, "tenants/acme/plan", "gold")
+	assertNotExist(t, dst, "tenants/other/users/1")
+	assertNotExist(t, dst, "tenants/acme/uncommitted")
+	if _, err := dst.GetAnnotation("tenants/acme/plan", "note"); err == nil {
+		t.Fatalf("annotations should not be copied")
+	}
+	if n, err := ExtractWith(dst, src, acme, ExtractOpt{Uncommitted: true}); err != nil || n != 3 {
+		t.Fatalf("%d %v", n, err)
+	}
+	assertGet(t, dst, "tenants/acme/uncommitted", "x")
+	// Keys are relative to the scopes
+	if n, err := Extract(dst.Scope("export"), src.Scope("tenants", "acme"), func(key string) bool {
+		return key == "plan"
+	}); err != nil || n != 1 {
+		t.Fatalf("%d %v", n, err)
+	}
+	assertGet(t, dst, "export/plan", "gold")
+	if err := dst.Commit("extract"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractSameRepo(t *testing.T) {
+	src := tmpDB(t, "refs/heads/src")
+	defer nukeDB(src)
+	dst, err := Open(src.Repo().Path(), "refs/heads/dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Free()
+	testExtract(t, src, dst)
+}
+
+func TestExtractAcrossRepos(t *testing.T) {
+	src := tmpDB(t, "")
+	defer nukeDB(src)
+	dst, err := Init(tmpdir(t), "refs/heads/test", WithCompression(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(dst)
+	testExtract(t, src, dst)
+}
@@ -0,0 +1,122 @@
+package libpack
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A BinaryPolicy tells DumpCSV what to do with binary values: values
+// which are not valid UTF-8, or contain NUL bytes.
+type BinaryPolicy int
+
+const (
+	// Binary values are written in base64, prefixed with "base64:".
+	// Text values which start with "base64:" are encoded too, so that
+	// every value can be decoded.
+	BinaryBase64 BinaryPolicy = iota
+	// Binary values are left out of the export.
+	BinarySkip
+)
+
+// Base64Prefix marks the values encoded in base64 by DumpCSV.
+const Base64Prefix = "base64:"
+
+// CSVOpt are the settings of DumpCSV.
+type CSVOpt struct {
+	// Subtree to export, relative to the scope of the database. If
+	// empty, the whole scope is exported.
+	Prefix string
+	// Maximum number of components of the exported keys, relative to
+	// Prefix: 1 only exports the values directly in Prefix. If 0, every
+	// value is exported.
+	MaxDepth int
+	// Column separator, ',' if zero. Use '\t' for tab-separated values.
+	Comma rune
+	// If set, the first row holds the names of the columns.
+	Header bool
+	// If set, a "size" column holds the size of each value in bytes.
+	Size bool
+	// If set, a "commit" column holds the id of the last commit which
+	// changed each value, as returned by Blame, or an empty string for
+	// uncommitted values. This looks up the history of every value.
+	LastCommit bool
+	// What to do with binary values
+	Binary BinaryPolicy
+}
+
+// DumpCSV writes the values of the uncommitted tree to w as CSV, one row
+// per value, sorted by key, with the columns "key" and "value" followed
+// by the optional columns selected by opt. Keys are relative to
+// opt.Prefix. Fields are quoted when they contain the separator, quotes
+// or newlines.
+func (db *DB) DumpCSV(w io.Writer, opt CSVOpt) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("dump", "", &err)
+	cw := csv.NewWriter(w)
+	if opt.Comma != 0 {
+		cw.Comma = opt.Comma
+	}
+	if opt.Header {
+		header := []string{"key", "value"}
+		if opt.Size {
+			header = append(header, "size")
+		}
+		if opt.LastCommit {
+			header = append(header, "commit")
+		}
+		if err := cw.Write(header); err != nil {
+			return err
+		}
+	}
+	err = db.WalkKeys(opt.Prefix, func(key string, value []byte) error {
+		if opt.MaxDepth > 0 && strings.Count(key, "/")+1 > opt.MaxDepth {
+			return nil
+		}
+		field := string(value)
+		if isBinaryValue(field) || strings.HasPrefix(field, Base64Prefix) {
+			if opt.Binary == BinarySkip && isBinaryValue(field) {
+				return nil
+			}
+			field = Base64Prefix + base64.StdEncoding.EncodeToString(value)
+		}
+		row := []string{key, field}
+		if opt.Size {
+			row = append(row, strconv.Itoa(len(value)))
+		}
+		if opt.LastCommit {
+			var commit string
+			info, err := db.Blame(path.Join(opt.Prefix, key))
+			switch err {
+			case nil:
+				commit = info.Id
+			case ErrUncommitted, ErrShallowHistory:
+			default:
+				return err
+			}
+			row = append(row, commit)
+		}
+		return cw.Write(row)
+	})
+	if err == ErrNotExist && TreePath(opt.Prefix) == "/" {
+		// Empty database
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// isBinaryValue is like isBinary, and also checks that the whole value
+// is valid UTF-8.
+func isBinaryValue(value string) bool {
+	return !utf8.ValidString(value) || strings.IndexByte(value, 0) >= 0
+}
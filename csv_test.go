@@ -0,0 +1,72 @@
+package libpack
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDumpCSV(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.SetMany(map[string]string{
+		"users/b":       "two, with comma",
+		"users/a":       "line1\nline2",
+		"users/quote":   `say "hi"`,
+		"users/bin":     "\x00\xff",
+		"users/trick":   "base64:abc",
+		"users/sub/key": "deep",
+	})
+	db.SetAnnotation("users/a", "note", "hidden")
+	var buf bytes.Buffer
+	if err := db.DumpCSV(&buf, CSVOpt{Prefix: "users", Header: true, Size: true}); err != nil {
+		t.Fatal(err)
+	}
+	expected := "key,value,size\n" +
+		"a,\"line1\nline2\",11\n" +
+		"b,\"two, with comma\",15\n" +
+		"bin,base64:AP8=,2\n" +
+		"quote,\"say \"\"hi\"\"\",8\n" +
+		"sub/key,deep,4\n" +
+		"trick,base64:YmFzZTY0OmFiYw==,10\n"
+	if buf.String() != expected {
+		t.Fatalf("%q", buf.String())
+	}
+	// Flat, tab-separated, without binary values
+	buf.Reset()
+	if err := db.Scope("users").DumpCSV(&buf, CSVOpt{MaxDepth: 1, Comma: '\t', Binary: BinarySkip}); err != nil {
+		t.Fatal(err)
+	}
+	expected = "a\t\"line1\nline2\"\n" +
+		"b\ttwo, with comma\n" +
+		"quote\t\"say \"\"hi\"\"\"\n" +
+		"trick\tbase64:YmFzZTY0OmFiYw==\n"
+	if buf.String() != expected {
+		t.Fatalf("%q", buf.String())
+	}
+}
+
+func TestDumpCSVLastCommit(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	var buf bytes.Buffer
+	if err := db.DumpCSV(&buf, CSVOpt{Header: true, LastCommit: true}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "key,value,commit\n" {
+		t.Fatalf("%q", buf.String())
+	}
+	db.Set("a", "1")
+	db.Commit("a")
+	first, _ := db.Head()
+	db.Set("b", "2")
+	db.Commit("b")
+	db.Set("c", "3")
+	buf.Reset()
+	if err := db.DumpCSV(&buf, CSVOpt{LastCommit: true}); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := db.Head()
+	if expected := "a,1," + first + "\nb,2," + second + "\nc,3,\n"; buf.String() != expected {
+		t.Fatalf("%q != %q", buf.String(), expected)
+	}
+}
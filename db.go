@@ -2,14 +2,17 @@ package libpack
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	git "github.com/libgit2/git2go"
@@ -24,59 +27,512 @@ type DB struct {
 	tree   *git.Tree
 	parent *DB
 	l      sync.RWMutex
+	// Serializes commits, see commitLocked
+	commitL sync.Mutex
+
+	// Blobs set since the tree was last updated, see stage.
+	pending     map[string]blobEntry
+	pendingDirs map[string]bool
+
+	onRemoteUpdate []func(oldHead, newHead string)
+	onSyncError    []func(error)
+	watcher        *watcher
+	commitHooks    []func([]Change) error
+	postHooks      []func(string, []Change)
+	// Goroutines started by SyncFrom, stopped by Free
+	syncers map[*syncer]bool
+
+	authorName  string
+	authorEmail string
+	now         func() time.Time
+	signer      Signer
+	readOnly    bool
+	locking     bool
+	lockTimeout time.Duration
+	cache       *cache
+	// Values larger than this are compressed, see WithCompression
+	compressThreshold int
+	encrypt           func([]byte) ([]byte, error)
+	decrypt           func([]byte) ([]byte, error)
+	// If set, Set records the modification time of keys, see WithModTime
+	modTime bool
+	// See ShowInternal and AllowInternalWrites
+	showInternal   bool
+	internalWrites bool
+	// See WithLimits
+	limits Limits
+	// See WithKeyEscaping and CaseInsensitive
+	escapeKeys      bool
+	caseInsensitive bool
+	// See SetAutoCommit
+	autoCommit *autoCommitter
+	// See AddValidator
+	validators []validator
+	violations []Violation
+	// Number of commits downloaded by Pull and Fetch, see WithDepth
+	depth int
+	// See AllowBrokenRef
+	allowBrokenRef bool
+	// See SetMetrics
+	metrics MetricsSink
+	// See MergeOnPull
+	mergeOnPull bool
+	// See SetRetention
+	retention RetentionPolicy
+	// See AutoRefresh
+	refresh *refresher
+	// Set while a batch is running, see Batch. Accessed atomically.
+	batching int32
+	// Holds a loggerBox, see SetLogger
+	logger atomic.Value
+	// If set, the repository is removed by Free
+	ephemeral string
+	closed    bool
 }
 
+// ErrReadOnly is returned when trying to commit to a read-only database.
+var ErrReadOnly = errors.New("read-only database")
+
+// Scope returns a view of the database restricted to the subtree at
+// path `scope`. Scoped databases share the uncommitted tree of the
+// database they are derived from: changes made through one are
+// immediately visible in the other.
 func (db *DB) Scope(scope ...string) *DB {
-	// FIXME: do we risk duplicate db.repo.Free()?
 	newScope := []string{db.scope}
-	newScope = append(newScope, scope...)
+	for _, s := range scope {
+		newScope = append(newScope, db.escapeKey(s))
+	}
 	return &DB{
 		repo:   db.repo,
-		commit: db.commit,
 		ref:    db.ref,
-		scope:  path.Join(newScope...), // If parent!=nil, scope is relative to parent
-		tree:   db.tree,
+		scope:  path.Join(newScope...), // Always relative to the root database
 		parent: db,
 	}
 }
 
+// ScopeChecked is like Scope, but returns an error if name is not a valid
+// path: if one of its components is "..", or if it contains a NUL byte.
+// If mustExist is set, ScopeChecked also checks that there is a subtree
+// at name in the uncommitted tree, and returns ErrNotExist otherwise.
+func (db *DB) ScopeChecked(name string, mustExist bool) (sub *DB, err error) {
+	defer db.wrapError("scope", name, &err)
+	if strings.Contains(name, "\x00") {
+		return nil, fmt.Errorf("invalid scope %q: contains a NUL byte", name)
+	}
+	for _, c := range strings.Split(name, "/") {
+		if c == ".." {
+			return nil, fmt.Errorf("invalid scope %q: contains '..'", name)
+		}
+	}
+	scoped := db.Scope(name)
+	if !mustExist {
+		return scoped, nil
+	}
+	if err := db.checkClosed(); err != nil {
+		return nil, err
+	}
+	key := TreePath(scoped.scope)
+	if key == "/" {
+		return scoped, nil
+	}
+	tree, err := db.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	info, err := TreeStat(db.repo, tree, key)
+	if err != nil {
+		return nil, err
+	}
+	if info.Kind != KindTree {
+		return nil, fmt.Errorf("%s is not a subtree", name)
+	}
+	return scoped, nil
+}
+
+// root returns the database from which db was derived with Scope,
+// or db itself if it is not scoped.
+func (db *DB) root() *DB {
+	for db.parent != nil {
+		db = db.parent
+	}
+	return db
+}
+
+// Path returns the absolute path of the scope of db, or "/" if db is
+// not scoped.
+func (db *DB) Path() string {
+	p := TreePath(db.scope)
+	if p == "/" {
+		return p
+	}
+	return "/" + db.unescapeKey(p)
+}
+
+// Root returns the database from which db was derived with Scope, or db
+// itself if it is not scoped.
+func (db *DB) Root() *DB {
+	return db.root()
+}
+
+// Parent returns a database scoped to the parent directory of the scope
+// of db. The parent of an unscoped database is itself.
+func (db *DB) Parent() *DB {
+	p := TreePath(db.scope)
+	if p == "/" {
+		return db.root()
+	}
+	dir := path.Dir(p)
+	if dir == "." {
+		return db.root()
+	}
+	return db.root().Scope(dir)
+}
+
+// snapshot returns the current uncommitted tree of the database,
+// including pending changes.
+// Since git trees are immutable, the caller can safely use it without
+// holding the lock.
+func (db *DB) snapshot() (*git.Tree, error) {
+	root := db.root()
+	root.l.RLock()
+	if len(root.pending) == 0 {
+		defer root.l.RUnlock()
+		return root.tree, nil
+	}
+	root.l.RUnlock()
+	root.l.Lock()
+	defer root.l.Unlock()
+	if err := root.flushLocked(); err != nil {
+		return nil, err
+	}
+	return root.tree, nil
+}
+
+// change runs a pipeline built by f on top of the uncommitted tree of the
+// database, and replaces the uncommitted tree with the result.
+// The database is locked for the entire operation, so concurrent changes
+// are never lost.
+func (db *DB) change(f func(p *Pipeline) *Pipeline) (err error) {
+	root := db.root()
+	defer root.afterWrite(&err)
+	root.l.Lock()
+	defer root.l.Unlock()
+	if err := root.flushLocked(); err != nil {
+		return err
+	}
+	newTree, err := f(NewPipeline(root.repo).Base(root.tree)).Run()
+	if err != nil {
+		return err
+	}
+	root.tree = newTree
+	return nil
+}
+
 // Init initializes a new git-backed database from the following
 // elements:
-// * A bare git repository at `repo`
+// * A git repository at `repo`. If there is none, a bare repository is
+//   created. If repo is an existing checkout, its git directory is used.
 // * A git reference name `ref` (for example "refs/heads/foo")
-// * An optional scope to expose only a subset of the git tree (for example "/myapp/v1")
-func Init(repo, ref string) (*DB, error) {
-	r, err := git.InitRepository(repo, true)
+// * Optional settings, see Option.
+func Init(repo, ref string, opts ...Option) (*DB, error) {
+	return InitOpt(repo, InitOptions{Ref: ref, Options: opts})
+}
+
+// CreatedKey is the key of the marker recording the creation time of
+// a database, see InitOptions.
+const CreatedKey = InternalTree + "/created"
+
+// InitOptions are the settings of InitOpt.
+type InitOptions struct {
+	// Git reference of the database, for example "refs/heads/foo"
+	Ref string
+	// Author and committer of the commits made by the database.
+	// If empty, DefaultAuthorName and DefaultAuthorEmail are used.
+	AuthorName  string
+	AuthorEmail string
+	// If set, the creation time of the database is recorded at
+	// CreatedKey in the first commit.
+	CreatedMarker bool
+	// Values committed in the first commit
+	Seed map[string]string
+	// Message of the first commit. The default is "init".
+	Message string
+	// If set, InitOpt fails if the directory exists, is not empty and
+	// is not a git repository, instead of initializing a repository
+	// in it.
+	RefuseNonEmpty bool
+	// Other settings of the database
+	Options []Option
+}
+
+// InitOpt is like Init, with more settings.
+// If CreatedMarker or Seed are set and the reference has no commits yet,
+// they are committed atomically in a first commit. If the reference
+// already exists, they are ignored.
+func InitOpt(repo string, opt InitOptions) (*DB, error) {
+	if opt.RefuseNonEmpty {
+		if err := checkInitDir(repo); err != nil {
+			return nil, err
+		}
+	}
+	r, err := git.OpenRepository(repo)
 	if err != nil {
-		return nil, err
+		r, err = git.InitRepository(repo, true)
+		if err != nil {
+			return nil, err
+		}
 	}
-	db, err := newRepo(r, ref)
+	opts := opt.Options
+	if opt.AuthorName != "" || opt.AuthorEmail != "" {
+		name, email := opt.AuthorName, opt.AuthorEmail
+		if name == "" {
+			name = DefaultAuthorName
+		}
+		if email == "" {
+			email = DefaultAuthorEmail
+		}
+		opts = append([]Option{WithAuthor(name, email)}, opts...)
+	}
+	db, err := newRepo(r, opt.Ref, opts)
 	if err != nil {
 		return nil, err
 	}
+	if err := enableRefLog(r, db.ref); err != nil {
+		db.Free()
+		return nil, err
+	}
+	if (!opt.CreatedMarker && len(opt.Seed) == 0) || db.headId() != nil {
+		return db, nil
+	}
+	if err := db.seed(opt); err != nil {
+		db.Free()
+		return nil, err
+	}
 	return db, nil
 }
 
-func Open(repo, ref string) (*DB, error) {
+// checkInitDir returns an error if dir exists, is not empty, and is not
+// a git repository.
+func checkInitDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) || len(entries) == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r, err := git.OpenRepository(dir)
+	if err != nil {
+		return fmt.Errorf("%s: directory is not empty and is not a git repository", dir)
+	}
+	r.Free()
+	return nil
+}
+
+// seed makes the first commit of a database created by InitOpt.
+func (db *DB) seed(opt InitOptions) error {
+	for k := range opt.Seed {
+		if err := db.checkReserved(k); err != nil {
+			return err
+		}
+	}
+	if err := db.setMany(opt.Seed, ""); err != nil {
+		return err
+	}
+	if opt.CreatedMarker {
+		created := db.signature().When.UTC().Format(time.RFC3339Nano)
+		if err := db.setMany(map[string]string{CreatedKey: created}, ""); err != nil {
+			return err
+		}
+	}
+	msg := opt.Message
+	if msg == "" {
+		msg = "init"
+	}
+	return db.Commit(msg)
+}
+
+// Open opens an existing git-backed database. See Init for a description
+// of the arguments.
+// Each handle has its own uncommitted tree, starting from the commit
+// currently pointed to by ref: handles opened on the same repository only
+// share the git object database. If the reference was moved by another
+// handle since the last Update, Commit merges both histories.
+// The reference doesn't need to exist: it is created by the first commit.
+// See OpenOpt to refuse missing references.
+func Open(repo, ref string, opts ...Option) (*DB, error) {
 	r, err := git.OpenRepository(repo)
 	if err != nil {
 		return nil, err
 	}
-	db, err := newRepo(r, ref)
+	db, err := newRepo(r, ref, opts)
 	if err != nil {
 		return nil, err
 	}
 	return db, nil
 }
 
-func newRepo(repo *git.Repository, ref string) (*DB, error) {
+// OpenOptions are the settings of OpenOpt.
+type OpenOptions struct {
+	// Git reference of the database, for example "refs/heads/foo"
+	Ref string
+	// If set, OpenOpt fails with a *RefNotFoundError if the reference
+	// doesn't exist, unless Create is set.
+	MustExist bool
+	// If set and the reference doesn't exist, it is created, pointing
+	// to an empty commit.
+	Create bool
+	// Other settings of the database
+	Options []Option
+}
+
+// A RefNotFoundError is returned by OpenOpt when the reference of the
+// database doesn't exist.
+type RefNotFoundError struct {
+	Ref string
+	// Existing references with a similar name, closest first
+	Nearby []string
+}
+
+func (e *RefNotFoundError) Error() string {
+	if len(e.Nearby) == 0 {
+		return fmt.Sprintf("reference not found: %s", e.Ref)
+	}
+	return fmt.Sprintf("reference not found: %s (did you mean %s?)", e.Ref, strings.Join(e.Nearby, ", "))
+}
+
+// OpenOpt is like Open, with more settings. Unlike Open, it can refuse
+// to open a database whose reference doesn't exist.
+func OpenOpt(repo string, opt OpenOptions) (*DB, error) {
+	r, err := git.OpenRepository(repo)
+	if err != nil {
+		return nil, err
+	}
+	if ref, err := r.LookupReference(opt.Ref); err == nil {
+		ref.Free()
+	} else if opt.Create {
+		if err := createEmptyRef(r, opt.Ref); err != nil {
+			r.Free()
+			return nil, err
+		}
+	} else if opt.MustExist {
+		nearby, err := nearbyRefs(r, opt.Ref)
+		r.Free()
+		if err != nil {
+			return nil, err
+		}
+		return nil, &RefNotFoundError{Ref: opt.Ref, Nearby: nearby}
+	}
+	return newRepo(r, opt.Ref, opt.Options)
+}
+
+// createEmptyRef creates the reference ref, pointing to a new commit of
+// an empty tree.
+func createEmptyRef(r *git.Repository, ref string) error {
+	builder, err := r.TreeBuilder()
+	if err != nil {
+		return err
+	}
+	defer builder.Free()
+	id, err := builder.Write()
+	if err != nil {
+		return err
+	}
+	tree, err := lookupTree(r, id)
+	if err != nil {
+		return err
+	}
+	defer tree.Free()
+	commit, err := mkCommit(r, ref, "init", defaultSignature(), nil, tree, nil)
+	if err != nil {
+		return err
+	}
+	commit.Free()
+	return nil
+}
+
+// nearbyRefs returns the references of r whose name is close to ref.
+func nearbyRefs(r *git.Repository, ref string) ([]string, error) {
+	iter, err := r.NewReferenceNameIterator()
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Free()
+	// References by distance to ref
+	var byDistance [4][]string
+	for {
+		name, err := iter.Next()
+		if isGitIterOver(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if d := editDistance(name, ref); d < len(byDistance) {
+			byDistance[d] = append(byDistance[d], name)
+		}
+	}
+	var nearby []string
+	for _, names := range byDistance {
+		sort.Strings(names)
+		nearby = append(nearby, names...)
+	}
+	return nearby, nil
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// newRepo returns a database bound to ref in repo, which it owns from
+// now on: on error, repo is freed.
+func newRepo(repo *git.Repository, ref string, opts []Option) (*DB, error) {
 	db := &DB{
-		repo: repo,
-		ref:  ref,
+		repo:        repo,
+		ref:         ref,
+		authorName:  DefaultAuthorName,
+		authorEmail: DefaultAuthorEmail,
+		now:         time.Now,
+		cache:       newCache(DefaultCacheEntries, DefaultCacheBytes),
 	}
+	for _, opt := range opts {
+		opt(db)
+	}
+	if db.cache != nil {
+		db.cache.logf = db.logf
+	}
+	registerDB(db)
 	if err := db.Update(); err != nil {
-		db.Free()
-		return nil, err
+		if _, broken := err.(*BrokenRefError); !broken || !db.allowBrokenRef {
+			db.Free()
+			return nil, err
+		}
 	}
 	return db, nil
 }
@@ -85,17 +541,152 @@ func newRepo(repo *git.Repository, ref string) (*DB, error) {
 // in use.
 // This is required in addition to Golang garbage collection, because
 // of the libgit2 C bindings.
+// After Free, all methods of the database return ErrClosed. Calling Free
+// on a scoped database does nothing: resources are owned by the database
+// it was derived from.
 func (db *DB) Free() {
+	if db.parent != nil {
+		return
+	}
+	if db.checkClosed() == nil {
+		db.stopAutoCommit()
+	}
+	// The goroutines of StartWatching and SyncFrom use the repository
+	db.StopWatching()
+	db.stopSyncers()
 	db.l.Lock()
-	db.repo.Free()
+	defer db.l.Unlock()
+	if db.closed {
+		return
+	}
+	db.closed = true
+	unregisterDB(db)
 	if db.commit != nil {
 		db.commit.Free()
+		db.commit = nil
+	}
+	if db.tree != nil {
+		db.tree.Free()
+		db.tree = nil
+	}
+	db.discardPending()
+	db.repo.Free()
+	if db.ephemeral != "" {
+		os.RemoveAll(db.ephemeral)
+	}
+}
+
+// Close releases the resources of the database, like Free. If automatic
+// commits are enabled, the last batch of changes is committed first, and
+// the error of that commit is returned.
+func (db *DB) Close() error {
+	if db.parent != nil {
+		return nil
+	}
+	var err error
+	if db.checkClosed() == nil {
+		err = db.stopAutoCommit()
+	}
+	db.Free()
+	return err
+}
+
+// ErrClosed is returned when using a database after Free or Close
+// was called.
+var ErrClosed = errors.New("database is closed")
+
+func (db *DB) checkClosed() error {
+	for db.parent != nil {
+		db = db.parent
+	}
+	db.l.RLock()
+	defer db.l.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// ErrNotExist is returned when looking up a key which doesn't exist.
+var ErrNotExist = os.ErrNotExist
+
+// ErrIsDirectory is returned, in a *KeyError, when reading a value at a
+// key which is a subtree.
+var ErrIsDirectory = errors.New("is a directory")
+
+// ErrNotDirectory is returned, in a *KeyError, when listing a key which
+// is a value, or looking up a key below a value.
+var ErrNotDirectory = errors.New("not a directory")
+
+// A KeyError records an error, such as ErrIsDirectory or ErrNotDirectory,
+// and the key which caused it.
+type KeyError struct {
+	// Key relative to the root of the database
+	Key string
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Key, e.Err)
+}
+
+// Unwrap returns the underlying error, so that errors.Is(err,
+// ErrIsDirectory) holds for a *KeyError with ErrIsDirectory.
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// keyError returns a *KeyError for key, a path in the tree of the root
+// database.
+func (db *DB) keyError(key string, err error) error {
+	return &KeyError{Key: db.unescapeKey(TreePath(key)), Err: err}
+}
+
+// lookupError returns the error to report when looking up key, a path
+// in tree t, failed with err: a *KeyError with ErrNotDirectory if key or
+// one of its parents is a value, or err itself.
+func (db *DB) lookupError(t *git.Tree, key string, err error) error {
+	if e, ok := err.(*KeyError); ok {
+		return db.keyError(key, e.Err)
+	}
+	if !git.IsErrorCode(err, git.ErrNotFound) {
+		return err
+	}
+	key = TreePath(key)
+	for dir := path.Dir(key); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if e, err := t.EntryByPath(dir); err == nil {
+			if e.Type != git.ObjectTree {
+				return db.keyError(key, ErrNotDirectory)
+			}
+			break
+		}
+	}
+	return err
+}
+
+// ErrNoCommits is returned by Head when nothing was ever committed
+// to the database.
+var ErrNoCommits = errors.New("no commits")
+
+// Head returns the id of the latest commit.
+// If nothing was ever committed, ErrNoCommits is returned.
+func (db *DB) Head() (string, error) {
+	if err := db.checkClosed(); err != nil {
+		return "", err
+	}
+	head := db.headId()
+	if head == nil {
+		return "", ErrNoCommits
 	}
-	db.l.Unlock()
+	return head.String(), nil
 }
 
-// Head returns the id of the latest commit
-func (db *DB) Head() *git.Oid {
+// headId returns the id of the latest commit, or nil if nothing
+// was ever committed.
+func (db *DB) headId() *git.Oid {
+	if db.parent != nil {
+		return db.parent.headId()
+	}
 	db.l.RLock()
 	defer db.l.RUnlock()
 	if db.commit != nil {
@@ -104,9 +695,35 @@ func (db *DB) Head() *git.Oid {
 	return nil
 }
 
+// TreeHash returns the id of the uncommitted tree of the database,
+// including all uncommitted changes.
+func (db *DB) TreeHash() (hash string, err error) {
+	if err := db.checkClosed(); err != nil {
+		return "", err
+	}
+	defer db.wrapError("tree-hash", "", &err)
+	root, err := db.snapshot()
+	if err != nil {
+		return "", err
+	}
+	if root == nil {
+		empty, err := emptyTree(db.repo)
+		if err != nil {
+			return "", err
+		}
+		return empty.String(), nil
+	}
+	tree, err := TreeScope(db.repo, root, db.scope)
+	if err != nil {
+		return "", err
+	}
+	defer tree.Free()
+	return tree.Id().String(), nil
+}
+
 func (db *DB) Latest() *git.Oid {
-	if db.tree != nil {
-		return db.tree.Id()
+	if tree, err := db.snapshot(); err == nil && tree != nil {
+		return tree.Id()
 	}
 	return nil
 }
@@ -115,12 +732,55 @@ func (db *DB) Repo() *git.Repository {
 	return db.repo
 }
 
-func (db *DB) Tree() (*git.Tree, error) {
-	return TreeScope(db.repo, db.tree, db.scope)
+func (db *DB) Tree() (t *git.Tree, err error) {
+	if err := db.checkClosed(); err != nil {
+		return nil, err
+	}
+	defer db.wrapError("tree", "", &err)
+	tree, err := db.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return TreeScope(db.repo, tree, db.scope)
+}
+
+func (db *DB) Dump(dst io.Writer) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("dump", "", &err)
+	db.autoRefresh()
+	tree, err := db.snapshot()
+	if err != nil {
+		return err
+	}
+	decode := db.root().decodeValue
+	return db.walk(tree, "/", func(key string, e *git.TreeEntry, obj git.Object) error {
+		return dumpEntry(dst, key, e, obj, decode)
+	})
+}
+
+// walk walks tree at key, relative to the scope of db. Internal entries
+// are hidden when walking the root of the tree, see ShowInternal.
+func (db *DB) walk(tree *git.Tree, key string, h func(string, *git.TreeEntry, git.Object) error) error {
+	key = db.fullKey(key)
+	return treeWalk(db.repo, tree, key, db.walkHandler(key, h))
 }
 
-func (db *DB) Dump(dst io.Writer) error {
-	return TreeDump(db.repo, db.tree, path.Join(db.scope, "/"), dst)
+// walkHandler wraps h, the handler of a walk of the subtree at the full
+// key `key`, to hide internal and keep entries, and unescape keys.
+func (db *DB) walkHandler(key string, h func(string, *git.TreeEntry, git.Object) error) func(string, *git.TreeEntry, git.Object) error {
+	if db.hidesInternal(key) {
+		h = hideInternal(h)
+	}
+	h = db.hideKeepEntries(h)
+	if db.root().escapeKeys {
+		walkFn := h
+		h = func(k string, e *git.TreeEntry, obj git.Object) error {
+			return walkFn(db.unescapeKey(k), e, obj)
+		}
+	}
+	return h
 }
 
 // AddDB copies the contents of src into db at prefix key.
@@ -129,38 +789,128 @@ func (db *DB) Dump(dst io.Writer) error {
 // In case of a conflict, the content of the new tree wins.
 // Conflicts are resolved at the file granularity (content is
 // never merged).
-func (db *DB) AddDB(key string, src *DB) error {
+func (db *DB) AddDB(key string, src *DB) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("add", key, &err)
 	// No tree to add, nothing to do
-	src.l.RLock()
-	defer src.l.RUnlock()
-	if src.tree == nil {
+	if t, err := src.snapshot(); err != nil {
+		return err
+	} else if t == nil {
 		return nil
 	}
-	return db.Add(key, src.tree.Id())
+	tree, err := src.Tree()
+	if err != nil {
+		return err
+	}
+	defer tree.Free()
+	if err := db.checkTree(src.repo, db.fullKey(key), tree, src.root().decodeValue); err != nil {
+		return err
+	}
+	return db.Add(key, tree.Id())
 }
 
-func (db *DB) Add(key string, obj interface{}) error {
-	db.l.Lock()
-	defer db.l.Unlock()
-	if db.parent != nil {
-		return db.parent.Add(path.Join(db.scope, key), obj)
-	}
-	newTree, err := NewPipeline(db.repo).Base(db.tree).Add(key, obj, true).Run()
-	if err != nil {
+func (db *DB) Add(key string, obj interface{}) (err error) {
+	if err := db.checkClosed(); err != nil {
 		return err
 	}
-	db.tree = newTree
-	return nil
+	defer db.wrapError("add", key, &err)
+	return db.change(func(p *Pipeline) *Pipeline {
+		return p.Add(db.fullKey(key), obj, true)
+	})
 }
 
-func (db *DB) Walk(key string, h func(string, git.Object) error) error {
-	return TreeWalk(db.repo, db.tree, path.Join(db.scope, key), h)
+// Walk calls h for each object of the subtree at key, with its path
+// relative to key. If h returns an error, the walk ends and the error is
+// returned, except for ErrStopWalk. See WalkKeys and WalkDirs to walk
+// values or subtrees in a guaranteed order.
+func (db *DB) Walk(key string, h func(string, git.Object) error) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("walk", key, &err)
+	if err := db.checkKey(key, false); err != nil {
+		return err
+	}
+	db.autoRefresh()
+	tree, err := db.snapshot()
+	if err != nil {
+		return err
+	}
+	err = db.walk(tree, key, func(key string, e *git.TreeEntry, obj git.Object) error {
+		return h(key, obj)
+	})
+	if err == ErrStopWalk {
+		return nil
+	}
+	return err
 }
 
 // Update looks up the value of the database's reference, and changes
 // the memory representation accordingly.
 // If the committed tree is changed, then uncommitted changes are lost.
+// See UpdateWith to keep them.
 func (db *DB) Update() error {
+	return db.UpdateWith(UpdateOpt{})
+}
+
+// A DirtyPolicy tells UpdateWith what to do with uncommitted changes
+// when the reference of the database has moved.
+type DirtyPolicy int
+
+const (
+	// Uncommitted changes are discarded, as with Update.
+	DirtyDiscard DirtyPolicy = iota
+	// Uncommitted changes are applied on top of the new head.
+	DirtyMerge
+	// ErrDirty is returned, and nothing is changed.
+	DirtyFail
+)
+
+// UpdateOpt are the settings of UpdateWith.
+type UpdateOpt struct {
+	OnDirty DirtyPolicy
+}
+
+// ErrDirty is returned by UpdateWith when the reference of the database
+// has moved, and there are uncommitted changes.
+var ErrDirty = errors.New("uncommitted changes")
+
+// An UpdateConflictError is returned by UpdateWith when merging
+// uncommitted changes, if keys changed locally were also changed by the
+// new commits, to a different value.
+type UpdateConflictError struct {
+	Keys []string
+}
+
+func (e *UpdateConflictError) Error() string {
+	return fmt.Sprintf("update: %d conflicting keys: %s", len(e.Keys), strings.Join(e.Keys, ", "))
+}
+
+// UpdateWith is like Update, but opt.OnDirty chooses what happens to
+// uncommitted changes when the committed tree is changed.
+// With DirtyMerge, the keys changed locally are changed in the same way
+// in the new tree. If one of them has a different value in the new
+// tree, nothing is changed and an *UpdateConflictError listing all such
+// keys is returned.
+func (db *DB) UpdateWith(opt UpdateOpt) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("update", "", &err)
+	if db.parent != nil {
+		return db.parent.UpdateWith(opt)
+	}
+	// If the reference still points to the latest commit, don't do
+	// anything, without waiting for the lock or loading the commit
+	if tip, err := db.repo.LookupReference(db.ref); err == nil {
+		target := tip.Target()
+		tip.Free()
+		if head := db.headId(); head != nil && target != nil && head.Equal(target) {
+			return nil
+		}
+	}
 	db.l.Lock()
 	defer db.l.Unlock()
 	tip, err := db.repo.LookupReference(db.ref)
@@ -168,126 +918,1014 @@ func (db *DB) Update() error {
 		db.commit = nil
 		return nil
 	}
+	defer tip.Free()
+	commit, err := peelCommit(tip)
+	if err != nil {
+		if target := tip.Target(); target != nil && git.IsErrorCode(err, git.ErrNotFound) {
+			return &BrokenRefError{Ref: db.ref, Target: target.String()}
+		}
+		return err
+	}
 	// If we already have the latest commit, don't do anything
-	if db.commit != nil && db.commit.Id().Equal(tip.Target()) {
+	if db.commit != nil && db.commit.Id().Equal(commit.Id()) {
+		commit.Free()
 		return nil
 	}
-	commit, err := lookupCommit(db.repo, tip.Target())
+	commitTree, err := commit.Tree()
 	if err != nil {
+		commit.Free()
 		return err
 	}
+	var local []Change
+	if opt.OnDirty != DirtyDiscard {
+		if err := db.flushLocked(); err != nil {
+			commit.Free()
+			return err
+		}
+		if local, err = commitDiff(db.repo, db.commit, db.tree); err != nil {
+			commit.Free()
+			return err
+		}
+	}
+	var (
+		keys  []string
+		apply []blobEntry
+	)
+	if len(local) > 0 {
+		if opt.OnDirty == DirtyFail {
+			commit.Free()
+			return ErrDirty
+		}
+		if keys, apply, err = rebaseChanges(local, db.tree, commitTree); err != nil {
+			commit.Free()
+			return err
+		}
+	}
+	if opt.OnDirty == DirtyDiscard && db.dirtyLocked() {
+		db.logf(LogInfo, "%s: discarding uncommitted changes on top of %s", db.ref, commitName(db.commit))
+	} else if len(keys) > 0 {
+		db.logf(LogInfo, "%s: rebasing %d uncommitted changes onto %s", db.ref, len(keys), commit.Id())
+	}
+	db.logf(LogDebug, "%s: updated from %s to %s", db.ref, commitName(db.commit), commit.Id())
 	if db.commit != nil {
 		db.commit.Free()
 	}
 	db.commit = commit
-	if db.tree != nil {
-		db.tree.Free()
+	db.discardPending()
+	// The previous tree is not freed, since it may still be in use
+	// by concurrent readers.
+	db.tree = commitTree
+	for i, key := range keys {
+		if err := db.stage(key, apply[i].id, apply[i].mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirtyLocked returns true if there are uncommitted changes. The caller
+// must hold the lock.
+func (db *DB) dirtyLocked() bool {
+	if len(db.pending) > 0 {
+		return true
+	}
+	if db.tree == nil {
+		return false
+	}
+	return db.commit == nil || !db.commit.TreeId().Equal(db.tree.Id())
+}
+
+// rebaseChanges returns the keys and entries to stage on top of tree to
+// apply the changes made in the tree local, or an *UpdateConflictError.
+// The entries of deleted keys have a nil id.
+func rebaseChanges(changes []Change, local, tree *git.Tree) ([]string, []blobEntry, error) {
+	var (
+		keys      []string
+		apply     []blobEntry
+		conflicts []string
+	)
+	for _, c := range changes {
+		var current *git.Oid
+		if tree != nil {
+			if e, err := lookupEntry(tree, c.Key); err == nil {
+				current = e.id
+			}
+		}
+		switch {
+		case sameOid(current, c.NewId):
+			// Already applied
+		case !sameOid(current, c.OldId):
+			conflicts = append(conflicts, c.Key)
+		case c.Kind == Deleted:
+			keys = append(keys, c.Key)
+			apply = append(apply, blobEntry{})
+		default:
+			e, err := lookupEntry(local, c.Key)
+			if err != nil {
+				return nil, nil, err
+			}
+			keys = append(keys, c.Key)
+			apply = append(apply, *e)
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return nil, nil, &UpdateConflictError{Keys: conflicts}
+	}
+	return keys, apply, nil
+}
+
+// Mkdir adds an empty subtree at key if it doesn't exist. It is kept by
+// commits, merges and checkouts: see KeepEntry.
+func (db *DB) Mkdir(key string) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("mkdir", key, &err)
+	if err := db.checkKey(key, false); err != nil {
+		return err
+	}
+	if err := db.checkKeyLimits(db.fullKey(key)); err != nil {
+		return err
+	}
+	return db.change(func(p *Pipeline) *Pipeline {
+		return p.Mkdir(db.fullKey(key))
+	})
+}
+
+// Get returns the value of the Git blob at path `key`.
+// If there is no blob at the specified key, an error is returned: a
+// *KeyError with ErrIsDirectory if key is a subtree, or with
+// ErrNotDirectory if it is below a blob.
+func (db *DB) Get(key string) (value string, err error) {
+	if err := db.checkClosed(); err != nil {
+		return "", err
+	}
+	defer db.wrapError("get", key, &err)
+	if err := db.checkKey(key, false); err != nil {
+		return "", err
+	}
+	db.autoRefresh()
+	if m := db.metricsSink(); m != nil {
+		defer observeGet(m, time.Now(), &value, &err)
+	}
+	key = db.fullKey(key)
+	root := db.root()
+	tree, e, err := db.lookupPending(key)
+	if err != nil {
+		return "", err
+	}
+	if e != nil && e.id == nil {
+		// Deleted since the tree was last updated
+		return "", ErrNotExist
+	}
+	if e == nil {
+		if tree == nil {
+			return "", os.ErrNotExist
+		}
+		if TreePath(key) == "/" {
+			return "", db.keyError(key, ErrIsDirectory)
+		}
+		if root.cache != nil {
+			e, err = root.cache.entry(tree, key)
+		} else {
+			e, err = lookupEntry(tree, key)
+		}
+		if err != nil {
+			return "", db.lookupError(tree, key, err)
+		}
+	}
+	if e.mode == 040000 {
+		return "", db.keyError(key, ErrIsDirectory)
+	}
+	var data string
+	if root.cache != nil {
+		data, err = root.cache.blob(db.repo, e.id)
+	} else {
+		data, err = blobContents(db.repo, e.id)
+	}
+	if err != nil {
+		return "", err
+	}
+	return root.decodeValue(data, e.mode)
+}
+
+// GetMany returns the values of several keys, looked up in the same
+// version of the uncommitted tree. Subtrees shared by several keys are
+// only looked up once.
+// Keys which don't exist, or aren't blobs, are returned in missing rather
+// than causing an error.
+func (db *DB) GetMany(keys []string) (values map[string]string, missing []string, err error) {
+	if err := db.checkClosed(); err != nil {
+		return nil, nil, err
+	}
+	defer db.wrapError("get", "", &err)
+	tree, err := db.snapshot()
+	if err != nil {
+		return nil, nil, err
+	}
+	root := db.root()
+	values = make(map[string]string, len(keys))
+	if tree == nil {
+		return values, append(missing, keys...), nil
+	}
+	trees := map[string]*git.Tree{"/": tree}
+	defer func() {
+		for dir, t := range trees {
+			if t != nil && dir != "/" {
+				t.Free()
+			}
+		}
+	}()
+	var lookupDir func(dir string) *git.Tree
+	lookupDir = func(dir string) *git.Tree {
+		dir = TreePath(dir)
+		if t, ok := trees[dir]; ok {
+			return t
+		}
+		var t *git.Tree
+		if parent := lookupDir(path.Dir(dir)); parent != nil {
+			if e := parent.EntryByName(path.Base(dir)); e != nil && e.Type == git.ObjectTree {
+				t, _ = lookupTree(db.repo, e.Id)
+			}
+		}
+		trees[dir] = t
+		return t
+	}
+	for _, key := range keys {
+		full := TreePath(db.fullKey(key))
+		if full == "/" {
+			missing = append(missing, key)
+			continue
+		}
+		dir := lookupDir(path.Dir(full))
+		if dir == nil {
+			missing = append(missing, key)
+			continue
+		}
+		e := dir.EntryByName(path.Base(full))
+		if e == nil || e.Type != git.ObjectBlob {
+			missing = append(missing, key)
+			continue
+		}
+		var data string
+		if root.cache != nil {
+			data, err = root.cache.blob(db.repo, e.Id)
+		} else {
+			data, err = blobContents(db.repo, e.Id)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if values[key], err = root.decodeValue(data, e.Filemode); err != nil {
+			return nil, nil, err
+		}
+	}
+	return values, missing, nil
+}
+
+func lookupEntry(t *git.Tree, key string) (*blobEntry, error) {
+	e, err := t.EntryByPath(TreePath(key))
+	if err != nil {
+		return nil, err
+	}
+	return &blobEntry{e.Id, e.Filemode}, nil
+}
+
+// Stat returns information about the entry at path `key`: whether
+// it is a blob or a tree, its size, id and filemode.
+// If there is no entry at key, ErrNotExist is returned.
+func (db *DB) Stat(key string) (info EntryInfo, err error) {
+	if err := db.checkClosed(); err != nil {
+		return EntryInfo{}, err
+	}
+	defer db.wrapError("stat", key, &err)
+	db.autoRefresh()
+	tree, err := db.snapshot()
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	info, err = TreeStat(db.repo, tree, db.fullKey(key))
+	if err != nil || info.Kind != KindBlob {
+		return info, err
+	}
+	if info.ContentType, err = db.ContentType(key); err != nil {
+		return EntryInfo{}, err
+	}
+	return info, nil
+}
+
+// Set writes the specified value in a Git blob, and updates the
+// uncommitted tree to point to that blob as `key`.
+func (db *DB) Set(key, value string) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("set", key, &err)
+	if m := db.metricsSink(); m != nil {
+		m.ObserveValue("set", len(value))
+		defer observeOp(m, "set", time.Now(), &err)
+	}
+	return db.SetMany(map[string]string{key: value})
+}
+
+// SetMany writes each value of kv in a Git blob, and updates the
+// uncommitted tree to point to those blobs at their respective keys.
+// Keys are written in sorted order.
+func (db *DB) SetMany(kv map[string]string) error {
+	for k := range kv {
+		if err := db.checkReserved(k); err != nil {
+			return err
+		}
+	}
+	return db.setMany(kv, "")
+}
+
+// setMany is like SetMany, and records contentType as the content type
+// of each key.
+func (db *DB) setMany(kv map[string]string, contentType string) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("set", "", &err)
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	root := db.root()
+	blobs := make([]blobEntry, len(keys))
+	for _, k := range keys {
+		if err := db.checkValue(db.fullKey(k), kv[k]); err != nil {
+			return err
+		}
+	}
+	for i, k := range keys {
+		data, mode, err := root.encodeValue(kv[k])
+		if err != nil {
+			return err
+		}
+		id, err := createBlob(root.repo, data)
+		if err != nil {
+			return err
+		}
+		blobs[i] = blobEntry{id, mode}
+	}
+	defer root.afterWrite(&err)
+	root.l.Lock()
+	defer root.l.Unlock()
+	for i, k := range keys {
+		k = db.fullKey(k)
+		if err := root.stage(k, blobs[i].id, blobs[i].mode); err != nil {
+			return err
+		}
+		if root.modTime {
+			if err := root.stageModTime(k); err != nil {
+				return err
+			}
+		}
+		if err := root.stageContentType(k, contentType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetNX sets key to value in the uncommitted tree only if there is no
+// entry at key, and returns true if the value was written. The check and
+// the write are atomic with respect to other calls on the database.
+func (db *DB) SetNX(key, value string) (set bool, err error) {
+	if err := db.checkClosed(); err != nil {
+		return false, err
+	}
+	defer db.wrapError("set", key, &err)
+	if err := db.checkReserved(key); err != nil {
+		return false, err
+	}
+	if err := db.checkValue(db.fullKey(key), value); err != nil {
+		return false, err
+	}
+	root := db.root()
+	data, mode, err := root.encodeValue(value)
+	if err != nil {
+		return false, err
+	}
+	id, err := createBlob(root.repo, data)
+	if err != nil {
+		return false, err
+	}
+	key = db.fullKey(key)
+	defer root.afterWrite(&err)
+	root.l.Lock()
+	defer root.l.Unlock()
+	if exists, err := root.hasPathLocked(key); err != nil || exists {
+		return false, err
+	}
+	if err := root.stage(key, id, mode); err != nil {
+		return false, err
+	}
+	if root.modTime {
+		if err := root.stageModTime(key); err != nil {
+			return false, err
+		}
+	}
+	if err := root.stageContentType(key, ""); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetOrSet returns the value of key in the uncommitted tree. If there is
+// no entry at key, it is set to def first, as with SetNX.
+func (db *DB) GetOrSet(key, def string) (string, error) {
+	for {
+		set, err := db.SetNX(key, def)
+		if err != nil {
+			return "", err
+		}
+		if set {
+			return def, nil
+		}
+		value, err := db.Get(key)
+		// Retry if the key was deleted in the meantime
+		if !isNotExist(err) {
+			return value, err
+		}
+	}
+}
+
+// SetStream writes the data from `src` to a new Git blob,
+// and updates the uncommitted tree to point to that blob as `key`.
+func (db *DB) SetStream(key string, src io.Reader) error {
+	if err := db.checkKeyLimits(db.fullKey(key)); err != nil {
+		return err
+	}
+	// Stop reading as soon as the value is too large
+	if max := db.root().limits.MaxValueBytes; max > 0 {
+		src = io.LimitReader(src, max+1)
+	}
+	// FIXME: instead of buffering the entire value, use
+	// libgit2 CreateBlobFromChunks to stream the data straight
+	// into git.
+	buf := new(bytes.Buffer)
+	_, err := io.Copy(buf, src)
+	if err != nil {
+		return err
+	}
+	return db.Set(key, buf.String())
+}
+
+// SetWithMode is like Set, and also sets the filemode of the value:
+// the value is executable if any executable bit of mode is set. If mode
+// is a symbolic link, value is its target, as with SetLink.
+// Git only records the executable bit of regular files: other permission
+// bits are ignored.
+func (db *DB) SetWithMode(key, value string, mode os.FileMode) error {
+	if mode&os.ModeSymlink != 0 {
+		return db.SetLink(key, value)
+	}
+	if mode&os.ModeType != 0 {
+		return fmt.Errorf("unsupported file mode: %v", mode)
+	}
+	if err := db.checkReserved(key); err != nil {
+		return err
+	}
+	data, _, err := db.root().encodeValue(value)
+	if err != nil {
+		return err
+	}
+	gitMode := modeBlob
+	if mode&0111 != 0 {
+		gitMode = modeExecutable
+	}
+	return db.setBlob(key, data, gitMode)
+}
+
+// SetLink sets key to a symbolic link to target. Checkout creates a
+// symbolic link, and Get returns the target. Targets are never
+// compressed nor encrypted.
+func (db *DB) SetLink(key, target string) error {
+	if err := db.checkReserved(key); err != nil {
+		return err
+	}
+	return db.setBlob(key, target, modeLink)
+}
+
+// setBlob writes data to a new blob, and sets key to that blob with
+// the filemode mode.
+func (db *DB) setBlob(key, data string, mode int) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("set", key, &err)
+	if err := db.checkValue(db.fullKey(key), data); err != nil {
+		return err
+	}
+	id, err := createBlob(db.repo, data)
+	if err != nil {
+		return err
+	}
+	return db.setBlobID(key, id, mode)
+}
+
+// setBlobID sets key to the existing blob `id` with the filemode mode.
+func (db *DB) setBlobID(key string, id *git.Oid, mode int) (err error) {
+	root := db.root()
+	key = db.fullKey(key)
+	defer root.afterWrite(&err)
+	root.l.Lock()
+	defer root.l.Unlock()
+	if err := root.stage(key, id, mode); err != nil {
+		return err
+	}
+	if root.modTime {
+		if err := root.stageModTime(key); err != nil {
+			return err
+		}
+	}
+	return root.stageContentType(key, "")
+}
+
+// Append appends data to the value of key in the uncommitted tree. If
+// there is no value at key, it is created. Concurrent calls to Append are
+// serialized, so that no appended data is lost.
+// FIXME: the existing value is loaded in memory. Stream it into the new
+// blob when git2go exposes blob streaming.
+func (db *DB) Append(key, data string) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("append", key, &err)
+	if err := db.checkReserved(key); err != nil {
+		return err
+	}
+	key = db.fullKey(key)
+	root := db.root()
+	defer root.afterWrite(&err)
+	root.l.Lock()
+	defer root.l.Unlock()
+	e, err := root.entryLocked(key)
+	if err != nil && !isNotExist(err) {
+		return err
+	}
+	value := data
+	executable := false
+	if e != nil {
+		if e.mode == modeLink {
+			return fmt.Errorf("%s: can't append to a symbolic link", key)
+		}
+		old, err := blobContents(root.repo, e.id)
+		if err != nil {
+			return err
+		}
+		if old, err = root.decodeValue(old, e.mode); err != nil {
+			return err
+		}
+		value = old + data
+		executable = e.mode == modeExecutable
+	}
+	if err := root.checkValueLocked(key, value); err != nil {
+		return err
+	}
+	encoded, mode, err := root.encodeValue(value)
+	if err != nil {
+		return err
+	}
+	if executable {
+		mode = modeExecutable
+	}
+	id, err := createBlob(root.repo, encoded)
+	if err != nil {
+		return err
+	}
+	if err := root.stage(key, id, mode); err != nil {
+		return err
+	}
+	if root.modTime {
+		if err := root.stageModTime(key); err != nil {
+			return err
+		}
+	}
+	if e == nil {
+		return root.stageContentType(key, "")
+	}
+	return nil
+}
+
+// AppendBytes is like Append, for binary data.
+func (db *DB) AppendBytes(key string, data []byte) error {
+	return db.Append(key, string(data))
+}
+
+// Delete removes the value or subtree at key from the uncommitted tree,
+// along with the annotations of key. If there is nothing at key,
+// ErrNotExist is returned.
+func (db *DB) Delete(key string) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("delete", key, &err)
+	key = TreePath(db.fullKey(key))
+	if key == "/" {
+		return fmt.Errorf("can't delete the root of the tree")
+	}
+	root := db.root()
+	defer root.afterWrite(&err)
+	root.l.Lock()
+	defer root.l.Unlock()
+	if exists, err := root.hasPathLocked(key); err != nil {
+		return err
+	} else if !exists {
+		return ErrNotExist
+	}
+	if err := root.stage(key, nil, 0); err != nil {
+		return err
+	}
+	annot := path.Join(AnnotationTree, MkAnnotation(key))
+	if exists, err := root.hasPathLocked(annot); err != nil {
+		return err
+	} else if exists {
+		return root.stage(annot, nil, 0)
+	}
+	return nil
+}
+
+// DeletePrefix removes the subtree at prefix from the uncommitted tree,
+// along with the annotations of the keys it contains, and returns the
+// keys which were removed, sorted.
+// The subtree is dropped in a single operation, but listing its keys
+// requires reading every tree it contains: to remove a large subtree
+// without listing it, use Delete.
+// If there is nothing at prefix, no keys are returned.
+func (db *DB) DeletePrefix(prefix string) (keys []string, err error) {
+	if err := db.checkClosed(); err != nil {
+		return nil, err
+	}
+	defer db.wrapError("delete", prefix, &err)
+	key := TreePath(db.fullKey(prefix))
+	if key == "/" {
+		return nil, fmt.Errorf("can't delete the root of the tree")
+	}
+	root := db.root()
+	defer root.afterWrite(&err)
+	root.l.Lock()
+	defer root.l.Unlock()
+	if exists, err := root.hasPathLocked(key); err != nil || !exists {
+		return nil, err
+	}
+	if err := root.flushLocked(); err != nil {
+		return nil, err
+	}
+	var removed []string
+	e, err := root.tree.EntryByPath(key)
+	if err != nil {
+		return nil, err
+	}
+	if e.Type == git.ObjectTree {
+		subtree, err := lookupTree(root.repo, e.Id)
+		if err != nil {
+			return nil, err
+		}
+		defer subtree.Free()
+		err = subtree.Walk(func(parent string, e *git.TreeEntry) int {
+			if e.Type == git.ObjectBlob && e.Name != KeepEntry {
+				removed = append(removed, path.Join(key, parent, e.Name))
+			}
+			return 0
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		removed = append(removed, key)
+	}
+	if err := root.stage(key, nil, 0); err != nil {
+		return nil, err
+	}
+	scope := TreePath(db.scope)
+	for i, k := range removed {
+		annot := path.Join(AnnotationTree, MkAnnotation(k))
+		if root.hasEntryLocked(annot) {
+			if err := root.stage(annot, nil, 0); err != nil {
+				return nil, err
+			}
+		}
+		if scope != "/" {
+			k = strings.TrimPrefix(k, scope+"/")
+		}
+		removed[i] = db.unescapeKey(k)
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+func TreePath(p string) string {
+	p = path.Clean(strings.Replace(p, "\\", "/", -1))
+	if p == "/" || p == "." {
+		return "/"
+	}
+	// Remove leading / from the path
+	// as libgit2.TreeEntryByPath does not accept it
+	p = strings.TrimLeft(p, "/")
+	return p
+}
+
+// List returns a list of object names at the subtree `key`.
+// If there is no subtree at `key`, an error is returned: a *KeyError
+// with ErrNotDirectory if it is a blob, or is below one.
+func (db *DB) List(key string) (names []string, err error) {
+	if err := db.checkClosed(); err != nil {
+		return nil, err
+	}
+	defer db.wrapError("list", key, &err)
+	db.autoRefresh()
+	if m := db.metricsSink(); m != nil {
+		defer observeOp(m, "list", time.Now(), &err)
+	}
+	tree, err := db.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	names, err = TreeList(db.repo, tree, db.fullKey(key))
+	if err != nil {
+		return nil, db.lookupError(tree, db.fullKey(key), err)
+	}
+	hide := db.hidesInternal(db.fullKey(key))
+	visible := names[:0]
+	for _, name := range names {
+		if !db.hiddenEntry(name, hide) {
+			visible = append(visible, db.unescapeKey(name))
+		}
+	}
+	return visible, nil
+}
+
+// ListEntries returns information about each entry of the subtree at
+// `key`, sorted by name.
+// If there is no subtree at `key`, an error is returned: a *KeyError
+// with ErrNotDirectory if it is a blob, or is below one.
+func (db *DB) ListEntries(key string) (entries []EntryInfo, err error) {
+	if err := db.checkClosed(); err != nil {
+		return nil, err
+	}
+	defer db.wrapError("list", key, &err)
+	tree, err := db.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	entries, err = TreeListEntries(db.repo, tree, db.fullKey(key))
+	if err != nil {
+		return nil, db.lookupError(tree, db.fullKey(key), err)
+	}
+	hide := db.hidesInternal(db.fullKey(key))
+	visible := entries[:0]
+	for _, e := range entries {
+		if !db.hiddenEntry(e.Name, hide) {
+			e.Name = db.unescapeKey(e.Name)
+			visible = append(visible, e)
+		}
+	}
+	return visible, nil
+}
+
+// Commit atomically stores all database changes since the last commit
+// into a new Git commit object, and updates the database's reference
+// to point to that commit.
+// If there are no changes since the last commit, no commit is created.
+// Hooks registered with AddCommitHook are called before the reference
+// is updated, and can abort the commit by returning an error. Hooks
+// registered with AddPostCommitHook are called after the reference is
+// updated.
+// Reads and writes are not blocked while the new tree is written: the
+// changes made in the meantime are left uncommitted.
+func (db *DB) Commit(msg string) error {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	if db.parent != nil {
+		return db.parent.Commit(msg)
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	return db.commitAs(msg, db.signature(), CommitOpt{})
+}
+
+// CommitAs is like Commit, but uses the specified author name and email
+// for this commit instead of the ones configured with SetAuthor.
+func (db *DB) CommitAs(msg, name, email string) error {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	if db.parent != nil {
+		return db.parent.CommitAs(msg, name, email)
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	return db.commitAs(msg, &git.Signature{Name: name, Email: email, When: db.now()}, CommitOpt{})
+}
+
+// DefaultSummaryKeys is the number of keys listed in generated commit
+// messages, if CommitOpt.MaxKeys is not set.
+const DefaultSummaryKeys = 10
+
+// CommitOpt are the settings of CommitWith.
+type CommitOpt struct {
+	// If set and the message is empty, a message summarizing the
+	// changes is generated, for example
+	// "3 keys changed: +foo/bar, ~services/web/replicas, -old/key".
+	// Internal keys, such as annotations, are not listed.
+	Summarize bool
+	// Maximum number of keys listed in the summary
+	MaxKeys int
+	// Metadata attached to the commit as trailers, see CommitMeta. If
+	// set and the message is empty, a summary is generated as with
+	// Summarize.
+	Meta map[string]string
+}
+
+// CommitWith is like Commit, with more settings.
+func (db *DB) CommitWith(msg string, opt CommitOpt) error {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	if db.parent != nil {
+		return db.parent.CommitWith(msg, opt)
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	return db.commitAs(msg, db.signature(), opt)
+}
+
+func (db *DB) commitAs(msg string, sig *git.Signature, opt CommitOpt) (err error) {
+	defer db.wrapError("commit", "", &err)
+	start := time.Now()
+	m := db.metricsSink()
+	if m != nil {
+		defer observeOp(m, "commit", start, &err)
+	}
+	commit, err := db.commitLocked(msg, sig, opt)
+	if err != nil || commit == nil {
+		return err
+	}
+	defer commit.Free()
+	if m != nil {
+		db.observeCommit(m, commit, time.Since(start))
+	}
+	db.runPostCommitHooks(commit)
+	return nil
+}
+
+// commitLocked does the work of Commit, and returns the new commit, which
+// the caller must free, or nil if nothing was committed. The lock is only held to take a snapshot of
+// the uncommitted tree, and to update the reference and swap in the new
+// tree: the tree is written and the hooks are run on the snapshot, so
+// that reads are not blocked by large commits. Changes made in the
+// meantime are kept uncommitted. If the database was updated in the
+// meantime, the commit is done again with the lock held.
+func (db *DB) commitLocked(msg string, sig *git.Signature, opt CommitOpt) (*git.Commit, error) {
+	db.commitL.Lock()
+	defer db.commitL.Unlock()
+	trailers, err := formatTrailers(opt.Meta)
+	if err != nil {
+		return nil, err
+	}
+	db.l.RLock()
+	head, base, hooks := db.commit, db.tree, db.commitHooks
+	pending := make(map[string]blobEntry, len(db.pending))
+	for k, e := range db.pending {
+		pending[k] = e
+	}
+	// Our own copy of the head, which Update may free
+	var parent *git.Commit
+	if head != nil {
+		parent, err = lookupCommit(db.repo, head.Id())
+	}
+	db.l.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if parent != nil {
+		defer parent.Free()
+	}
+	tree := base
+	if len(pending) > 0 {
+		if tree, err = treeApply(db.repo, base, pending); err != nil {
+			return nil, err
+		}
+	}
+	if tree == nil || parent != nil && parent.TreeId().Equal(tree.Id()) {
+		// Nothing to commit
+		db.l.Lock()
+		defer db.l.Unlock()
+		return db.ownCommit(db.commitTreeLocked(msg, sig, opt))
+	}
+	if err := db.callCommitHooks(hooks, parent, tree); err != nil {
+		return nil, err
 	}
-	if commitTree, err := commit.Tree(); err != nil {
-		return err
-	} else {
-		db.tree = commitTree
+	fullMsg, err := db.commitMessage(msg, opt, trailers, parent, tree)
+	if err != nil {
+		return nil, err
 	}
-	return nil
-}
-
-// Mkdir adds an empty subtree at key if it doesn't exist.
-func (db *DB) Mkdir(key string) error {
 	db.l.Lock()
 	defer db.l.Unlock()
-	if db.parent != nil {
-		return db.parent.Mkdir(path.Join(db.scope, key))
+	if db.commit != head {
+		return db.ownCommit(db.commitTreeLocked(msg, sig, opt))
 	}
-	p := NewPipeline(db.repo)
-	newTree, err := p.Base(db.tree).Mkdir(path.Join(db.scope, key)).Run()
+	commit, err := db.updateRefLocked(tree, fullMsg, sig)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	db.tree = newTree
-	return nil
-}
-
-// Get returns the value of the Git blob at path `key`.
-// If there is no blob at the specified key, an error
-// is returned.
-func (db *DB) Get(key string) (string, error) {
-	if db.parent != nil {
-		return db.parent.Get(path.Join(db.scope, key))
+	if db.tree == base {
+		db.tree = tree
+		db.keepPendingSince(pending)
 	}
-	return TreeGet(db.repo, db.tree, path.Join(db.scope, key))
+	return db.ownCommit(commit, nil)
 }
 
-// Set writes the specified value in a Git blob, and updates the
-// uncommitted tree to point to that blob as `key`.
-func (db *DB) Set(key, value string) error {
-	if db.parent != nil {
-		return db.parent.Set(path.Join(db.scope, key), value)
-	}
-	p := NewPipeline(db.repo)
-	newTree, err := p.Base(db.tree).Set(path.Join(db.scope, key), value).Run()
+// commitTreeLocked commits the uncommitted tree, and returns the new
+// commit, or nil if there was nothing to commit. The caller must hold the
+// lock.
+func (db *DB) commitTreeLocked(msg string, sig *git.Signature, opt CommitOpt) (*git.Commit, error) {
+	trailers, err := formatTrailers(opt.Meta)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	db.tree = newTree
-	return nil
-}
-
-// SetStream writes the data from `src` to a new Git blob,
-// and updates the uncommitted tree to point to that blob as `key`.
-func (db *DB) SetStream(key string, src io.Reader) error {
-	// FIXME: instead of buffering the entire value, use
-	// libgit2 CreateBlobFromChunks to stream the data straight
-	// into git.
-	buf := new(bytes.Buffer)
-	_, err := io.Copy(buf, src)
-	if err != nil {
-		return err
+	if err := db.flushLocked(); err != nil {
+		return nil, err
 	}
-	return db.Set(key, buf.String())
-}
-
-func TreePath(p string) string {
-	p = path.Clean(p)
-	if p == "/" || p == "." {
-		return "/"
+	if db.tree == nil {
+		// Nothing to commit
+		return nil, nil
 	}
-	// Remove leading / from the path
-	// as libgit2.TreeEntryByPath does not accept it
-	p = strings.TrimLeft(p, "/")
-	return p
+	if db.commit != nil && db.commit.TreeId().Equal(db.tree.Id()) {
+		// No changes since the last commit
+		db.resetAutoCommit()
+		return nil, nil
+	}
+	if err := db.runCommitHooks(db.commit, db.tree); err != nil {
+		return nil, err
+	}
+	if msg, err = db.commitMessage(msg, opt, trailers, db.commit, db.tree); err != nil {
+		return nil, err
+	}
+	return db.updateRefLocked(db.tree, msg, sig)
 }
 
-// List returns a list of object names at the subtree `key`.
-// If there is no subtree at `key`, an error is returned.
-func (db *DB) List(key string) ([]string, error) {
-	return TreeList(db.repo, db.tree, path.Join(db.scope, key))
+// commitMessage returns the message of a commit of tree on top of parent:
+// msg, or a summary of the changes if opt asks for one, followed by
+// trailers.
+func (db *DB) commitMessage(msg string, opt CommitOpt, trailers string, parent *git.Commit, tree *git.Tree) (string, error) {
+	if msg == "" && (opt.Summarize || len(opt.Meta) > 0) {
+		changes, err := commitDiff(db.repo, parent, tree)
+		if err != nil {
+			return "", err
+		}
+		max := opt.MaxKeys
+		if max <= 0 {
+			max = DefaultSummaryKeys
+		}
+		msg = summarizeChanges(changes, max)
+	}
+	return appendTrailers(msg, trailers), nil
 }
 
-// Commit atomically stores all database changes since the last commit
-// into a new Git commit object, and updates the database's reference
-// to point to that commit.
-func (db *DB) Commit(msg string) error {
-	if db.parent != nil {
-		return db.parent.Commit(msg)
-	}
-	db.l.Lock()
-	defer db.l.Unlock()
-	if db.tree == nil {
-		// Nothing to commit
-		return nil
+// updateRefLocked commits tree on top of the head of the database, and
+// updates the reference and the head. The caller must hold the lock.
+func (db *DB) updateRefLocked(tree *git.Tree, msg string, sig *git.Signature) (*git.Commit, error) {
+	if db.locking {
+		unlock, err := lockRepo(db.repo.Path(), db.lockTimeout)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
 	}
-	commit, err := CommitToRef(db.repo, db.tree, db.commit, db.ref, msg)
+	commit, err := commitToRef(db.repo, tree, db.commit, db.ref, msg, sig, db.signer)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	if commit.ParentCount() > 1 {
+		db.logf(LogInfo, "%s: merged concurrent change %s into commit", db.ref, commit.ParentId(0))
+	}
+	db.logf(LogInfo, "%s: %s -> %s (commit)", db.ref, commitName(db.commit), commit.Id())
 	if db.commit != nil {
 		db.commit.Free()
 	}
 	db.commit = commit
-	return nil
+	db.resetAutoCommit()
+	return commit, nil
 }
 
+// CommitToRef creates a new commit of tree with the default signature,
+// and updates refname to point to it. If refname was changed since
+// parent, the new tree is merged with it.
 func CommitToRef(r *git.Repository, tree *git.Tree, parent *git.Commit, refname, msg string) (*git.Commit, error) {
+	return commitToRef(r, tree, parent, refname, msg, defaultSignature(), nil)
+}
+
+func commitToRef(r *git.Repository, tree *git.Tree, parent *git.Commit, refname, msg string, sig *git.Signature, sign Signer) (*git.Commit, error) {
 	// Retry loop in case of conflict
 	// FIXME: use a custom inter-process lock as a first attempt for performance
 	var (
@@ -297,7 +1935,7 @@ func CommitToRef(r *git.Repository, tree *git.Tree, parent *git.Commit, refname,
 	for {
 		if !needMerge {
 			// Create simple commit
-			commit, err := mkCommit(r, refname, msg, tree, parent)
+			commit, err := mkCommit(r, refname, msg, sig, sign, tree, parent)
 			if isGitConcurrencyErr(err) {
 				needMerge = true
 				continue
@@ -308,7 +1946,7 @@ func CommitToRef(r *git.Repository, tree *git.Tree, parent *git.Commit, refname,
 				var err error
 				// Create a temporary intermediary commit, to pass to MergeCommits
 				// NOTE: this commit will not be part of the final history.
-				tmpCommit, err = mkCommit(r, "", msg, tree, parent)
+				tmpCommit, err = mkCommit(r, "", msg, sig, sign, tree, parent)
 				if err != nil {
 					return nil, err
 				}
@@ -323,43 +1961,14 @@ func CommitToRef(r *git.Repository, tree *git.Tree, parent *git.Commit, refname,
 			}
 
 			// Merge simple commit with the tip
-			opts, err := git.DefaultMergeOptions()
-			if err != nil {
-				return nil, err
-			}
-			idx, err := r.MergeCommits(tmpCommit, tip, &opts)
-			if err != nil {
-				return nil, err
-			}
-			conflicts, err := idx.ConflictIterator()
-			if err != nil {
-				return nil, err
-			}
-			defer conflicts.Free()
-			for {
-				c, err := conflicts.Next()
-				if isGitIterOver(err) {
-					break
-				} else if err != nil {
-					return nil, err
-				}
-				if c.Our != nil {
-					idx.RemoveConflict(c.Our.Path)
-					if err := idx.Add(c.Our); err != nil {
-						return nil, fmt.Errorf("error resolving merge conflict for '%s': %v", c.Our.Path, err)
-					}
-				}
-			}
-			mergedId, err := idx.WriteTreeTo(r)
-			if err != nil {
-				return nil, fmt.Errorf("WriteTree: %v", err)
-			}
-			mergedTree, err := lookupTree(r, mergedId)
+			defer tip.Free()
+			mergedTree, err := mergeCommits(r, tmpCommit, tip)
 			if err != nil {
 				return nil, err
 			}
+			defer mergedTree.Free()
 			// Create new commit from merged tree (discarding simple commit)
-			commit, err := mkCommit(r, refname, msg, mergedTree, parent, tip)
+			commit, err := mkCommit(r, refname, msg, sig, sign, mergedTree, parent, tip)
 			if isGitConcurrencyErr(err) {
 				// FIXME: enforce a maximum number of retries to avoid infinite loops
 				continue
@@ -370,7 +1979,45 @@ func CommitToRef(r *git.Repository, tree *git.Tree, parent *git.Commit, refname,
 	return nil, fmt.Errorf("too many failed merge attempts, giving up")
 }
 
-func mkCommit(r *git.Repository, refname string, msg string, tree *git.Tree, parent *git.Commit, extraParents ...*git.Commit) (*git.Commit, error) {
+// mergeCommits merges commits ours and theirs, and returns the
+// resulting tree. Conflicts are resolved in favor of ours.
+func mergeCommits(r *git.Repository, ours, theirs *git.Commit) (*git.Tree, error) {
+	opts, err := git.DefaultMergeOptions()
+	if err != nil {
+		return nil, err
+	}
+	idx, err := r.MergeCommits(ours, theirs, &opts)
+	if err != nil {
+		return nil, err
+	}
+	defer idx.Free()
+	conflicts, err := idx.ConflictIterator()
+	if err != nil {
+		return nil, err
+	}
+	defer conflicts.Free()
+	for {
+		c, err := conflicts.Next()
+		if isGitIterOver(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if c.Our != nil {
+			idx.RemoveConflict(c.Our.Path)
+			if err := idx.Add(c.Our); err != nil {
+				return nil, fmt.Errorf("error resolving merge conflict for '%s': %w", c.Our.Path, err)
+			}
+		}
+	}
+	mergedId, err := idx.WriteTreeTo(r)
+	if err != nil {
+		return nil, fmt.Errorf("WriteTree: %w", err)
+	}
+	return lookupTree(r, mergedId)
+}
+
+func mkCommit(r *git.Repository, refname string, msg string, sig *git.Signature, sign Signer, tree *git.Tree, parent *git.Commit, extraParents ...*git.Commit) (*git.Commit, error) {
 	var parents []*git.Commit
 	if parent != nil {
 		parents = append(parents, parent)
@@ -378,10 +2025,13 @@ func mkCommit(r *git.Repository, refname string, msg string, tree *git.Tree, par
 	if len(extraParents) > 0 {
 		parents = append(parents, extraParents...)
 	}
+	if sign != nil {
+		return mkSignedCommitToRef(r, refname, msg, sig, sign, tree, parents)
+	}
 	id, err := r.CreateCommit(
 		refname,
-		&git.Signature{"libpack", "libpack", time.Now()}, // author
-		&git.Signature{"libpack", "libpack", time.Now()}, // committer
+		sig, // author
+		sig, // committer
 		msg,
 		tree, // git tree to commit
 		parents...,
@@ -392,7 +2042,35 @@ func mkCommit(r *git.Repository, refname string, msg string, tree *git.Tree, par
 	return lookupCommit(r, id)
 }
 
+// mkSignedCommitToRef creates a signed commit, and updates refname to
+// point to it if the reference still points to the last parent, see
+// updateRef.
+func mkSignedCommitToRef(r *git.Repository, refname string, msg string, sig *git.Signature, sign Signer, tree *git.Tree, parents []*git.Commit) (*git.Commit, error) {
+	id, err := mkSignedCommit(r, msg, sig, sign, tree, parents)
+	if err != nil {
+		return nil, err
+	}
+	if refname != "" {
+		var expected string
+		if len(parents) > 0 {
+			expected = parents[len(parents)-1].Id().String()
+		}
+		logMsg := "commit: " + strings.SplitN(msg, "\n", 2)[0]
+		if err := updateRef(r, refname, id, expected, logMsg); err != nil {
+			return nil, err
+		}
+	}
+	return lookupCommit(r, id)
+}
+
+// errConcurrentUpdate is returned when a reference was changed by
+// someone else while a commit was being created.
+var errConcurrentUpdate = errors.New("reference was updated concurrently")
+
 func isGitConcurrencyErr(err error) bool {
+	if err == errConcurrentUpdate {
+		return true
+	}
 	gitErr, ok := err.(*git.GitError)
 	if !ok {
 		return false
@@ -408,51 +2086,126 @@ func isGitIterOver(err error) bool {
 	return gitErr.Code == git.ErrIterOver
 }
 
-// Pull downloads objects at the specified url and remote ref name,
-// and updates the local ref of db.
-// The uncommitted tree is left unchanged (ie uncommitted changes are
-// not merged or rebased).
-func (db *DB) Pull(url, ref string) error {
+// Pull downloads the commits of the reference `ref` at url, and applies
+// them to the reference of db, like Fetch and ApplyFetched:
+//
+//   - if the reference of db doesn't exist, or is behind the remote
+//     reference, it is fast-forwarded;
+//   - if it already contains the remote commits (it is equal or ahead),
+//     nothing is changed;
+//   - if both have commits the other doesn't have, ErrNonFastForward is
+//     returned, and nothing is changed. With MergeOnPull, a merge commit
+//     is created instead.
+//
+// If the reference moves, uncommitted changes are discarded, like with
+// Update.
+// The values changed by the downloaded commits are checked by the
+// validators registered with an incoming policy, see AddValidatorPolicy.
+// If they are rejected, the local ref is left unchanged.
+func (db *DB) Pull(url, ref string) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("pull", "", &err)
+	if m := db.metricsSink(); m != nil {
+		defer observeOp(m, "pull", time.Now(), &err)
+	}
 	if ref == "" {
 		ref = db.ref
 	}
-	refspec := fmt.Sprintf("%s:%s", ref, db.ref)
-	fmt.Printf("Creating anonymous remote url=%s refspec=%s\n", url, refspec)
-	remote, err := db.repo.CreateAnonymousRemote(url, refspec)
-	if err != nil {
+	head, err := db.Fetch(url, ref)
+	if err != nil || head == "" {
 		return err
 	}
-	defer remote.Free()
-	if err := remote.Fetch(nil, nil, fmt.Sprintf("libpack.pull %s %s", url, refspec)); err != nil {
+	if local := lookupTip(db.repo, db.ref); local != nil {
+		headId, err := git.NewOid(head)
+		if err != nil {
+			local.Free()
+			return err
+		}
+		rel, err := compareCommits(db.repo, local.Id(), headId)
+		local.Free()
+		if err != nil {
+			return err
+		}
+		if rel == commitsDiverged && !db.root().mergeOnPull {
+			return ErrNonFastForward
+		}
+	}
+	if err := db.ApplyFetched(head); err != nil {
 		return err
 	}
-	return db.Update()
+	return db.markPublished()
 }
 
 // Push uploads the committed contents of the db at the specified url and
 // remote ref name. The remote ref is created if it doesn't exist.
+// If the remote ref has commits which the reference of db doesn't
+// contain (it is behind, or has diverged), ErrNonFastForward is returned
+// and nothing is pushed: see ForcePush to overwrite it.
+// Pushing from a shallow repository (see WithDepth) fails with
+// ErrShallowPush.
 func (db *DB) Push(url, ref string) error {
+	return db.push(url, ref, false)
+}
+
+// ForcePush is like Push, but replaces the remote ref even if it has
+// commits which the reference of db doesn't contain. They are lost.
+func (db *DB) ForcePush(url, ref string) error {
+	return db.push(url, ref, true)
+}
+
+func (db *DB) push(url, ref string, force bool) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("push", "", &err)
+	if m := db.metricsSink(); m != nil {
+		defer observeOp(m, "push", time.Now(), &err)
+	}
 	if ref == "" {
 		ref = db.ref
 	}
+	if isShallow(db.repo) {
+		return ErrShallowPush
+	}
+	if !force {
+		if err := db.checkPush(url, ref); err != nil {
+			return err
+		}
+	}
 	// The '+' prefix sets force=true,
 	// so the remote ref is created if it doesn't exist.
-	refspec := fmt.Sprintf("+%s:%s", db.ref, ref)
-	remote, err := db.repo.CreateAnonymousRemote(url, refspec)
+	if err := pushRefspecs(db.repo, url, fmt.Sprintf("+%s:%s", db.ref, ref)); err != nil {
+		return err
+	}
+	return db.markPublished()
+}
+
+func pushRefspecs(r *git.Repository, url string, refspecs ...string) error {
+	if len(refspecs) == 0 {
+		return nil
+	}
+	if isShallow(r) {
+		return ErrShallowPush
+	}
+	remote, err := r.CreateAnonymousRemote(url, refspecs[0])
 	if err != nil {
 		return err
 	}
 	defer remote.Free()
 	push, err := remote.NewPush()
 	if err != nil {
-		return fmt.Errorf("git_push_new: %v", err)
+		return fmt.Errorf("git_push_new: %w", err)
 	}
 	defer push.Free()
-	if err := push.AddRefspec(refspec); err != nil {
-		return fmt.Errorf("git_push_refspec_add: %v", err)
+	for _, refspec := range refspecs {
+		if err := push.AddRefspec(refspec); err != nil {
+			return fmt.Errorf("git_push_refspec_add: %w", err)
+		}
 	}
 	if err := push.Finish(); err != nil {
-		return fmt.Errorf("git_push_finish: %v", err)
+		return fmt.Errorf("git_push_finish: %w", err)
 	}
 	return nil
 }
@@ -464,13 +2217,97 @@ func (db *DB) Push(url, ref string) error {
 // is created and returned, and the caller is responsible for removing it.
 //
 func (db *DB) Checkout(dir string) (checkoutDir string, err error) {
+	if err := db.checkClosed(); err != nil {
+		return "", err
+	}
+	defer db.wrapError("checkout", "", &err)
 	if db.parent != nil {
 		return db.parent.Checkout(path.Join(db.scope, dir))
 	}
-	head := db.Head()
+	if m := db.metricsSink(); m != nil {
+		defer observeOp(m, "checkout", time.Now(), &err)
+	}
+	head := db.headId()
+	if head == nil {
+		return "", fmt.Errorf("no head to checkout")
+	}
+	if dir == "" {
+		dir, err = ioutil.TempDir("", "libpack-checkout-")
+		if err != nil {
+			return "", err
+		}
+		defer func() {
+			if err != nil {
+				os.RemoveAll(dir)
+			}
+		}()
+	}
+	if err := checkoutCommit(db.repo, head, dir); err != nil {
+		return "", err
+	}
+	commit, err := lookupCommit(db.repo, head)
+	if err != nil {
+		return "", err
+	}
+	defer commit.Free()
+	tree, err := commit.Tree()
+	if err != nil {
+		return "", err
+	}
+	defer tree.Free()
+	if err := db.decodeCheckout(tree, dir); err != nil {
+		return "", err
+	}
+	if err := db.removeKeepEntries(tree, dir); err != nil {
+		return "", err
+	}
+	if db.hidesInternal(db.scope) {
+		if err := os.RemoveAll(path.Join(dir, InternalTree)); err != nil {
+			return "", err
+		}
+	}
+	// FIXME: enforce scoping in the git checkout command instead
+	// of here.
+	d := path.Join(dir, db.scope)
+	db.logf(LogDebug, "checked out %s in %s", head, d)
+	return d, nil
+}
+
+// CheckoutScope populates the directory at dir with the committed
+// contents of the subtree at scope, relative to the scope of db.
+// Uncommitted changes are ignored. If there is no subtree at scope in
+// the latest commit, ErrNotExist is returned.
+//
+// As with Checkout, if dir is an empty string, a temporary directory
+// is created and returned, and the caller is responsible for removing it.
+func (db *DB) CheckoutScope(scope, dir string) (checkoutDir string, err error) {
+	if err := db.checkClosed(); err != nil {
+		return "", err
+	}
+	defer db.wrapError("checkout", scope, &err)
+	head := db.headId()
 	if head == nil {
 		return "", fmt.Errorf("no head to checkout")
 	}
+	commit, err := lookupCommit(db.repo, head)
+	if err != nil {
+		return "", err
+	}
+	defer commit.Free()
+	tree, err := commit.Tree()
+	if err != nil {
+		return "", err
+	}
+	defer tree.Free()
+	key := db.fullKey(scope)
+	subtree, err := TreeScope(db.repo, tree, key)
+	if err != nil {
+		if git.IsErrorCode(err, git.ErrNotFound) {
+			return "", ErrNotExist
+		}
+		return "", err
+	}
+	defer subtree.Free()
 	if dir == "" {
 		dir, err = ioutil.TempDir("", "libpack-checkout-")
 		if err != nil {
@@ -482,31 +2319,103 @@ func (db *DB) Checkout(dir string) (checkoutDir string, err error) {
 			}
 		}()
 	}
+	if err := checkoutTree(db.repo, subtree, dir); err != nil {
+		return "", err
+	}
+	if err := db.root().decodeCheckout(subtree, dir); err != nil {
+		return "", err
+	}
+	if err := db.removeKeepEntries(subtree, dir); err != nil {
+		return "", err
+	}
+	if db.hidesInternal(key) {
+		if err := os.RemoveAll(path.Join(dir, InternalTree)); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// checkoutTree populates the directory at dir with the contents of tree,
+// using a temporary index. The paths of the tree are checked first, see
+// checkTreePaths.
+func checkoutTree(r *git.Repository, tree *git.Tree, dir string) error {
+	if err := checkTreePaths(r, tree); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// If the tree is empty, there is nothing to do
+	if tree.EntryCount() == 0 {
+		return nil
+	}
+	idx, err := ioutil.TempFile("", "libpack-index")
+	if err != nil {
+		return err
+	}
+	idx.Close()
+	defer os.RemoveAll(idx.Name())
+	for _, args := range [][]string{
+		{"read-tree", tree.Id().String()},
+		{"checkout-index", "-a", "-f"},
+	} {
+		stderr := new(bytes.Buffer)
+		cmd := exec.Command("git", append([]string{"--git-dir", r.Path(), "--work-tree", dir}, args...)...)
+		cmd.Env = append(os.Environ(), "GIT_INDEX_FILE="+idx.Name())
+		cmd.Stderr = stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("git %s: %s", args[0], stderr.String())
+		}
+	}
+	return nil
+}
+
+// checkoutCommit populates the directory at dir with the contents of
+// commit id. The paths of the tree are checked first, see checkTreePaths.
+func checkoutCommit(r *git.Repository, id *git.Oid, dir string) error {
+	commit, err := lookupCommit(r, id)
+	if err != nil {
+		return err
+	}
+	defer commit.Free()
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	defer tree.Free()
+	if err := checkTreePaths(r, tree); err != nil {
+		return err
+	}
 	stderr := new(bytes.Buffer)
 	args := []string{
-		"--git-dir", db.repo.Path(), "--work-tree", dir,
-		"checkout", head.String(), ".",
+		"--git-dir", r.Path(), "--work-tree", dir,
+		"checkout", id.String(), ".",
 	}
 	cmd := exec.Command("git", args...)
 	cmd.Stderr = stderr
 	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("%s", stderr.String())
+		return fmt.Errorf("%s", stderr.String())
 	}
-	// FIXME: enforce scoping in the git checkout command instead
-	// of here.
-	d := path.Join(dir, db.scope)
-	fmt.Printf("--> %s\n", d)
-	return d, nil
+	return nil
 }
 
 // Checkout populates the directory at dir with the uncommitted
 // contents of db.
 // FIXME: this does not work properly at the moment.
-func (db *DB) CheckoutUncommitted(dir string) error {
-	if db.tree == nil {
+func (db *DB) CheckoutUncommitted(dir string) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("checkout", "", &err)
+	root, err := db.snapshot()
+	if err != nil {
+		return err
+	}
+	if root == nil {
 		return fmt.Errorf("no tree")
 	}
-	tree, err := TreeScope(db.repo, db.tree, db.scope)
+	tree, err := TreeScope(db.repo, root, db.scope)
 	if err != nil {
 		return err
 	}
@@ -515,6 +2424,9 @@ func (db *DB) CheckoutUncommitted(dir string) error {
 	if tree.EntryCount() == 0 {
 		return nil
 	}
+	if err := checkTreePaths(db.repo, tree); err != nil {
+		return err
+	}
 	idx, err := ioutil.TempFile("", "libpack-index")
 	if err != nil {
 		return err
@@ -544,6 +2456,15 @@ func (db *DB) CheckoutUncommitted(dir string) error {
 	if err := checkoutIndex.Run(); err != nil {
 		return fmt.Errorf("%s", stderr.String())
 	}
+	if err := db.root().decodeCheckout(tree, dir); err != nil {
+		return err
+	}
+	if err := db.removeKeepEntries(tree, dir); err != nil {
+		return err
+	}
+	if db.hidesInternal(db.scope) {
+		return os.RemoveAll(path.Join(dir, InternalTree))
+	}
 	return nil
 }
 
@@ -556,7 +2477,7 @@ func (db *DB) CheckoutUncommitted(dir string) error {
 func (db *DB) ExecInCheckout(path string, args ...string) error {
 	checkout, err := db.Checkout("")
 	if err != nil {
-		return fmt.Errorf("checkout: %v", err)
+		return fmt.Errorf("checkout: %w", err)
 	}
 	defer os.RemoveAll(checkout)
 	cmd := exec.Command(path, args...)
@@ -605,6 +2526,7 @@ func lookupTip(r *git.Repository, refname string) *git.Commit {
 	if err != nil {
 		return nil
 	}
+	defer ref.Free()
 	commit, err := lookupCommit(r, ref.Target())
 	if err != nil {
 		return nil
@@ -612,6 +2534,19 @@ func lookupTip(r *git.Repository, refname string) *git.Commit {
 	return commit
 }
 
+// peelCommit returns the commit pointed to by ref, following
+// annotated tags if necessary.
+func peelCommit(ref *git.Reference) (*git.Commit, error) {
+	obj, err := ref.Peel(git.ObjectCommit)
+	if err != nil {
+		return nil, err
+	}
+	if commit, ok := obj.(*git.Commit); ok {
+		return commit, nil
+	}
+	return nil, fmt.Errorf("reference %s does not point to a commit", ref.Name())
+}
+
 // lookupCommit looks up an object at hash `id` in `repo`, and returns
 // it as a git commit. If the object is not a commit, an error is returned.
 func lookupCommit(r *git.Repository, id *git.Oid) (*git.Commit, error) {
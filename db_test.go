@@ -2,13 +2,20 @@ package libpack
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	git "github.com/libgit2/git2go"
 )
 
 var (
@@ -73,7 +80,13 @@ func TestPush(t *testing.T) {
 	dst.Set("committed-key", "this should go away")
 	dst.Commit("")
 
-	if err := src.Push(dst.Repo().Path(), "refs/heads/test"); err != nil {
+	// The histories have diverged
+	if err := src.Push(dst.Repo().Path(), "refs/heads/test"); err != ErrNonFastForward {
+		t.Fatalf("%v", err)
+	}
+	assertGet(t, dst, "committed-key", "this should go away")
+
+	if err := src.ForcePush(dst.Repo().Path(), "refs/heads/test"); err != nil {
 		t.Fatal(err)
 	}
 
@@ -92,9 +105,7 @@ func TestInit(t *testing.T) {
 		t.Fatal(err)
 	}
 	// Test that tmp1 is a bare git repo
-	if _, err := os.Stat(path.Join(tmp1, "refs")); err != nil {
-		t.Fatal(err)
-	}
+	assertBareRepo(t, tmp1)
 
 	// Init a non-existing dir
 	tmp2 := path.Join(tmp1, "new")
@@ -103,9 +114,7 @@ func TestInit(t *testing.T) {
 		t.Fatal(err)
 	}
 	// Test that tmp2 is a bare git repo
-	if _, err := os.Stat(path.Join(tmp2, "refs")); err != nil {
-		t.Fatal(err)
-	}
+	assertBareRepo(t, tmp2)
 
 	// Init an already-initialized dir
 	_, err = Init(tmp2, "refs/heads/test")
@@ -114,14 +123,248 @@ func TestInit(t *testing.T) {
 	}
 }
 
+func assertBareRepo(t *testing.T, dir string) {
+	r, err := git.OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Free()
+	if !r.IsBare() {
+		t.Fatalf("%s is not a bare repository", dir)
+	}
+}
+
+func TestInitWorkTree(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	if out, err := exec.Command("git", "init", tmp).CombinedOutput(); err != nil {
+		t.Fatalf("%s", out)
+	}
+	db, err := Init(tmp, "refs/heads/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	if p := path.Clean(db.Repo().Path()); p != path.Join(tmp, ".git") {
+		t.Fatalf("%s", p)
+	}
+	db.Set("foo", "bar")
+	if err := db.Commit("first"); err != nil {
+		t.Fatal(err)
+	}
+	// No bare repository was created in the work tree
+	if _, err := os.Stat(path.Join(tmp, "objects")); !os.IsNotExist(err) {
+		t.Fatalf("%v", err)
+	}
+	db2, err := Open(tmp, "refs/heads/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Free()
+	assertGet(t, db2, "foo", "bar")
+}
+
+func TestPackedRefs(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("foo", "A")
+	if err := db.Commit("first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runGit(db.Repo(), "pack-refs", "--all"); err != nil {
+		t.Fatal(err)
+	}
+	db2, err := Open(db.Repo().Path(), db.ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Free()
+	assertGet(t, db2, "foo", "A")
+	db.Set("foo", "B")
+	if err := db.Commit("second"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runGit(db.Repo(), "pack-refs", "--all"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db2.Update(); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db2, "foo", "B")
+	head, _ := db.Head()
+	if head2, _ := db2.Head(); head2 != head {
+		t.Fatalf("%s != %s", head2, head)
+	}
+
+	// Push and pull between repositories with packed refs
+	remote := tmpDB(t, "")
+	defer nukeDB(remote)
+	if err := db.Push(remote.Repo().Path(), db.ref); err != nil {
+		t.Fatal(err)
+	}
+	if err := runGit(remote.Repo(), "pack-refs", "--all"); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Update(); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, remote, "foo", "B")
+	remote.Set("foo", "C")
+	if err := remote.Commit("third"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runGit(remote.Repo(), "pack-refs", "--all"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Pull(remote.Repo().Path(), db.ref); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db, "foo", "C")
+}
+
+func TestInitOpt(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	now := time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)
+	db, err := InitOpt(path.Join(tmp, "db"), InitOptions{
+		Ref:           "refs/heads/test",
+		AuthorName:    "alice",
+		AuthorEmail:   "alice@example.com",
+		CreatedMarker: true,
+		Seed:          map[string]string{"foo": "bar", "a/b": "c"},
+		Options:       []Option{WithClock(func() time.Time { return now })},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	commits, err := db.Log("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 1 || strings.TrimSpace(commits[0].Message) != "init" || commits[0].Author != "alice" {
+		t.Fatalf("%#v", commits)
+	}
+	assertGet(t, db, "foo", "bar")
+	assertGet(t, db, "a/b", "c")
+	assertGet(t, db, CreatedKey, now.Format(time.RFC3339Nano))
+
+	// Seeding is skipped if the reference exists
+	db2, err := InitOpt(path.Join(tmp, "db"), InitOptions{Ref: "refs/heads/test", Seed: map[string]string{"foo": "baz"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Free()
+	assertGet(t, db2, "foo", "bar")
+
+	if _, err := InitOpt(path.Join(tmp, "reserved"), InitOptions{Ref: "refs/heads/test", Seed: map[string]string{InternalTree + "/x": "y"}}); err != ErrReservedPath {
+		t.Fatalf("%v", err)
+	}
+
+	// Non-empty directories
+	dir := path.Join(tmp, "notrepo")
+	os.Mkdir(dir, 0700)
+	ioutil.WriteFile(path.Join(dir, "file"), []byte("hello"), 0600)
+	if _, err := InitOpt(dir, InitOptions{Ref: "refs/heads/test", RefuseNonEmpty: true}); err == nil {
+		t.Fatalf("non-empty directories should be refused")
+	}
+	if db3, err := InitOpt(path.Join(tmp, "db"), InitOptions{Ref: "refs/heads/test", RefuseNonEmpty: true}); err != nil {
+		t.Fatal(err)
+	} else {
+		db3.Free()
+	}
+}
+
+func TestOpenOpt(t *testing.T) {
+	db := tmpDB(t, "refs/heads/config")
+	defer nukeDB(db)
+	db.Set("foo", "bar")
+	if err := db.Commit("first"); err != nil {
+		t.Fatal(err)
+	}
+	repo := db.Repo().Path()
+	for _, packed := range []bool{false, true} {
+		if packed {
+			if err := runGit(db.Repo(), "pack-refs", "--all"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := OpenOpt(repo, OpenOptions{Ref: "refs/heads/confg", MustExist: true})
+		rerr, ok := err.(*RefNotFoundError)
+		if !ok {
+			t.Fatalf("%v", err)
+		}
+		if len(rerr.Nearby) != 1 || rerr.Nearby[0] != "refs/heads/config" {
+			t.Fatalf("%v", rerr.Nearby)
+		}
+		db2, err := OpenOpt(repo, OpenOptions{Ref: "refs/heads/config", MustExist: true})
+		if err != nil {
+			t.Fatalf("packed=%v: %v", packed, err)
+		}
+		assertGet(t, db2, "foo", "bar")
+		db2.Free()
+	}
+	// Missing references are allowed by default
+	db3, err := OpenOpt(repo, OpenOptions{Ref: "refs/heads/other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db3.Free()
+	db4, err := OpenOpt(repo, OpenOptions{Ref: "refs/heads/new", MustExist: true, Create: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db4.Free()
+	if _, err := db4.Head(); err != nil {
+		t.Fatal(err)
+	}
+	if db5, err := OpenOpt(repo, OpenOptions{Ref: "refs/heads/new", MustExist: true}); err != nil {
+		t.Fatal(err)
+	} else {
+		db5.Free()
+	}
+}
+
 func TestScopeNoop(t *testing.T) {
+	testBackends(t, func(t *testing.T, root *DB) {
+		root.Set("foo/bar", "hello")
+		for _, s := range nopScopes {
+			scoped := root.Scope(s)
+			assertGet(t, scoped, "foo/bar", "hello")
+		}
+	})
+}
+
+func TestScopeChecked(t *testing.T) {
 	root := tmpDB(t, "")
 	defer nukeDB(root)
 	root.Set("foo/bar", "hello")
 	for _, s := range nopScopes {
-		scoped := root.Scope(s)
+		scoped, err := root.ScopeChecked(s, true)
+		if err != nil {
+			t.Fatalf("%q: %v", s, err)
+		}
 		assertGet(t, scoped, "foo/bar", "hello")
 	}
+	for _, s := range []string{"..", "foo/../..", "../foo", "foo/..", "foo\x00bar"} {
+		if _, err := root.ScopeChecked(s, false); err == nil {
+			t.Fatalf("%q: should fail", s)
+		}
+	}
+	scoped, err := root.ScopeChecked("//foo/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, scoped, "bar", "hello")
+	if _, err := root.ScopeChecked("missing", true); err != ErrNotExist {
+		t.Fatalf("%v", err)
+	}
+	if _, err := root.ScopeChecked("foo/bar", true); err == nil {
+		t.Fatalf("scoping to a value should fail")
+	}
+	if _, err := root.ScopeChecked("missing", false); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestScopeDump(t *testing.T) {
@@ -136,43 +379,74 @@ func TestScopeDump(t *testing.T) {
 }
 
 func TestScopeSetGet(t *testing.T) {
-	root := tmpDB(t, "")
-	defer nukeDB(root)
-	scoped := root.Scope("foo/bar")
-	scoped.Set("hello", "world")
-	assertGet(t, scoped, "hello", "world")
-	assertGet(t, root, "foo/bar/hello", "world")
+	testBackends(t, func(t *testing.T, root *DB) {
+		scoped := root.Scope("foo/bar")
+		scoped.Set("hello", "world")
+		assertGet(t, scoped, "hello", "world")
+		assertGet(t, root, "foo/bar/hello", "world")
+	})
 }
 
 func TestScopeTree(t *testing.T) {
-	db := tmpDB(t, "")
-	defer nukeDB(db)
-	db.Set("a/b/c/d/hello", "world")
-	tree, err := db.Scope("a/b/c/d").Tree()
-	if err != nil {
-		t.Fatal(err)
-	}
-	var buf bytes.Buffer
-	TreeDump(db.repo, tree, "/", &buf)
-	if s := buf.String(); s != "hello = world\n" {
-		t.Fatalf("%v", s)
-	}
+	testBackends(t, func(t *testing.T, db *DB) {
+		db.Set("a/b/c/d/hello", "world")
+		tree, err := db.Scope("a/b/c/d").Tree()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		TreeDump(db.repo, tree, "/", &buf)
+		if s := buf.String(); s != "hello = world\n" {
+			t.Fatalf("%v", s)
+		}
+	})
 }
 
 func TestMultiScope(t *testing.T) {
+	testBackends(t, func(t *testing.T, root *DB) {
+		root.Set("a/b/c/d", "hello")
+		a := root.Scope("a")
+		ab := a.Scope("b")
+		var abDump bytes.Buffer
+		ab.Dump(&abDump)
+		if s := abDump.String(); s != "c/\nc/d = hello\n" {
+			t.Fatalf("%v\n", s)
+		}
+	})
+}
+
+func TestScopePath(t *testing.T) {
 	root := tmpDB(t, "")
 	defer nukeDB(root)
-	root.Set("a/b/c/d", "hello")
-	a := root.Scope("a")
-	ab := a.Scope("b")
-	var abDump bytes.Buffer
-	ab.Dump(&abDump)
-	if s := abDump.String(); s != "c/\nc/d = hello\n" {
-		t.Fatalf("%v\n", s)
+	if p := root.Path(); p != "/" {
+		t.Fatalf("%v", p)
+	}
+	if root.Root() != root || root.Parent() != root {
+		t.Fatalf("the root should be its own root and parent")
+	}
+	ab := root.Scope("a").Scope("b")
+	if p := ab.Path(); p != "/a/b" {
+		t.Fatalf("%v", p)
 	}
+	if ab.Root() != root {
+		t.Fatalf("wrong root")
+	}
+	a := ab.Parent()
+	if p := a.Path(); p != "/a" {
+		t.Fatalf("%v", p)
+	}
+	if a.Parent() != root {
+		t.Fatalf("wrong parent")
+	}
+	if p := root.Scope("/x/", "y/").Path(); p != "/x/y" {
+		t.Fatalf("%v", p)
+	}
+	ab.Set("c", "hello")
+	assertGet(t, a, "b/c", "hello")
+	assertGet(t, ab.Root(), "a/b/c", "hello")
 }
 
-// A convenience interface to allow querying DB and GlobalTree
+// A convenience interface to allow querying DB and Snapshot
 // with the same utilities
 type ReadDB interface {
 	Get(string) (string, error)
@@ -216,7 +490,7 @@ func TestList(t *testing.T) {
 	db := tmpDB(t, "")
 	defer nukeDB(db)
 	db.Set("foo", "bar")
-	if db.tree == nil {
+	if db.Latest() == nil {
 		t.Fatalf("%#v\n")
 	}
 	for _, rootpath := range []string{"", ".", "/", "////", "///."} {
@@ -232,52 +506,103 @@ func TestList(t *testing.T) {
 		"does-not-exist",
 		"sldhfsjkdfhkjsdfh",
 		"a/b/c/d",
-		"foo/sdfsdf",
 	} {
 		_, err := db.List(wrongpath)
 		if err == nil {
 			t.Fatalf("should fail: %s", wrongpath)
 		}
-		if !strings.Contains(err.Error(), "does not exist in the given tree") {
+		opErr, ok := err.(*OpError)
+		if !ok || opErr.Op != "list" || opErr.Key != wrongpath || opErr.Ref != "refs/heads/test" || !git.IsErrorCode(opErr.Err, git.ErrNotFound) {
 			t.Fatalf("wrong error: %v", err)
 		}
 	}
+	for _, blobpath := range []string{"foo", "foo/sdfsdf"} {
+		_, err := db.List(blobpath)
+		assertKeyError(t, err, ErrNotDirectory, blobpath)
+	}
 }
 
-func TestSetGetSimple(t *testing.T) {
-	db := tmpDB(t, "")
-	defer nukeDB(db)
-	if err := db.Set("foo", "bar"); err != nil {
-		t.Fatal(err)
-	}
-	if key, err := db.Get("foo"); err != nil {
-		t.Fatal(err)
-	} else if key != "bar" {
-		t.Fatalf("%#v", key)
+func assertKeyError(t *testing.T, err, target error, key string) {
+	var kerr *KeyError
+	if !errors.Is(err, target) || !errors.As(err, &kerr) || kerr.Key != key {
+		t.Fatalf("%s: wrong error: %v", key, err)
 	}
 }
 
-func TestSetGetMultiple(t *testing.T) {
+func TestGetDirectory(t *testing.T) {
 	db := tmpDB(t, "")
 	defer nukeDB(db)
-	if err := db.Set("foo", "bar"); err != nil {
-		t.Fatal(err)
-	}
-	if err := db.Set("ga", "bu"); err != nil {
-		t.Fatal(err)
-	}
-	if key, err := db.Get("foo"); err != nil {
+	db.Set("a/b/c", "hello")
+	db.Set("blob", "world")
+	for key, full := range map[string]string{"": "/", "/": "/", "a": "a", "a/b": "a/b"} {
+		_, err := db.Get(key)
+		assertKeyError(t, err, ErrIsDirectory, full)
+	}
+	// Scoped
+	_, err := db.Scope("a").Get("")
+	assertKeyError(t, err, ErrIsDirectory, "a")
+	_, err = db.Scope("a").List("b/c")
+	assertKeyError(t, err, ErrNotDirectory, "a/b/c")
+	// Below a blob
+	for _, key := range []string{"blob/x", "a/b/c/d/e"} {
+		_, err := db.Get(key)
+		assertKeyError(t, err, ErrNotDirectory, key)
+	}
+	// The same errors are returned once the changes are committed
+	db.Commit("")
+	_, err = db.Get("a")
+	assertKeyError(t, err, ErrIsDirectory, "a")
+	_, err = db.Get("blob/x")
+	assertKeyError(t, err, ErrNotDirectory, "blob/x")
+	assertKeyError(t, db.Append("a", "x"), ErrIsDirectory, "a")
+	snap, err := db.Snapshot()
+	if err != nil {
 		t.Fatal(err)
-	} else if key != "bar" {
-		t.Fatalf("%#v", key)
 	}
-	if key, err := db.Get("ga"); err != nil {
+	_, err = snap.Get("a")
+	assertKeyError(t, err, ErrIsDirectory, "a")
+	_, err = snap.List("blob")
+	assertKeyError(t, err, ErrNotDirectory, "blob")
+	// Dump and Walk are unaffected
+	if err := db.Dump(ioutil.Discard); err != nil {
 		t.Fatal(err)
-	} else if key != "bu" {
-		t.Fatalf("%#v", key)
 	}
 }
 
+func TestSetGetSimple(t *testing.T) {
+	testBackends(t, func(t *testing.T, db *DB) {
+		if err := db.Set("foo", "bar"); err != nil {
+			t.Fatal(err)
+		}
+		if key, err := db.Get("foo"); err != nil {
+			t.Fatal(err)
+		} else if key != "bar" {
+			t.Fatalf("%#v", key)
+		}
+	})
+}
+
+func TestSetGetMultiple(t *testing.T) {
+	testBackends(t, func(t *testing.T, db *DB) {
+		if err := db.Set("foo", "bar"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Set("ga", "bu"); err != nil {
+			t.Fatal(err)
+		}
+		if key, err := db.Get("foo"); err != nil {
+			t.Fatal(err)
+		} else if key != "bar" {
+			t.Fatalf("%#v", key)
+		}
+		if key, err := db.Get("ga"); err != nil {
+			t.Fatal(err)
+		} else if key != "bu" {
+			t.Fatalf("%#v", key)
+		}
+	})
+}
+
 func TestCommitConcurrentNoConflict(t *testing.T) {
 	db1 := tmpDB(t, "")
 	defer nukeDB(db1)
@@ -288,10 +613,15 @@ func TestCommitConcurrentNoConflict(t *testing.T) {
 
 	assertGet(t, db1, "foo", "A")
 	assertGet(t, db2, "bar", "B")
+	// Uncommitted changes are not shared between handles
+	assertNotExist(t, db1, "bar")
+	assertNotExist(t, db2, "foo")
 
 	if err := db1.Commit("A"); err != nil {
 		t.Fatal(err)
 	}
+	// Nor are commits, until the handle is updated
+	assertNotExist(t, db2, "foo")
 
 	if err := db2.Commit("B"); err != nil {
 		t.Fatalf("%#v", err)
@@ -315,6 +645,8 @@ func TestCommitConcurrentWithConflict(t *testing.T) {
 
 	assertGet(t, db1, "foo", "A")
 	assertGet(t, db2, "foo", "B")
+	assertNotExist(t, db2, "1")
+	assertNotExist(t, db2, "2")
 
 	if err := db1.Commit("A"); err != nil {
 		t.Fatal(err)
@@ -333,35 +665,35 @@ func TestCommitConcurrentWithConflict(t *testing.T) {
 }
 
 func TestSetCommitGet(t *testing.T) {
-	db := tmpDB(t, "")
-	defer nukeDB(db)
-	if err := db.Set("foo", "bar"); err != nil {
-		t.Fatal(err)
-	}
-	if err := db.Set("ga", "bu"); err != nil {
-		t.Fatal(err)
-	}
-	if err := db.Commit("test"); err != nil {
-		t.Fatal(err)
-	}
-	if err := db.Set("ga", "added after commit"); err != nil {
-		t.Fatal(err)
-	}
-	var err error
-	db, err = Init(db.Repo().Path(), "refs/heads/test")
-	if err != nil {
-		t.Fatal(err)
-	}
-	if val, err := db.Get("foo"); err != nil {
-		t.Fatal(err)
-	} else if val != "bar" {
-		t.Fatalf("%#v", val)
-	}
-	if val, err := db.Get("ga"); err != nil {
-		t.Fatal(err)
-	} else if val != "bu" {
-		t.Fatalf("%#v", val)
-	}
+	testBackends(t, func(t *testing.T, db *DB) {
+		if err := db.Set("foo", "bar"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Set("ga", "bu"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Commit("test"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Set("ga", "added after commit"); err != nil {
+			t.Fatal(err)
+		}
+		db2, err := Open(db.Repo().Path(), db.ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db2.Free()
+		if val, err := db2.Get("foo"); err != nil {
+			t.Fatal(err)
+		} else if val != "bar" {
+			t.Fatalf("%#v", val)
+		}
+		if val, err := db2.Get("ga"); err != nil {
+			t.Fatal(err)
+		} else if val != "bu" {
+			t.Fatalf("%#v", val)
+		}
+	})
 }
 
 func TestSetGetNested(t *testing.T) {
@@ -482,6 +814,37 @@ func TestCheckout(t *testing.T) {
 	}
 }
 
+func TestCheckoutScope(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("services/web/conf", "hello")
+	db.Set("services/web/static/index", "html")
+	db.Set("services/db/conf", "other")
+	if err := db.Commit("test"); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := db.Scope("services").CheckoutScope("web", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for file, expected := range map[string]string{"conf": "hello", "static/index": "html"} {
+		data, err := ioutil.ReadFile(path.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Fatalf("%s: %q", file, data)
+		}
+	}
+	if _, err := os.Stat(path.Join(dir, "services")); !os.IsNotExist(err) {
+		t.Fatalf("%v", err)
+	}
+	if _, err := db.CheckoutScope("services/missing", ""); err != ErrNotExist {
+		t.Fatalf("%v", err)
+	}
+}
+
 func TestCheckoutTmp(t *testing.T) {
 	db := tmpDB(t, "")
 	defer nukeDB(db)
@@ -553,6 +916,8 @@ func TestPullToEmpty(t *testing.T) {
 	}
 
 	assertGet(t, db2, "foo/bar/baz", "hello world")
+	assertList(t, db2, "etc", "something")
+	assertList(t, db2, "etc/something")
 }
 
 // Test Update when the ref has not changed
@@ -574,6 +939,56 @@ func TestUpdate(t *testing.T) {
 	assertGet(t, db, "key", "value")
 }
 
+func TestUpdateUnchanged(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	commitKey(t, db, "committed", "1")
+	db.Set("key", "value")
+	db.Delete("committed")
+	tree := mustTreeHash(t, db)
+	for i := 0; i < 3; i++ {
+		if err := db.UpdateWith(UpdateOpt{OnDirty: DirtyFail}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Update(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertGet(t, db, "key", "value")
+	assertNotExist(t, db, "committed")
+	if h := mustTreeHash(t, db); h != tree {
+		t.Fatalf("%v != %v", h, tree)
+	}
+	if err := db.Commit(""); err != nil {
+		t.Fatal(err)
+	}
+	assertNotExist(t, db, "committed")
+}
+
+func BenchmarkUpdateUnchanged(b *testing.B) {
+	dir, err := ioutil.TempDir("", "libpack-bench-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := Init(dir, "refs/heads/test")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Free()
+	db.Set("foo", "bar")
+	if err := db.Commit(""); err != nil {
+		b.Fatal(err)
+	}
+	db.Set("foo", "baz")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.Update(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 // Test Update when the ref has changed out of band
 func TestUpdateWithChanges(t *testing.T) {
 	db1 := tmpDB(t, "refs/heads/test")
@@ -607,44 +1022,805 @@ func TestUpdateWithChanges(t *testing.T) {
 	assertGet(t, db1, "key2", "val2")
 }
 
-func TestAddDB(t *testing.T) {
-	db1 := tmpDB(t, "refs/heads/db1")
+func TestUpdateDirty(t *testing.T) {
+	db1 := tmpDB(t, "refs/heads/test")
 	defer nukeDB(db1)
-
-	db2, err := Open(db1.Repo().Path(), "refs/heads/db2")
+	db1.Set("shared", "base")
+	db1.Set("deleted", "base")
+	if err := db1.Commit("base"); err != nil {
+		t.Fatal(err)
+	}
+	db2, err := Open(db1.Repo().Path(), "refs/heads/test")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer nukeDB(db2)
-
-	db1.Set("hello", "world")
-	db1.Set("foo/bar/baz", "hello there")
-
-	db2.Set("k", "v")
-	db2.Set("db1/foo/bar/abc", "xyz")
-	if err := db2.AddDB("db1", db1); err != nil {
+	db1.Set("key1", "val1")
+	db1.Set("same", "same value")
+	if err := db1.Commit("commit 1"); err != nil {
 		t.Fatal(err)
 	}
-	assertGet(t, db2, "db1/hello", "world")
-	assertGet(t, db2, "k", "v")
-	assertGet(t, db2, "db1/foo/bar/baz", "hello there")
-	assertGet(t, db2, "db1/foo/bar/abc", "xyz")
-	assertGet(t, db2, "db1/foo/bar/abc", "xyz")
-}
 
-func TestEmptyCommit(t *testing.T) {
-	db := tmpDB(t, "")
-	defer nukeDB(db)
-	if err := db.Commit(""); err != nil {
+	// Clean databases are updated whatever the policy
+	db3, err := Open(db1.Repo().Path(), "refs/heads/test")
+	if err != nil {
 		t.Fatal(err)
 	}
-	db.Set("foo", "bar")
-	// This should commit something
-	if err := db.Commit(""); err != nil {
+	if err := db3.UpdateWith(UpdateOpt{OnDirty: DirtyFail}); err != nil {
 		t.Fatal(err)
 	}
-	// This should commit nothing (but not fail)
-	if err := db.Commit(""); err != nil {
-		t.Fatal(err)
+
+	db2.Set("local", "uncommitted")
+	db2.Set("same", "same value")
+	db2.Delete("deleted")
+	if err := db2.UpdateWith(UpdateOpt{OnDirty: DirtyFail}); err != ErrDirty {
+		t.Fatalf("%v", err)
+	}
+	assertNotExist(t, db2, "key1")
+	assertGet(t, db2, "local", "uncommitted")
+
+	if err := db2.UpdateWith(UpdateOpt{OnDirty: DirtyMerge}); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db2, "key1", "val1")
+	assertGet(t, db2, "local", "uncommitted")
+	assertGet(t, db2, "same", "same value")
+	assertGet(t, db2, "shared", "base")
+	assertNotExist(t, db2, "deleted")
+
+	// Conflicting changes
+	db1.Set("shared", "theirs")
+	if err := db1.Commit("commit 2"); err != nil {
+		t.Fatal(err)
+	}
+	db2.Set("shared", "ours")
+	err = db2.UpdateWith(UpdateOpt{OnDirty: DirtyMerge})
+	if cerr, ok := err.(*UpdateConflictError); !ok || len(cerr.Keys) != 1 || cerr.Keys[0] != "shared" {
+		t.Fatalf("%v", err)
+	}
+	assertGet(t, db2, "shared", "ours")
+	assertGet(t, db2, "local", "uncommitted")
+
+	if err := db2.UpdateWith(UpdateOpt{OnDirty: DirtyDiscard}); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db2, "shared", "theirs")
+	assertNotExist(t, db2, "local")
+	assertGet(t, db2, "deleted", "base")
+}
+
+func TestAddDB(t *testing.T) {
+	testBackends(t, func(t *testing.T, db1 *DB) {
+		db2, err := Open(db1.Repo().Path(), "refs/heads/db2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db2.Free()
+
+		db1.Set("hello", "world")
+		db1.Set("foo/bar/baz", "hello there")
+
+		db2.Set("k", "v")
+		db2.Set("db1/foo/bar/abc", "xyz")
+		if err := db2.AddDB("db1", db1); err != nil {
+			t.Fatal(err)
+		}
+		assertGet(t, db2, "db1/hello", "world")
+		assertGet(t, db2, "k", "v")
+		assertGet(t, db2, "db1/foo/bar/baz", "hello there")
+		assertGet(t, db2, "db1/foo/bar/abc", "xyz")
+		assertGet(t, db2, "db1/foo/bar/abc", "xyz")
+	})
+}
+
+func TestEmptyCommit(t *testing.T) {
+	testBackends(t, func(t *testing.T, db *DB) {
+		if err := db.Commit(""); err != nil {
+			t.Fatal(err)
+		}
+		db.Set("foo", "bar")
+		// This should commit something
+		if err := db.Commit(""); err != nil {
+			t.Fatal(err)
+		}
+		// This should commit nothing (but not fail)
+		if err := db.Commit(""); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestCommitSummary(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	summarize := CommitOpt{Summarize: true, MaxKeys: 3}
+	// Nothing to commit
+	if err := db.CommitWith("", summarize); err != nil {
+		t.Fatal(err)
+	}
+	if db.headId() != nil {
+		t.Fatalf("empty commit was created")
+	}
+	db.Set("old/key", "1")
+	db.Set("services/web/replicas", "1")
+	if err := db.Commit("base"); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("foo/bar", "1")
+	db.Set("services/web/replicas", "2")
+	db.Delete("old/key")
+	db.SetAnnotation("foo/bar", "note", "hello")
+	if err := db.CommitWith("", summarize); err != nil {
+		t.Fatal(err)
+	}
+	commits, err := db.Log("", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := commits[0].Message; msg != "3 keys changed: +foo/bar, -old/key, ~services/web/replicas" {
+		t.Fatalf("%q", msg)
+	}
+	head := db.headId().String()
+	if err := db.CommitWith("", summarize); err != nil {
+		t.Fatal(err)
+	}
+	if db.headId().String() != head {
+		t.Fatalf("empty commit was created")
+	}
+	// Explicit messages are kept
+	db.Set("foo/bar", "2")
+	if err := db.CommitWith("explicit", summarize); err != nil {
+		t.Fatal(err)
+	}
+	if commits, _ := db.Log("", 1); commits[0].Message != "explicit" {
+		t.Fatalf("%q", commits[0].Message)
+	}
+}
+
+func TestSummarizeChanges(t *testing.T) {
+	changes := []Change{
+		{Key: "a", Kind: Added},
+		{Key: InternalTree + "/annotations/a", Kind: Added},
+		{Key: "b", Kind: Modified},
+		{Key: "c", Kind: Deleted},
+	}
+	if msg := summarizeChanges(changes, 2); msg != "3 keys changed: +a, ~b, +1 more" {
+		t.Fatalf("%q", msg)
+	}
+	if msg := summarizeChanges(changes[:2], 2); msg != "1 key changed: +a" {
+		t.Fatalf("%q", msg)
+	}
+	if msg := summarizeChanges(changes[1:2], 2); msg != "internal changes only" {
+		t.Fatalf("%q", msg)
+	}
+}
+
+func TestCommitHook(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	var calls []string
+	db.AddCommitHook(func(pending []Change) error {
+		calls = append(calls, "first")
+		if len(pending) != 1 || pending[0].Key != "foo" || pending[0].Kind != Added {
+			t.Fatalf("%#v", pending)
+		}
+		return nil
+	})
+	db.AddCommitHook(func(pending []Change) error {
+		calls = append(calls, "second")
+		return fmt.Errorf("rejected")
+	})
+	db.Set("foo", "bar")
+	if err := db.Commit("test"); err == nil {
+		t.Fatalf("commit should have been rejected")
+	}
+	if fmt.Sprintf("%v", calls) != "[first second]" {
+		t.Fatalf("%v", calls)
+	}
+	if _, err := db.Head(); err != ErrNoCommits {
+		t.Fatalf("reference should not have been updated")
+	}
+	assertGet(t, db, "foo", "bar")
+}
+
+func TestPostCommitHook(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	logger := &testLogger{}
+	db.SetLogger(logger)
+	var commits []string
+	db.AddPostCommitHook(func(id string, changes []Change) {
+		panic("this should not break the handle")
+	})
+	db.AddPostCommitHook(func(id string, changes []Change) {
+		if len(changes) != 1 || changes[0].Key != "foo" {
+			t.Fatalf("%#v", changes)
+		}
+		commits = append(commits, id)
+	})
+	db.Set("foo", "bar")
+	if err := db.Commit("test"); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing changed: no commit, no hook
+	if err := db.Commit("test"); err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 1 || commits[0] != db.headId().String() {
+		t.Fatalf("%v", commits)
+	}
+	logger.find(t, "post-commit hook panicked: this should not break the handle")
+	assertGet(t, db, "foo", "bar")
+}
+
+func TestCommitAuthor(t *testing.T) {
+	when := time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", WithAuthor("Alice", "alice@example.com"), WithClock(func() time.Time { return when }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set("foo", "bar")
+	if err := db.Commit("test"); err != nil {
+		t.Fatal(err)
+	}
+	if a := db.commit.Author(); a.Name != "Alice" || a.Email != "alice@example.com" || !a.When.Equal(when) {
+		t.Fatalf("%#v", a)
+	}
+	db.Set("foo", "baz")
+	if err := db.CommitAs("test", "Bob", "bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if c := db.commit.Committer(); c.Name != "Bob" || c.Email != "bob@example.com" {
+		t.Fatalf("%#v", c)
+	}
+}
+
+func TestDeterministicCommit(t *testing.T) {
+	var heads []string
+	for i := 0; i < 2; i++ {
+		tmp := tmpdir(t)
+		defer os.RemoveAll(tmp)
+		db, err := Init(tmp, "refs/heads/test", Deterministic(time.Time{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SetMany(map[string]string{"foo": "bar", "a/b/c": "hello", "a/d": "world"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Commit("reproducible"); err != nil {
+			t.Fatal(err)
+		}
+		heads = append(heads, db.headId().String())
+	}
+	if heads[0] != heads[1] {
+		t.Fatalf("%v", heads)
+	}
+}
+
+func TestSignedCommit(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	sign := func(payload []byte) (string, error) {
+		return fmt.Sprintf("-----BEGIN FAKE SIGNATURE-----\n%d\n-----END FAKE SIGNATURE-----\n", len(payload)), nil
+	}
+	verify := func(payload, signature []byte) error {
+		expected, _ := sign(payload)
+		if string(signature) != expected {
+			return fmt.Errorf("bad signature: %q", signature)
+		}
+		return nil
+	}
+	db.Set("foo", "unsigned")
+	if err := db.Commit("unsigned"); err != nil {
+		t.Fatal(err)
+	}
+	unsigned := db.headId().String()
+	db.SetSigner(sign)
+	db.Set("foo", "signed")
+	if err := db.Commit("signed"); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db, "foo", "signed")
+	err := db.VerifyHead(verify)
+	verr, ok := err.(*SignatureError)
+	if !ok {
+		t.Fatalf("%#v", err)
+	}
+	if len(verr.Invalid) != 0 || len(verr.Unsigned) != 1 || verr.Unsigned[0] != unsigned {
+		t.Fatalf("%#v", verr)
+	}
+}
+
+func TestSignedCommitBadAuthor(t *testing.T) {
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Init(tmp, "refs/heads/test", WithAuthor("Eve\nparent 0000000000000000000000000000000000000000", "eve@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetSigner(func(payload []byte) (string, error) {
+		return "signature", nil
+	})
+	db.Set("foo", "bar")
+	if err := db.Commit("injected"); err == nil {
+		t.Fatalf("an author with a newline should be rejected")
+	}
+	if _, err := db.Head(); err != ErrNoCommits {
+		t.Fatalf("%v", err)
+	}
+}
+
+// Signed commits don't overwrite commits made concurrently by another
+// handle
+func TestSignedCommitConcurrent(t *testing.T) {
+	db1 := tmpDB(t, "")
+	defer nukeDB(db1)
+	db2, err := Open(db1.Repo().Path(), db1.ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Free()
+	commitKey(t, db1, "base", "base")
+	db2.Update()
+	db1.SetSigner(func(payload []byte) (string, error) {
+		return "signature", nil
+	})
+	commitKey(t, db2, "foo", "from db2")
+	commitKey(t, db1, "bar", "from db1")
+	db2.Update()
+	assertGet(t, db2, "foo", "from db2")
+	assertGet(t, db2, "bar", "from db1")
+}
+
+func TestHeadTreeHash(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	if _, err := db.Head(); err != ErrNoCommits {
+		t.Fatalf("%v", err)
+	}
+	if h, err := db.TreeHash(); err != nil {
+		t.Fatal(err)
+	} else if h != EmptyTreeId {
+		t.Fatalf("%v", h)
+	}
+	db.Set("foo", "bar")
+	before, err := db.TreeHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == EmptyTreeId {
+		t.Fatalf("TreeHash should reflect uncommitted changes")
+	}
+	if err := db.Commit(""); err != nil {
+		t.Fatal(err)
+	}
+	head, err := db.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != db.commit.Id().String() {
+		t.Fatalf("%v", head)
+	}
+	if after, _ := db.TreeHash(); after != before {
+		t.Fatalf("%v != %v", after, before)
+	}
+}
+
+func TestClose(t *testing.T) {
+	db := tmpDB(t, "")
+	defer os.RemoveAll(db.Repo().Path())
+	db.Set("foo", "bar")
+	db.Commit("")
+	scoped := db.Scope("a")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Closing twice is harmless
+	db.Free()
+	if _, err := db.Get("foo"); err != ErrClosed {
+		t.Fatalf("%v", err)
+	}
+	if err := db.Set("foo", "baz"); err != ErrClosed {
+		t.Fatalf("%v", err)
+	}
+	if err := db.Commit(""); err != ErrClosed {
+		t.Fatalf("%v", err)
+	}
+	if _, err := scoped.List("/"); err != ErrClosed {
+		t.Fatalf("%v", err)
+	}
+}
+
+// rss returns the resident set size of the current process in pages.
+func rss(t *testing.T) int {
+	data, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		t.Skipf("cannot measure memory usage: %v", err)
+	}
+	var size, resident int
+	fmt.Sscanf(string(data), "%d %d", &size, &resident)
+	return resident
+}
+
+func TestCloseMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	for i := 0; i < 100; i++ {
+		db.Set(fmt.Sprintf("key%d", i), "value")
+	}
+	db.Commit("")
+	repo := db.Repo().Path()
+	openClose := func(n int) {
+		for i := 0; i < n; i++ {
+			h, err := Open(repo, "refs/heads/test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.Get("key42")
+			h.List("/")
+			h.Close()
+		}
+	}
+	// Warm up allocators and caches
+	openClose(500)
+	before := rss(t)
+	openClose(3000)
+	after := rss(t)
+	// Allow some slack (4096 pages = 16MB with 4k pages)
+	if after-before > 4096 {
+		t.Fatalf("resident memory grew from %d to %d pages", before, after)
+	}
+}
+
+// Run with -race to detect unsynchronized access to the database.
+func TestConcurrentAccess(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			scoped := db.Scope(fmt.Sprintf("worker%d", i))
+			for j := 0; j < 20; j++ {
+				key := fmt.Sprintf("key%d", j)
+				if err := scoped.Set(key, "hello"); err != nil {
+					t.Error(err)
+					return
+				}
+				if v, err := scoped.Get(key); err != nil {
+					t.Error(err)
+					return
+				} else if v != "hello" {
+					t.Errorf("%#v", v)
+					return
+				}
+				if _, err := db.List("/"); err != nil {
+					t.Error(err)
+					return
+				}
+				if j%5 == 0 {
+					if err := db.Commit(fmt.Sprintf("worker %d step %d", i, j)); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := db.Commit("done"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 20; j++ {
+			assertGet(t, db, fmt.Sprintf("worker%d/key%d", i, j), "hello")
+		}
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("a/b/1", "one")
+	db.Set("a/b/2", "two")
+	db.Set("a/3", "three")
+	db.Set("4", "four")
+	scoped := db.Scope("a")
+	values, missing, err := scoped.GetMany([]string{"b/1", "b/2", "3", "b", "b/nope", "nope/nope", "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"b/1": "one", "b/2": "two", "3": "three"}
+	if len(values) != len(expected) {
+		t.Fatalf("%v", values)
+	}
+	for k, v := range expected {
+		if values[k] != v {
+			t.Fatalf("%s: %#v", k, values[k])
+		}
+	}
+	if s := fmt.Sprint(missing); s != "[b b/nope nope/nope /]" {
+		t.Fatalf("%v", s)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("foo/bar", "A")
+	db.Set("foo/baz", "B")
+	if err := db.SetAnnotation("foo/bar", "note", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("foo/bar"); err != nil {
+		t.Fatal(err)
+	}
+	assertNotExist(t, db, "foo/bar")
+	assertGet(t, db, "foo/baz", "B")
+	if _, err := db.GetAnnotation("foo/bar", "note"); err == nil {
+		t.Fatalf("annotations should be deleted with their key")
+	}
+	if err := db.Delete("foo/bar"); err != ErrNotExist {
+		t.Fatalf("%v", err)
+	}
+	// Deleting the last key of a subtree removes it
+	if err := db.Scope("foo").Delete("baz"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Stat("foo"); err != ErrNotExist {
+		t.Fatalf("%v", err)
+	}
+	// Subtrees can be deleted
+	db.Set("a/b/c", "C")
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	assertNotExist(t, db, "a/b/c")
+	if err := db.Delete("/"); err == nil {
+		t.Fatalf("deleting the root should fail")
+	}
+}
+
+func TestSetNX(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	if ok, err := db.SetNX("foo", "A"); err != nil || !ok {
+		t.Fatalf("%v %v", ok, err)
+	}
+	if ok, err := db.SetNX("foo", "B"); err != nil || ok {
+		t.Fatalf("%v %v", ok, err)
+	}
+	assertGet(t, db, "foo", "A")
+	db.Set("dir/key", "C")
+	if ok, err := db.Scope("dir").SetNX("/", "D"); err != nil || ok {
+		t.Fatalf("%v %v", ok, err)
+	}
+	if v, err := db.GetOrSet("foo", "B"); err != nil || v != "A" {
+		t.Fatalf("%v %v", v, err)
+	}
+	if v, err := db.GetOrSet("bar", "B"); err != nil || v != "B" {
+		t.Fatalf("%v %v", v, err)
+	}
+	assertGet(t, db, "bar", "B")
+
+	// Only one of several concurrent calls succeeds
+	var wg sync.WaitGroup
+	var l sync.Mutex
+	winners := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := db.SetNX("leader", fmt.Sprintf("%d", i))
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				l.Lock()
+				winners++
+				l.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if winners != 1 {
+		t.Fatalf("%d winners", winners)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	if err := db.Append("log", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AppendBytes("log", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db, "log", "ab")
+	db.Set("dir/key", "C")
+	if err := db.Append("dir", "x"); err == nil {
+		t.Fatalf("appending to a subtree should fail")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := db.Append("concurrent", fmt.Sprintf("<%d>", i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	value, err := db.Get("concurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if !strings.Contains(value, fmt.Sprintf("<%d>", i)) {
+			t.Fatalf("missing marker %d in %q", i, value)
+		}
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("foo/a", "A")
+	db.Set("foo/b/c", "C")
+	db.Set("bar", "B")
+	if err := db.Commit("first"); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("foo/b/d", "D")
+	removed, err := db.Scope("foo").DeletePrefix("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(removed, ",") != "b/c,b/d" {
+		t.Fatalf("%v", removed)
+	}
+	assertNotExist(t, db, "foo/b/c")
+	assertGet(t, db, "foo/a", "A")
+	if removed, err = db.DeletePrefix("bar"); err != nil || strings.Join(removed, ",") != "bar" {
+		t.Fatalf("%v %v", removed, err)
+	}
+	if removed, err = db.DeletePrefix("missing"); err != nil || len(removed) != 0 {
+		t.Fatalf("%v %v", removed, err)
+	}
+}
+
+func TestCommitConcurrentReads(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("existing/key", "value")
+	if err := db.Commit("first"); err != nil {
+		t.Fatal(err)
+	}
+	kv := make(map[string]string)
+	for i := 0; i < 50000; i++ {
+		kv[fmt.Sprintf("new/%d/%d", i%100, i)] = fmt.Sprint(i)
+	}
+	if err := db.SetMany(kv); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	start := time.Now()
+	go func() {
+		done <- db.Commit("large")
+	}()
+	var (
+		reads   int
+		slowest time.Duration
+	)
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			elapsed := time.Since(start)
+			if slowest > 50*time.Millisecond && slowest > elapsed/2 {
+				t.Fatalf("reads blocked for %v during a commit of %v (%d reads)", slowest, elapsed, reads)
+			}
+			assertGet(t, db, "new/42/42", "42")
+			return
+		default:
+		}
+		t0 := time.Now()
+		assertGet(t, db, "existing/key", "value")
+		if d := time.Since(t0); d > slowest {
+			slowest = d
+		}
+		reads++
+	}
+}
+
+func TestCommitConcurrentWrites(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("foo", "bar")
+	db.Commit("first")
+	entered := make(chan struct{})
+	resume := make(chan struct{})
+	db.AddCommitHook(func([]Change) error {
+		close(entered)
+		<-resume
+		return nil
+	})
+	db.Set("foo", "baz")
+	done := make(chan error)
+	go func() {
+		done <- db.Commit("second")
+	}()
+	<-entered
+	// The commit is in progress: reads and writes don't wait for it
+	assertGet(t, db, "foo", "baz")
+	db.Set("late", "value")
+	close(resume)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// Changes made during the commit are kept uncommitted
+	assertGet(t, db, "late", "value")
+	head, err := db.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := db.CommitInfo(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Message != "second" {
+		t.Fatalf("%q", info.Message)
+	}
+	committed, err := Open(db.Repo().Path(), "refs/heads/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer committed.Free()
+	assertGet(t, committed, "foo", "baz")
+	assertNotExist(t, committed, "late")
+	db.l.RLock()
+	dirty := db.dirtyLocked()
+	db.l.RUnlock()
+	if !dirty {
+		t.Fatalf("late change should be uncommitted")
+	}
+}
+
+func TestPostCommitHookStderr(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.AddPostCommitHook(func(id string, changes []Change) {
+		panic("no logger")
+	})
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	db.Set("foo", "bar")
+	err = db.Commit("test")
+	os.Stderr = stderr
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := ioutil.ReadAll(r)
+	if !strings.Contains(string(out), "libpack: post-commit hook panicked: no logger") {
+		t.Fatalf("%q", out)
 	}
 }
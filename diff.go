@@ -0,0 +1,104 @@
+package libpack
+
+import (
+	"fmt"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+// A ChangeKind describes how a key was changed between two trees.
+type ChangeKind int
+
+const (
+	Added ChangeKind = iota
+	Modified
+	Deleted
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Modified:
+		return "modified"
+	case Deleted:
+		return "deleted"
+	}
+	return fmt.Sprintf("ChangeKind(%d)", int(k))
+}
+
+// A Change describes a single key which differs between two trees.
+// OldId is nil for added keys, and NewId is nil for deleted keys.
+type Change struct {
+	Key   string
+	Kind  ChangeKind
+	OldId *git.Oid
+	NewId *git.Oid
+}
+
+// TreeDiff returns the list of keys changed between trees a and b.
+// A nil tree is treated as an empty tree.
+// Only blobs are reported: subtrees are recursed into.
+func TreeDiff(r *git.Repository, a, b *git.Tree) ([]Change, error) {
+	if a != nil && b != nil && a.Id().Equal(b.Id()) {
+		return nil, nil
+	}
+	diff, err := r.DiffTreeToTree(a, b, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer diff.Free()
+	n, err := diff.NumDeltas()
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]Change, 0, n)
+	for i := 0; i < n; i++ {
+		delta, err := diff.GetDelta(i)
+		if err != nil {
+			return nil, err
+		}
+		switch delta.Status {
+		case git.DeltaAdded:
+			changes = append(changes, Change{Key: delta.NewFile.Path, Kind: Added, NewId: delta.NewFile.Oid})
+		case git.DeltaDeleted:
+			changes = append(changes, Change{Key: delta.OldFile.Path, Kind: Deleted, OldId: delta.OldFile.Oid})
+		case git.DeltaModified, git.DeltaTypeChange:
+			changes = append(changes, Change{Key: delta.NewFile.Path, Kind: Modified, OldId: delta.OldFile.Oid, NewId: delta.NewFile.Oid})
+		}
+	}
+	return changes, nil
+}
+
+// summarizeChanges returns a commit message listing at most max of the
+// keys changed by changes, prefixed by "+" if they were added, "~" if
+// they were modified, and "-" if they were deleted. Internal keys are
+// left out.
+func summarizeChanges(changes []Change, max int) string {
+	var keys []string
+	for _, c := range changes {
+		if isInternal(c.Key) {
+			continue
+		}
+		prefix := "~"
+		switch c.Kind {
+		case Added:
+			prefix = "+"
+		case Deleted:
+			prefix = "-"
+		}
+		keys = append(keys, prefix+c.Key)
+	}
+	switch len(keys) {
+	case 0:
+		return "internal changes only"
+	case 1:
+		return "1 key changed: " + keys[0]
+	}
+	msg := fmt.Sprintf("%d keys changed: ", len(keys))
+	if len(keys) <= max {
+		return msg + strings.Join(keys, ", ")
+	}
+	return msg + strings.Join(keys[:max], ", ") + fmt.Sprintf(", +%d more", len(keys)-max)
+}
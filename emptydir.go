@@ -0,0 +1,81 @@
+package libpack
+
+import (
+	"os"
+	"path"
+
+	git "github.com/libgit2/git2go"
+)
+
+// KeepEntry is the name of the empty value which Mkdir writes in the
+// directories it creates, so that they are kept by merges and checkouts,
+// which drop empty trees. Unless the database is opened with
+// ShowInternal, it is hidden from List, ListEntries, Walk, Dump, Checkout
+// and diffs like InternalTree, at any depth. It can't be set.
+const KeepEntry = InternalTree + ".keep"
+
+func isKeepEntry(key string) bool {
+	return path.Base(TreePath(key)) == KeepEntry
+}
+
+// keepTree writes a tree containing only KeepEntry, and returns its id.
+func keepTree(r *git.Repository) (*git.Oid, error) {
+	empty, err := createBlob(r, "")
+	if err != nil {
+		return nil, err
+	}
+	builder, err := r.TreeBuilder()
+	if err != nil {
+		return nil, err
+	}
+	defer builder.Free()
+	if err := builder.Insert(KeepEntry, empty, 0100644); err != nil {
+		return nil, err
+	}
+	return builder.Write()
+}
+
+// hiddenEntry returns true if the entry `name` of a directory must be
+// hidden from listings and walks: InternalTree if hideInternal is set,
+// and KeepEntry unless db shows internal entries.
+func (db *DB) hiddenEntry(name string, hideInternal bool) bool {
+	if name == InternalTree {
+		return hideInternal
+	}
+	return name == KeepEntry && !db.root().showInternal
+}
+
+// hideKeepEntries wraps a walk handler so that it is not called for
+// KeepEntry values, unless db shows internal entries.
+func (db *DB) hideKeepEntries(h func(string, *git.TreeEntry, git.Object) error) func(string, *git.TreeEntry, git.Object) error {
+	if db.root().showInternal {
+		return h
+	}
+	return func(key string, e *git.TreeEntry, obj git.Object) error {
+		if e.Name == KeepEntry {
+			return nil
+		}
+		return h(key, e, obj)
+	}
+}
+
+// removeKeepEntries removes the KeepEntry files of a checkout of tree in
+// dir, leaving their directories empty.
+func (db *DB) removeKeepEntries(tree *git.Tree, dir string) error {
+	if db.root().showInternal {
+		return nil
+	}
+	return treeWalk(db.repo, tree, "/", func(key string, e *git.TreeEntry, obj git.Object) error {
+		if e.Name != KeepEntry {
+			return nil
+		}
+		p, err := checkoutPath(dir, key)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,163 @@
+package libpack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	git "github.com/libgit2/git2go"
+)
+
+func assertList(t *testing.T, db *DB, key string, expected ...string) {
+	names, err := db.List(key)
+	if err != nil {
+		t.Fatalf("%s: %v", key, err)
+	}
+	if len(names) != len(expected) || len(names) > 0 && !reflect.DeepEqual(names, expected) {
+		t.Fatalf("%s: %#v", key, names)
+	}
+}
+
+func assertEmptyDir(t *testing.T, dir string) {
+	st, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.IsDir() {
+		t.Fatalf("%s is not a directory", dir)
+	}
+	if files, err := ioutil.ReadDir(dir); err != nil || len(files) != 0 {
+		t.Fatalf("%s: %v %v", dir, files, err)
+	}
+}
+
+func TestMkdirPersists(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	if err := db.Mkdir("etc/something"); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("foo", "bar")
+	if err := db.Commit("mkdir"); err != nil {
+		t.Fatal(err)
+	}
+	assertList(t, db, "etc", "something")
+	assertList(t, db, "etc/something")
+
+	// Reopen
+	db2, err := Open(db.Repo().Path(), db.ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Free()
+	assertList(t, db2, "etc", "something")
+	assertList(t, db2, "etc/something")
+	if info, err := db2.Stat("etc/something"); err != nil || info.Kind != KindTree {
+		t.Fatalf("%#v %v", info, err)
+	}
+
+	// Pull
+	dst := tmpDB(t, "")
+	defer nukeDB(dst)
+	if err := dst.Pull(db.Repo().Path(), db.ref); err != nil {
+		t.Fatal(err)
+	}
+	assertList(t, dst, "etc/something")
+
+	// Merges keep the directory
+	merge, err := Init(tmpdir(t), "refs/heads/test", MergeOnPull())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(merge)
+	merge.Set("local", "1")
+	merge.Commit("local")
+	if err := merge.Pull(db.Repo().Path(), db.ref); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, merge, "local", "1")
+	assertList(t, merge, "etc/something")
+
+	// Checkout
+	dir, err := db.Checkout("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	assertEmptyDir(t, path.Join(dir, "etc/something"))
+	scopeDir, err := db.CheckoutScope("etc", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(scopeDir)
+	assertEmptyDir(t, path.Join(scopeDir, "something"))
+	into := tmpdir(t)
+	defer os.RemoveAll(into)
+	if err := db.CheckoutInto(into, CheckoutOpt{}); err != nil {
+		t.Fatal(err)
+	}
+	assertEmptyDir(t, path.Join(into, "etc/something"))
+}
+
+func TestKeepEntryHidden(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Mkdir("dir")
+	db.Set("dir2/key", "value")
+	db.Mkdir("dir2")
+	if err := db.Commit("mkdir"); err != nil {
+		t.Fatal(err)
+	}
+	// Existing directories are left unchanged
+	if _, err := db.Stat("dir2/" + KeepEntry); err == nil {
+		t.Fatalf("%s added to an existing directory", KeepEntry)
+	}
+	assertList(t, db, "dir")
+	if entries, err := db.ListEntries("dir"); err != nil || len(entries) != 0 {
+		t.Fatalf("%#v %v", entries, err)
+	}
+	err := db.Walk("/", func(key string, obj git.Object) error {
+		if strings.Contains(key, KeepEntry) {
+			t.Fatalf("%s walked", key)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dump bytes.Buffer
+	if err := db.Dump(&dump); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(dump.String(), KeepEntry) {
+		t.Fatalf("%s", dump.String())
+	}
+	if err := db.Set("dir/"+KeepEntry, "x"); err != ErrReservedPath {
+		t.Fatalf("%v", err)
+	}
+	// The directory is removed with its contents
+	keys, err := db.DeletePrefix("dir")
+	if err != nil || len(keys) != 0 {
+		t.Fatalf("%#v %v", keys, err)
+	}
+	if _, err := db.Stat("dir"); err == nil {
+		t.Fatalf("dir should not exist")
+	}
+
+	// ShowInternal shows it
+	shown, err := Open(db.Repo().Path(), db.ref, ShowInternal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shown.Free()
+	db.Mkdir("dir")
+	db.Commit("mkdir again")
+	shown.Update()
+	if names, err := shown.List("dir"); err != nil || len(names) != 1 || names[0] != KeepEntry {
+		t.Fatalf("%#v %v", names, err)
+	}
+}
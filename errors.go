@@ -0,0 +1,58 @@
+package libpack
+
+import (
+	"fmt"
+	"os"
+
+	git "github.com/libgit2/git2go"
+)
+
+// An OpError records an error returned by libgit2 or the file system,
+// and the operation, database and key which caused it.
+// The errors defined by this package, such as ErrNotExist or a *KeyError,
+// already describe what went wrong, and are returned as is.
+type OpError struct {
+	// Name of the operation, such as "get" or "commit"
+	Op string
+	// Path of the repository, and reference of the database
+	Repo string
+	Ref  string
+	// Key or scope, relative to the root of the database, if any
+	Key string
+	Err error
+}
+
+func (e *OpError) Error() string {
+	s := fmt.Sprintf("%s %s %s", e.Op, e.Repo, e.Ref)
+	if e.Key != "" {
+		s += " " + e.Key
+	}
+	return fmt.Sprintf("%s: %v", s, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// wrapError replaces *err with an *OpError for operation op on key, if
+// it is an error of libgit2 or of the file system. Exported methods
+// defer it.
+func (db *DB) wrapError(op, key string, err *error) {
+	switch (*err).(type) {
+	case *git.GitError, *os.PathError, *os.LinkError, *os.SyscallError:
+	default:
+		return
+	}
+	full := TreePath(db.fullKey(key))
+	if full == "/" {
+		full = ""
+	}
+	*err = &OpError{
+		Op:   op,
+		Repo: db.repo.Path(),
+		Ref:  db.ref,
+		Key:  db.unescapeKey(full),
+		Err:  *err,
+	}
+}
@@ -0,0 +1,41 @@
+package libpack
+
+import (
+	"testing"
+
+	git "github.com/libgit2/git2go"
+)
+
+func TestOpError(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("a/b", "c")
+	_, err := db.Scope("a").List("missing/dir")
+	opErr, ok := err.(*OpError)
+	if !ok {
+		t.Fatalf("%#v", err)
+	}
+	if opErr.Op != "list" || opErr.Repo != db.Repo().Path() || opErr.Ref != "refs/heads/test" || opErr.Key != "a/missing/dir" {
+		t.Fatalf("%#v", opErr)
+	}
+	if !git.IsErrorCode(opErr.Unwrap(), git.ErrNotFound) || !isNotExist(err) {
+		t.Fatalf("%v", opErr.Unwrap())
+	}
+	if _, err := db.Stat("missing"); !isNotExist(err) {
+		t.Fatalf("%v", err)
+	}
+	// Errors of this package are returned as is
+	if _, err := db.Get("missing"); err != ErrNotExist {
+		t.Fatalf("%v", err)
+	}
+	_, err = db.List("a/b")
+	assertKeyError(t, err, ErrNotDirectory, "a/b")
+	if err := db.Set("/"+InternalTree+"/x", "y"); err != ErrReservedPath {
+		t.Fatalf("%v", err)
+	}
+	// Methods which don't take a key record the operation
+	_, err = db.CommitInfo("0123456789012345678901234567890123456789")
+	if opErr, ok := err.(*OpError); !ok || opErr.Op != "commit-info" || opErr.Key != "" || !isNotExist(err) {
+		t.Fatalf("%#v", err)
+	}
+}
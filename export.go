@@ -0,0 +1,417 @@
+package libpack
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	git "github.com/libgit2/git2go"
+)
+
+// A Format is the encoding of the records written by Export and read by
+// Import. Each record holds a key, relative to the scope of the database,
+// a value, and the git filemode of the value: regular (0100644),
+// executable (0100755), or symbolic link (0120000).
+type Format int
+
+const (
+	// Each record is a protobuf message, prefixed with its length as a
+	// varint, as written by protobuf's writeDelimitedTo:
+	//
+	//   message Record {
+	//     bytes key = 1;
+	//     bytes value = 2;
+	//     uint32 mode = 3;
+	//   }
+	//
+	// A mode of 0 means a regular value.
+	FormatProtobuf Format = iota
+	// Each record is a msgpack array of 3 elements: the key as a string,
+	// the value as binary, and the mode as an unsigned integer.
+	FormatMsgpack
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatProtobuf:
+		return "protobuf"
+	case FormatMsgpack:
+		return "msgpack"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// An ImportError is returned by Import when a record is malformed.
+type ImportError struct {
+	// Offset of the record in the stream, in bytes
+	Offset int64
+	Err    error
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("malformed record at byte %d: %v", e.Offset, e.Err)
+}
+
+type exportRecord struct {
+	key   string
+	value []byte
+	mode  uint64
+}
+
+// Export writes the values of the uncommitted tree to w in format, one
+// record per value, sorted by key. Values are decoded like with Get, and
+// written one at a time.
+func (db *DB) Export(w io.Writer, format Format) (err error) {
+	defer db.wrapError("export", "", &err)
+	if format != FormatProtobuf && format != FormatMsgpack {
+		return fmt.Errorf("unsupported format: %v", format)
+	}
+	root := db.root()
+	bw := bufio.NewWriter(w)
+	err = db.walkSorted("/", func(key string, e *git.TreeEntry) error {
+		if e.Type != git.ObjectBlob {
+			return nil
+		}
+		data, err := blobContents(db.repo, e.Id)
+		if err != nil {
+			return err
+		}
+		value, err := root.decodeValue(data, e.Filemode)
+		if err != nil {
+			return err
+		}
+		rec := exportRecord{key, []byte(value), uint64(e.Filemode)}
+		if format == FormatMsgpack {
+			_, err = bw.Write(rec.msgpack())
+		} else {
+			_, err = bw.Write(rec.protobuf())
+		}
+		return err
+	})
+	if err == ErrNotExist {
+		// Empty database
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Import reads records in format from r, and writes their values in the
+// uncommitted tree, at their keys relative to the scope of db. It returns
+// the number of records read.
+// Values are written in the repository as they are read, but the tree
+// is only changed once all the records were read: if a record is
+// malformed, an *ImportError is returned, and nothing is changed. Values
+// are checked as by Set.
+func (db *DB) Import(r io.Reader, format Format) (n int, err error) {
+	if err := db.checkClosed(); err != nil {
+		return 0, err
+	}
+	defer db.wrapError("import", "", &err)
+	var read func(*countingReader) (exportRecord, error)
+	switch format {
+	case FormatProtobuf:
+		read = readProtobufRecord
+	case FormatMsgpack:
+		read = readMsgpackRecord
+	default:
+		return 0, fmt.Errorf("unsupported format: %v", format)
+	}
+	root := db.root()
+	cr := &countingReader{r: bufio.NewReader(r)}
+	var (
+		keys  []string
+		blobs []blobEntry
+	)
+	for {
+		offset := cr.n
+		rec, err := read(cr)
+		if err == io.EOF && cr.n == offset {
+			break
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, &ImportError{offset, err}
+		}
+		blob, err := db.importBlob(rec)
+		if err != nil {
+			return 0, &ImportError{offset, err}
+		}
+		keys = append(keys, db.fullKey(rec.key))
+		blobs = append(blobs, blob)
+	}
+	defer root.afterWrite(&err)
+	root.l.Lock()
+	defer root.l.Unlock()
+	for i, key := range keys {
+		if err := root.stage(key, blobs[i].id, blobs[i].mode); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+// importBlob checks the value of rec, and writes it in a blob.
+func (db *DB) importBlob(rec exportRecord) (blobEntry, error) {
+	if err := db.checkReserved(rec.key); err != nil {
+		return blobEntry{}, err
+	}
+	value := string(rec.value)
+	if err := db.checkValue(db.fullKey(rec.key), value); err != nil {
+		return blobEntry{}, err
+	}
+	root := db.root()
+	data, mode := value, modeLink
+	switch rec.mode {
+	case 0, modeBlob, modeExecutable:
+		var err error
+		if data, mode, err = root.encodeValue(value); err != nil {
+			return blobEntry{}, err
+		}
+		if rec.mode == modeExecutable {
+			mode = modeExecutable
+		}
+	case modeLink:
+	default:
+		return blobEntry{}, fmt.Errorf("unsupported mode %o", rec.mode)
+	}
+	id, err := createBlob(root.repo, data)
+	if err != nil {
+		return blobEntry{}, err
+	}
+	return blobEntry{id, mode}, nil
+}
+
+// countingReader counts the bytes read, to report the offset of
+// malformed records.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// readBytes reads n bytes from r. The buffer grows as data arrives, so
+// that a malformed length doesn't allocate more than the stream holds.
+func readBytes(r io.Reader, n uint64) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func (rec exportRecord) protobuf() []byte {
+	msg := append([]byte{1<<3 | 2}, appendUvarint(nil, uint64(len(rec.key)))...)
+	msg = append(msg, rec.key...)
+	msg = appendUvarint(append(msg, 2<<3|2), uint64(len(rec.value)))
+	msg = append(msg, rec.value...)
+	msg = appendUvarint(append(msg, 3<<3|0), rec.mode)
+	return append(appendUvarint(nil, uint64(len(msg))), msg...)
+}
+
+func readProtobufRecord(r *countingReader) (exportRecord, error) {
+	var rec exportRecord
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return rec, err
+	}
+	data, err := readBytes(r, size)
+	if err != nil {
+		return rec, err
+	}
+	msg := bytes.NewReader(data)
+	hasKey := false
+	for msg.Len() > 0 {
+		tag, err := binary.ReadUvarint(msg)
+		if err != nil {
+			return rec, errors.New("truncated field tag")
+		}
+		field, wireType := tag>>3, tag&7
+		var (
+			v     uint64
+			bytes []byte
+		)
+		switch wireType {
+		case 0:
+			v, err = binary.ReadUvarint(msg)
+		case 1:
+			_, err = readBytes(msg, 8)
+		case 2:
+			if v, err = binary.ReadUvarint(msg); err == nil {
+				bytes, err = readBytes(msg, v)
+			}
+		case 5:
+			_, err = readBytes(msg, 4)
+		default:
+			return rec, fmt.Errorf("unsupported wire type %d", wireType)
+		}
+		if err != nil {
+			return rec, fmt.Errorf("truncated field %d", field)
+		}
+		switch {
+		case field == 1 && wireType == 2:
+			rec.key, hasKey = string(bytes), true
+		case field == 2 && wireType == 2:
+			rec.value = bytes
+		case field == 3 && wireType == 0:
+			rec.mode = v
+		case field <= 3:
+			return rec, fmt.Errorf("wrong wire type %d for field %d", wireType, field)
+		}
+	}
+	if !hasKey {
+		return rec, errors.New("missing key")
+	}
+	return rec, nil
+}
+
+func (rec exportRecord) msgpack() []byte {
+	b := []byte{0x93}
+	switch n := len(rec.key); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= 0xff:
+		b = append(b, 0xd9, byte(n))
+	case n <= 0xffff:
+		b = append(b, 0xda, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0xdb, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	b = append(b, rec.key...)
+	switch n := len(rec.value); {
+	case n <= 0xff:
+		b = append(b, 0xc4, byte(n))
+	case n <= 0xffff:
+		b = append(b, 0xc5, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0xc6, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	b = append(b, rec.value...)
+	switch m := rec.mode; {
+	case m < 0x80:
+		b = append(b, byte(m))
+	case m <= 0xffff:
+		b = append(b, 0xcd, byte(m>>8), byte(m))
+	default:
+		b = append(b, 0xce, byte(m>>24), byte(m>>16), byte(m>>8), byte(m))
+	}
+	return b
+}
+
+func readMsgpackRecord(r *countingReader) (exportRecord, error) {
+	var rec exportRecord
+	b, err := r.ReadByte()
+	if err != nil {
+		return rec, err
+	}
+	if b != 0x93 {
+		return rec, fmt.Errorf("expected an array of 3 elements, found 0x%02x", b)
+	}
+	key, err := readMsgpackBytes(r)
+	if err != nil {
+		return rec, fmt.Errorf("key: %w", err)
+	}
+	if rec.value, err = readMsgpackBytes(r); err != nil {
+		return rec, fmt.Errorf("value: %w", err)
+	}
+	if rec.mode, err = readMsgpackUint(r); err != nil {
+		return rec, fmt.Errorf("mode: %w", err)
+	}
+	rec.key = string(key)
+	return rec, nil
+}
+
+// readMsgpackBytes reads a msgpack string or binary.
+func readMsgpackBytes(r *countingReader) ([]byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, noEOF(err)
+	}
+	var size uint64
+	switch {
+	case b&0xe0 == 0xa0:
+		size = uint64(b & 0x1f)
+	case b == 0xc4 || b == 0xd9:
+		size, err = readBigEndian(r, 1)
+	case b == 0xc5 || b == 0xda:
+		size, err = readBigEndian(r, 2)
+	case b == 0xc6 || b == 0xdb:
+		size, err = readBigEndian(r, 4)
+	default:
+		return nil, fmt.Errorf("expected a string or binary, found 0x%02x", b)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return readBytes(r, size)
+}
+
+// readMsgpackUint reads a msgpack unsigned integer.
+func readMsgpackUint(r *countingReader) (uint64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, noEOF(err)
+	}
+	switch {
+	case b < 0x80:
+		return uint64(b), nil
+	case b == 0xcc:
+		return readBigEndian(r, 1)
+	case b == 0xcd:
+		return readBigEndian(r, 2)
+	case b == 0xce:
+		return readBigEndian(r, 4)
+	case b == 0xcf:
+		return readBigEndian(r, 8)
+	}
+	return 0, fmt.Errorf("expected an unsigned integer, found 0x%02x", b)
+}
+
+func readBigEndian(r io.Reader, size int) (uint64, error) {
+	data, err := readBytes(r, uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// noEOF returns io.ErrUnexpectedEOF for io.EOF, for reads in the middle
+// of a record.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package libpack
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	for _, format := range []Format{FormatProtobuf, FormatMsgpack} {
+		testExportImport(t, format)
+	}
+}
+
+func testExportImport(t *testing.T, format Format) {
+	src := tmpDB(t, "")
+	defer nukeDB(src)
+	deep := "a/b/c/d/e/f/g/h/i/j/k"
+	big := strings.Repeat("x", 70000)
+	src.Set("foo", "bar")
+	src.Set("bin", "\x00\xff\x01binary\x93")
+	src.Set(deep, "deep")
+	src.Set("big", big)
+	src.Set("empty", "")
+	src.SetLink("link", "foo")
+	src.SetWithMode("run", "#!/bin/sh", 0755)
+	var buf bytes.Buffer
+	if err := src.Export(&buf, format); err != nil {
+		t.Fatalf("%v: %v", format, err)
+	}
+	dst := tmpDB(t, "")
+	defer nukeDB(dst)
+	n, err := dst.Scope("imported").Import(bytes.NewReader(buf.Bytes()), format)
+	if err != nil || n != 7 {
+		t.Fatalf("%v: %d %v", format, n, err)
+	}
+	imported := dst.Scope("imported")
+	assertGet(t, imported, "foo", "bar")
+	assertGet(t, imported, "bin", "\x00\xff\x01binary\x93")
+	assertGet(t, imported, deep, "deep")
+	assertGet(t, imported, "big", big)
+	assertGet(t, imported, "empty", "")
+	if ok, diffs, err := Equal(src, imported); !ok || err != nil {
+		t.Fatalf("%v: %v %v", format, diffs, err)
+	}
+	// Exporting again gives the same stream
+	var again bytes.Buffer
+	if err := imported.Export(&again, format); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Bytes(), buf.Bytes()) {
+		t.Fatalf("%v: export differs after import", format)
+	}
+	// A truncated stream is rejected, and nothing is imported
+	truncated := buf.Bytes()[:buf.Len()-1]
+	n, err = dst.Scope("truncated").Import(bytes.NewReader(truncated), format)
+	importErr, ok := err.(*ImportError)
+	if n != 0 || !ok || importErr.Offset <= 0 || importErr.Offset >= int64(buf.Len()) {
+		t.Fatalf("%v: %d %v", format, n, err)
+	}
+	assertNotExist(t, dst, "truncated")
+}
+
+func TestImportMalformed(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	good := exportRecord{"foo", []byte("bar"), modeBlob}
+	for _, c := range []struct {
+		format Format
+		data   []byte
+		offset int64
+	}{
+		{FormatMsgpack, []byte{0x92}, 0},
+		{FormatMsgpack, append(good.msgpack(), 0x93, 0xc0), int64(len(good.msgpack()))},
+		{FormatMsgpack, exportRecord{"bad", nil, 0100600}.msgpack(), 0},
+		{FormatProtobuf, append(good.protobuf(), 0x05, 0x18, 0x01), int64(len(good.protobuf()))},
+		{FormatProtobuf, append(good.protobuf(), 0x10), int64(len(good.protobuf()))},
+		{FormatProtobuf, exportRecord{"/_libpack/x", []byte("y"), 0}.protobuf(), 0},
+	} {
+		n, err := db.Import(bytes.NewReader(c.data), c.format)
+		if e, ok := err.(*ImportError); n != 0 || !ok || e.Offset != c.offset {
+			t.Fatalf("%v %x: %d %v", c.format, c.data, n, err)
+		}
+	}
+	assertNotExist(t, db, "foo")
+	// An empty stream imports nothing
+	if n, err := db.Import(bytes.NewReader(nil), FormatProtobuf); n != 0 || err != nil {
+		t.Fatalf("%d %v", n, err)
+	}
+}
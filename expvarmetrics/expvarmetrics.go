@@ -0,0 +1,55 @@
+// Package expvarmetrics provides a libpack.MetricsSink which publishes
+// the measurements of a database with the expvar package.
+package expvarmetrics
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/docker/libpack"
+)
+
+// A Sink publishes measurements in an expvar.Map, with the following
+// counters:
+//
+//	ops.<op>            number of operations
+//	errors.<op>         number of operations which failed
+//	latency_ns.<op>     total duration of the operations, in nanoseconds
+//	value_bytes.<op>    total size of the values read or written
+//	commits             number of commits
+//	commit_keys         total number of keys changed by commits
+//	commit_ns           total duration of commits, in nanoseconds
+type Sink struct {
+	m *expvar.Map
+}
+
+var _ libpack.MetricsSink = (*Sink)(nil)
+
+// New returns a Sink publishing its counters in a new expvar.Map named
+// name. Like expvar.NewMap, it panics if name is already in use.
+func New(name string) *Sink {
+	return &Sink{m: expvar.NewMap(name)}
+}
+
+// Map returns the map in which s publishes its counters.
+func (s *Sink) Map() *expvar.Map {
+	return s.m
+}
+
+func (s *Sink) ObserveOp(op string, d time.Duration, err error) {
+	s.m.Add("ops."+op, 1)
+	if err != nil {
+		s.m.Add("errors."+op, 1)
+	}
+	s.m.Add("latency_ns."+op, int64(d))
+}
+
+func (s *Sink) ObserveValue(op string, size int) {
+	s.m.Add("value_bytes."+op, int64(size))
+}
+
+func (s *Sink) ObserveCommit(keysChanged int, d time.Duration) {
+	s.m.Add("commits", 1)
+	s.m.Add("commit_keys", int64(keysChanged))
+	s.m.Add("commit_ns", int64(d))
+}
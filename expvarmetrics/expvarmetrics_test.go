@@ -0,0 +1,38 @@
+package expvarmetrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func counter(t *testing.T, s *Sink, name string) string {
+	v := s.Map().Get(name)
+	if v == nil {
+		return ""
+	}
+	return v.String()
+}
+
+func TestSink(t *testing.T) {
+	s := New("libpack_test")
+	s.ObserveOp("get", time.Millisecond, nil)
+	s.ObserveOp("get", 2*time.Millisecond, errors.New("not found"))
+	s.ObserveValue("get", 10)
+	s.ObserveValue("get", 5)
+	s.ObserveCommit(3, time.Second)
+	for name, expected := range map[string]string{
+		"ops.get":         "2",
+		"errors.get":      "1",
+		"latency_ns.get":  "3000000",
+		"value_bytes.get": "15",
+		"commits":         "1",
+		"commit_keys":     "3",
+		"commit_ns":       "1000000000",
+		"ops.set":         "",
+	} {
+		if v := counter(t, s, name); v != expected {
+			t.Fatalf("%s: %q != %q", name, v, expected)
+		}
+	}
+}
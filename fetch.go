@@ -0,0 +1,342 @@
+package libpack
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+// fetchedRefPrefix is the prefix of the references recording the
+// heads downloaded by Fetch.
+const fetchedRefPrefix = "refs/libpack/fetched/"
+
+// fetchedRef returns the reference in which Fetch records the head
+// downloaded for db.
+func (db *DB) fetchedRef() string {
+	return fetchedRefPrefix + strings.TrimPrefix(db.ref, "refs/")
+}
+
+// Fetch downloads the objects of the reference `remoteRef` at url, and
+// returns the id of the remote head. Unlike Pull, neither the database's
+// reference nor the uncommitted tree are changed: call ApplyFetched to
+// do so.
+// The fetched head is recorded in the repository, so it can be applied
+// later, even by another process.
+func (db *DB) Fetch(url, remoteRef string) (fetchedHead string, err error) {
+	if err := db.checkClosed(); err != nil {
+		return "", err
+	}
+	defer db.wrapError("fetch", "", &err)
+	if remoteRef == "" {
+		remoteRef = db.ref
+	}
+	refspec := fmt.Sprintf("+%s:%s", remoteRef, db.fetchedRef())
+	previous, err := db.FetchedHead()
+	if err != nil {
+		return "", err
+	}
+	if depth := db.root().depth; depth > 0 {
+		if err := fetchShallow(db.repo, url, refspec, depth); err != nil {
+			return "", err
+		}
+	} else {
+		remote, err := db.repo.CreateAnonymousRemote(url, refspec)
+		if err != nil {
+			return "", err
+		}
+		defer remote.Free()
+		if err := remote.Fetch(nil, db.signature(), fmt.Sprintf("libpack.fetch %s %s", url, refspec)); err != nil {
+			return "", err
+		}
+	}
+	head, err := db.FetchedHead()
+	if err != nil {
+		return "", err
+	}
+	if head == previous {
+		db.logf(LogDebug, "fetch %s %s: no new commits, head %s", url, remoteRef, head)
+	} else {
+		db.logf(LogInfo, "fetch %s %s: head %s, previously fetched %s", url, remoteRef, head, previous)
+	}
+	return head, nil
+}
+
+// FetchedHead returns the id of the head recorded by the last call to
+// Fetch, or an empty string if nothing was fetched.
+func (db *DB) FetchedHead() (string, error) {
+	if err := db.checkClosed(); err != nil {
+		return "", err
+	}
+	ref, err := db.repo.LookupReference(db.fetchedRef())
+	if err != nil {
+		return "", nil
+	}
+	defer ref.Free()
+	return ref.Target().String(), nil
+}
+
+// ApplyFetched moves the database's reference to the commit `head`
+// downloaded by Fetch, and updates the uncommitted tree like Pull.
+// If head is empty, the head recorded by the last Fetch is used.
+// If the reference already contains head, nothing is done. If it has
+// diverged, head is merged into it, with conflicts resolved in favor
+// of the local history.
+// The values changed by head are checked by the validators registered
+// with an incoming policy, see AddValidatorPolicy.
+// The reference is only moved if nobody else did in the meantime,
+// even across processes: otherwise, an error is returned.
+func (db *DB) ApplyFetched(head string) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("apply", "", &err)
+	if db.parent != nil {
+		return db.parent.ApplyFetched(head)
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if head == "" {
+		var err error
+		if head, err = db.FetchedHead(); err != nil {
+			return err
+		} else if head == "" {
+			return fmt.Errorf("nothing fetched")
+		}
+	}
+	headId, err := git.NewOid(head)
+	if err != nil {
+		return err
+	}
+	fetched, err := lookupCommit(db.repo, headId)
+	if err != nil {
+		return err
+	}
+	defer fetched.Free()
+	fetchedTree, err := fetched.Tree()
+	if err != nil {
+		return err
+	}
+	defer fetchedTree.Free()
+	sig := db.signature()
+	msg := fmt.Sprintf("libpack.apply %s", head)
+	if db.locking {
+		unlock, err := lockRepo(db.repo.Path(), db.lockTimeout)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	local := lookupTip(db.repo, db.ref)
+	if local == nil {
+		if err := db.checkIncoming(nil, fetchedTree, head); err != nil {
+			return err
+		}
+		ref, err := db.repo.CreateReference(db.ref, headId, false, sig, msg)
+		if err != nil {
+			return err
+		}
+		ref.Free()
+		db.logf(LogInfo, "%s: none -> %s (apply)", db.ref, head)
+		return db.Update()
+	}
+	defer local.Free()
+	base, err := db.repo.MergeBase(local.Id(), headId)
+	if err != nil {
+		return err
+	}
+	switch {
+	case base.Equal(headId):
+		// Already applied
+		db.logf(LogDebug, "%s: %s already contains fetched commit %s", db.ref, local.Id(), head)
+		return nil
+	case base.Equal(local.Id()):
+		// Fast-forward
+		if err := db.checkIncoming(local, fetchedTree, head); err != nil {
+			return err
+		}
+		if err := updateRef(db.repo, db.ref, headId, local.Id().String(), msg); err != nil {
+			return fmt.Errorf("apply: %w", err)
+		}
+		db.logf(LogInfo, "%s: %s -> %s (apply, fast-forward)", db.ref, local.Id(), head)
+	default:
+		tree, err := mergeCommits(db.repo, local, fetched)
+		if err != nil {
+			return err
+		}
+		defer tree.Free()
+		if err := db.checkIncoming(local, tree, head); err != nil {
+			return err
+		}
+		db.l.RLock()
+		signer := db.signer
+		db.l.RUnlock()
+		commit, err := mkCommit(db.repo, "", msg, sig, signer, tree, local, fetched)
+		if err != nil {
+			return err
+		}
+		defer commit.Free()
+		if err := updateRef(db.repo, db.ref, commit.Id(), local.Id().String(), msg); err != nil {
+			return fmt.Errorf("apply: %w", err)
+		}
+		db.logf(LogInfo, "%s: %s -> %s (apply, merged %s from base %s)", db.ref, local.Id(), commit.Id(), head, base)
+	}
+	return db.Update()
+}
+
+// MaxSyncBackoff is the longest delay between two attempts of SyncFrom
+// after errors.
+var MaxSyncBackoff = 5 * time.Minute
+
+// SyncFrom starts a goroutine which fetches the reference `ref` at url
+// every `interval`, and applies it with ApplyFetched. onChange, if not
+// nil, is called each time the database's reference is moved as a result.
+// Attempts are spread randomly by up to 10% of interval. After an error,
+// the delay is doubled for each consecutive failure, up to MaxSyncBackoff,
+// and the functions registered with OnSyncError are called.
+// A new connection is made for each attempt, since git2go doesn't allow
+// keeping one open.
+// Calling the returned function stops the goroutine, and waits for it
+// to exit. Free stops it too. It must not be called from onChange.
+func (db *DB) SyncFrom(url, ref string, interval time.Duration, onChange func(oldHead, newHead string)) (stop func()) {
+	s := &syncer{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	root := db.root()
+	root.l.Lock()
+	if root.syncers == nil {
+		root.syncers = make(map[*syncer]bool)
+	}
+	root.syncers[s] = true
+	root.l.Unlock()
+	go func() {
+		defer close(s.done)
+		defer func() {
+			root.l.Lock()
+			delete(root.syncers, s)
+			root.l.Unlock()
+		}()
+		delay := interval
+		failures := 0
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(jitter(delay)):
+			}
+			oldHead, newHead, err := db.syncOnce(url, ref)
+			if err == ErrClosed {
+				return
+			}
+			if err != nil {
+				failures++
+				delay = syncBackoff(interval, failures)
+				db.syncError(err)
+				continue
+			}
+			failures = 0
+			delay = interval
+			if oldHead != newHead && onChange != nil {
+				onChange(oldHead, newHead)
+			}
+		}
+	}()
+	return s.halt
+}
+
+// syncer is a goroutine started by SyncFrom.
+type syncer struct {
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// halt stops the goroutine, and waits for it to exit.
+func (s *syncer) halt() {
+	s.once.Do(func() { close(s.stop) })
+	<-s.done
+}
+
+// stopSyncers stops the goroutines started by SyncFrom.
+func (db *DB) stopSyncers() {
+	db.l.RLock()
+	var syncers []*syncer
+	for s := range db.syncers {
+		syncers = append(syncers, s)
+	}
+	db.l.RUnlock()
+	for _, s := range syncers {
+		s.halt()
+	}
+}
+
+// OnSyncError registers a function to be called when an attempt of
+// SyncFrom fails.
+func (db *DB) OnSyncError(f func(error)) {
+	if db.parent != nil {
+		db.parent.OnSyncError(f)
+		return
+	}
+	db.l.Lock()
+	db.onSyncError = append(db.onSyncError, f)
+	db.l.Unlock()
+}
+
+func (db *DB) syncError(err error) {
+	root := db.root()
+	root.l.RLock()
+	callbacks := root.onSyncError
+	root.l.RUnlock()
+	for _, f := range callbacks {
+		f(err)
+	}
+}
+
+// syncOnce fetches and applies ref from url, and returns the database's
+// head before and after.
+func (db *DB) syncOnce(url, ref string) (oldHead, newHead string, err error) {
+	oldHead, err = db.Head()
+	if err != nil && err != ErrNoCommits {
+		return "", "", err
+	}
+	head, err := db.Fetch(url, ref)
+	if err != nil {
+		return "", "", err
+	}
+	if err := db.ApplyFetched(head); err != nil {
+		return "", "", err
+	}
+	newHead, err = db.Head()
+	if err != nil {
+		return "", "", err
+	}
+	return oldHead, newHead, nil
+}
+
+// jitter returns d, randomly changed by up to 10%.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	spread := int64(d) / 10
+	if spread == 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(2*spread)-spread)
+}
+
+func syncBackoff(interval time.Duration, failures int) time.Duration {
+	delay := interval
+	for i := 0; i < failures && delay < MaxSyncBackoff; i++ {
+		delay *= 2
+	}
+	if delay > MaxSyncBackoff {
+		delay = MaxSyncBackoff
+	}
+	return delay
+}
@@ -0,0 +1,169 @@
+package libpack
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestFetchApply(t *testing.T) {
+	src := tmpDB(t, "")
+	defer nukeDB(src)
+	src.Set("foo", "A")
+	if err := src.Commit("A"); err != nil {
+		t.Fatal(err)
+	}
+	dst := tmpDB(t, "")
+	defer nukeDB(dst)
+	head, err := dst.Fetch(src.Repo().Path(), src.ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srcHead, _ := src.Head(); head != srcHead {
+		t.Fatalf("%s != %s", head, srcHead)
+	}
+	// Nothing is applied yet
+	if _, err := dst.Head(); err != ErrNoCommits {
+		t.Fatalf("%#v", err)
+	}
+	assertNotExist(t, dst, "foo")
+	// The fetched head survives reopening the database
+	dst2, err := Open(dst.Repo().Path(), dst.ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst2.Free()
+	if fetched, err := dst2.FetchedHead(); err != nil {
+		t.Fatal(err)
+	} else if fetched != head {
+		t.Fatalf("%s != %s", fetched, head)
+	}
+	if err := dst2.ApplyFetched(""); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, dst2, "foo", "A")
+
+	// Diverged histories are merged
+	src.Set("bar", "B")
+	if err := src.Commit("B"); err != nil {
+		t.Fatal(err)
+	}
+	dst2.Set("baz", "C")
+	if err := dst2.Commit("C"); err != nil {
+		t.Fatal(err)
+	}
+	head, err = dst2.Fetch(src.Repo().Path(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dst2.ApplyFetched(head); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, dst2, "foo", "A")
+	assertGet(t, dst2, "bar", "B")
+	assertGet(t, dst2, "baz", "C")
+	// Applying again does nothing
+	before, _ := dst2.Head()
+	if err := dst2.ApplyFetched(head); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := dst2.Head(); after != before {
+		t.Fatalf("%s != %s", after, before)
+	}
+}
+
+func TestApplyFetchedReadOnly(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	commitKey(t, db, "foo", "A")
+	if err := db.Tag("v1", ""); err != nil {
+		t.Fatal(err)
+	}
+	head, _ := db.Head()
+	tagged, err := OpenAtTag(db.Repo().Path(), "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tagged.Free()
+	if err := tagged.ApplyFetched(head); err != ErrReadOnly {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestSyncFrom(t *testing.T) {
+	src := tmpDB(t, "")
+	defer nukeDB(src)
+	dst := tmpDB(t, "")
+	defer nukeDB(dst)
+	changes := make(chan [2]string, 10)
+	stop := dst.SyncFrom(src.Repo().Path(), src.ref, 10*time.Millisecond, func(oldHead, newHead string) {
+		changes <- [2]string{oldHead, newHead}
+	})
+	defer stop()
+	src.Set("foo", "A")
+	if err := src.Commit("A"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case c := <-changes:
+		if head, _ := src.Head(); c[0] != "" || c[1] != head {
+			t.Fatalf("%v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no change notified")
+	}
+	assertGet(t, dst, "foo", "A")
+	// No-op fetches are not notified
+	select {
+	case c := <-changes:
+		t.Fatalf("unexpected notification: %v", c)
+	case <-time.After(100 * time.Millisecond):
+	}
+	stop()
+	// Stopping twice is harmless
+	stop()
+}
+
+func TestSyncFromError(t *testing.T) {
+	dst := tmpDB(t, "")
+	defer nukeDB(dst)
+	errs := make(chan error, 10)
+	dst.OnSyncError(func(err error) {
+		errs <- err
+	})
+	stop := dst.SyncFrom(path.Join(tmpdir(t), "does-not-exist"), "refs/heads/test", 10*time.Millisecond, nil)
+	defer stop()
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no error reported")
+	}
+}
+
+func TestFreeStopsSyncFrom(t *testing.T) {
+	dst := tmpDB(t, "")
+	defer os.RemoveAll(dst.Repo().Path())
+	stop := dst.SyncFrom(path.Join(tmpdir(t), "does-not-exist"), "refs/heads/test", 10*time.Millisecond, nil)
+	time.Sleep(30 * time.Millisecond)
+	dst.Free()
+	done := make(chan struct{})
+	go func() {
+		stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the goroutine should exit when the database is freed")
+	}
+}
+
+func TestSyncBackoff(t *testing.T) {
+	if d := syncBackoff(time.Second, 3); d != 8*time.Second {
+		t.Fatalf("%v", d)
+	}
+	if d := syncBackoff(time.Second, 100); d != MaxSyncBackoff {
+		t.Fatalf("%v", d)
+	}
+}
@@ -0,0 +1,130 @@
+package libpack
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultPruneAge is the age after which unreachable objects are pruned
+// by GC, unless specified otherwise.
+const DefaultPruneAge = 14 * 24 * time.Hour
+
+// GCOpt holds the options of GC.
+type GCOpt struct {
+	// Unreachable objects older than PruneAge are deleted.
+	// If PruneAge is 0, DefaultPruneAge is used. If it is negative,
+	// all unreachable objects are deleted.
+	PruneAge time.Duration
+	// If NoPrune is true, unreachable objects are never deleted.
+	NoPrune bool
+}
+
+// gcRefPrefix is the namespace of the temporary references used to
+// protect uncommitted trees during GC.
+const gcRefPrefix = "refs/libpack/gc/"
+
+// gcCount numbers the calls to GC in this process. Accessed atomically.
+var gcCount uint64
+
+// newGCRefPrefix returns a new prefix for the temporary references of a
+// GC, unique among the processes and goroutines running GC on the same
+// repository, so that they never delete each other's references.
+func newGCRefPrefix() string {
+	return fmt.Sprintf("%s%d-%d/", gcRefPrefix, os.Getpid(), atomic.AddUint64(&gcCount, 1))
+}
+
+// GC packs the loose objects of the database's repository, and deletes
+// unreachable objects older than opt.PruneAge.
+// Objects reachable from any reference, or from the uncommitted tree of
+// any database open on the same repository in the current process, are
+// never deleted. It is safe to call GC while other handles read the
+// repository.
+func (db *DB) GC(opt GCOpt) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("gc", "", &err)
+	repoPath := db.repo.Path()
+	// Protect uncommitted trees with temporary references
+	var protect []string
+	defer func() {
+		for _, name := range protect {
+			if ref, err := db.repo.LookupReference(name); err == nil {
+				ref.Delete()
+				ref.Free()
+			}
+		}
+	}()
+	prefix := newGCRefPrefix()
+	for i, live := range liveDBs(repoPath) {
+		tree, err := live.snapshot()
+		if err != nil {
+			return err
+		}
+		if tree == nil {
+			continue
+		}
+		name := fmt.Sprintf("%s%d", prefix, i)
+		ref, err := db.repo.CreateReference(name, tree.Id(), false, defaultSignature(), "libpack.gc")
+		if err != nil {
+			return err
+		}
+		ref.Free()
+		protect = append(protect, name)
+	}
+	args := []string{"--git-dir", repoPath, "gc", "--quiet"}
+	if opt.NoPrune {
+		args = append(args, "--no-prune")
+	} else {
+		age := opt.PruneAge
+		if age == 0 {
+			age = DefaultPruneAge
+		}
+		if age < 0 {
+			args = append(args, "--prune=now")
+		} else {
+			args = append(args, fmt.Sprintf("--prune=%d.seconds.ago", int64(age/time.Second)))
+		}
+	}
+	stderr := new(bytes.Buffer)
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git gc: %s", stderr.String())
+	}
+	return nil
+}
+
+// LooseObjectCount returns the number of loose (unpacked) objects in the
+// database's repository. It can be used to decide when to call GC.
+func (db *DB) LooseObjectCount() (n int, err error) {
+	if err := db.checkClosed(); err != nil {
+		return 0, err
+	}
+	defer db.wrapError("count-objects", "", &err)
+	objects := path.Join(db.repo.Path(), "objects")
+	dirs, err := ioutil.ReadDir(objects)
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	for _, d := range dirs {
+		// Loose objects are stored in directories named after the
+		// first 2 hex digits of their id.
+		if !d.IsDir() || len(d.Name()) != 2 {
+			continue
+		}
+		files, err := ioutil.ReadDir(path.Join(objects, d.Name()))
+		if err != nil {
+			return 0, err
+		}
+		count += len(files)
+	}
+	return count, nil
+}
@@ -0,0 +1,49 @@
+package libpack
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGC(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("foo", "bar")
+	db.Commit("")
+	db.Set("uncommitted", "value")
+	if n, err := db.LooseObjectCount(); err != nil {
+		t.Fatal(err)
+	} else if n == 0 {
+		t.Fatalf("there should be loose objects")
+	}
+	if err := db.GC(GCOpt{PruneAge: -1}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.LooseObjectCount(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatalf("%d loose objects after gc", n)
+	}
+	assertGet(t, db, "foo", "bar")
+	assertGet(t, db, "uncommitted", "value")
+	if err := db.Commit(""); err != nil {
+		t.Fatal(err)
+	}
+	// The temporary references are deleted
+	refs, err := ListRefs(db.Repo().Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range refs {
+		if strings.HasPrefix(ref, gcRefPrefix) {
+			t.Fatalf("%s was not deleted", ref)
+		}
+	}
+}
+
+func TestGCRefPrefix(t *testing.T) {
+	// Concurrent calls to GC must not share references
+	if a, b := newGCRefPrefix(), newGCRefPrefix(); a == b || !strings.HasPrefix(a, gcRefPrefix) {
+		t.Fatalf("%s %s", a, b)
+	}
+}
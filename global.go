@@ -1,33 +1,196 @@
 package libpack
 
 import (
+	"errors"
 	"fmt"
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	git "github.com/libgit2/git2go"
 )
 
-func getAnnotation(db *DB, name string) (string, error) {
-	return db.Get(MkAnnotation(name))
+// InternalTree is the subtree in which libpack stores its own data,
+// such as annotations. Unless the database is opened with ShowInternal,
+// it is hidden from List, ListEntries, Walk, Dump, Checkout and diffs of
+// the root of the database, but can still be read explicitly. Writing to
+// it with Set fails with ErrReservedPath, unless the database is opened
+// with AllowInternalWrites.
+const InternalTree = "_libpack"
+
+// AnnotationTree is the subtree in which annotations are stored.
+const AnnotationTree = InternalTree + "/annotations"
+
+// ModTimeAnnotation is the name of the annotation recording the
+// modification time of keys, see WithModTime.
+const ModTimeAnnotation = "mtime"
+
+// ErrReservedPath is returned when trying to set a key in InternalTree,
+// or a KeepEntry.
+var ErrReservedPath = errors.New("reserved path")
+
+// ShowInternal makes InternalTree visible when listing, walking or
+// diffing the root of the database, as in earlier versions of libpack.
+func ShowInternal() Option {
+	return func(db *DB) {
+		db.showInternal = true
+	}
+}
+
+// AllowInternalWrites allows keys in InternalTree to be set like any
+// other key. Changing libpack's own data may break annotations.
+func AllowInternalWrites() Option {
+	return func(db *DB) {
+		db.internalWrites = true
+	}
 }
 
-func setAnnotation(db *DB, name, value string) error {
-	return db.Set(MkAnnotation(name), value)
+// hidesInternal returns true if InternalTree must be hidden when
+// reading the subtree at key, relative to the root of the database.
+func (db *DB) hidesInternal(key string) bool {
+	return TreePath(key) == "/" && !db.root().showInternal
 }
 
-func walkAnnotations(db *DB, h func(name, value string)) error {
-	return db.Walk("/", func(k string, obj git.Object) error {
-		blob, isBlob := obj.(*git.Blob)
-		if !isBlob {
+// checkReserved returns ErrReservedPath if key, relative to the scope
+// of db, is in InternalTree and db doesn't allow internal writes.
+func (db *DB) checkReserved(key string) error {
+	if err := db.checkKey(key, true); err != nil {
+		return err
+	}
+	if isInternal(db.fullKey(key)) && !db.root().internalWrites {
+		return ErrReservedPath
+	}
+	return nil
+}
+
+func isInternal(key string) bool {
+	key = TreePath(key)
+	return key == InternalTree || strings.HasPrefix(key, InternalTree+"/") || isKeepEntry(key)
+}
+
+// hideInternal wraps a walk handler so that it is not called for
+// internal entries.
+func hideInternal(h func(string, *git.TreeEntry, git.Object) error) func(string, *git.TreeEntry, git.Object) error {
+	return func(key string, e *git.TreeEntry, obj git.Object) error {
+		if isInternal(key) {
 			return nil
 		}
-		targetPath, err := ParseAnnotation(k)
+		return h(key, e, obj)
+	}
+}
+
+// WithModTime makes Set record the time at which each key is changed,
+// in an annotation stored along with the value. See ModTime.
+func WithModTime() Option {
+	return func(db *DB) {
+		db.modTime = true
+	}
+}
+
+// stageModTime records the current time as the modification time
+// of key. The caller must hold the lock.
+func (db *DB) stageModTime(key string) error {
+	if TreePath(key) == "/" || isInternal(key) {
+		return nil
+	}
+	annot, err := annotationKey(key, ModTimeAnnotation)
+	if err != nil {
+		return err
+	}
+	data, mode, err := db.encodeValue(db.now().UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		return err
+	}
+	id, err := createBlob(db.repo, data)
+	if err != nil {
+		return err
+	}
+	return db.stage(annot, id, mode)
+}
+
+// ModTime returns the time at which key was last changed with Set.
+// Modification times are only recorded by databases opened with
+// WithModTime.
+func (db *DB) ModTime(key string) (time.Time, error) {
+	v, err := db.GetAnnotation(key, ModTimeAnnotation)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, v)
+}
+
+// annotationKey returns the key at which annotation `name` of `target`
+// is stored.
+func annotationKey(target, name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		return "", fmt.Errorf("invalid annotation name: %q", name)
+	}
+	return path.Join(AnnotationTree, MkAnnotation(target), name), nil
+}
+
+// SetAnnotation sets annotation `name` of the key `target` to `value`.
+// Annotations are stored in the same tree as the data, under
+// AnnotationTree, so they are committed, pushed and pulled with it.
+// Targets of a scoped database are relative to its scope.
+func (db *DB) SetAnnotation(target, name, value string) error {
+	if err := db.checkKey(target, false); err != nil {
+		return err
+	}
+	key, err := annotationKey(db.fullKey(target), name)
+	if err != nil {
+		return err
+	}
+	return db.root().setMany(map[string]string{key: value}, "")
+}
+
+// GetAnnotation returns the value of annotation `name` of the key `target`.
+func (db *DB) GetAnnotation(target, name string) (string, error) {
+	if err := db.checkKey(target, false); err != nil {
+		return "", err
+	}
+	key, err := annotationKey(db.fullKey(target), name)
+	if err != nil {
+		return "", err
+	}
+	return db.root().Get(key)
+}
+
+// WalkAnnotations calls h for each annotation of the keys in the
+// database.
+func (db *DB) WalkAnnotations(h func(target, name, value string)) (err error) {
+	defer db.wrapError("walk", "", &err)
+	root := db.root()
+	if _, err := root.Stat(AnnotationTree); err == ErrNotExist {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	scope := TreePath(db.scope)
+	tree, err := root.snapshot()
+	if err != nil {
+		return err
+	}
+	return TreeWalk(root.repo, tree, AnnotationTree, func(k string, obj git.Object) error {
+		if _, isBlob := obj.(*git.Blob); !isBlob {
+			return nil
+		}
+		target, err := ParseAnnotation(path.Dir(k))
+		if err != nil {
+			return err
+		}
+		target = TreePath(target)
+		if scope != "/" {
+			if target != scope && !strings.HasPrefix(target, scope+"/") {
+				return nil
+			}
+			target = TreePath(strings.TrimPrefix(target, scope))
+		}
+		value, err := root.Get(path.Join(AnnotationTree, k))
 		if err != nil {
 			return err
 		}
-		h(targetPath, string(blob.Contents()))
+		h(target, path.Base(k), value)
 		return nil
 	})
 }
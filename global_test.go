@@ -0,0 +1,190 @@
+package libpack
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnnotations(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("foo/bar", "hello")
+	if err := db.SetAnnotation("foo/bar", "owner", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetAnnotation("foo", "owner", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetAnnotation("/", "owner", "root"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetAnnotation("foo", "in/valid", "x"); err == nil {
+		t.Fatalf("annotation names with a slash should be rejected")
+	}
+	if err := db.Commit("annotated"); err != nil {
+		t.Fatal(err)
+	}
+	db2, err := Open(db.Repo().Path(), db.ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Free()
+	if v, err := db2.GetAnnotation("foo/bar", "owner"); err != nil {
+		t.Fatal(err)
+	} else if v != "alice" {
+		t.Fatalf("%#v", v)
+	}
+	var annotations []string
+	if err := db2.WalkAnnotations(func(target, name, value string) {
+		annotations = append(annotations, fmt.Sprintf("%s %s=%s", target, name, value))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(annotations)
+	if s := fmt.Sprint(annotations); s != "[/ owner=root foo owner=bob foo/bar owner=alice]" {
+		t.Fatalf("%v", s)
+	}
+	// Scoped databases see annotations relative to their scope
+	scoped := db2.Scope("foo")
+	if v, err := scoped.GetAnnotation("bar", "owner"); err != nil {
+		t.Fatal(err)
+	} else if v != "alice" {
+		t.Fatalf("%#v", v)
+	}
+	annotations = nil
+	if err := scoped.WalkAnnotations(func(target, name, value string) {
+		annotations = append(annotations, fmt.Sprintf("%s %s=%s", target, name, value))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(annotations)
+	if s := fmt.Sprint(annotations); s != "[/ owner=bob bar owner=alice]" {
+		t.Fatalf("%v", s)
+	}
+}
+
+func TestAnnotationRoundTrip(t *testing.T) {
+	for _, target := range []string{
+		"/",
+		"foo",
+		"foo/bar",
+		"a/b/c/d/e/f/g/h/i/j/k/l",
+		strings.Repeat("deep/", 50) + "key",
+	} {
+		annot := MkAnnotation(target)
+		parsed, err := ParseAnnotation(annot)
+		if err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		if TreePath(parsed) != TreePath(target) {
+			t.Fatalf("%s: %s != %s", annot, parsed, target)
+		}
+	}
+	// The level must match the number of components
+	for _, annot := range []string{"2/foo", "1/foo/bar", "3/a/b", "x/foo"} {
+		if _, err := ParseAnnotation(annot); err == nil {
+			t.Fatalf("%s should not parse", annot)
+		}
+	}
+}
+
+func TestModTime(t *testing.T) {
+	now := time.Date(2014, 1, 2, 3, 4, 5, 6, time.UTC)
+	db, err := Init(tmpdir(t), "refs/heads/test", WithModTime(), WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(db)
+	db.Set("foo/bar", "hello")
+	if mtime, err := db.ModTime("foo/bar"); err != nil {
+		t.Fatal(err)
+	} else if !mtime.Equal(now) {
+		t.Fatalf("%v", mtime)
+	}
+	// Annotations are not visible in the normal key namespace
+	if names, err := db.List("/"); err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(names) != "[foo]" {
+		t.Fatalf("%v", names)
+	}
+	if err := db.Commit("with mtime"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Hour)
+	db.Scope("foo").Set("bar", "world")
+	if mtime, err := db.ModTime("foo/bar"); err != nil {
+		t.Fatal(err)
+	} else if !mtime.Equal(now) {
+		t.Fatalf("%v", mtime)
+	}
+	// Without the option, modification times are not recorded
+	db2, err := Open(db.Repo().Path(), db.ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Free()
+	if mtime, err := db2.ModTime("foo/bar"); err != nil {
+		t.Fatal(err)
+	} else if !mtime.Equal(now.Add(-time.Hour)) {
+		t.Fatalf("%v", mtime)
+	}
+	db2.Set("baz", "hello")
+	if _, err := db2.ModTime("baz"); err == nil {
+		t.Fatalf("mtime should not be recorded")
+	}
+}
+
+func TestHideInternal(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("foo", "bar")
+	if err := db.SetAnnotation("foo", "owner", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set(InternalTree+"/x", "y"); err != ErrReservedPath {
+		t.Fatalf("%v", err)
+	}
+	if err := db.Scope(InternalTree).Set("x", "y"); err != ErrReservedPath {
+		t.Fatalf("%v", err)
+	}
+	if names, err := db.List("/"); err != nil || strings.Join(names, ",") != "foo" {
+		t.Fatalf("%v %v", names, err)
+	}
+	if err := db.Commit("annotated"); err != nil {
+		t.Fatal(err)
+	}
+	head, _ := db.Head()
+	changes, err := db.CommitChanges(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Key != "foo" {
+		t.Fatalf("%v", changes)
+	}
+	dir, err := db.Checkout("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := os.Stat(path.Join(dir, InternalTree)); !os.IsNotExist(err) {
+		t.Fatalf("%v", err)
+	}
+
+	shown, err := Open(db.Repo().Path(), db.ref, ShowInternal(), AllowInternalWrites())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shown.Free()
+	if names, err := shown.List("/"); err != nil || strings.Join(names, ",") != InternalTree+",foo" {
+		t.Fatalf("%v %v", names, err)
+	}
+	if err := shown.Set(InternalTree+"/x", "y"); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, shown, InternalTree+"/x", "y")
+}
@@ -0,0 +1,187 @@
+package libpack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+// A GraphFormat is the output format of ExportGraph.
+type GraphFormat int
+
+const (
+	// A Graphviz digraph, with an edge from each commit to its parents,
+	// and from each reference to the commit it points to.
+	GraphDOT GraphFormat = iota
+	// A JSON object: "commits" lists the commits, most recent first, each
+	// with the ids of its parents, and "refs" maps each reference to the
+	// id of its commit.
+	GraphJSON
+)
+
+// GraphOpt are options for ExportGraphWith.
+type GraphOpt struct {
+	Format GraphFormat
+	// Maximum number of commits, the most recent ones, if not 0
+	MaxCommits int
+	// Only export the commits made since then, if not zero
+	Since time.Time
+}
+
+// graphCommit describes a commit in the JSON output of ExportGraph.
+type graphCommit struct {
+	Id      string    `json:"id"`
+	Short   string    `json:"short"`
+	Subject string    `json:"subject"`
+	When    time.Time `json:"when"`
+	Parents []string  `json:"parents"`
+	Refs    []string  `json:"refs,omitempty"`
+}
+
+type graph struct {
+	Commits []graphCommit     `json:"commits"`
+	Refs    map[string]string `json:"refs"`
+}
+
+// ExportGraph writes the history of refs, in the repository at repoPath,
+// to w in format: each commit reachable from one of refs is labeled with
+// its short id, the first line of its message and its date, and the
+// commits which refs point to are highlighted. If refs is empty, all the
+// references of the repository are exported.
+// The output only depends on the commits and references, so that it can
+// be compared between runs.
+func ExportGraph(repoPath string, refs []string, w io.Writer, format GraphFormat) error {
+	return ExportGraphWith(repoPath, refs, w, GraphOpt{Format: format})
+}
+
+// ExportGraphWith is like ExportGraph, with options to limit the number
+// of commits. Edges to parents which are not exported are left out.
+func ExportGraphWith(repoPath string, refs []string, w io.Writer, opt GraphOpt) error {
+	if opt.Format != GraphDOT && opt.Format != GraphJSON {
+		return fmt.Errorf("unsupported graph format: %d", opt.Format)
+	}
+	r, err := git.OpenRepository(repoPath)
+	if err != nil {
+		return err
+	}
+	defer r.Free()
+	if len(refs) == 0 {
+		if refs, err = ListRefs(repoPath); err != nil {
+			return err
+		}
+	} else {
+		refs = append([]string(nil), refs...)
+	}
+	sort.Strings(refs)
+	g := graph{Refs: make(map[string]string)}
+	var heads []*git.Oid
+	for _, name := range refs {
+		ref, err := r.LookupReference(name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		commit, err := peelCommit(ref)
+		ref.Free()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		g.Refs[name] = commit.Id().String()
+		heads = append(heads, commit.Id())
+		commit.Free()
+	}
+	if len(heads) > 0 {
+		_, err = walkHistoryFrom(r, heads, func(c *git.Commit) error {
+			when := c.Committer().When
+			if !opt.Since.IsZero() && when.Before(opt.Since) {
+				return ErrStopWalk
+			}
+			info := commitInfo(c)
+			g.Commits = append(g.Commits, graphCommit{
+				Id:      info.Id,
+				Short:   info.Id[:7],
+				Subject: strings.SplitN(info.Message, "\n", 2)[0],
+				When:    when.UTC(),
+				Parents: info.Parents,
+			})
+			if opt.MaxCommits > 0 && len(g.Commits) >= opt.MaxCommits {
+				return ErrStopWalk
+			}
+			return nil
+		})
+		if err != nil && err != ErrStopWalk {
+			return err
+		}
+	}
+	g.prune()
+	if opt.Format == GraphJSON {
+		return json.NewEncoder(w).Encode(g)
+	}
+	return g.writeDOT(w)
+}
+
+// prune removes the parents which are not in the graph, and records the
+// references pointing to each commit.
+func (g *graph) prune() {
+	index := make(map[string]int)
+	for i, c := range g.Commits {
+		index[c.Id] = i
+	}
+	for i := range g.Commits {
+		c := &g.Commits[i]
+		parents := []string{}
+		for _, p := range c.Parents {
+			if _, ok := index[p]; ok {
+				parents = append(parents, p)
+			}
+		}
+		c.Parents = parents
+	}
+	var names []string
+	for name := range g.Refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if i, ok := index[g.Refs[name]]; ok {
+			g.Commits[i].Refs = append(g.Commits[i].Refs, name)
+		}
+	}
+	if g.Commits == nil {
+		g.Commits = []graphCommit{}
+	}
+}
+
+func (g *graph) writeDOT(w io.Writer) error {
+	lines := []string{"digraph history {", "\tnode [shape=box];"}
+	for _, c := range g.Commits {
+		attrs := ""
+		if len(c.Refs) > 0 {
+			attrs = ", style=\"bold,filled\", fillcolor=lightblue"
+		}
+		label := fmt.Sprintf("%s\\n%s\\n%s", c.Short, dotEscape(c.Subject), c.When.Format(time.RFC3339))
+		lines = append(lines, fmt.Sprintf("\t\"%s\" [label=\"%s\"%s];", c.Id, label, attrs))
+		for _, p := range c.Parents {
+			lines = append(lines, fmt.Sprintf("\t\"%s\" -> \"%s\";", c.Id, p))
+		}
+	}
+	for _, c := range g.Commits {
+		for _, name := range c.Refs {
+			lines = append(lines,
+				fmt.Sprintf("\t\"%s\" [shape=ellipse, style=filled, fillcolor=gold];", dotEscape(name)),
+				fmt.Sprintf("\t\"%s\" -> \"%s\" [style=dashed];", dotEscape(name), c.Id))
+		}
+	}
+	lines = append(lines, "}", "")
+	_, err := io.WriteString(w, strings.Join(lines, "\n"))
+	return err
+}
+
+// dotEscape escapes s for a quoted Graphviz string.
+func dotEscape(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n", "\r", "").Replace(s)
+}
@@ -0,0 +1,93 @@
+package libpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportGraph(t *testing.T) {
+	staging := tmpDB(t, "refs/heads/staging")
+	defer nukeDB(staging)
+	commitKey(t, staging, "foo", "1")
+	prod, err := staging.Fork("refs/heads/prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitKey(t, staging, "foo", "2")
+	prod.Set("bar", "1")
+	if err := prod.Commit("hotfix \"quoted\"\n\ndetails"); err != nil {
+		t.Fatal(err)
+	}
+	path := staging.Repo().Path()
+	refs := []string{"refs/heads/staging", "refs/heads/prod"}
+	var dot bytes.Buffer
+	if err := ExportGraph(path, refs, &dot, GraphDOT); err != nil {
+		t.Fatal(err)
+	}
+	prodHead, _ := prod.Head()
+	stagingHead, _ := staging.Head()
+	base, _ := prod.Log("", 0)
+	for _, s := range []string{
+		"digraph history {",
+		`"` + prodHead + `" -> "` + base[1].Id + `";`,
+		`"` + stagingHead + `" -> "` + base[1].Id + `";`,
+		`"refs/heads/prod" -> "` + prodHead + `"`,
+		`hotfix \"quoted\"\n`,
+		prodHead[:7] + `\n`,
+	} {
+		if !strings.Contains(dot.String(), s) {
+			t.Fatalf("%q not in:\n%s", s, dot.String())
+		}
+	}
+	if strings.Contains(dot.String(), "details") {
+		t.Fatalf("only the first line of messages should be exported:\n%s", dot.String())
+	}
+	// The output is deterministic, whatever the order of refs
+	var again bytes.Buffer
+	if err := ExportGraph(path, []string{refs[1], refs[0]}, &again, GraphDOT); err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != dot.String() {
+		t.Fatalf("%s\n!=\n%s", again.String(), dot.String())
+	}
+	// JSON adjacency
+	var out bytes.Buffer
+	if err := ExportGraph(path, nil, &out, GraphJSON); err != nil {
+		t.Fatal(err)
+	}
+	var g graph
+	if err := json.Unmarshal(out.Bytes(), &g); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Commits) != 3 || g.Refs["refs/heads/prod"] != prodHead {
+		t.Fatalf("%s", out.String())
+	}
+	for _, c := range g.Commits {
+		if c.Id == base[1].Id && len(c.Parents) != 0 || c.Id == prodHead && (len(c.Refs) != 1 || c.Refs[0] != "refs/heads/prod") {
+			t.Fatalf("%#v", c)
+		}
+	}
+	// Limits
+	out.Reset()
+	if err := ExportGraphWith(path, refs, &out, GraphOpt{Format: GraphJSON, MaxCommits: 2}); err != nil {
+		t.Fatal(err)
+	}
+	g = graph{}
+	json.Unmarshal(out.Bytes(), &g)
+	if len(g.Commits) != 2 || len(g.Commits[0].Parents) != 0 || len(g.Commits[1].Parents) != 0 {
+		t.Fatalf("%s", out.String())
+	}
+	out.Reset()
+	if err := ExportGraphWith(path, refs, &out, GraphOpt{Format: GraphJSON, Since: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"commits":[]`) {
+		t.Fatalf("%s", out.String())
+	}
+	if err := ExportGraph(path, []string{"refs/heads/missing"}, &out, GraphDOT); err == nil {
+		t.Fatalf("a missing reference should fail")
+	}
+}
@@ -0,0 +1,152 @@
+package libpack
+
+import (
+	git "github.com/libgit2/git2go"
+)
+
+// AddCommitHook registers a function to be called by Commit before the
+// database's reference is updated, with the list of changes relative to
+// the parent commit.
+// If a hook returns an error, the commit is aborted, the error is
+// returned, and uncommitted changes are left intact.
+// Hooks are called in the order they were registered. They may be called
+// with the database locked, so they must not call methods of the database.
+func (db *DB) AddCommitHook(f func(pending []Change) error) {
+	if db.parent != nil {
+		db.parent.AddCommitHook(f)
+		return
+	}
+	db.l.Lock()
+	db.commitHooks = append(db.commitHooks, f)
+	db.l.Unlock()
+}
+
+// runCommitHooks calls the registered commit hooks with the changes
+// between parent and tree. The caller must hold the lock.
+func (db *DB) runCommitHooks(parent *git.Commit, tree *git.Tree) error {
+	return db.callCommitHooks(db.commitHooks, parent, tree)
+}
+
+// callCommitHooks calls hooks with the changes between parent and tree.
+func (db *DB) callCommitHooks(hooks []func([]Change) error, parent *git.Commit, tree *git.Tree) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	changes, err := commitDiff(db.repo, parent, tree)
+	if err != nil {
+		return err
+	}
+	db.unescapeChanges(changes)
+	for _, h := range hooks {
+		if err := h(changes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitDiff returns the changes between the tree of commit parent
+// (or an empty tree if parent is nil) and tree.
+func commitDiff(r *git.Repository, parent *git.Commit, tree *git.Tree) ([]Change, error) {
+	var parentTree *git.Tree
+	if parent != nil {
+		t, err := parent.Tree()
+		if err != nil {
+			return nil, err
+		}
+		defer t.Free()
+		parentTree = t
+	}
+	return TreeDiff(r, parentTree, tree)
+}
+
+// AddPostCommitHook registers a function to be called by Commit after
+// the database's reference has been updated, with the id of the new
+// commit and the list of changes it introduced.
+// Hooks are not called if Commit did not create a new commit.
+// A panic in a hook is recovered and logged (see SetLogger), or reported
+// on stderr if the database has no logger, and does not prevent the
+// following hooks from being called.
+func (db *DB) AddPostCommitHook(f func(commitID string, changes []Change)) {
+	if db.parent != nil {
+		db.parent.AddPostCommitHook(f)
+		return
+	}
+	db.l.Lock()
+	db.postHooks = append(db.postHooks, f)
+	db.l.Unlock()
+}
+
+// commitChanges returns the changes introduced by commit, which was just
+// created by Commit. Changes are computed against the last parent of the
+// commit, which is the previous value of the reference (when the commit
+// is a merge, the first parent is the previous commit of the handle
+// instead).
+func (db *DB) commitChanges(commit *git.Commit) ([]Change, error) {
+	var parent *git.Commit
+	if n := commit.ParentCount(); n > 0 {
+		parent = commit.Parent(n - 1)
+		defer parent.Free()
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
+	changes, err := commitDiff(db.repo, parent, tree)
+	if err != nil {
+		return nil, err
+	}
+	db.unescapeChanges(changes)
+	return changes, nil
+}
+
+// unescapeChanges replaces the keys of changes, which are paths in the
+// tree, with the keys they were written at, see WithKeyEscaping.
+func (db *DB) unescapeChanges(changes []Change) {
+	for i := range changes {
+		changes[i].Key = db.unescapeKey(changes[i].Key)
+	}
+}
+
+// runPostCommitHooks calls the registered post-commit hooks for commit,
+// see commitChanges. The caller must own commit: db.commit may be freed
+// by a concurrent Commit or Update once the lock is released, see
+// ownCommit.
+func (db *DB) runPostCommitHooks(commit *git.Commit) {
+	db.l.RLock()
+	hooks := db.postHooks
+	db.l.RUnlock()
+	if len(hooks) == 0 {
+		return
+	}
+	changes, err := db.commitChanges(commit)
+	if err != nil {
+		db.warnf("post-commit hooks: %v", err)
+		return
+	}
+	id := commit.Id().String()
+	for _, h := range hooks {
+		db.runPostCommitHook(h, id, changes)
+	}
+}
+
+func (db *DB) runPostCommitHook(h func(string, []Change), id string, changes []Change) {
+	defer func() {
+		if r := recover(); r != nil {
+			db.warnf("post-commit hook panicked: %v", r)
+		}
+	}()
+	h(id, changes)
+}
+
+// ownCommit returns a new handle on commit, which the caller must free.
+// It is called with the lock held by the functions which return the new
+// head of the database, since db.commit may be freed as soon as the lock
+// is released.
+func (db *DB) ownCommit(commit *git.Commit, err error) (*git.Commit, error) {
+	if err != nil || commit == nil {
+		return commit, err
+	}
+	return lookupCommit(db.repo, commit.Id())
+}
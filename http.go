@@ -0,0 +1,257 @@
+package libpack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// NewHTTPHandler returns a handler exposing the contents of db as a
+// key-value API:
+//
+//	GET    /keys/{key}    returns the value of key
+//	PUT    /keys/{key}    sets the value of key to the request body
+//	DELETE /keys/{key}    deletes key
+//	GET    /keys/{key}/   lists the subtree at key, in JSON
+//	POST   /commit        commits, with the request body as message
+//	GET    /head          returns the id of the latest commit
+//
+// Values are returned with an ETag header, which is the id of their blob.
+// PUT and DELETE honor If-Match and If-None-Match, and fail with
+// 412 Precondition Failed if they don't match.
+// Writing a value over a subtree, or under another value, fails with
+// 409 Conflict.
+// To serve only part of a database, pass a scoped database.
+func NewHTTPHandler(db *DB) http.Handler {
+	return &httpHandler{db: db}
+}
+
+type httpHandler struct {
+	db *DB
+	// Serializes conditional writes
+	l sync.Mutex
+}
+
+// A dirEntry describes an entry of a subtree listed by the HTTP API.
+type dirEntry struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	Size int64  `json:"size"`
+	Id   string `json:"id"`
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/keys/"):
+		h.serveKey(w, r, strings.TrimPrefix(r.URL.Path, "/keys"))
+	case r.URL.Path == "/commit" && r.Method == "POST":
+		h.commit(w, r)
+	case r.URL.Path == "/head" && r.Method == "GET":
+		h.head(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *httpHandler) serveKey(w http.ResponseWriter, r *http.Request, key string) {
+	switch r.Method {
+	case "GET", "HEAD":
+		if strings.HasSuffix(key, "/") {
+			h.list(w, r, key)
+		} else {
+			h.get(w, r, key)
+		}
+	case "PUT":
+		h.put(w, r, key)
+	case "DELETE":
+		h.delete(w, r, key)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *httpHandler) get(w http.ResponseWriter, r *http.Request, key string) {
+	info, err := h.db.Stat(key)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if info.Kind != KindBlob {
+		http.Error(w, fmt.Sprintf("%s is a directory", key), http.StatusConflict)
+		return
+	}
+	value, err := h.db.Get(key)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", etag(info.Id))
+	w.Write([]byte(value))
+}
+
+func (h *httpHandler) list(w http.ResponseWriter, r *http.Request, key string) {
+	if info, err := h.db.Stat(key); err != nil {
+		httpError(w, err)
+		return
+	} else if info.Kind != KindTree {
+		http.Error(w, fmt.Sprintf("%s is not a directory", key), http.StatusConflict)
+		return
+	}
+	entries, err := h.db.ListEntries(key)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	dir := make([]dirEntry, 0, len(entries))
+	for _, e := range entries {
+		dir = append(dir, dirEntry{Name: e.Name, Kind: e.Kind.String(), Size: e.Size, Id: e.Id})
+	}
+	w.Header().Set("Content-Type", JSONContentType)
+	json.NewEncoder(w).Encode(dir)
+}
+
+func (h *httpHandler) put(w http.ResponseWriter, r *http.Request, key string) {
+	value, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.l.Lock()
+	defer h.l.Unlock()
+	info, err := h.db.Stat(key)
+	if err != nil && err != ErrNotExist {
+		httpError(w, err)
+		return
+	}
+	exists := err == nil
+	if exists && info.Kind != KindBlob {
+		http.Error(w, fmt.Sprintf("%s is a directory", key), http.StatusConflict)
+		return
+	}
+	// Refuse to replace a parent value with a subtree
+	for dir := path.Dir(key); dir != "/" && dir != "."; dir = path.Dir(dir) {
+		if info, err := h.db.Stat(dir); err == nil && info.Kind == KindBlob {
+			http.Error(w, fmt.Sprintf("%s is not a directory", dir), http.StatusConflict)
+			return
+		}
+	}
+	if !checkPreconditions(w, r, exists, info.Id) {
+		return
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "application/octet-stream" {
+		contentType = ""
+	}
+	if err := h.db.SetTyped(key, string(value), contentType); err != nil {
+		httpError(w, err)
+		return
+	}
+	if info, err := h.db.Stat(key); err == nil {
+		w.Header().Set("ETag", etag(info.Id))
+	}
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (h *httpHandler) delete(w http.ResponseWriter, r *http.Request, key string) {
+	h.l.Lock()
+	defer h.l.Unlock()
+	info, err := h.db.Stat(key)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if !checkPreconditions(w, r, true, info.Id) {
+		return
+	}
+	if err := h.db.Delete(key); err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *httpHandler) commit(w http.ResponseWriter, r *http.Request) {
+	msg, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.db.Commit(string(msg)); err != nil {
+		httpError(w, err)
+		return
+	}
+	h.head(w, r)
+}
+
+func (h *httpHandler) head(w http.ResponseWriter, r *http.Request) {
+	head, err := h.db.Head()
+	if err == ErrNoCommits {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		httpError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, head)
+}
+
+// checkPreconditions checks the If-Match and If-None-Match headers of r
+// against the current state of a key. If they don't match, it replies
+// with 412 Precondition Failed and returns false.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, exists bool, id string) bool {
+	if match := r.Header.Get("If-Match"); match != "" {
+		if !exists || !etagMatch(match, id) {
+			http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+			return false
+		}
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if exists && etagMatch(match, id) {
+			http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+			return false
+		}
+	}
+	return true
+}
+
+func etag(id string) string {
+	return `"` + id + `"`
+}
+
+// etagMatch returns true if the value of an If-Match or If-None-Match
+// header matches the ETag of blob id.
+func etagMatch(header, id string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag(id) {
+			return true
+		}
+	}
+	return false
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	switch {
+	case isNotExist(err):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err == ErrReadOnly:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
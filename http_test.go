@@ -0,0 +1,130 @@
+package libpack
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func httpDo(t *testing.T, h http.Handler, method, url, body string, header map[string]string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func assertStatus(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	if w.Code != status {
+		t.Fatalf("status %d instead of %d: %s", w.Code, status, w.Body.String())
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	h := NewHTTPHandler(db)
+
+	assertStatus(t, httpDo(t, h, "GET", "/keys/foo/bar", "", nil), http.StatusNotFound)
+	assertStatus(t, httpDo(t, h, "GET", "/head", "", nil), http.StatusNotFound)
+	binary := "\x00\xff\x01binary"
+	w := httpDo(t, h, "PUT", "/keys/foo/bar", binary, nil)
+	assertStatus(t, w, http.StatusCreated)
+	tag := w.Header().Get("ETag")
+	assertGet(t, db, "foo/bar", binary)
+
+	w = httpDo(t, h, "GET", "/keys/foo/bar", "", nil)
+	assertStatus(t, w, http.StatusOK)
+	if w.Body.String() != binary {
+		t.Fatalf("%q", w.Body.String())
+	}
+	if w.Header().Get("ETag") != tag {
+		t.Fatalf("%v != %v", w.Header().Get("ETag"), tag)
+	}
+
+	// Conditional writes
+	assertStatus(t, httpDo(t, h, "PUT", "/keys/foo/bar", "new", map[string]string{"If-None-Match": "*"}), http.StatusPreconditionFailed)
+	assertStatus(t, httpDo(t, h, "PUT", "/keys/foo/bar", "new", map[string]string{"If-Match": `"0000"`}), http.StatusPreconditionFailed)
+	assertStatus(t, httpDo(t, h, "PUT", "/keys/foo/bar", "new", map[string]string{"If-Match": tag}), http.StatusNoContent)
+	assertGet(t, db, "foo/bar", "new")
+	assertStatus(t, httpDo(t, h, "DELETE", "/keys/foo/bar", "", map[string]string{"If-Match": tag}), http.StatusPreconditionFailed)
+
+	// Conflicts
+	assertStatus(t, httpDo(t, h, "PUT", "/keys/foo", "value", nil), http.StatusConflict)
+	assertStatus(t, httpDo(t, h, "PUT", "/keys/foo/bar/baz", "value", nil), http.StatusConflict)
+
+	// Listing
+	httpDo(t, h, "PUT", "/keys/foo/json", `{"a":1}`, map[string]string{"Content-Type": JSONContentType})
+	w = httpDo(t, h, "GET", "/keys/foo/", "", nil)
+	assertStatus(t, w, http.StatusOK)
+	var entries []dirEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name != "bar" || entries[0].Kind != "blob" || entries[1].Name != "json" {
+		t.Fatalf("%#v", entries)
+	}
+	if ct := httpDo(t, h, "GET", "/keys/foo/json", "", nil).Header().Get("Content-Type"); ct != JSONContentType {
+		t.Fatalf("%v", ct)
+	}
+
+	// Commit and head
+	w = httpDo(t, h, "POST", "/commit", "from http", nil)
+	assertStatus(t, w, http.StatusOK)
+	head, err := db.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(w.Body.String()) != head {
+		t.Fatalf("%v != %v", w.Body.String(), head)
+	}
+	w = httpDo(t, h, "GET", "/head", "", nil)
+	if strings.TrimSpace(w.Body.String()) != head {
+		t.Fatalf("%v != %v", w.Body.String(), head)
+	}
+
+	assertStatus(t, httpDo(t, h, "DELETE", "/keys/foo/bar", "", nil), http.StatusNoContent)
+	assertNotExist(t, db, "foo/bar")
+	assertStatus(t, httpDo(t, h, "DELETE", "/keys/foo/bar", "", nil), http.StatusNotFound)
+}
+
+func TestHTTPHandlerScope(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("public/foo", "hello")
+	db.Set("private/key", "secret")
+	srv := httptest.NewServer(NewHTTPHandler(db.Scope("public")))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/keys/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Fatalf("%v %q", resp.Status, body)
+	}
+	resp, err = http.Get(srv.URL + "/keys/private/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("%v", resp.Status)
+	}
+	req, _ := http.NewRequest("PUT", srv.URL+"/keys/bar", strings.NewReader("world"))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assertGet(t, db, "public/bar", "world")
+}
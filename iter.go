@@ -0,0 +1,112 @@
+package libpack
+
+import (
+	"path"
+
+	git "github.com/libgit2/git2go"
+)
+
+// Keys returns an iterator over the keys and values of the subtree at
+// prefix, which can be used in a range loop:
+//
+//	var err error
+//	for key, value := range db.Keys("users", &err) {
+//		...
+//	}
+//	if err != nil {
+//		...
+//	}
+//
+// Keys are relative to the scope of db, and are produced in the order of
+// WalkKeys. Values are read from the tree as the loop goes, and the loop
+// can be stopped at any time.
+// The iterator reads the uncommitted tree as it was when Keys was
+// called: changes made afterwards are not visible, so no key is skipped
+// or produced twice.
+// If errp is not nil, it is set when the iteration ends to the error
+// which ended it, or to nil. If there is no subtree at prefix, there are
+// no keys and no error.
+func (db *DB) Keys(prefix string, errp *error) func(yield func(key, value string) bool) {
+	return db.keys(prefix, errp)
+}
+
+// KeysBytes is like Keys, with values as byte slices.
+func (db *DB) KeysBytes(prefix string, errp *error) func(yield func(key string, value []byte) bool) {
+	seq := db.keys(prefix, errp)
+	return func(yield func(string, []byte) bool) {
+		seq(func(key, value string) bool {
+			return yield(key, []byte(value))
+		})
+	}
+}
+
+func (db *DB) keys(prefix string, errp *error) func(yield func(string, string) bool) {
+	var id *git.Oid
+	err := db.checkClosed()
+	if err == nil {
+		var tree *git.Tree
+		if tree, err = db.snapshot(); err == nil && tree != nil {
+			id = tree.Id()
+		}
+	}
+	setErr := func(e error) {
+		if errp != nil {
+			*errp = e
+		}
+	}
+	return func(yield func(string, string) bool) {
+		setErr(err)
+		if err != nil || id == nil {
+			return
+		}
+		setErr(db.iterTree(id, prefix, yield))
+	}
+}
+
+// iterTree calls yield for each blob of the subtree at prefix of the
+// tree id, until it returns false.
+func (db *DB) iterTree(id *git.Oid, prefix string, yield func(string, string) bool) error {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	tree, err := lookupTree(db.repo, id)
+	if err != nil {
+		return err
+	}
+	defer tree.Free()
+	full := db.fullKey(prefix)
+	subtree, err := TreeScope(db.repo, tree, full)
+	if err != nil {
+		if git.IsErrorCode(err, git.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	defer subtree.Free()
+	base := TreePath(prefix)
+	decode := db.root().decodeValue
+	err = db.walkSortedTree(subtree, "", db.hidesInternal(full), func(key string, e *git.TreeEntry) error {
+		if e.Type != git.ObjectBlob {
+			return nil
+		}
+		data, err := blobContents(db.repo, e.Id)
+		if err != nil {
+			return err
+		}
+		value, err := decode(data, e.Filemode)
+		if err != nil {
+			return err
+		}
+		if base != "/" {
+			key = path.Join(base, key)
+		}
+		if !yield(key, value) {
+			return ErrStopWalk
+		}
+		return nil
+	})
+	if err == ErrStopWalk {
+		return nil
+	}
+	return err
+}
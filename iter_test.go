@@ -0,0 +1,63 @@
+package libpack
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestKeys(t *testing.T) {
+	db := tmpDB(t, "")
+	dir := db.Repo().Path()
+	defer os.RemoveAll(dir)
+	db.Set("users/bob", "2")
+	db.Set("users/alice", "1")
+	db.Set("users/carol/admin", "true")
+	db.Set("groups/admin", "carol")
+	var (
+		err  error
+		keys []string
+	)
+	seq := db.Keys("users", &err)
+	// Changes made after Keys are not visible
+	db.Set("users/aaron", "0")
+	db.Delete("users/bob")
+	for key, value := range seq {
+		keys = append(keys, key+"="+value)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"users/alice=1", "users/bob=2", "users/carol/admin=true"}) {
+		t.Fatalf("%#v", keys)
+	}
+	// Early break
+	keys = nil
+	for key, value := range db.KeysBytes("/", &err) {
+		keys = append(keys, key+"="+string(value))
+		if len(keys) == 2 {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"groups/admin=carol", "users/aaron=0"}) {
+		t.Fatalf("%#v", keys)
+	}
+	for key := range db.Keys("nope", &err) {
+		t.Fatalf("%s", key)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Errors are reported through errp
+	seq = db.Keys("/", &err)
+	db.Close()
+	for key := range seq {
+		t.Fatalf("%s", key)
+	}
+	if err != ErrClosed {
+		t.Fatalf("%v", err)
+	}
+}
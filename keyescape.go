@@ -0,0 +1,162 @@
+package libpack
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// WithKeyEscaping makes the database escape each component of the keys
+// it is given, so that arbitrary strings can be used as key components:
+// control characters, invalid UTF-8, '%', '\' and a leading '.' are
+// percent-encoded before being written in the tree, and decoded by List,
+// ListEntries, Walk, Dump and the other methods which return keys.
+// Names such as ".git" or ".." are therefore stored as "%2Egit" and
+// "%2E.", and checked out as such.
+//
+// Slashes still separate components: use JoinKey and SplitKey for
+// components which contain slashes. Backslashes don't.
+//
+// Names found in the tree which were not written with escaping are
+// returned as they are if they do not decode to themselves, but they
+// can't be read back: writing with and without escaping in the same tree
+// doesn't corrupt either, but only keys written the same way are shared.
+func WithKeyEscaping() Option {
+	return func(db *DB) {
+		db.escapeKeys = true
+	}
+}
+
+// escapeKey returns key, relative to the scope of db, as it is stored in
+// the tree of db: escaped, and folded to lower case if db is
+// case-insensitive.
+func (db *DB) escapeKey(key string) string {
+	root := db.root()
+	if root.caseInsensitive {
+		key = foldKey(key)
+	}
+	if !root.escapeKeys {
+		// Backslashes separate components, as on Windows
+		return strings.Replace(key, "\\", "/", -1)
+	}
+	if key == "" || key == "." {
+		return key
+	}
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = escapeComponent(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+// unescapeKey is the reverse of escapeKey.
+func (db *DB) unescapeKey(key string) string {
+	if !db.root().escapeKeys {
+		return key
+	}
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = unescapeComponent(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+// fullKey returns key, relative to the scope of db, as a path in the tree
+// of the root database.
+func (db *DB) fullKey(key string) string {
+	return path.Join(db.scope, db.escapeKey(key))
+}
+
+func escapeComponent(name string) string {
+	var buf []byte
+	for i := 0; i < len(name); {
+		c := name[i]
+		size := 1
+		if c >= utf8.RuneSelf {
+			if r, n := utf8.DecodeRuneInString(name[i:]); r != utf8.RuneError || n > 1 {
+				size = n
+			}
+		}
+		if shouldEscape(c, size, i) {
+			if buf == nil {
+				buf = append(buf, name[:i]...)
+			}
+			buf = append(buf, fmt.Sprintf("%%%02X", c)...)
+		} else if buf != nil {
+			buf = append(buf, name[i:i+size]...)
+		}
+		i += size
+	}
+	if buf == nil {
+		return name
+	}
+	return string(buf)
+}
+
+func shouldEscape(c byte, size, pos int) bool {
+	switch {
+	case c >= utf8.RuneSelf:
+		// Invalid UTF-8
+		return size == 1
+	case c < 0x20, c == 0x7f, c == '%', c == '\\':
+		return true
+	case c == '.':
+		return pos == 0
+	}
+	return false
+}
+
+// unescapeComponent decodes a name encoded by escapeComponent. Names
+// which escapeComponent could not have returned are left unchanged.
+func unescapeComponent(name string) string {
+	if strings.IndexByte(name, '%') < 0 {
+		return name
+	}
+	buf := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		if name[i] == '%' && i+2 < len(name) && isHex(name[i+1]) && isHex(name[i+2]) {
+			buf = append(buf, unhex(name[i+1])<<4|unhex(name[i+2]))
+			i += 2
+			continue
+		}
+		buf = append(buf, name[i])
+	}
+	if decoded := string(buf); escapeComponent(decoded) == name {
+		return decoded
+	}
+	return name
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	if c <= '9' {
+		return c - '0'
+	}
+	return c - 'A' + 10
+}
+
+// JoinKey returns a key made of components, in which slashes do not
+// separate components: they are encoded, along with '%', as "%2F" and
+// "%25". SplitKey returns the original components.
+func JoinKey(components ...string) string {
+	parts := make([]string, len(components))
+	for i, c := range components {
+		c = strings.Replace(c, "%", "%25", -1)
+		parts[i] = strings.Replace(c, "/", "%2F", -1)
+	}
+	return strings.Join(parts, "/")
+}
+
+// SplitKey splits a key returned by JoinKey into its components.
+func SplitKey(key string) []string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		p = strings.Replace(p, "%2F", "/", -1)
+		parts[i] = strings.Replace(p, "%25", "%", -1)
+	}
+	return parts
+}
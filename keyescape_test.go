@@ -0,0 +1,222 @@
+package libpack
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	git "github.com/libgit2/git2go"
+)
+
+func TestEscapeComponent(t *testing.T) {
+	for name, escaped := range map[string]string{
+		"foo":      "foo",
+		".git":     "%2Egit",
+		"..":       "%2E.",
+		"a.b":      "a.b",
+		"50%":      "50%25",
+		"a\\b":     "a%5Cb",
+		"a\x00b\n": "a%00b%0A",
+		"h\xe9llo": "h%E9llo",
+		"héllo":    "héllo",
+		"%2E":      "%252E",
+	} {
+		if e := escapeComponent(name); e != escaped {
+			t.Fatalf("%q: %q != %q", name, e, escaped)
+		}
+		if u := unescapeComponent(escaped); u != name {
+			t.Fatalf("%q: %q != %q", escaped, u, name)
+		}
+	}
+	// Names which were not escaped are left unchanged
+	for _, name := range []string{"a%41", "100%", "%2e", "%zz"} {
+		if u := unescapeComponent(name); u != name {
+			t.Fatalf("%q: %q", name, u)
+		}
+	}
+}
+
+func TestJoinKey(t *testing.T) {
+	key := JoinKey("a/b", "%2F", "c")
+	if key != "a%2Fb/%252F/c" {
+		t.Fatalf("%q", key)
+	}
+	if parts := SplitKey(key); !reflect.DeepEqual(parts, []string{"a/b", "%2F", "c"}) {
+		t.Fatalf("%#v", parts)
+	}
+}
+
+func TestKeyEscaping(t *testing.T) {
+	db, err := Init(tmpdir(t), "refs/heads/test", WithKeyEscaping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(db)
+	kv := map[string]string{
+		".git/config":     "a",
+		"..":              "b",
+		"50%/x":           "c",
+		"nul\x00/\x01":    "d",
+		JoinKey("a/b"):    "e",
+		"plain/key":       "f",
+		"dir/.hidden/key": "g",
+	}
+	if err := db.SetMany(kv); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range kv {
+		assertGet(t, db, k, v)
+	}
+	assertGet(t, db.Scope(".git"), "config", "a")
+	if p := db.Scope(".git").Path(); p != "/.git" {
+		t.Fatalf("%q", p)
+	}
+	names, err := db.List("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"..", ".git", "50%", "a%2Fb", "dir", "nul\x00", "plain"}) {
+		t.Fatalf("%#v", names)
+	}
+	walked := make(map[string]bool)
+	err = db.Walk("/", func(key string, obj git.Object) error {
+		if _, ok := obj.(*git.Blob); ok {
+			walked[key] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range kv {
+		if !walked[k] {
+			t.Fatalf("%q not walked: %v", k, walked)
+		}
+	}
+	var dump bytes.Buffer
+	if err := db.Dump(&dump); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dump.String(), ".git/config") {
+		t.Fatalf("%s", dump.String())
+	}
+	// Keys are stored escaped in the tree
+	tree, err := db.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"%2Egit/config", "%2E.", "50%25/x", "nul%00/%01", "a%252Fb"} {
+		if _, err := lookupEntry(tree, k); err != nil {
+			t.Fatalf("%s: %v", k, err)
+		}
+	}
+	keys, err := db.DeletePrefix(".git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{".git/config"}) {
+		t.Fatalf("%#v", keys)
+	}
+}
+
+func TestKeyEscapingMixed(t *testing.T) {
+	db, err := Init(tmpdir(t), "refs/heads/test", WithKeyEscaping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(db)
+	db.Set(".git/config", "escaped")
+	db.Commit("")
+
+	raw, err := Open(db.Repo().Path(), "refs/heads/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Free()
+	assertGet(t, raw, "%2Egit/config", "escaped")
+	raw.Set("a%41", "raw")
+	raw.Set(".hidden", "raw")
+	raw.Set("100%", "raw")
+	raw.Commit("")
+
+	if err := db.Update(); err != nil {
+		t.Fatal(err)
+	}
+	names, err := db.List("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{".git", ".hidden", "100%", "a%41"}) {
+		t.Fatalf("%#v", names)
+	}
+	assertGet(t, db, ".git/config", "escaped")
+	assertNotExist(t, db, ".hidden")
+	// Writing through one database doesn't change the keys of the other
+	db.Set("a%41", "escaped")
+	assertGet(t, db, "a%41", "escaped")
+	db.Commit("")
+	if err := raw.Update(); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, raw, "a%41", "raw")
+	assertGet(t, raw, "a%2541", "escaped")
+}
+
+func TestKeyEscapingChanges(t *testing.T) {
+	db, err := Init(tmpdir(t), "refs/heads/test", WithKeyEscaping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(db)
+	db.Set("first", "x")
+	db.Commit("")
+	first, _ := db.Head()
+	var validated, hooked, posted []string
+	db.AddValidator("/", func(key string, value []byte) error {
+		validated = append(validated, key)
+		return nil
+	})
+	db.AddCommitHook(func(pending []Change) error {
+		for _, c := range pending {
+			hooked = append(hooked, c.Key)
+		}
+		return nil
+	})
+	db.AddPostCommitHook(func(id string, changes []Change) {
+		for _, c := range changes {
+			posted = append(posted, c.Key)
+		}
+	})
+	scope := db.Scope("50%")
+	if err := scope.Set(".git", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Commit(""); err != nil {
+		t.Fatal(err)
+	}
+	for _, keys := range [][]string{validated, hooked, posted} {
+		if !reflect.DeepEqual(keys, []string{"50%/.git"}) {
+			t.Fatalf("%#v", keys)
+		}
+	}
+	head, _ := db.Head()
+	changes, err := scope.CommitChanges(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Key != ".git" {
+		t.Fatalf("%v", changes)
+	}
+	var buf bytes.Buffer
+	if err := scope.DiffPatch(first, head, &buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := "diff --git a/.git b/.git\nnew file mode 100644\n--- /dev/null\n+++ b/.git\n@@ -0,0 +1 @@\n+a\n\\ No newline at end of file\n"
+	if buf.String() != expected {
+		t.Fatalf("%q", buf.String())
+	}
+}
@@ -0,0 +1,41 @@
+package libpack
+
+import (
+	"fmt"
+	"strings"
+)
+
+// An InvalidKeyError is returned when a key can't be used: because one
+// of its components is "..", or contains a NUL byte, or because it
+// names the root of the database where a value is expected.
+//
+// Keys are otherwise normalized: backslashes separate components like
+// slashes, unless the database escapes keys (see WithKeyEscaping), and
+// repeated or trailing slashes are ignored.
+type InvalidKeyError struct {
+	Key    string
+	Reason string
+}
+
+func (e *InvalidKeyError) Error() string {
+	return fmt.Sprintf("invalid key %q: %s", e.Key, e.Reason)
+}
+
+// checkKey returns an *InvalidKeyError if key, relative to the scope of
+// db, can't be used. If value is set, key must name a value, so an empty
+// key is rejected, even in a scoped database.
+func (db *DB) checkKey(key string, value bool) error {
+	escaped := db.escapeKey(key)
+	if strings.Contains(escaped, "\x00") {
+		return &InvalidKeyError{key, "contains a NUL byte"}
+	}
+	for _, c := range strings.Split(escaped, "/") {
+		if c == ".." {
+			return &InvalidKeyError{key, "contains '..'"}
+		}
+	}
+	if value && TreePath(escaped) == "/" {
+		return &InvalidKeyError{key, "empty key"}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package libpack
+
+import (
+	"testing"
+
+	git "github.com/libgit2/git2go"
+)
+
+// keyPathTests are the inputs given to each entry point, and the
+// normalized key they should be stored at, or "" if they are invalid.
+var keyPathTests = []struct {
+	input string
+	key   string
+}{
+	{"a/b", "a/b"},
+	{"/a/b", "a/b"},
+	{"a//b", "a/b"},
+	{"a///b//", "a/b"},
+	{"a/b/", "a/b"},
+	{"a\\b", "a/b"},
+	{"\\a\\\\b\\", "a/b"},
+	{"a/./b", "a/b"},
+	{"./a/b", "a/b"},
+	{"a/../b", ""},
+	{"..\\a", ""},
+	{"a/b/..", ""},
+	{"a\x00b", ""},
+}
+
+func assertInvalidKey(t *testing.T, input string, err error) {
+	if _, ok := err.(*InvalidKeyError); !ok {
+		t.Fatalf("%q: %v", input, err)
+	}
+}
+
+func TestKeyPath(t *testing.T) {
+	for _, tt := range keyPathTests {
+		db := tmpDB(t, "")
+		err := db.Set(tt.input, "value")
+		if tt.key == "" {
+			assertInvalidKey(t, tt.input, err)
+			_, err = db.Get(tt.input)
+			assertInvalidKey(t, tt.input, err)
+			assertInvalidKey(t, tt.input, db.Mkdir(tt.input))
+			assertInvalidKey(t, tt.input, db.Walk(tt.input, func(string, git.Object) error { return nil }))
+			assertInvalidKey(t, tt.input, db.SetAnnotation(tt.input, "note", "x"))
+			_, err = db.GetAnnotation(tt.input, "note")
+			assertInvalidKey(t, tt.input, err)
+			nukeDB(db)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", tt.input, err)
+		}
+		assertGet(t, db, tt.key, "value")
+		assertGet(t, db, tt.input, "value")
+		if names, err := db.List("a"); err != nil || len(names) != 1 || names[0] != "b" {
+			t.Fatalf("%q: %v %v", tt.input, names, err)
+		}
+		// Scope
+		assertGet(t, db.Scope(tt.input), "/", "value")
+		// Annotations
+		if err := db.SetAnnotation(tt.input, "note", "x"); err != nil {
+			t.Fatalf("%q: %v", tt.input, err)
+		}
+		if v, err := db.GetAnnotation(tt.key, "note"); err != nil || v != "x" {
+			t.Fatalf("%q: %v %v", tt.input, v, err)
+		}
+		// Mkdir replaces the value with a directory
+		if err := db.Mkdir(tt.input); err != nil {
+			t.Fatalf("%q: %v", tt.input, err)
+		}
+		if info, err := db.Stat(tt.key); err != nil || info.Kind != KindTree {
+			t.Fatalf("%q: %#v %v", tt.input, info, err)
+		}
+		// Walk
+		db.Set(tt.key+"/c", "value")
+		var walked []string
+		err = db.Walk(tt.input, func(key string, obj git.Object) error {
+			walked = append(walked, key)
+			return nil
+		})
+		if err != nil || len(walked) != 1 || walked[0] != "c" {
+			t.Fatalf("%q: %v %v", tt.input, walked, err)
+		}
+		nukeDB(db)
+	}
+}
+
+func TestKeyPathEmpty(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	for _, key := range []string{"", "/", "//", ".", "\\"} {
+		assertInvalidKey(t, key, db.Set(key, "value"))
+		assertInvalidKey(t, key, db.Scope("a").Set("../"+key, "value"))
+	}
+	// The root can still be listed, walked and annotated
+	if err := db.Mkdir("/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetAnnotation("/", "note", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetAnnotation("foo", "a\\b", "x"); err == nil {
+		t.Fatalf("annotation names can't contain separators")
+	}
+}
+
+func TestKeyPathEscaped(t *testing.T) {
+	db, err := Init(tmpdir(t), "refs/heads/test", WithKeyEscaping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(db)
+	// Backslashes and ".." are plain components
+	if err := db.Set("a\\b/..", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := db.List("/"); err != nil || len(names) != 1 || names[0] != "a\\b" {
+		t.Fatalf("%#v %v", names, err)
+	}
+	assertGet(t, db.Scope("a\\b"), "..", "value")
+}
@@ -0,0 +1,100 @@
+package libpack
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Limits are the maximum sizes of the keys and values written in a
+// database, see WithLimits. A zero field means no limit.
+type Limits struct {
+	// Maximum size of a value, in bytes
+	MaxValueBytes int64
+	// Maximum length of a key, relative to the root of the database
+	MaxKeyLength int
+	// Maximum number of components of a key, relative to the root of
+	// the database
+	MaxKeyDepth int
+}
+
+// WithLimits makes the database refuse to write keys or values larger
+// than l. Internal keys, such as annotations, are not limited.
+// The default is no limits.
+func WithLimits(l Limits) Option {
+	return func(db *DB) {
+		db.limits = l
+	}
+}
+
+// A ValueTooLargeError is returned when writing a value larger than
+// Limits.MaxValueBytes.
+type ValueTooLargeError struct {
+	Key string
+	Max int64
+}
+
+func (e *ValueTooLargeError) Error() string {
+	return fmt.Sprintf("%s: value larger than %d bytes", e.Key, e.Max)
+}
+
+// A KeyTooLongError is returned when writing a key longer than
+// Limits.MaxKeyLength.
+type KeyTooLongError struct {
+	Key string
+	Max int
+}
+
+func (e *KeyTooLongError) Error() string {
+	return fmt.Sprintf("%s: key longer than %d bytes", e.Key, e.Max)
+}
+
+// A KeyTooDeepError is returned when writing a key with more than
+// Limits.MaxKeyDepth components.
+type KeyTooDeepError struct {
+	Key string
+	Max int
+}
+
+func (e *KeyTooDeepError) Error() string {
+	return fmt.Sprintf("%s: key deeper than %d levels", e.Key, e.Max)
+}
+
+// checkKeyLimits checks key, relative to the root of the database,
+// against the limits of db.
+func (db *DB) checkKeyLimits(key string) error {
+	l := db.root().limits
+	key = TreePath(key)
+	if isInternal(key) {
+		return nil
+	}
+	if l.MaxKeyLength > 0 && len(key) > l.MaxKeyLength {
+		return &KeyTooLongError{Key: key, Max: l.MaxKeyLength}
+	}
+	if l.MaxKeyDepth > 0 && strings.Count(key, "/")+1 > l.MaxKeyDepth {
+		return &KeyTooDeepError{Key: key, Max: l.MaxKeyDepth}
+	}
+	return nil
+}
+
+// checkLimits checks key, relative to the root of the database, and the
+// size of its value against the limits of db.
+func (db *DB) checkLimits(key string, size int64) error {
+	if err := db.checkKeyLimits(key); err != nil {
+		return err
+	}
+	l := db.root().limits
+	if l.MaxValueBytes > 0 && size > l.MaxValueBytes && !isInternal(key) {
+		return &ValueTooLargeError{Key: TreePath(key), Max: l.MaxValueBytes}
+	}
+	return nil
+}
+
+// isLimitError returns true if err was returned because of the limits
+// of a database.
+func isLimitError(err error) bool {
+	switch err.(type) {
+	case *ValueTooLargeError, *KeyTooLongError, *KeyTooDeepError:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package libpack
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	db, err := Init(tmpdir(t), "refs/heads/test", WithLimits(Limits{MaxValueBytes: 8, MaxKeyLength: 12, MaxKeyDepth: 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(db)
+	if err := db.Set("a/b/c", "12345678"); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := db.Set("foo", "123456789").(*ValueTooLargeError); !ok || err.Key != "foo" {
+		t.Fatalf("%v", err)
+	}
+	if err, ok := db.Set("a/b/c/d", "1").(*KeyTooDeepError); !ok || err.Max != 3 {
+		t.Fatalf("%v", err)
+	}
+	// Keys are relative to the root of the database
+	if err, ok := db.Scope("a/b").Set("c/d", "1").(*KeyTooDeepError); !ok || err.Key != "a/b/c/d" {
+		t.Fatalf("%v", err)
+	}
+	if _, ok := db.Set("abcdefghijklm", "1").(*KeyTooLongError); !ok {
+		t.Fatalf("key should be too long")
+	}
+	if _, ok := db.Mkdir("a/b/c/d").(*KeyTooDeepError); !ok {
+		t.Fatalf("key should be too deep")
+	}
+	if _, ok := db.Append("a/b/c", "9").(*ValueTooLargeError); !ok {
+		t.Fatalf("value should be too large")
+	}
+	assertGet(t, db, "a/b/c", "12345678")
+	// Annotations are not limited
+	if err := db.SetTyped("a/b/c", "1", "application/x-very-long-content-type"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// endlessReader returns an infinite stream of bytes, and counts them.
+type endlessReader struct {
+	n int64
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	r.n += int64(len(p))
+	return len(p), nil
+}
+
+func TestLimitsStream(t *testing.T) {
+	db, err := Init(tmpdir(t), "refs/heads/test", WithLimits(Limits{MaxValueBytes: 1024}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(db)
+	if err := db.SetStream("small", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	src := &endlessReader{}
+	if _, ok := db.SetStream("large", src).(*ValueTooLargeError); !ok {
+		t.Fatalf("value should be too large")
+	}
+	if src.n > 64*1024 {
+		t.Fatalf("read %d bytes", src.n)
+	}
+	if _, ok := db.SetStream("large", io.LimitReader(src, 1025)).(*ValueTooLargeError); !ok {
+		t.Fatalf("value should be too large")
+	}
+	if err := db.SetStream("large", io.LimitReader(src, 1024)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoLimits(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	key := strings.Repeat("a/", 100) + "b"
+	if err := db.Set(key, strings.Repeat("x", 1<<20)); err != nil {
+		t.Fatal(err)
+	}
+}
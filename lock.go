@@ -0,0 +1,58 @@
+package libpack
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrLockTimeout is returned by Commit when the repository lock
+// could not be acquired before the timeout set with WithLocking.
+var ErrLockTimeout = errors.New("timeout waiting for repository lock")
+
+// lockFileName is the name of the lock file created in the repository
+// directory by databases opened with WithLocking.
+const lockFileName = "libpack.lock"
+
+// lockPollInterval is how often a held lock is checked.
+const lockPollInterval = 10 * time.Millisecond
+
+// WithLocking makes Commit take an advisory lock on the repository while
+// it reads and updates the database's reference, so that commits from
+// several processes are serialized.
+// The lock is a file created in the repository directory. If it can't be
+// acquired within `timeout`, Commit returns ErrLockTimeout. A timeout of
+// 0 means wait forever.
+// Only processes using WithLocking honor the lock. If a process dies while
+// holding it, the lock file must be removed by hand.
+func WithLocking(timeout time.Duration) Option {
+	return func(db *DB) {
+		db.locking = true
+		db.lockTimeout = timeout
+	}
+}
+
+// lockRepo acquires the lock file of the repository at dir, and returns
+// a function which releases it.
+func lockRepo(dir string, timeout time.Duration) (unlock func(), err error) {
+	lockPath := filepath.Join(dir, lockFileName)
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return nil, ErrLockTimeout
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
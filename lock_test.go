@@ -0,0 +1,70 @@
+package libpack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockingNoLostCommits(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		h, err := Open(db.Repo().Path(), db.ref, WithLocking(10*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Free()
+		wg.Add(1)
+		go func(i int, h *DB) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				if err := h.Set(fmt.Sprintf("%d/%d", i, j), "hello"); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := h.Commit(fmt.Sprintf("%d/%d", i, j)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i, h)
+	}
+	wg.Wait()
+	if err := db.Update(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		for j := 0; j < n; j++ {
+			assertGet(t, db, fmt.Sprintf("%d/%d", i, j), "hello")
+		}
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	h, err := Open(db.Repo().Path(), db.ref, WithLocking(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Free()
+	lockPath := filepath.Join(db.Repo().Path(), lockFileName)
+	if err := ioutil.WriteFile(lockPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	h.Set("foo", "bar")
+	if err := h.Commit("locked"); err != ErrLockTimeout {
+		t.Fatalf("%#v", err)
+	}
+	// Uncommitted changes are kept
+	assertGet(t, h, "foo", "bar")
+	if _, err := h.Head(); err != ErrNoCommits {
+		t.Fatalf("%#v", err)
+	}
+}
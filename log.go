@@ -0,0 +1,145 @@
+package libpack
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+// CommitInfo describes a commit of the database.
+type CommitInfo struct {
+	Id      string
+	Message string
+	Author  string
+	Email   string
+	When    time.Time
+	// Ids of the parent commits
+	Parents []string
+	// Label of the batch which made the commit, see BatchTrailer
+	Op string
+	// Trailers of the message, see CommitMeta
+	Meta map[string]string
+}
+
+func commitInfo(c *git.Commit) CommitInfo {
+	author := c.Author()
+	info := CommitInfo{
+		Id:      c.Id().String(),
+		Message: c.Message(),
+		Author:  author.Name,
+		Email:   author.Email,
+		When:    author.When,
+	}
+	info.Meta = parseTrailers(info.Message)
+	info.Op = info.Meta[BatchTrailer]
+	for i := uint(0); i < c.ParentCount(); i++ {
+		info.Parents = append(info.Parents, c.ParentId(i).String())
+	}
+	return info
+}
+
+// ErrStopWalk can be returned by the handlers of Walk, WalkKeys, WalkDirs,
+// WalkParallel and Snapshot.Walk to end the walk early, in which case the
+// walk returns nil. A handler of WalkPage returning it ends the page
+// before the current object. It is also returned by walkHistory callbacks.
+var ErrStopWalk = errors.New("stop walk")
+
+// Log returns up to `limit` commits of the history of the database,
+// most recent first, starting from commit `from`, or from the latest
+// commit if from is empty. If limit is 0, the whole history is returned.
+// If the history was truncated by a shallow fetch, the available commits
+// are returned along with ErrShallowHistory.
+func (db *DB) Log(from string, limit int) (commits []CommitInfo, err error) {
+	if err := db.checkClosed(); err != nil {
+		return nil, err
+	}
+	defer db.wrapError("log", "", &err)
+	var start *git.Oid
+	if from == "" {
+		if start = db.headId(); start == nil {
+			return nil, ErrNoCommits
+		}
+	} else {
+		var err error
+		if start, err = git.NewOid(from); err != nil {
+			return nil, err
+		}
+	}
+	truncated, err := walkHistory(db.repo, start, func(c *git.Commit) error {
+		commits = append(commits, commitInfo(c))
+		if limit > 0 && len(commits) >= limit {
+			return ErrStopWalk
+		}
+		return nil
+	})
+	if err == ErrStopWalk {
+		return commits, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if truncated {
+		return commits, ErrShallowHistory
+	}
+	return commits, nil
+}
+
+// CommitChanges returns the keys changed by commit `commitID`, relative
+// to its first parent (or to an empty tree for the first commit).
+// Only keys in the scope of the database are returned, relative to the
+// scope. Values are not read.
+// For the boundary commit of a shallow history, whose parent was not
+// downloaded, ErrShallowHistory is returned.
+func (db *DB) CommitChanges(commitID string) (changes []Change, err error) {
+	if err := db.checkClosed(); err != nil {
+		return nil, err
+	}
+	defer db.wrapError("changes", "", &err)
+	id, err := git.NewOid(commitID)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := lookupCommit(db.repo, id)
+	if err != nil {
+		return nil, err
+	}
+	defer commit.Free()
+	var parent *git.Commit
+	if commit.ParentCount() > 0 {
+		// The parents of the boundary of a shallow fetch are missing
+		if parent = commit.Parent(0); parent == nil {
+			return nil, ErrShallowHistory
+		}
+		defer parent.Free()
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
+	changes, err = commitDiff(db.repo, parent, tree)
+	if err != nil {
+		return nil, err
+	}
+	scope := TreePath(db.scope)
+	filtered := changes[:0]
+	for _, c := range changes {
+		if isKeepEntry(c.Key) && !db.root().showInternal {
+			continue
+		}
+		if scope == "/" {
+			if isInternal(c.Key) && db.hidesInternal(scope) {
+				continue
+			}
+		} else if strings.HasPrefix(c.Key, scope+"/") {
+			c.Key = strings.TrimPrefix(c.Key, scope+"/")
+		} else {
+			continue
+		}
+		c.Key = db.unescapeKey(c.Key)
+		filtered = append(filtered, c)
+	}
+	return filtered, nil
+}
@@ -0,0 +1,84 @@
+package libpack
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	if _, err := db.Log("", 0); err != ErrNoCommits {
+		t.Fatalf("%v", err)
+	}
+	for _, msg := range []string{"A", "B", "C"} {
+		db.Set("foo", msg)
+		if err := db.Commit(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commits, err := db.Log("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 3 || commits[0].Message != "C" || commits[2].Message != "A" {
+		t.Fatalf("%#v", commits)
+	}
+	if head, _ := db.Head(); commits[0].Id != head {
+		t.Fatalf("%v != %v", commits[0].Id, head)
+	}
+	if len(commits[2].Parents) != 0 || commits[1].Parents[0] != commits[2].Id {
+		t.Fatalf("%#v", commits)
+	}
+	// Pages
+	page, err := db.Log(commits[1].Id, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].Id != commits[1].Id {
+		t.Fatalf("%#v", page)
+	}
+}
+
+func TestCommitChanges(t *testing.T) {
+	db, err := Init(tmpdir(t), "refs/heads/test", WithModTime())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(db)
+	db.Set("a/x", "1")
+	db.Set("a/y", "2")
+	db.Set("b", "3")
+	if err := db.Commit("first"); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("a/x", "changed")
+	db.Delete("a/y")
+	db.Set("a/z", "new")
+	if err := db.Commit("second"); err != nil {
+		t.Fatal(err)
+	}
+	log, err := db.Log("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := db.CommitChanges(log[1].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 {
+		t.Fatalf("%#v", changes)
+	}
+	changes, err = db.Scope("a").CommitChanges(log[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary []string
+	for _, c := range changes {
+		summary = append(summary, fmt.Sprintf("%s %s", c.Key, c.Kind))
+	}
+	if strings.Join(summary, ", ") != "x modified, y deleted, z added" {
+		t.Fatalf("%v", summary)
+	}
+}
@@ -0,0 +1,85 @@
+package libpack
+
+import (
+	"fmt"
+	"os"
+
+	git "github.com/libgit2/git2go"
+)
+
+// A LogLevel is the importance of a message logged by a database.
+type LogLevel int
+
+const (
+	// Details, such as cache invalidations
+	LogDebug LogLevel = iota
+	// Changes of the state of the database, such as reference updates
+	LogInfo
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// A Logger receives the messages logged by a database, see SetLogger.
+// It may be called from several goroutines at once, and with the
+// database locked, so it must not call methods of the database.
+type Logger interface {
+	Logf(level LogLevel, format string, args ...interface{})
+}
+
+// LoggerFunc is an adapter to use a function as a Logger.
+type LoggerFunc func(level LogLevel, format string, args ...interface{})
+
+func (f LoggerFunc) Logf(level LogLevel, format string, args ...interface{}) {
+	f(level, format, args...)
+}
+
+// SetLogger makes the database log its reference updates, fetches,
+// merges, discarded uncommitted changes and cache invalidations to l.
+// Messages never include values, only their size and the ids of
+// objects. If l is nil, which is the default, nothing is logged.
+func (db *DB) SetLogger(l Logger) {
+	db.root().logger.Store(loggerBox{l})
+}
+
+// loggerBox wraps the Logger of a database, since an atomic.Value
+// always holds the same concrete type.
+type loggerBox struct {
+	l Logger
+}
+
+// logf logs a message with the logger set with SetLogger, if any.
+// The logger is read without the lock, so logf can be called
+// anywhere.
+func (db *DB) logf(level LogLevel, format string, args ...interface{}) {
+	if b, ok := db.root().logger.Load().(loggerBox); ok && b.l != nil {
+		b.l.Logf(level, format, args...)
+	}
+}
+
+// warnf reports a failure which can't be returned to the caller, such as
+// the panic of a hook: with the logger set with SetLogger, or on stderr
+// if there is none, so that it is never silently dropped.
+func (db *DB) warnf(format string, args ...interface{}) {
+	if b, ok := db.root().logger.Load().(loggerBox); ok && b.l != nil {
+		b.l.Logf(LogInfo, format, args...)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "libpack: "+format+"\n", args...)
+}
+
+// commitName returns the id of c, or "none" if c is nil, for log
+// messages.
+func commitName(c *git.Commit) string {
+	if c == nil {
+		return "none"
+	}
+	return c.Id().String()
+}
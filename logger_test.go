@@ -0,0 +1,77 @@
+package libpack
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type testLogger struct {
+	l        sync.Mutex
+	messages []string
+}
+
+func (l *testLogger) Logf(level LogLevel, format string, args ...interface{}) {
+	l.l.Lock()
+	defer l.l.Unlock()
+	l.messages = append(l.messages, level.String()+": "+fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) find(t *testing.T, s string) {
+	if !l.logged(s) {
+		t.Fatalf("%q not logged: %q", s, l.messages)
+	}
+}
+
+func (l *testLogger) logged(s string) bool {
+	l.l.Lock()
+	defer l.l.Unlock()
+	for _, m := range l.messages {
+		if strings.Contains(m, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogger(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	logger := &testLogger{}
+	db.Scope("a").SetLogger(logger)
+	db.Set("password", "hunter2")
+	db.Commit("")
+	logger.find(t, "info: refs/heads/test: none -> "+db.headId().String()+" (commit)")
+	db.Get("password")
+	db.Set("foo", "bar")
+	db.Commit("")
+	db.Get("password")
+	logger.find(t, "debug: cache: dropping 1 paths")
+
+	// Uncommitted changes are discarded by Update
+	other, err := Open(db.Repo().Path(), db.ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Free()
+	other.Set("x", "y")
+	other.Commit("")
+	if err := db.Update(); err != nil {
+		t.Fatal(err)
+	}
+	logger.find(t, "info: refs/heads/test: discarding uncommitted changes")
+
+	for _, m := range logger.messages {
+		if strings.Contains(m, "hunter2") {
+			t.Fatalf("value logged: %q", m)
+		}
+	}
+	db.SetLogger(nil)
+	n := len(logger.messages)
+	db.Set("foo", "baz")
+	db.Commit("")
+	if len(logger.messages) != n {
+		t.Fatalf("%q", logger.messages[n:])
+	}
+}
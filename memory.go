@@ -0,0 +1,43 @@
+package libpack
+
+import (
+	"io/ioutil"
+	"os"
+
+	git "github.com/libgit2/git2go"
+)
+
+// InitMemory initializes a new ephemeral database, which lives only until
+// Free is called. It supports the same operations as a database created
+// with Init.
+//
+// The version of libgit2 we use doesn't allow plugging in-memory object
+// and reference backends from Go, so the repository is stored in a
+// temporary directory, in shared memory when available (/dev/shm), and
+// removed by Free.
+func InitMemory(ref string, opts ...Option) (*DB, error) {
+	dir, err := ioutil.TempDir(memoryDir(), "libpack-memory-")
+	if err != nil {
+		return nil, err
+	}
+	r, err := git.InitRepository(dir, true)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	db, err := newRepo(r, ref, opts)
+	if err != nil {
+		// newRepo has freed r
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	db.ephemeral = dir
+	return db, nil
+}
+
+func memoryDir() string {
+	if st, err := os.Stat("/dev/shm"); err == nil && st.IsDir() {
+		return "/dev/shm"
+	}
+	return ""
+}
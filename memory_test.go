@@ -0,0 +1,60 @@
+package libpack
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// testBackends runs f against a database created with Init, and
+// against a database created with InitMemory.
+func testBackends(t *testing.T, f func(t *testing.T, db *DB)) {
+	disk := tmpDB(t, "")
+	defer nukeDB(disk)
+	f(t, disk)
+
+	mem, err := InitMemory("refs/heads/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mem.Free()
+	f(t, mem)
+}
+
+func TestMemorySetCommitGet(t *testing.T) {
+	testBackends(t, func(t *testing.T, db *DB) {
+		db.Set("foo", "bar")
+		db.Scope("a/b").Set("c", "d")
+		if err := db.Commit(""); err != nil {
+			t.Fatal(err)
+		}
+		assertGet(t, db, "foo", "bar")
+		assertGet(t, db, "a/b/c", "d")
+	})
+}
+
+func TestMemoryList(t *testing.T) {
+	testBackends(t, func(t *testing.T, db *DB) {
+		db.Set("dir/foo", "bar")
+		db.Mkdir("dir/sub")
+		names, err := db.List("dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprintf("%v", names) != "[foo sub]" {
+			t.Fatalf("%v", names)
+		}
+	})
+}
+
+func TestMemoryFree(t *testing.T) {
+	db, err := InitMemory("refs/heads/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := db.Repo().Path()
+	db.Free()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("%s should have been removed: %v", dir, err)
+	}
+}
@@ -0,0 +1,101 @@
+package libpack
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+// CommitMeta is like Commit, and attaches the key/value pairs of meta to
+// the commit, as trailers at the end of its message: one "key: value"
+// line per pair, sorted by key. Since they are part of the message,
+// they are pushed and pulled with the commit. See CommitInfo.Meta.
+// Keys must be made of letters, digits, '-' and '_', and values must fit
+// on one line. If msg is empty, a summary of the changes is used.
+func (db *DB) CommitMeta(msg string, meta map[string]string) error {
+	return db.CommitWith(msg, CommitOpt{Meta: meta})
+}
+
+// CommitInfo returns the description of commit `commitID`, including its
+// metadata.
+func (db *DB) CommitInfo(commitID string) (info CommitInfo, err error) {
+	if err := db.checkClosed(); err != nil {
+		return CommitInfo{}, err
+	}
+	defer db.wrapError("commit-info", "", &err)
+	id, err := git.NewOid(commitID)
+	if err != nil {
+		return CommitInfo{}, err
+	}
+	commit, err := lookupCommit(db.repo, id)
+	if err != nil {
+		return CommitInfo{}, err
+	}
+	defer commit.Free()
+	return commitInfo(commit), nil
+}
+
+// formatTrailers returns the trailer lines for meta, sorted by key.
+func formatTrailers(meta map[string]string) (string, error) {
+	keys := make([]string, 0, len(meta))
+	for k, v := range meta {
+		if !isTrailerKey(k) {
+			return "", fmt.Errorf("invalid metadata key: %q", k)
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			return "", fmt.Errorf("invalid metadata value for %s: %q", k, v)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var lines []string
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("%s: %s", k, strings.TrimSpace(meta[k])))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// appendTrailers adds trailer lines at the end of msg, separated from it
+// by an empty line.
+func appendTrailers(msg, trailers string) string {
+	if trailers == "" {
+		return msg
+	}
+	return strings.TrimRight(msg, "\n") + "\n\n" + trailers + "\n"
+}
+
+func isTrailerKey(k string) bool {
+	if k == "" {
+		return false
+	}
+	for _, c := range k {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// parseTrailers returns the trailers of a commit message: the key/value
+// pairs of its last paragraph, if it is not the first one and every line
+// of it is a "key: value" line. Otherwise, it returns nil.
+func parseTrailers(msg string) map[string]string {
+	paragraphs := strings.Split(strings.TrimRight(msg, "\n"), "\n\n")
+	last := strings.TrimLeft(paragraphs[len(paragraphs)-1], "\n")
+	if len(paragraphs) < 2 || last == "" {
+		return nil
+	}
+	meta := make(map[string]string)
+	for _, line := range strings.Split(last, "\n") {
+		i := strings.Index(line, ": ")
+		if i < 0 || !isTrailerKey(line[:i]) {
+			return nil
+		}
+		meta[line[:i]] = strings.TrimSpace(line[i+2:])
+	}
+	return meta
+}
@@ -0,0 +1,75 @@
+package libpack
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCommitMeta(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("foo", "bar")
+	meta := map[string]string{"deploy-id": "42", "actor": "alice", "ticket": "OPS-7"}
+	if err := db.CommitMeta("deploy web", meta); err != nil {
+		t.Fatal(err)
+	}
+	head, err := db.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := db.CommitInfo(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info.Meta, meta) {
+		t.Fatalf("%#v", info.Meta)
+	}
+	if info.Message != "deploy web\n\nactor: alice\ndeploy-id: 42\nticket: OPS-7\n" {
+		t.Fatalf("%q", info.Message)
+	}
+	// Without a message, the changes are summarized
+	db.Set("foo", "baz")
+	if err := db.Scope("sub").CommitMeta("", map[string]string{"actor": "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	commits, err := db.Log("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := commits[0]; c.Meta["actor"] != "bob" || !strings.HasPrefix(c.Message, "1 key changed: ~foo\n\n") {
+		t.Fatalf("%#v", c)
+	}
+	if c := commits[1]; c.Meta["actor"] != "alice" {
+		t.Fatalf("%#v", c)
+	}
+	// Invalid metadata is rejected, and nothing is committed
+	db.Set("foo", "qux")
+	if err := db.CommitMeta("bad", map[string]string{"bad key": "x"}); err == nil {
+		t.Fatalf("invalid key should be rejected")
+	}
+	if err := db.CommitMeta("bad", map[string]string{"actor": "a\nb"}); err == nil {
+		t.Fatalf("invalid value should be rejected")
+	}
+	if h, _ := db.Head(); h != commits[0].Id {
+		t.Fatalf("head moved")
+	}
+	if _, err := db.CommitInfo("deadbeef"); err == nil {
+		t.Fatalf("invalid commit id should fail")
+	}
+}
+
+func TestParseTrailers(t *testing.T) {
+	for msg, meta := range map[string]map[string]string{
+		"":                               nil,
+		"fix: typo":                      nil,
+		"subject\n\nbody text":           nil,
+		"subject\n\nk: v\nnot a trailer": nil,
+		"subject\n\nk: v\n":              {"k": "v"},
+		"subject\n\nbody\n\nA-b: 1\nc_d: two words\n": {"A-b": "1", "c_d": "two words"},
+	} {
+		if m := parseTrailers(msg); !reflect.DeepEqual(m, meta) {
+			t.Fatalf("%q: %#v", msg, m)
+		}
+	}
+}
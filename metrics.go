@@ -0,0 +1,65 @@
+package libpack
+
+import (
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+// A MetricsSink receives measurements of the operations of a database,
+// see SetMetrics. Its methods are called synchronously, possibly from
+// several goroutines at once, so they must be fast and safe for
+// concurrent use.
+type MetricsSink interface {
+	// ObserveOp is called after each operation, with its name ("get",
+	// "set", "list", "commit", "pull", "push", "checkout"), duration
+	// and error.
+	ObserveOp(op string, d time.Duration, err error)
+	// ObserveValue is called with the size of the value read by a
+	// successful "get", or written by a "set".
+	ObserveValue(op string, size int)
+	// ObserveCommit is called after a commit is created, with the
+	// number of keys it changed, and the time it took.
+	ObserveCommit(keysChanged int, d time.Duration)
+}
+
+// SetMetrics makes the database report measurements of its operations
+// to m. If m is nil, which is the default, nothing is measured.
+func (db *DB) SetMetrics(m MetricsSink) {
+	root := db.root()
+	root.l.Lock()
+	root.metrics = m
+	root.l.Unlock()
+}
+
+// metricsSink returns the sink set with SetMetrics, or nil.
+func (db *DB) metricsSink() MetricsSink {
+	root := db.root()
+	root.l.RLock()
+	defer root.l.RUnlock()
+	return root.metrics
+}
+
+// observeOp reports op, started at start, to m. It is meant to be
+// deferred, with a pointer to the error returned by the operation.
+func observeOp(m MetricsSink, op string, start time.Time, err *error) {
+	m.ObserveOp(op, time.Since(start), *err)
+}
+
+// observeGet is like observeOp, for Get, and also reports the size of
+// the value it returned.
+func observeGet(m MetricsSink, start time.Time, value *string, err *error) {
+	m.ObserveOp("get", time.Since(start), *err)
+	if *err == nil {
+		m.ObserveValue("get", len(*value))
+	}
+}
+
+// observeCommit reports commit, which took d to create, to m.
+func (db *DB) observeCommit(m MetricsSink, commit *git.Commit, d time.Duration) {
+	changes, err := db.commitChanges(commit)
+	if err != nil {
+		return
+	}
+	m.ObserveCommit(len(changes), d)
+}
@@ -0,0 +1,73 @@
+package libpack
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type testMetrics struct {
+	l       sync.Mutex
+	ops     map[string]int
+	errors  map[string]int
+	values  map[string]int
+	commits []int
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{ops: map[string]int{}, errors: map[string]int{}, values: map[string]int{}}
+}
+
+func (m *testMetrics) ObserveOp(op string, d time.Duration, err error) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.ops[op]++
+	if err != nil {
+		m.errors[op]++
+	}
+}
+
+func (m *testMetrics) ObserveValue(op string, size int) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.values[op] += size
+}
+
+func (m *testMetrics) ObserveCommit(keysChanged int, d time.Duration) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.commits = append(m.commits, keysChanged)
+}
+
+func TestMetrics(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("before", "x")
+	m := newTestMetrics()
+	db.Scope("a").SetMetrics(m)
+	db.Set("foo", "hello")
+	db.Scope("a").Set("bar", "12")
+	db.Get("foo")
+	db.Get("nope")
+	db.List("/")
+	db.Commit("")
+	// Nothing to commit
+	db.Commit("")
+	if m.ops["set"] != 2 || m.values["set"] != 7 {
+		t.Fatalf("%v %v", m.ops, m.values)
+	}
+	if m.ops["get"] != 2 || m.errors["get"] != 1 || m.values["get"] != 5 {
+		t.Fatalf("%v %v %v", m.ops, m.errors, m.values)
+	}
+	if m.ops["list"] != 1 || m.ops["commit"] != 2 {
+		t.Fatalf("%v", m.ops)
+	}
+	if len(m.commits) != 1 || m.commits[0] != 3 {
+		t.Fatalf("%v", m.commits)
+	}
+	db.SetMetrics(nil)
+	db.Set("foo", "x")
+	if m.ops["set"] != 2 {
+		t.Fatalf("%v", m.ops)
+	}
+}
@@ -0,0 +1,189 @@
+// Package mockstore provides an implementation in memory of
+// libpack.Store, for the unit tests of code using libpack.
+package mockstore
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/libpack"
+)
+
+// A Store is a libpack.Store backed by a map. It is safe for concurrent
+// use.
+type Store struct {
+	l      sync.RWMutex
+	values map[string]string
+	// Messages of the commits, oldest first
+	commits []string
+}
+
+var _ libpack.Store = (*Store)(nil)
+
+// New returns a new, empty store.
+func New() *Store {
+	return &Store{values: make(map[string]string)}
+}
+
+// Get returns the value of key. Like libpack.DB, it returns a
+// *libpack.KeyError if key is a subtree or is below a value.
+func (s *Store) Get(key string) (string, error) {
+	if err := checkKey(key, false); err != nil {
+		return "", err
+	}
+	key = libpack.TreePath(key)
+	s.l.RLock()
+	defer s.l.RUnlock()
+	if v, ok := s.values[key]; ok {
+		return v, nil
+	}
+	if key == "/" || s.isDir(key) {
+		return "", &libpack.KeyError{Key: key, Err: libpack.ErrIsDirectory}
+	}
+	if s.isBelowValue(key) {
+		return "", &libpack.KeyError{Key: key, Err: libpack.ErrNotDirectory}
+	}
+	return "", libpack.ErrNotExist
+}
+
+// Set sets key to value. Values and subtrees in the way are replaced,
+// as in libpack.DB.
+func (s *Store) Set(key, value string) error {
+	if err := checkKey(key, true); err != nil {
+		return err
+	}
+	key = libpack.TreePath(key)
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.removeLocked(key)
+	for dir := parent(key); dir != "/"; dir = parent(dir) {
+		delete(s.values, dir)
+	}
+	s.values[key] = value
+	return nil
+}
+
+// Delete removes the value or subtree at key.
+func (s *Store) Delete(key string) error {
+	key = libpack.TreePath(key)
+	if key == "/" {
+		return fmt.Errorf("can't delete the root of the tree")
+	}
+	s.l.Lock()
+	defer s.l.Unlock()
+	if !s.removeLocked(key) {
+		return libpack.ErrNotExist
+	}
+	return nil
+}
+
+// List returns the names of the entries of the subtree at key.
+func (s *Store) List(key string) ([]string, error) {
+	if err := checkKey(key, false); err != nil {
+		return nil, err
+	}
+	key = libpack.TreePath(key)
+	s.l.RLock()
+	defer s.l.RUnlock()
+	if key != "/" && !s.isDir(key) {
+		if _, ok := s.values[key]; ok || s.isBelowValue(key) {
+			return nil, &libpack.KeyError{Key: key, Err: libpack.ErrNotDirectory}
+		}
+		return nil, libpack.ErrNotExist
+	}
+	seen := make(map[string]bool)
+	names := []string{}
+	for k := range s.values {
+		if key != "/" {
+			if !strings.HasPrefix(k, key+"/") {
+				continue
+			}
+			k = k[len(key)+1:]
+		}
+		name := strings.SplitN(k, "/", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Commit records msg in the list of commits returned by Commits.
+func (s *Store) Commit(msg string) error {
+	s.l.Lock()
+	s.commits = append(s.commits, msg)
+	s.l.Unlock()
+	return nil
+}
+
+// Commits returns the messages of the calls to Commit, oldest first.
+func (s *Store) Commits() []string {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	return append([]string(nil), s.commits...)
+}
+
+// isDir returns true if there are values under key. The caller must
+// hold the lock.
+func (s *Store) isDir(key string) bool {
+	for k := range s.values {
+		if strings.HasPrefix(k, key+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isBelowValue returns true if a parent of key is a value. The caller
+// must hold the lock.
+func (s *Store) isBelowValue(key string) bool {
+	for dir := parent(key); dir != "/"; dir = parent(dir) {
+		if _, ok := s.values[dir]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// removeLocked removes the value or subtree at key, and returns false
+// if there was nothing at key. The caller must hold the lock.
+func (s *Store) removeLocked(key string) bool {
+	_, found := s.values[key]
+	delete(s.values, key)
+	for k := range s.values {
+		if strings.HasPrefix(k, key+"/") {
+			delete(s.values, k)
+			found = true
+		}
+	}
+	return found
+}
+
+// checkKey rejects the keys which libpack.DB rejects, with a
+// *libpack.InvalidKeyError. If value is set, key must name a value, so
+// the root of the tree is rejected.
+func checkKey(key string, value bool) error {
+	if strings.Contains(key, "\x00") {
+		return &libpack.InvalidKeyError{Key: key, Reason: "contains a NUL byte"}
+	}
+	for _, c := range strings.Split(strings.Replace(key, "\\", "/", -1), "/") {
+		if c == ".." {
+			return &libpack.InvalidKeyError{Key: key, Reason: "contains '..'"}
+		}
+	}
+	if value && libpack.TreePath(key) == "/" {
+		return &libpack.InvalidKeyError{Key: key, Reason: "empty key"}
+	}
+	return nil
+}
+
+func parent(key string) string {
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		return key[:i]
+	}
+	return "/"
+}
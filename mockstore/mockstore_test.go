@@ -0,0 +1,23 @@
+package mockstore
+
+import (
+	"testing"
+
+	"github.com/docker/libpack"
+	"github.com/docker/libpack/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (libpack.Store, func()) {
+		return New(), func() {}
+	})
+}
+
+func TestCommits(t *testing.T) {
+	s := New()
+	s.Commit("a")
+	s.Commit("b")
+	if c := s.Commits(); len(c) != 2 || c[0] != "a" || c[1] != "b" {
+		t.Fatalf("%v", c)
+	}
+}
@@ -0,0 +1,234 @@
+//go:build fuse
+// +build fuse
+
+package libpack
+
+import (
+	"io"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	git "github.com/libgit2/git2go"
+	"golang.org/x/net/context"
+)
+
+// Mount exposes the committed tree of db as a read-only filesystem at
+// mountpoint: keys are files, and subtrees are directories. The
+// filesystem follows the database's latest commit, so it changes when
+// Update, Pull or Commit move it.
+// Calling Close on the result unmounts the filesystem.
+// Mount is only available when libpack is built with the "fuse" tag.
+func Mount(db *DB, mountpoint string) (io.Closer, error) {
+	if err := db.checkClosed(); err != nil {
+		return nil, err
+	}
+	conn, err := fuse.Mount(mountpoint, fuse.ReadOnly(), fuse.FSName("libpack"), fuse.Subtype("libpack"))
+	if err != nil {
+		return nil, err
+	}
+	m := &mount{
+		dir:  mountpoint,
+		conn: conn,
+		done: make(chan error, 1),
+	}
+	filesys := &mountFS{db: db.root(), scope: db.scope}
+	go func() {
+		m.done <- fs.Serve(conn, filesys)
+	}()
+	<-conn.Ready
+	if err := conn.MountError; err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+type mount struct {
+	dir  string
+	conn *fuse.Conn
+	done chan error
+	once sync.Once
+	err  error
+}
+
+func (m *mount) Close() error {
+	m.once.Do(func() {
+		if err := fuse.Unmount(m.dir); err != nil {
+			m.err = err
+			return
+		}
+		m.err = <-m.done
+		if err := m.conn.Close(); m.err == nil {
+			m.err = err
+		}
+	})
+	return m.err
+}
+
+// attrValid is how long the kernel may cache attributes, so that
+// changes of the database's head are seen quickly.
+const attrValid = time.Second
+
+type mountFS struct {
+	db    *DB
+	scope string
+
+	// The last blob read, so that reading a large value in several
+	// chunks doesn't load it each time. git2go can't stream blobs.
+	l        sync.Mutex
+	lastBlob string
+	lastData string
+}
+
+func (f *mountFS) Root() (fs.Node, error) {
+	return &mountNode{fs: f, key: f.scope}, nil
+}
+
+// tree returns the tree of the latest commit, or nil if nothing was
+// committed.
+func (f *mountFS) tree() (*git.Tree, error) {
+	head := f.db.headId()
+	if head == nil {
+		return nil, nil
+	}
+	commit, err := lookupCommit(f.db.repo, head)
+	if err != nil {
+		return nil, err
+	}
+	defer commit.Free()
+	return commit.Tree()
+}
+
+// entry returns the entry at key in the latest commit. If key is the
+// root of the tree, e is nil.
+func (f *mountFS) entry(key string) (e *git.TreeEntry, err error) {
+	key = TreePath(key)
+	tree, err := f.tree()
+	if err != nil {
+		return nil, err
+	}
+	if tree == nil {
+		if key == "/" {
+			return nil, nil
+		}
+		return nil, fuse.ENOENT
+	}
+	defer tree.Free()
+	if key == "/" {
+		return nil, nil
+	}
+	e, err = tree.EntryByPath(key)
+	if git.IsErrorCode(err, git.ErrNotFound) {
+		return nil, fuse.ENOENT
+	}
+	return e, err
+}
+
+// value returns the decoded contents of the blob of e.
+func (f *mountFS) value(e *git.TreeEntry) (string, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	if f.lastBlob == e.Id.String() {
+		return f.lastData, nil
+	}
+	data, err := blobContents(f.db.repo, e.Id)
+	if err != nil {
+		return "", err
+	}
+	if data, err = f.db.decodeValue(data, e.Filemode); err != nil {
+		return "", err
+	}
+	f.lastBlob = e.Id.String()
+	f.lastData = data
+	return data, nil
+}
+
+// A mountNode is a file or directory of a mounted database. Nodes are
+// looked up by path on each access, so they always reflect the latest
+// commit.
+type mountNode struct {
+	fs  *mountFS
+	key string
+}
+
+func (n *mountNode) Attr(ctx context.Context, a *fuse.Attr) error {
+	e, err := n.fs.entry(n.key)
+	if err != nil {
+		return err
+	}
+	a.Valid = attrValid
+	if e == nil || e.Type == git.ObjectTree {
+		a.Mode = os.ModeDir | 0555
+		return nil
+	}
+	value, err := n.fs.value(e)
+	if err != nil {
+		return err
+	}
+	a.Mode = 0444
+	a.Size = uint64(len(value))
+	return nil
+}
+
+func (n *mountNode) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	key := path.Join(n.key, name)
+	if n.fs.db.hiddenEntry(name, n.fs.db.hidesInternal(n.key)) {
+		return nil, fuse.ENOENT
+	}
+	if _, err := n.fs.entry(key); err != nil {
+		return nil, err
+	}
+	return &mountNode{fs: n.fs, key: key}, nil
+}
+
+func (n *mountNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	tree, err := n.fs.tree()
+	if err != nil || tree == nil {
+		return nil, err
+	}
+	defer tree.Free()
+	entries, err := TreeListEntries(n.fs.db.repo, tree, n.key)
+	if err != nil {
+		return nil, err
+	}
+	dirents := make([]fuse.Dirent, 0, len(entries))
+	for _, info := range entries {
+		if n.fs.db.hiddenEntry(info.Name, n.fs.db.hidesInternal(n.key)) {
+			continue
+		}
+		d := fuse.Dirent{Name: info.Name, Type: fuse.DT_File}
+		if info.Kind == KindTree {
+			d.Type = fuse.DT_Dir
+		}
+		dirents = append(dirents, d)
+	}
+	return dirents, nil
+}
+
+func (n *mountNode) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	e, err := n.fs.entry(n.key)
+	if err != nil {
+		return err
+	}
+	if e == nil || e.Type == git.ObjectTree {
+		return fuse.Errno(syscall.EISDIR)
+	}
+	value, err := n.fs.value(e)
+	if err != nil {
+		return err
+	}
+	if req.Offset >= int64(len(value)) {
+		return nil
+	}
+	end := req.Offset + int64(req.Size)
+	if end > int64(len(value)) {
+		end = int64(len(value))
+	}
+	resp.Data = []byte(value[req.Offset:end])
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !fuse
+// +build !fuse
+
+package libpack
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrNoFUSE is returned by Mount when libpack was built without FUSE
+// support.
+var ErrNoFUSE = errors.New("libpack was built without FUSE support (build tag \"fuse\")")
+
+// Mount is only available when libpack is built with the "fuse" tag.
+func Mount(db *DB, mountpoint string) (io.Closer, error) {
+	return nil, ErrNoFUSE
+}
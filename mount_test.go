@@ -0,0 +1,89 @@
+//go:build fuse
+// +build fuse
+
+package libpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMount(t *testing.T) {
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skip("FUSE is not available")
+	}
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	large := strings.Repeat("0123456789", 100000)
+	db.Set("foo/bar", "hello")
+	db.Set("large", large)
+	if err := db.Commit("A"); err != nil {
+		t.Fatal(err)
+	}
+	dir := tmpdir(t)
+	defer os.RemoveAll(dir)
+	m, err := Mount(db, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if data, err := ioutil.ReadFile(path.Join(dir, "foo/bar")); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "hello" {
+		t.Fatalf("%q", data)
+	}
+	// Random access in a large value
+	f, err := os.Open(path.Join(dir, "large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := f.Stat(); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != int64(len(large)) {
+		t.Fatalf("size %d instead of %d", fi.Size(), len(large))
+	}
+	buf := make([]byte, 10)
+	if _, err := f.ReadAt(buf, 500003); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if string(buf) != "3456789012" {
+		t.Fatalf("%q", buf)
+	}
+	// Uncommitted changes are not visible, committed ones are
+	db.Set("foo/baz", "world")
+	if _, err := os.Stat(path.Join(dir, "foo/baz")); !os.IsNotExist(err) {
+		t.Fatalf("%v", err)
+	}
+	if err := db.Commit("B"); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := ioutil.ReadDir(path.Join(dir, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	if strings.Join(names, " ") != "bar baz" {
+		t.Fatalf("%v", names)
+	}
+	// Writes are refused
+	if err := ioutil.WriteFile(path.Join(dir, "foo/bar"), []byte("new"), 0644); err == nil {
+		t.Fatalf("the filesystem should be read-only")
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The mountpoint is usable again
+	if entries, err := ioutil.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Fatalf("%v %v", entries, err)
+	}
+}
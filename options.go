@@ -0,0 +1,86 @@
+package libpack
+
+import (
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+const (
+	DefaultAuthorName  = "libpack"
+	DefaultAuthorEmail = "libpack"
+)
+
+// An Option changes the settings of a database when it is opened
+// with Init or Open.
+type Option func(*DB)
+
+// WithAuthor sets the name and email recorded as author and committer
+// of the commits made by the database.
+func WithAuthor(name, email string) Option {
+	return func(db *DB) {
+		db.authorName = name
+		db.authorEmail = email
+	}
+}
+
+// WithClock sets the function used to timestamp commits.
+// The default is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(db *DB) {
+		db.now = now
+	}
+}
+
+// Deterministic makes commits reproducible: two databases committing
+// the same tree with the same message and parents produce the same commit
+// id. Author and committer are set to the default signature, and all
+// commits are timestamped with `when` (or the Unix epoch if `when` is
+// the zero time).
+// Tree entries are always sorted canonically by git, so identical
+// content always produces identical trees.
+func Deterministic(when time.Time) Option {
+	if when.IsZero() {
+		when = time.Unix(0, 0).UTC()
+	}
+	return func(db *DB) {
+		db.authorName = DefaultAuthorName
+		db.authorEmail = DefaultAuthorEmail
+		db.now = func() time.Time { return when }
+	}
+}
+
+// SetAuthor sets the name and email recorded as author and committer
+// of the commits made by the database from now on.
+func (db *DB) SetAuthor(name, email string) {
+	if db.parent != nil {
+		db.parent.SetAuthor(name, email)
+		return
+	}
+	db.l.Lock()
+	db.authorName = name
+	db.authorEmail = email
+	db.l.Unlock()
+}
+
+// signature returns the signature to use for the next commit.
+func (db *DB) signature() *git.Signature {
+	if db.parent != nil {
+		return db.parent.signature()
+	}
+	db.l.RLock()
+	defer db.l.RUnlock()
+	return &git.Signature{
+		Name:  db.authorName,
+		Email: db.authorEmail,
+		When:  db.now(),
+	}
+}
+
+func defaultSignature() *git.Signature {
+	return &git.Signature{
+		Name:  DefaultAuthorName,
+		Email: DefaultAuthorEmail,
+		When:  time.Now(),
+	}
+}
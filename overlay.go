@@ -0,0 +1,290 @@
+package libpack
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+// Set and SetMany don't change the uncommitted tree directly: new blobs are
+// recorded in an overlay of pending changes, which is folded into the tree
+// only when it is needed (by Commit, or any method reading the tree other
+// than Get). Folding writes each modified tree once, instead of once per
+// Set.
+
+// A blobEntry is a blob and its filemode in a tree. In the overlay of
+// pending changes, a nil id marks a deleted key.
+type blobEntry struct {
+	id   *git.Oid
+	mode int
+}
+
+// stage records blob `id` with filemode `mode` at `key` in the overlay of
+// pending changes. If id is nil, key is deleted instead.
+// The caller must hold the lock.
+func (db *DB) stage(key string, id *git.Oid, mode int) error {
+	key = TreePath(key)
+	db.recordAutoCommit(key, id == nil)
+	if key == "/" && id == nil {
+		return fmt.Errorf("can't delete the root of the tree")
+	}
+	if key == "/" {
+		if err := db.flushLocked(); err != nil {
+			return err
+		}
+		tree, err := treeAdd(db.repo, db.tree, key, id, true)
+		if err != nil {
+			return err
+		}
+		db.tree = tree
+		return nil
+	}
+	// Changes which overwrite each other must be applied in order.
+	if db.pendingDirs[key] || db.pendingAncestor(key) {
+		if err := db.flushLocked(); err != nil {
+			return err
+		}
+	}
+	if db.pending == nil {
+		db.pending = make(map[string]blobEntry)
+		db.pendingDirs = make(map[string]bool)
+	}
+	db.pending[key] = blobEntry{id, mode}
+	for dir := path.Dir(key); dir != "."; dir = path.Dir(dir) {
+		db.pendingDirs[dir] = true
+	}
+	return nil
+}
+
+// hasEntryLocked returns true if there is an entry at key in the
+// uncommitted tree, including pending changes. The caller must hold
+// the lock.
+func (db *DB) hasEntryLocked(key string) bool {
+	key = TreePath(key)
+	if e, ok := db.pending[key]; ok {
+		return e.id != nil
+	}
+	if db.tree == nil {
+		return false
+	}
+	_, err := db.tree.EntryByPath(key)
+	return err == nil
+}
+
+// hasPathLocked is like hasEntryLocked, but also finds subtrees which
+// only exist in pending changes, and takes into account the pending
+// changes of parent paths. The caller must hold the lock.
+func (db *DB) hasPathLocked(key string) (bool, error) {
+	key = TreePath(key)
+	if db.pendingDirs[key] || db.pendingAncestor(key) {
+		if err := db.flushLocked(); err != nil {
+			return false, err
+		}
+	}
+	return db.hasEntryLocked(key), nil
+}
+
+// entryLocked returns the blob at key in the uncommitted tree, including
+// pending changes, or ErrNotExist. The caller must hold the lock.
+func (db *DB) entryLocked(key string) (*blobEntry, error) {
+	key = TreePath(key)
+	if e, ok := db.pending[key]; ok {
+		if e.id == nil {
+			return nil, ErrNotExist
+		}
+		return &e, nil
+	}
+	if db.pendingDirs[key] || db.pendingAncestor(key) {
+		if err := db.flushLocked(); err != nil {
+			return nil, err
+		}
+	}
+	if db.tree == nil {
+		return nil, ErrNotExist
+	}
+	if key == "/" {
+		return nil, db.keyError(key, ErrIsDirectory)
+	}
+	e, err := lookupEntry(db.tree, key)
+	if err != nil {
+		if err = db.lookupError(db.tree, key, err); git.IsErrorCode(err, git.ErrNotFound) {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+	if e.mode == 040000 {
+		return nil, db.keyError(key, ErrIsDirectory)
+	}
+	return e, nil
+}
+
+// pendingAncestor returns true if a blob was staged at one of the parent
+// paths of key. The caller must hold the lock.
+func (db *DB) pendingAncestor(key string) bool {
+	for dir := path.Dir(key); dir != "."; dir = path.Dir(dir) {
+		if _, ok := db.pending[dir]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// flushLocked folds pending changes into the uncommitted tree.
+// The caller must hold the lock.
+func (db *DB) flushLocked() error {
+	if len(db.pending) == 0 {
+		return nil
+	}
+	tree, err := treeApply(db.repo, db.tree, db.pending)
+	if err != nil {
+		return err
+	}
+	db.tree = tree
+	db.discardPending()
+	return nil
+}
+
+// keepPendingSince keeps the pending changes which were staged after
+// the snapshot `committed` of the overlay was taken, and drops the
+// others, which were folded into the uncommitted tree. The caller must
+// hold the lock.
+func (db *DB) keepPendingSince(committed map[string]blobEntry) {
+	pending := db.pending
+	db.discardPending()
+	for key, e := range pending {
+		if c, ok := committed[key]; ok && sameOid(c.id, e.id) && c.mode == e.mode {
+			continue
+		}
+		if db.pending == nil {
+			db.pending = make(map[string]blobEntry)
+			db.pendingDirs = make(map[string]bool)
+		}
+		db.pending[key] = e
+		for dir := path.Dir(key); dir != "."; dir = path.Dir(dir) {
+			db.pendingDirs[dir] = true
+		}
+		db.recordAutoCommit(key, e.id == nil)
+	}
+}
+
+// discardPending drops pending changes. The caller must hold the lock.
+func (db *DB) discardPending() {
+	db.pending = nil
+	db.pendingDirs = nil
+}
+
+// lookupPending returns the tree in which key can be looked up. If
+// a blob was staged at key, it is returned instead.
+// Pending changes are only folded if they affect key.
+func (db *DB) lookupPending(key string) (*git.Tree, *blobEntry, error) {
+	root := db.root()
+	key = TreePath(key)
+	root.l.RLock()
+	if e, ok := root.pending[key]; ok {
+		root.l.RUnlock()
+		return nil, &e, nil
+	}
+	if key != "/" && !root.pendingDirs[key] && !root.pendingAncestor(key) {
+		tree := root.tree
+		root.l.RUnlock()
+		return tree, nil, nil
+	}
+	root.l.RUnlock()
+	tree, err := db.snapshot()
+	return tree, nil, err
+}
+
+// treeApply creates a new tree by setting each blob of `blobs` at its
+// path in `tree`, which may be nil. Intermediary subtrees are created as
+// needed, and existing objects are overwritten. Entries with a nil id are
+// removed, along with the subtrees left empty by their removal.
+// Each modified tree is only written once.
+func treeApply(r *git.Repository, tree *git.Tree, blobs map[string]blobEntry) (*git.Tree, error) {
+	var (
+		builder *git.TreeBuilder
+		err     error
+	)
+	if tree == nil {
+		builder, err = r.TreeBuilder()
+	} else {
+		builder, err = r.TreeBuilderFromTree(tree)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer builder.Free()
+	subs := make(map[string]map[string]blobEntry)
+	for key, blob := range blobs {
+		i := strings.Index(key, "/")
+		if i < 0 && blob.id == nil {
+			if tree != nil && tree.EntryByName(key) != nil {
+				if err := builder.Remove(key); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if i < 0 {
+			if err := builder.Insert(key, blob.id, blob.mode); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		dir := key[:i]
+		if subs[dir] == nil {
+			subs[dir] = make(map[string]blobEntry)
+		}
+		subs[dir][key[i+1:]] = blob
+	}
+	for dir, sub := range subs {
+		var subtree *git.Tree
+		if tree != nil {
+			if e := tree.EntryByName(dir); e != nil && e.Type == git.ObjectTree {
+				subtree, err = lookupTree(r, e.Id)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		deleteOnly := onlyDeletions(sub)
+		if subtree == nil && deleteOnly {
+			// Nothing to delete
+			continue
+		}
+		newSubtree, err := treeApply(r, subtree, sub)
+		if subtree != nil {
+			subtree.Free()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if deleteOnly && newSubtree.EntryCount() == 0 {
+			newSubtree.Free()
+			if err := builder.Remove(dir); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		err = builder.Insert(dir, newSubtree.Id(), 040000)
+		newSubtree.Free()
+		if err != nil {
+			return nil, err
+		}
+	}
+	id, err := builder.Write()
+	if err != nil {
+		return nil, err
+	}
+	return lookupTree(r, id)
+}
+
+func onlyDeletions(blobs map[string]blobEntry) bool {
+	for _, blob := range blobs {
+		if blob.id != nil {
+			return false
+		}
+	}
+	return true
+}
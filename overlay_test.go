@@ -0,0 +1,95 @@
+package libpack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSetOverwriteOrder(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("a", "blob")
+	db.Set("a/b", "nested")
+	assertGet(t, db, "a/b", "nested")
+	db.Set("x/y/z", "nested")
+	db.Set("x/y", "blob")
+	assertGet(t, db, "x/y", "blob")
+	assertNotExist(t, db, "x/y/z")
+	if err := db.Commit("overwrite"); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db, "a/b", "nested")
+	assertGet(t, db, "x/y", "blob")
+}
+
+func TestSetPendingMerge(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("dir/1", "one")
+	db.Set("dir/sub/2", "two")
+	if err := db.Commit("base"); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("dir/sub/3", "three")
+	db.Set("dir/4", "four")
+	// Get doesn't need to fold pending changes
+	assertGet(t, db, "dir/4", "four")
+	assertNotExist(t, db, "other")
+	if names, err := db.List("dir/sub"); err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(names) != "[2 3]" {
+		t.Fatalf("%v", names)
+	}
+	assertGet(t, db, "dir/1", "one")
+	assertGet(t, db, "dir/sub/2", "two")
+}
+
+func BenchmarkSetDeep(b *testing.B) {
+	dir, err := ioutil.TempDir("", "libpack-bench-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := Init(dir, "refs/heads/test")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Free()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.Set(fmt.Sprintf("a/b/c/d/%d", i), "hello"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := db.Commit("bench"); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkPipelineSetDeep writes every ancestor tree on each Set, which
+// is what DB.Set did before pending changes were introduced.
+func BenchmarkPipelineSetDeep(b *testing.B) {
+	dir, err := ioutil.TempDir("", "libpack-bench-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := Init(dir, "refs/heads/test")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Free()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.change(func(p *Pipeline) *Pipeline {
+			return p.Set(fmt.Sprintf("a/b/c/d/%d", i), "hello")
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := db.Commit("bench"); err != nil {
+		b.Fatal(err)
+	}
+}
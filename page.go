@@ -0,0 +1,215 @@
+package libpack
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+// ListPage and WalkPage return entries in the order of git trees: by
+// name, except that the name of a subtree is compared as if it ended
+// with a slash. This is what makes paging cheap: the start of a page is
+// found by a binary search in the tree, and only the entries of the page
+// are read.
+//
+// The resume token returned with each page records the id of the tree
+// being listed. Since git trees are immutable, the following pages are
+// read from the same tree as long as it exists in the repository, even
+// if the database was changed between calls. If it has been garbage
+// collected, the current tree is used instead, starting after the last
+// returned name.
+
+// ListPage returns the names of at most limit entries of the subtree at
+// dir, following the entry recorded in the resume token `after`, or from
+// the first entry if after is empty. The returned token can be passed
+// to the next call; it is empty if there are no more entries.
+func (db *DB) ListPage(dir, after string, limit int) (names []string, next string, err error) {
+	defer db.wrapError("list", dir, &err)
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("invalid page limit: %d", limit)
+	}
+	tree, last, err := db.pageTree(dir, after)
+	if err != nil {
+		return nil, "", err
+	}
+	defer tree.Free()
+	hide := db.hidesInternal(db.fullKey(dir))
+	var lastKey string
+	for i := searchEntries(tree, last); i < tree.EntryCount(); i++ {
+		e := tree.EntryByIndex(i)
+		if db.hiddenEntry(e.Name, hide) {
+			continue
+		}
+		if len(names) == limit {
+			return names, pageToken(tree, lastKey), nil
+		}
+		names = append(names, db.unescapeKey(e.Name))
+		lastKey = entryKey(e)
+	}
+	return names, "", nil
+}
+
+// WalkPage is like Walk, but calls h for at most limit objects, starting
+// after the object recorded in the resume token `after`, or from the
+// beginning of the walk if after is empty. The returned token can be
+// passed to the next call; it is empty if the walk is complete.
+func (db *DB) WalkPage(key, after string, limit int, h func(string, git.Object) error) (next string, err error) {
+	defer db.wrapError("walk", key, &err)
+	if limit <= 0 {
+		return "", fmt.Errorf("invalid page limit: %d", limit)
+	}
+	tree, last, err := db.pageTree(key, after)
+	if err != nil {
+		return "", err
+	}
+	defer tree.Free()
+	var (
+		lastPath string
+		count    int
+	)
+	visit := func(p string, e *git.TreeEntry) error {
+		if count == limit {
+			return ErrStopWalk
+		}
+		obj, err := db.repo.Lookup(e.Id)
+		if err != nil {
+			return err
+		}
+		defer obj.Free()
+		if err := h(db.unescapeKey(strings.TrimSuffix(p, "/")), obj); err != nil {
+			return err
+		}
+		count++
+		lastPath = p
+		return nil
+	}
+	var resume []string
+	if last != "" {
+		resume = splitKeys(last)
+	}
+	hideRoot := db.hidesInternal(db.fullKey(key))
+	err = db.walkPageTree(tree, "", resume, hideRoot, visit)
+	if err == ErrStopWalk {
+		return pageToken(tree, lastPath), nil
+	}
+	return "", err
+}
+
+// pageTree returns the tree to list for the subtree at key and the resume
+// token `after`, along with the position recorded in the token.
+func (db *DB) pageTree(key, after string) (*git.Tree, string, error) {
+	if err := db.checkClosed(); err != nil {
+		return nil, "", err
+	}
+	if after != "" {
+		i := strings.Index(after, ":")
+		if i < 0 {
+			return nil, "", fmt.Errorf("invalid page token: %q", after)
+		}
+		id, err := git.NewOid(after[:i])
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid page token: %q", after)
+		}
+		if tree, err := lookupTree(db.repo, id); err == nil {
+			return tree, after[i+1:], nil
+		}
+		after = after[i+1:]
+	}
+	tree, err := db.snapshot()
+	if err != nil {
+		return nil, "", err
+	}
+	if tree == nil {
+		return nil, "", ErrNotExist
+	}
+	subtree, err := TreeScope(db.repo, tree, db.fullKey(key))
+	if err != nil {
+		if err = db.lookupError(tree, db.fullKey(key), err); git.IsErrorCode(err, git.ErrNotFound) {
+			return nil, "", ErrNotExist
+		}
+		return nil, "", err
+	}
+	return subtree, after, nil
+}
+
+// walkPageTree walks t in pre-order, like git_tree_walk, calling visit
+// with the path of each entry relative to the walked tree. The paths of
+// subtrees end with a slash.
+// Entries up to the path given by the components of resume are skipped.
+func (db *DB) walkPageTree(t *git.Tree, prefix string, resume []string, hideInternal bool, visit func(string, *git.TreeEntry) error) error {
+	start := uint64(0)
+	if len(resume) > 0 {
+		start = searchEntries(t, strings.TrimSuffix(resume[0], "/"))
+	}
+	for i := start; i < t.EntryCount(); i++ {
+		e := t.EntryByIndex(i)
+		if db.hiddenEntry(e.Name, hideInternal) {
+			continue
+		}
+		k := entryKey(e)
+		p := prefix + k
+		var sub []string
+		if len(resume) > 0 && k == resume[0] {
+			// On the path of the last visited entry: skip it,
+			// and resume the walk of its subtree
+			sub = resume[1:]
+		} else {
+			if len(resume) > 0 && k < resume[0] {
+				continue
+			}
+			if err := visit(p, e); err != nil {
+				return err
+			}
+		}
+		resume = nil
+		if e.Type != git.ObjectTree {
+			continue
+		}
+		subtree, err := lookupTree(db.repo, e.Id)
+		if err != nil {
+			return err
+		}
+		err = db.walkPageTree(subtree, p, sub, false, visit)
+		subtree.Free()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entryKey returns the name of e as it is compared to sort git trees:
+// the names of subtrees are followed by a slash.
+func entryKey(e *git.TreeEntry) string {
+	if e.Type == git.ObjectTree {
+		return e.Name + "/"
+	}
+	return e.Name
+}
+
+// searchEntries returns the index of the first entry of t which comes
+// after key in the tree, or 0 if key is empty.
+func searchEntries(t *git.Tree, key string) uint64 {
+	if key == "" {
+		return 0
+	}
+	n := int(t.EntryCount())
+	return uint64(sort.Search(n, func(i int) bool {
+		return entryKey(t.EntryByIndex(uint64(i))) > key
+	}))
+}
+
+// splitKeys splits a path returned by walkPageTree into entry keys.
+func splitKeys(p string) []string {
+	keys := strings.SplitAfter(p, "/")
+	if keys[len(keys)-1] == "" {
+		keys = keys[:len(keys)-1]
+	}
+	return keys
+}
+
+func pageToken(t *git.Tree, last string) string {
+	return t.Id().String() + ":" + last
+}
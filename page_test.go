@@ -0,0 +1,80 @@
+package libpack
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	git "github.com/libgit2/git2go"
+)
+
+func TestListPage(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	for i := 0; i < 10; i++ {
+		db.Set(fmt.Sprintf("dir/%d", i), "x")
+	}
+	db.Set("dir/5.txt", "x")
+	db.Set("dir/5/sub", "x")
+	var all []string
+	after := ""
+	for {
+		names, next, err := db.ListPage("dir", after, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) > 3 {
+			t.Fatalf("%v", names)
+		}
+		all = append(all, names...)
+		if next == "" {
+			break
+		}
+		after = next
+		// Changes made between pages are not seen
+		db.Set("dir/00", "x")
+	}
+	if strings.Join(all, ",") != "0,1,2,3,4,5.txt,5,6,7,8,9" {
+		t.Fatalf("%v", all)
+	}
+	if _, _, err := db.ListPage("missing", "", 3); err != ErrNotExist {
+		t.Fatalf("%v", err)
+	}
+	if _, _, err := db.ListPage("dir", "bogus", 3); err == nil {
+		t.Fatalf("invalid tokens should be rejected")
+	}
+}
+
+func TestWalkPage(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("a/b/c", "x")
+	db.Set("a/b/d", "x")
+	db.Set("a/e", "x")
+	db.Set("f", "x")
+	var walked []string
+	db.Walk("/", func(key string, obj git.Object) error {
+		walked = append(walked, key)
+		return nil
+	})
+	for _, limit := range []int{1, 2, 3, 100} {
+		var all []string
+		after := ""
+		for {
+			next, err := db.WalkPage("/", after, limit, func(key string, obj git.Object) error {
+				all = append(all, key)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next == "" {
+				break
+			}
+			after = next
+		}
+		if strings.Join(all, ",") != strings.Join(walked, ",") {
+			t.Fatalf("limit %d: %v != %v", limit, all, walked)
+		}
+	}
+}
@@ -0,0 +1,780 @@
+package libpack
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+// MaxDiffSize is the size above which the contents of values are not
+// compared line by line by DiffKey and DiffPatch. Blobs stored with a
+// larger size are not read at all.
+var MaxDiffSize = 8 << 20
+
+// diffContext is the number of unchanged lines around each hunk.
+const diffContext = 3
+
+// DiffKey writes in w a unified diff of the value at key between
+// commits `from` and `to`. An empty commit id designates the uncommitted
+// tree. A key missing on one side is diffed against an empty value.
+// For binary values (containing a NUL byte) and values larger than
+// MaxDiffSize, only their sizes are written.
+// Nothing is written if the value is the same on both sides. If key
+// exists on neither side, ErrNotExist is returned.
+func (db *DB) DiffKey(from, to, key string, w io.Writer) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("diff", key, &err)
+	a, b, err := db.diffTrees(from, to)
+	if err != nil {
+		return err
+	}
+	defer freeTree(a)
+	defer freeTree(b)
+	full := db.fullKey(key)
+	oldEntry := treeBlobEntry(a, full)
+	newEntry := treeBlobEntry(b, full)
+	if oldEntry == nil && newEntry == nil {
+		return ErrNotExist
+	}
+	return db.writeKeyDiff(w, TreePath(key), oldEntry, newEntry)
+}
+
+// DiffPatch writes in w a git-style patch of all the values changed
+// between commits `from` and `to`, relative to the scope of the database.
+// An empty commit id designates the uncommitted tree. See DiffKey.
+func (db *DB) DiffPatch(from, to string, w io.Writer) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("diff", "", &err)
+	a, b, err := db.diffTrees(from, to)
+	if err != nil {
+		return err
+	}
+	defer freeTree(a)
+	defer freeTree(b)
+	changes, err := TreeDiff(db.repo, a, b)
+	if err != nil {
+		return err
+	}
+	scope := TreePath(db.scope)
+	// Paths in the tree, by key relative to the scope
+	paths := make(map[string]string)
+	var keys []string
+	for _, c := range changes {
+		if isKeepEntry(c.Key) && !db.root().showInternal {
+			continue
+		}
+		var key string
+		if scope == "/" {
+			if isInternal(c.Key) && db.hidesInternal(scope) {
+				continue
+			}
+			key = c.Key
+		} else if strings.HasPrefix(c.Key, scope+"/") {
+			key = strings.TrimPrefix(c.Key, scope+"/")
+		} else {
+			continue
+		}
+		key = db.unescapeKey(key)
+		paths[key] = c.Key
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		p := paths[key]
+		if err := db.writeKeyDiff(w, key, treeBlobEntry(a, p), treeBlobEntry(b, p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffTrees returns the trees of commits from and to, or the
+// uncommitted tree for empty ids. Both trees must be freed with
+// freeTree.
+func (db *DB) diffTrees(from, to string) (a, b *git.Tree, err error) {
+	if a, err = db.commitOrUncommittedTree(from); err != nil {
+		return nil, nil, err
+	}
+	if b, err = db.commitOrUncommittedTree(to); err != nil {
+		freeTree(a)
+		return nil, nil, err
+	}
+	return a, b, nil
+}
+
+func (db *DB) commitOrUncommittedTree(id string) (*git.Tree, error) {
+	if id == "" {
+		tree, err := db.snapshot()
+		if err != nil || tree == nil {
+			return nil, err
+		}
+		// The uncommitted tree may be freed by concurrent changes
+		return lookupTree(db.repo, tree.Id())
+	}
+	oid, err := git.NewOid(id)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := lookupCommit(db.repo, oid)
+	if err != nil {
+		return nil, err
+	}
+	defer commit.Free()
+	return commit.Tree()
+}
+
+func freeTree(t *git.Tree) {
+	if t != nil {
+		t.Free()
+	}
+}
+
+// treeBlobEntry returns the blob at key in t, or nil if there is none.
+func treeBlobEntry(t *git.Tree, key string) *blobEntry {
+	if t == nil {
+		return nil
+	}
+	e, err := t.EntryByPath(TreePath(key))
+	if err != nil || e.Type != git.ObjectBlob {
+		return nil
+	}
+	return &blobEntry{e.Id, e.Filemode}
+}
+
+// writeKeyDiff writes the diff of key between the blobs oldEntry and
+// newEntry, either of which may be nil.
+func (db *DB) writeKeyDiff(w io.Writer, key string, oldEntry, newEntry *blobEntry) error {
+	if oldEntry != nil && newEntry != nil && oldEntry.id.Equal(newEntry.id) {
+		return nil
+	}
+	// Blobs larger than MaxDiffSize are not read
+	oldSize, err := entrySize(db.repo, oldEntry)
+	if err != nil {
+		return err
+	}
+	newSize, err := entrySize(db.repo, newEntry)
+	if err != nil {
+		return err
+	}
+	if oldSize > int64(MaxDiffSize) || newSize > int64(MaxDiffSize) {
+		writeDiffHeader(w, key, oldEntry, newEntry)
+		_, err := fmt.Fprintf(w, "binary blobs differ, %d vs %d bytes\n", oldSize, newSize)
+		return err
+	}
+	var oldValue, newValue string
+	if oldEntry != nil {
+		if oldValue, err = db.blobValue(*oldEntry); err != nil {
+			return err
+		}
+	}
+	if newEntry != nil {
+		if newValue, err = db.blobValue(*newEntry); err != nil {
+			return err
+		}
+	}
+	if oldValue == newValue && oldEntry != nil && newEntry != nil {
+		// Same value, stored differently
+		return nil
+	}
+	oldName, newName := writeDiffHeader(w, key, oldEntry, newEntry)
+	if isBinary(oldValue) || isBinary(newValue) || len(oldValue) > MaxDiffSize || len(newValue) > MaxDiffSize {
+		_, err := fmt.Fprintf(w, "binary blobs differ, %d vs %d bytes\n", len(oldValue), len(newValue))
+		return err
+	}
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", oldName, newName)
+	return writeHunks(w, diffLines(splitLines(oldValue), splitLines(newValue)))
+}
+
+// writeDiffHeader writes the header of the diff of key, and returns the
+// names of both sides.
+func writeDiffHeader(w io.Writer, key string, oldEntry, newEntry *blobEntry) (oldName, newName string) {
+	fmt.Fprintf(w, "diff --git a/%s b/%s\n", key, key)
+	oldName, newName = "a/"+key, "b/"+key
+	switch {
+	case oldEntry == nil:
+		fmt.Fprintf(w, "new file mode %o\n", newEntry.mode)
+		oldName = "/dev/null"
+	case newEntry == nil:
+		fmt.Fprintf(w, "deleted file mode %o\n", oldEntry.mode)
+		newName = "/dev/null"
+	}
+	return oldName, newName
+}
+
+// entrySize returns the size of the blob of e as stored, or 0 if e is nil.
+func entrySize(r *git.Repository, e *blobEntry) (int64, error) {
+	if e == nil {
+		return 0, nil
+	}
+	return blobSize(r, e.id)
+}
+
+// blobSize returns the size of the blob id of r, without reading it.
+// git2go doesn't expose git_odb_read_header: shell out to git instead.
+func blobSize(r *git.Repository, id *git.Oid) (int64, error) {
+	out, err := exec.Command("git", "--git-dir", r.Path(), "cat-file", "-s", id.String()).Output()
+	if err != nil {
+		return 0, fmt.Errorf("git cat-file: %w", err)
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+}
+
+func isBinary(s string) bool {
+	if len(s) > 8000 {
+		s = s[:8000]
+	}
+	return strings.IndexByte(s, 0) >= 0
+}
+
+// splitLines splits s into lines, each ending with "\n" except maybe
+// the last one.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// A diffOp is a line of a diff: kind is ' ' for unchanged lines,
+// '-' for deleted lines and '+' for added lines.
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffLines returns the shortest edit script from a to b, using the
+// Myers algorithm.
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	off := max + 1
+	v := make([]int, 2*max+2)
+	var trace [][]int
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+	// Backtrack from the end
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[off+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, diffOp{'+', b[y-1]})
+			} else {
+				ops = append(ops, diffOp{'-', a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// writeHunks writes the changes of ops as unified diff hunks.
+func writeHunks(w io.Writer, ops []diffOp) error {
+	// Line numbers before each op
+	aLine := make([]int, len(ops)+1)
+	bLine := make([]int, len(ops)+1)
+	for i, op := range ops {
+		aLine[i+1], bLine[i+1] = aLine[i], bLine[i]
+		if op.kind != '+' {
+			aLine[i+1]++
+		}
+		if op.kind != '-' {
+			bLine[i+1]++
+		}
+	}
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for {
+			j := end + 1
+			for j < len(ops) && ops[j].kind == ' ' {
+				j++
+			}
+			if j < len(ops) && j-end-1 <= 2*diffContext {
+				end = j
+				continue
+			}
+			break
+		}
+		stop := end + diffContext + 1
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+		if _, err := fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(aLine[start], aLine[stop]-aLine[start]), hunkRange(bLine[start], bLine[stop]-bLine[start])); err != nil {
+			return err
+		}
+		for _, op := range ops[start:stop] {
+			line := op.line
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n\\ No newline at end of file\n"
+			}
+			if _, err := fmt.Fprintf(w, "%c%s", op.kind, line); err != nil {
+				return err
+			}
+		}
+		i = stop
+	}
+	return nil
+}
+
+// hunkRange formats the range of lines of a hunk, where before is the
+// number of lines before the hunk.
+func hunkRange(before, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", before)
+	case 1:
+		return fmt.Sprintf("%d", before+1)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
+
+// A PatchConflictError is returned by ApplyPatch when some changes of
+// the patch don't apply to the uncommitted tree.
+type PatchConflictError struct {
+	// Reason of the conflict, by key
+	Conflicts map[string]string
+}
+
+func (e *PatchConflictError) Error() string {
+	keys := make([]string, 0, len(e.Conflicts))
+	for k := range e.Conflicts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	msgs := make([]string, len(keys))
+	for i, k := range keys {
+		msgs[i] = fmt.Sprintf("%s: %s", k, e.Conflicts[k])
+	}
+	return fmt.Sprintf("patch does not apply: %s", strings.Join(msgs, "; "))
+}
+
+// A filePatch is the part of a patch changing one key.
+type filePatch struct {
+	key     string
+	created bool
+	deleted bool
+	binary  bool
+	hunks   []hunk
+}
+
+type hunk struct {
+	oldStart, oldCount int
+	ops                []diffOp
+}
+
+// ApplyPatch applies a git-style patch, as written by DiffPatch or
+// `git diff`, to the uncommitted tree. Paths are relative to the scope of
+// the database.
+// Hunks must match the current values exactly, but may be found at a
+// different line than the one recorded in the patch. If any change does
+// not apply, nothing is changed and a *PatchConflictError is returned.
+// Values are read and written with the database locked, so the patch is
+// applied atomically: if writing one of the values fails, the others are
+// rolled back.
+// Binary patches, renames and copies are not supported.
+func (db *DB) ApplyPatch(r io.Reader) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("apply-patch", "", &err)
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	patches, err := parsePatch(string(data))
+	if err != nil {
+		return err
+	}
+	for _, p := range patches {
+		if p.binary {
+			return fmt.Errorf("%s: binary patches are not supported", p.key)
+		}
+		if err := db.checkReserved(p.key); err != nil {
+			return err
+		}
+	}
+	root := db.root()
+	defer root.afterWrite(&err)
+	root.l.Lock()
+	defer root.l.Unlock()
+	conflicts := make(map[string]string)
+	set := make(map[string]string)
+	var del []string
+	for _, p := range patches {
+		key := db.fullKey(p.key)
+		e, err := root.entryLocked(key)
+		if err != nil && !isNotExist(err) {
+			return err
+		}
+		exists := e != nil
+		if p.created && exists {
+			conflicts[p.key] = "already exists"
+			continue
+		}
+		if !p.created && !exists {
+			conflicts[p.key] = "does not exist"
+			continue
+		}
+		var old string
+		if exists {
+			data, err := blobContents(root.repo, e.id)
+			if err != nil {
+				return err
+			}
+			if old, err = root.decodeValue(data, e.mode); err != nil {
+				return err
+			}
+		}
+		value, reason := applyHunks(old, p.hunks)
+		if reason != "" {
+			conflicts[p.key] = reason
+			continue
+		}
+		if p.deleted {
+			if value != "" {
+				conflicts[p.key] = "deleted value does not match"
+				continue
+			}
+			del = append(del, key)
+			continue
+		}
+		set[key] = value
+	}
+	if len(conflicts) > 0 {
+		return &PatchConflictError{Conflicts: conflicts}
+	}
+	return root.setAndDeleteLocked(set, del)
+}
+
+// setAndDeleteLocked deletes the keys of del and sets the keys of kv,
+// all at once: if one of them fails, the uncommitted tree and the
+// pending changes are restored. Keys are full paths. The caller must
+// hold the lock.
+func (db *DB) setAndDeleteLocked(kv map[string]string, del []string) (err error) {
+	tree := db.tree
+	pending := make(map[string]blobEntry, len(db.pending))
+	for k, e := range db.pending {
+		pending[k] = e
+	}
+	pendingDirs := make(map[string]bool, len(db.pendingDirs))
+	for k := range db.pendingDirs {
+		pendingDirs[k] = true
+	}
+	defer func() {
+		if err != nil {
+			db.tree, db.pending, db.pendingDirs = tree, pending, pendingDirs
+		}
+	}()
+	for _, k := range del {
+		if err := db.stage(k, nil, 0); err != nil {
+			return err
+		}
+		annot := path.Join(AnnotationTree, MkAnnotation(k))
+		if exists, err := db.hasPathLocked(annot); err != nil {
+			return err
+		} else if exists {
+			if err := db.stage(annot, nil, 0); err != nil {
+				return err
+			}
+		}
+	}
+	for k, v := range kv {
+		if err := db.checkValueLocked(k, v); err != nil {
+			return err
+		}
+		data, mode, err := db.encodeValue(v)
+		if err != nil {
+			return err
+		}
+		id, err := createBlob(db.repo, data)
+		if err != nil {
+			return err
+		}
+		if err := db.stage(k, id, mode); err != nil {
+			return err
+		}
+		if db.modTime {
+			if err := db.stageModTime(k); err != nil {
+				return err
+			}
+		}
+		if err := db.stageContentType(k, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyHunks applies hunks to value. If they don't apply, the reason is
+// returned.
+func applyHunks(value string, hunks []hunk) (string, string) {
+	lines := splitLines(value)
+	if value == "" {
+		lines = nil
+	}
+	var out []string
+	cur := 0
+	for i, h := range hunks {
+		var oldLines, newLines []string
+		for _, op := range h.ops {
+			if op.kind != '+' {
+				oldLines = append(oldLines, op.line)
+			}
+			if op.kind != '-' {
+				newLines = append(newLines, op.line)
+			}
+		}
+		pos := h.oldStart - 1
+		if h.oldCount == 0 {
+			pos = h.oldStart
+		}
+		pos = findLines(lines, oldLines, pos, cur)
+		if pos < 0 {
+			return "", fmt.Sprintf("hunk %d does not match at line %d", i+1, h.oldStart)
+		}
+		out = append(out, lines[cur:pos]...)
+		out = append(out, newLines...)
+		cur = pos + len(oldLines)
+	}
+	out = append(out, lines[cur:]...)
+	return strings.Join(out, ""), ""
+}
+
+// findLines returns the position of sub in lines closest to pos, and not
+// before min, or -1 if sub is not found.
+func findLines(lines, sub []string, pos, min int) int {
+	matches := func(p int) bool {
+		if p < min || p+len(sub) > len(lines) {
+			return false
+		}
+		for i, l := range sub {
+			if lines[p+i] != l {
+				return false
+			}
+		}
+		return true
+	}
+	for delta := 0; pos-delta >= min || pos+delta <= len(lines); delta++ {
+		if matches(pos - delta) {
+			return pos - delta
+		}
+		if matches(pos + delta) {
+			return pos + delta
+		}
+	}
+	return -1
+}
+
+// parsePatch parses a git-style patch.
+func parsePatch(patch string) ([]*filePatch, error) {
+	var (
+		patches []*filePatch
+		cur     *filePatch
+		h       *hunk
+		// Lines left in the current hunk
+		oldLeft, newLeft int
+	)
+	lines := splitLines(patch)
+	for n, line := range lines {
+		if h != nil && (oldLeft > 0 || newLeft > 0) {
+			if line == "" || line == "\n" {
+				// Some tools strip the space of empty context lines
+				line = " " + line
+			}
+			kind := line[0]
+			text := line[1:]
+			switch kind {
+			case ' ':
+				oldLeft--
+				newLeft--
+			case '-':
+				oldLeft--
+			case '+':
+				newLeft--
+			case '\\':
+				stripLastNewline(h)
+				continue
+			default:
+				return nil, fmt.Errorf("line %d: invalid hunk line: %q", n+1, line)
+			}
+			h.ops = append(h.ops, diffOp{kind, text})
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, `\`):
+			if h == nil {
+				return nil, fmt.Errorf("line %d: unexpected %q", n+1, line)
+			}
+			stripLastNewline(h)
+		case strings.HasPrefix(line, "diff --git "):
+			cur = &filePatch{}
+			h = nil
+			patches = append(patches, cur)
+			fields := strings.Fields(line)
+			if len(fields) == 4 {
+				cur.key = strings.TrimPrefix(fields[3], "b/")
+			}
+		case strings.HasPrefix(line, "--- "):
+			if cur == nil || cur.hunks != nil {
+				cur = &filePatch{}
+				patches = append(patches, cur)
+			}
+			h = nil
+			if name := patchPath(line[4:]); name == "" {
+				cur.created = true
+			} else {
+				cur.key = name
+			}
+		case strings.HasPrefix(line, "+++ "):
+			if cur == nil {
+				return nil, fmt.Errorf("line %d: unexpected %q", n+1, line)
+			}
+			if name := patchPath(line[4:]); name == "" {
+				cur.deleted = true
+			} else {
+				cur.key = name
+			}
+		case strings.HasPrefix(line, "@@ "):
+			if cur == nil {
+				return nil, fmt.Errorf("line %d: hunk outside of a file", n+1)
+			}
+			oldStart, oldCount, _, newCount, err := parseHunkHeader(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n+1, err)
+			}
+			cur.hunks = append(cur.hunks, hunk{oldStart: oldStart, oldCount: oldCount})
+			h = &cur.hunks[len(cur.hunks)-1]
+			oldLeft, newLeft = oldCount, newCount
+		case cur != nil && strings.HasPrefix(line, "new file mode"):
+			cur.created = true
+		case cur != nil && strings.HasPrefix(line, "deleted file mode"):
+			cur.deleted = true
+		case cur != nil && (strings.HasPrefix(line, "Binary files") || strings.HasPrefix(line, "binary blobs differ") || strings.HasPrefix(line, "GIT binary patch")):
+			cur.binary = true
+		case cur != nil && (strings.HasPrefix(line, "rename ") || strings.HasPrefix(line, "copy ")):
+			return nil, fmt.Errorf("line %d: renames and copies are not supported", n+1)
+		}
+	}
+	if h != nil && (oldLeft > 0 || newLeft > 0) {
+		return nil, fmt.Errorf("truncated hunk")
+	}
+	for _, p := range patches {
+		if p.key == "" {
+			return nil, fmt.Errorf("missing file name in patch")
+		}
+	}
+	return patches, nil
+}
+
+// stripLastNewline handles a "\ No newline at end of file" line.
+func stripLastNewline(h *hunk) {
+	if len(h.ops) > 0 {
+		last := &h.ops[len(h.ops)-1]
+		last.line = strings.TrimSuffix(last.line, "\n")
+	}
+}
+
+// patchPath returns the key named in a ---/+++ line of a patch, or an
+// empty string for /dev/null.
+func patchPath(name string) string {
+	name = strings.TrimRight(name, "\n")
+	// Strip timestamps added by diff(1)
+	if i := strings.Index(name, "\t"); i >= 0 {
+		name = name[:i]
+	}
+	if name == "/dev/null" {
+		return ""
+	}
+	if i := strings.Index(name, "/"); i >= 0 && (strings.HasPrefix(name, "a/") || strings.HasPrefix(name, "b/")) {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// parseHunkHeader parses a line such as "@@ -1,3 +1,4 @@".
+func parseHunkHeader(line string) (oldStart, oldCount, newStart, newCount int, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || fields[0] != "@@" || fields[3] != "@@" {
+		return 0, 0, 0, 0, fmt.Errorf("invalid hunk header: %q", line)
+	}
+	if oldStart, oldCount, err = parseRange(fields[1], "-"); err != nil {
+		return
+	}
+	newStart, newCount, err = parseRange(fields[2], "+")
+	return
+}
+
+func parseRange(s, prefix string) (start, count int, err error) {
+	if !strings.HasPrefix(s, prefix) {
+		return 0, 0, fmt.Errorf("invalid hunk range: %q", s)
+	}
+	parts := strings.SplitN(s[1:], ",", 2)
+	if start, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0, err
+	}
+	count = 1
+	if len(parts) == 2 {
+		if count, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, err
+		}
+	}
+	return start, count, nil
+}
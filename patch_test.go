@@ -0,0 +1,244 @@
+package libpack
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	ops := diffLines(splitLines("a\nb\nc\n"), splitLines("a\nB\nc\nd"))
+	var kinds []string
+	for _, op := range ops {
+		kinds = append(kinds, string(op.kind)+op.line)
+	}
+	if strings.Join(kinds, "|") != " a\n|-b\n|+B\n| c\n|+d" {
+		t.Fatalf("%q", kinds)
+	}
+}
+
+func TestDiffKey(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("conf/k", "a\nb\nc\n")
+	db.Set("conf/deleted", "gone\n")
+	db.Set("conf/bin", "\x00\x01")
+	if err := db.Commit("first"); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := db.Head()
+	db.Set("conf/k", "a\nB\nc\n")
+	db.Delete("conf/deleted")
+	db.Set("conf/added", "new")
+	db.Set("conf/bin", "\x00\x01\x02")
+	if err := db.Commit("second"); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := db.Head()
+
+	var buf bytes.Buffer
+	if err := db.DiffKey(first, second, "conf/k", &buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := "diff --git a/conf/k b/conf/k\n--- a/conf/k\n+++ b/conf/k\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"
+	if buf.String() != expected {
+		t.Fatalf("%q", buf.String())
+	}
+	buf.Reset()
+	if err := db.DiffKey(first, second, "conf/bin", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "binary blobs differ, 2 vs 3 bytes") {
+		t.Fatalf("%q", buf.String())
+	}
+	if err := db.DiffKey(first, second, "missing", &buf); err != ErrNotExist {
+		t.Fatalf("%v", err)
+	}
+
+	buf.Reset()
+	if err := db.Scope("conf").DiffPatch(first, second, &buf); err != nil {
+		t.Fatal(err)
+	}
+	expected = "diff --git a/added b/added\nnew file mode 100644\n--- /dev/null\n+++ b/added\n@@ -0,0 +1 @@\n+new\n\\ No newline at end of file\n" +
+		"diff --git a/bin b/bin\nbinary blobs differ, 2 vs 3 bytes\n" +
+		"diff --git a/deleted b/deleted\ndeleted file mode 100644\n--- a/deleted\n+++ /dev/null\n@@ -1 +0,0 @@\n-gone\n" +
+		"diff --git a/k b/k\n--- a/k\n+++ b/k\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"
+	if buf.String() != expected {
+		t.Fatalf("%s", buf.String())
+	}
+
+	// Uncommitted changes
+	db.Set("conf/k", "a\nB\nc\nd\n")
+	buf.Reset()
+	if err := db.DiffKey(second, "", "conf/k", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(buf.String(), "@@ -1,3 +1,4 @@\n a\n B\n c\n+d\n") {
+		t.Fatalf("%q", buf.String())
+	}
+}
+
+func TestDiffModesAndLargeValues(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("large", "small\n")
+	if err := db.Commit("first"); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := db.Head()
+	if err := db.SetWithMode("script", "#!/bin/sh\n", 0755); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("large", strings.Repeat("x\n", 100))
+	if err := db.Commit("second"); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := db.Head()
+	defer func(max int) { MaxDiffSize = max }(MaxDiffSize)
+	MaxDiffSize = 50
+	var buf bytes.Buffer
+	if err := db.DiffPatch(first, second, &buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := "diff --git a/large b/large\nbinary blobs differ, 6 vs 200 bytes\n" +
+		"diff --git a/script b/script\nnew file mode 100755\n--- /dev/null\n+++ b/script\n@@ -0,0 +1 @@\n+#!/bin/sh\n"
+	if buf.String() != expected {
+		t.Fatalf("%q", buf.String())
+	}
+	buf.Reset()
+	if err := db.DiffPatch(second, first, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "deleted file mode 100755\n") {
+		t.Fatalf("%q", buf.String())
+	}
+}
+
+func TestDiffHunks(t *testing.T) {
+	var a, b []string
+	for i := 0; i < 20; i++ {
+		line := string('a'+rune(i)) + "\n"
+		a = append(a, line)
+		if i == 2 || i == 15 {
+			line = "changed\n"
+		}
+		b = append(b, line)
+	}
+	var buf bytes.Buffer
+	if err := writeHunks(&buf, diffLines(a, b)); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(buf.String(), "@@ -") != 2 || !strings.Contains(buf.String(), "@@ -1,6 +1,6 @@\n") || !strings.Contains(buf.String(), "@@ -13,7 +13,7 @@\n") {
+		t.Fatalf("%s", buf.String())
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	src := tmpDB(t, "")
+	defer nukeDB(src)
+	src.Set("k", "a\nb\nc\n")
+	src.Set("deleted", "gone\n")
+	if err := src.Commit("first"); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := src.Head()
+	src.Set("k", "a\nB\nc\n")
+	src.Delete("deleted")
+	src.Set("dir/added", "new")
+	if err := src.Commit("second"); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := src.Head()
+	var patch bytes.Buffer
+	if err := src.DiffPatch(first, second, &patch); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := tmpDB(t, "")
+	defer nukeDB(dst)
+	dst.Set("k", "a\nb\nc\n")
+	dst.Set("deleted", "gone\n")
+	if err := dst.ApplyPatch(bytes.NewReader(patch.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, dst, "k", "a\nB\nc\n")
+	assertGet(t, dst, "dir/added", "new")
+	assertNotExist(t, dst, "deleted")
+
+	// Conflicts leave the tree unchanged
+	conflicting := tmpDB(t, "")
+	defer nukeDB(conflicting)
+	conflicting.Set("k", "x\ny\nz\n")
+	conflicting.Set("deleted", "gone\n")
+	err := conflicting.ApplyPatch(bytes.NewReader(patch.Bytes()))
+	cerr, ok := err.(*PatchConflictError)
+	if !ok {
+		t.Fatalf("%v", err)
+	}
+	if len(cerr.Conflicts) != 1 || cerr.Conflicts["k"] == "" {
+		t.Fatalf("%#v", cerr.Conflicts)
+	}
+	assertGet(t, conflicting, "k", "x\ny\nz\n")
+	assertGet(t, conflicting, "deleted", "gone\n")
+	assertNotExist(t, conflicting, "dir/added")
+}
+
+func TestApplyPatchRollback(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("deleted", "gone\n")
+	db.Set("k", "a\n")
+	if err := db.Commit("first"); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := db.Head()
+	db.Delete("deleted")
+	db.Set("k", "rejected\n")
+	if err := db.Commit("second"); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := db.Head()
+	db.AddValidator("k", func(key string, value []byte) error {
+		if string(value) == "rejected\n" {
+			return errors.New("rejected")
+		}
+		return nil
+	})
+	var reverse bytes.Buffer
+	if err := db.DiffPatch(second, first, &reverse); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ApplyPatch(&reverse); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db, "deleted", "gone\n")
+	// The validator fails after the deletion was staged
+	var forward bytes.Buffer
+	if err := db.DiffPatch(first, second, &forward); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.ApplyPatch(&forward).(*ValidationError); !ok {
+		t.Fatalf("the patch should be rejected")
+	}
+	assertGet(t, db, "deleted", "gone\n")
+	assertGet(t, db, "k", "a\n")
+}
+
+func TestParsePatch(t *testing.T) {
+	patch := "--- a/k\t2014-01-01\n+++ b/k\t2014-01-02\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n\\ No newline at end of file\n"
+	patches, err := parsePatch(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patches) != 1 || patches[0].key != "k" || len(patches[0].hunks) != 1 {
+		t.Fatalf("%#v", patches)
+	}
+	value, reason := applyHunks("0\na\nb\n", patches[0].hunks)
+	if reason != "" || value != "0\na\nc" {
+		t.Fatalf("%q %s", value, reason)
+	}
+	if _, err := parsePatch("@@ -1 +1 @@\n-a\n+b\n"); err == nil {
+		t.Fatal("hunk outside of a file should fail")
+	}
+}
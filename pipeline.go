@@ -81,8 +81,9 @@ type addArg struct {
 
 // Mkdir appends a new `mkdir` instruction to a pipeline, and
 // returns the new combined pipeline.
-// `mkdir` inserts an empty subtree in the input tree, at
-// the path `key`.
+// `mkdir` inserts a subtree in the input tree, at the path `key`,
+// unless there is already one. The subtree only contains KeepEntry,
+// so that it is not dropped by merges and checkouts.
 func (t *Pipeline) Mkdir(key string) *Pipeline {
 	return t.setPrev(OpMkdir, key)
 }
@@ -141,7 +142,7 @@ func (t *Pipeline) Run() (*git.Tree, error) {
 			case *Pipeline:
 				{
 					if out, err := val.Run(); err != nil {
-						return nil, fmt.Errorf("add: run source: %v", err)
+						return nil, fmt.Errorf("add: run source: %w", err)
 					} else {
 						id = out.Id()
 					}
@@ -176,11 +177,23 @@ func (t *Pipeline) Run() (*git.Tree, error) {
 			if !ok {
 				return nil, fmt.Errorf("mkdir: invalid argument: %v", t.arg)
 			}
-			empty, err := emptyTree(t.repo)
+			if in != nil {
+				if e, err := in.EntryByPath(TreePath(key)); err == nil && e.Type == git.ObjectTree {
+					return in, nil
+				}
+			}
+			if TreePath(key) == "/" {
+				empty, err := emptyTree(t.repo)
+				if err != nil {
+					return nil, err
+				}
+				return treeAdd(t.repo, in, key, empty, true)
+			}
+			keep, err := keepTree(t.repo)
 			if err != nil {
 				return nil, err
 			}
-			return treeAdd(t.repo, in, key, empty, true)
+			return treeAdd(t.repo, in, key, keep, true)
 		}
 	case OpSet:
 		{
@@ -191,26 +204,9 @@ func (t *Pipeline) Run() (*git.Tree, error) {
 			if len(kv) != 2 {
 				return nil, fmt.Errorf("invalid argument")
 			}
-			// FIXME: libgit2 crashes if value is empty.
-			// Work around this by shelling out to git.
-			var (
-				id  *git.Oid
-				err error
-			)
-			if kv[1] == "" {
-				out, err := exec.Command("git", "--git-dir", t.repo.Path(), "hash-object", "-w", "--stdin").Output()
-				if err != nil {
-					return nil, fmt.Errorf("git hash-object: %v", err)
-				}
-				id, err = git.NewOid(strings.Trim(string(out), " \t\r\n"))
-				if err != nil {
-					return nil, fmt.Errorf("git newoid %v", err)
-				}
-			} else {
-				id, err = t.repo.CreateBlobFromBuffer([]byte(kv[1]))
-				if err != nil {
-					return nil, err
-				}
+			id, err := createBlob(t.repo, kv[1])
+			if err != nil {
+				return nil, err
 			}
 			return treeAdd(t.repo, in, kv[0], id, true)
 		}
@@ -226,6 +222,24 @@ func (t *Pipeline) Run() (*git.Tree, error) {
 	return nil, fmt.Errorf("invalid op: %v", t.op)
 }
 
+// createBlob writes value in a new blob, and returns its id.
+func createBlob(r *git.Repository, value string) (*git.Oid, error) {
+	// FIXME: libgit2 crashes if value is empty.
+	// Work around this by shelling out to git.
+	if value == "" {
+		out, err := exec.Command("git", "--git-dir", r.Path(), "hash-object", "-w", "--stdin").Output()
+		if err != nil {
+			return nil, fmt.Errorf("git hash-object: %w", err)
+		}
+		id, err := git.NewOid(strings.Trim(string(out), " \t\r\n"))
+		if err != nil {
+			return nil, fmt.Errorf("git newoid %w", err)
+		}
+		return id, nil
+	}
+	return r.CreateBlobFromBuffer([]byte(value))
+}
+
 func (t *Pipeline) setPrev(op TreeOp, arg interface{}) *Pipeline {
 	return &Pipeline{
 		prev: t,
@@ -0,0 +1,172 @@
+package libpack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+// A RefLogEntry records a change of the reference of a database.
+type RefLogEntry struct {
+	// Ids of the commit before and after the change. Old is empty if
+	// the reference was created.
+	Old string
+	New string
+	// Who made the change, and when
+	Name  string
+	Email string
+	When  time.Time
+	// The operation which changed the reference, and its message, for
+	// example "commit: add users" or "libpack.pull <url> <refspec>"
+	Message string
+}
+
+// enableRefLog makes sure that changes of ref in r are recorded in its
+// reflog. Bare repositories don't have reflogs by default.
+func enableRefLog(r *git.Repository, ref string) error {
+	if r.IsBare() {
+		config, err := r.Config()
+		if err != nil {
+			return err
+		}
+		defer config.Free()
+		if err := config.SetBool("core.logAllRefUpdates", true); err != nil {
+			return err
+		}
+	}
+	// git only logs the references under refs/heads by default: an
+	// existing log is always appended to.
+	return r.EnsureLog(ref)
+}
+
+// RefLog returns the latest changes of the reference of the database,
+// most recent first. If limit is positive, at most limit entries are
+// returned.
+// Only the changes made since the reflog was enabled, by Init, are
+// recorded.
+func (db *DB) RefLog(limit int) (entries []RefLogEntry, err error) {
+	if err := db.checkClosed(); err != nil {
+		return nil, err
+	}
+	defer db.wrapError("reflog", "", &err)
+	return readRefLog(db.repo, db.ref, limit)
+}
+
+// UndoLastRefChange moves the reference of the database back to the
+// commit it pointed to before its last change, as recorded in the
+// reflog. The undo is itself recorded, so calling UndoLastRefChange
+// twice restores the original head.
+// It fails if the reference was changed by someone else in the meantime,
+// if it was created by the last change, or if the previous commit is not
+// in the repository anymore. Uncommitted changes are lost, as with Update.
+func (db *DB) UndoLastRefChange() (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("undo", "", &err)
+	if db.parent != nil {
+		return db.parent.UndoLastRefChange()
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	entries, err := readRefLog(db.repo, db.ref, 1)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("%s: no reference change to undo", db.ref)
+	}
+	last := entries[0]
+	if last.Old == "" {
+		return fmt.Errorf("%s: the last change created the reference", db.ref)
+	}
+	id, err := git.NewOid(last.Old)
+	if err != nil {
+		return err
+	}
+	previous, err := lookupCommit(db.repo, id)
+	if err != nil {
+		return fmt.Errorf("%s: previous commit %s is not available: %w", db.ref, last.Old, err)
+	}
+	previous.Free()
+	// Only move the reference if it wasn't changed since the last entry
+	if err := runGit(db.repo, "update-ref", "-m", "libpack.undo "+last.New, db.ref, last.Old, last.New); err != nil {
+		return err
+	}
+	db.logf(LogInfo, "%s: %s -> %s (undo)", db.ref, last.New, last.Old)
+	return db.Update()
+}
+
+// readRefLog parses the reflog of ref in r, and returns at most limit
+// entries, most recent first. A missing reflog is empty.
+func readRefLog(r *git.Repository, ref string, limit int) ([]RefLogEntry, error) {
+	data, err := ioutil.ReadFile(path.Join(r.Path(), "logs", ref))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	var entries []RefLogEntry
+	for i := len(lines) - 1; i >= 0; i-- {
+		if limit > 0 && len(entries) == limit {
+			break
+		}
+		if lines[i] == "" {
+			continue
+		}
+		e, err := parseRefLogLine(lines[i])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ref, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// parseRefLogLine parses an entry of a reflog, in the format
+// "<old> <new> <name> <<email>> <unix time> <zone>\t<message>".
+func parseRefLogLine(line string) (RefLogEntry, error) {
+	var e RefLogEntry
+	header := line
+	if i := strings.Index(line, "\t"); i >= 0 {
+		header, e.Message = line[:i], line[i+1:]
+	}
+	lt, gt := strings.LastIndex(header, "<"), strings.LastIndex(header, ">")
+	ids := strings.Fields(header)
+	if len(ids) < 2 || lt < 0 || gt < lt {
+		return e, fmt.Errorf("invalid reflog entry: %q", line)
+	}
+	e.Old, e.New = ids[0], ids[1]
+	if strings.Trim(e.Old, "0") == "" {
+		e.Old = ""
+	}
+	e.Name = strings.TrimSpace(strings.TrimPrefix(header[:lt], ids[0]+" "+ids[1]))
+	e.Email = header[lt+1 : gt]
+	date := strings.Fields(header[gt+1:])
+	if len(date) != 2 || len(date[1]) != 5 {
+		return e, fmt.Errorf("invalid reflog entry: %q", line)
+	}
+	secs, err := strconv.ParseInt(date[0], 10, 64)
+	if err != nil {
+		return e, fmt.Errorf("invalid reflog entry: %q", line)
+	}
+	hours, err1 := strconv.Atoi(date[1][1:3])
+	minutes, err2 := strconv.Atoi(date[1][3:])
+	if err1 != nil || err2 != nil {
+		return e, fmt.Errorf("invalid reflog entry: %q", line)
+	}
+	offset := hours*3600 + minutes*60
+	if date[1][0] == '-' {
+		offset = -offset
+	}
+	e.When = time.Unix(secs, 0).In(time.FixedZone(date[1], offset))
+	return e, nil
+}
@@ -0,0 +1,102 @@
+package libpack
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRefLog(t *testing.T) {
+	db := tmpDB(t, "refs/heads/test")
+	defer nukeDB(db)
+	entries, err := db.RefLog(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("%#v", entries)
+	}
+	db.Set("foo", "1")
+	if err := db.Commit("first"); err != nil {
+		t.Fatal(err)
+	}
+	first := db.headId().String()
+	db.Set("foo", "2")
+	if err := db.Commit("second\n\nwith details"); err != nil {
+		t.Fatal(err)
+	}
+	second := db.headId().String()
+	entries, err = db.RefLog(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%#v", entries)
+	}
+	e := entries[0]
+	if e.Old != first || e.New != second || !strings.Contains(e.Message, "second") || strings.Contains(e.Message, "details") {
+		t.Fatalf("%#v", e)
+	}
+	if e.Name != DefaultAuthorName || e.Email != DefaultAuthorEmail || time.Since(e.When) > time.Hour {
+		t.Fatalf("%#v", e)
+	}
+	if e := entries[1]; e.Old != "" || e.New != first {
+		t.Fatalf("%#v", e)
+	}
+	if entries, _ := db.RefLog(1); len(entries) != 1 || entries[0].New != second {
+		t.Fatalf("%#v", entries)
+	}
+}
+
+func TestUndoLastRefChange(t *testing.T) {
+	db := tmpDB(t, "refs/heads/test")
+	defer nukeDB(db)
+	db.Set("foo", "1")
+	if err := db.Commit("first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UndoLastRefChange(); err == nil {
+		t.Fatalf("undoing the creation of the reference should fail")
+	}
+	first := db.headId().String()
+	db.Set("foo", "2")
+	if err := db.Commit("second"); err != nil {
+		t.Fatal(err)
+	}
+	second := db.headId().String()
+	if err := db.UndoLastRefChange(); err != nil {
+		t.Fatal(err)
+	}
+	if head := db.headId().String(); head != first {
+		t.Fatalf("%v", head)
+	}
+	assertGet(t, db, "foo", "1")
+	entries, err := db.RefLog(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := entries[0]; e.Old != second || e.New != first || !strings.HasPrefix(e.Message, "libpack.undo") {
+		t.Fatalf("%#v", e)
+	}
+	// Undoing the undo
+	if err := db.UndoLastRefChange(); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db, "foo", "2")
+}
+
+func TestParseRefLogLine(t *testing.T) {
+	e, err := parseRefLogLine("0000000000000000000000000000000000000000 1111111111111111111111111111111111111111 Jane Doe <jane@example.com> 1400000000 -0130\tcommit: hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Old != "" || e.New != strings.Repeat("1", 40) || e.Name != "Jane Doe" || e.Email != "jane@example.com" || e.Message != "commit: hello" {
+		t.Fatalf("%#v", e)
+	}
+	if _, offset := e.When.Zone(); e.When.Unix() != 1400000000 || offset != -5400 {
+		t.Fatalf("%v", e.When)
+	}
+	if _, err := parseRefLogLine("garbage"); err == nil {
+		t.Fatalf("should fail")
+	}
+}
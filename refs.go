@@ -0,0 +1,198 @@
+package libpack
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	git "github.com/libgit2/git2go"
+)
+
+// openDBs records the database handles open in this process, and the
+// path of their repository.
+var openDBs = struct {
+	sync.Mutex
+	m map[*DB]string
+}{m: make(map[*DB]string)}
+
+func registerDB(db *DB) {
+	openDBs.Lock()
+	openDBs.m[db] = db.repo.Path()
+	openDBs.Unlock()
+}
+
+func unregisterDB(db *DB) {
+	openDBs.Lock()
+	delete(openDBs.m, db)
+	openDBs.Unlock()
+}
+
+// liveDBs returns the database handles of the current process which
+// are open on the repository at repoPath.
+func liveDBs(repoPath string) []*DB {
+	openDBs.Lock()
+	defer openDBs.Unlock()
+	var dbs []*DB
+	for db, p := range openDBs.m {
+		if p == repoPath {
+			dbs = append(dbs, db)
+		}
+	}
+	return dbs
+}
+
+func isRefOpen(r *git.Repository, ref string) bool {
+	for _, db := range liveDBs(r.Path()) {
+		if db.ref == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// ListRefs returns the names of all references in the repository at
+// repoPath, sorted.
+func ListRefs(repoPath string) ([]string, error) {
+	r, err := git.OpenRepository(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Free()
+	iter, err := r.NewReferenceNameIterator()
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Free()
+	var refs []string
+	for {
+		name, err := iter.Next()
+		if isGitIterOver(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		refs = append(refs, name)
+	}
+	sort.Strings(refs)
+	return refs, nil
+}
+
+// DeleteRef deletes the reference `ref` in the repository at repoPath.
+// Objects are not deleted.
+// Deleting a reference which a database handle of the current process is
+// bound to is not allowed.
+func DeleteRef(repoPath, ref string) error {
+	r, err := git.OpenRepository(repoPath)
+	if err != nil {
+		return err
+	}
+	defer r.Free()
+	if isRefOpen(r, ref) {
+		return fmt.Errorf("%s is in use by an open database", ref)
+	}
+	reference, err := r.LookupReference(ref)
+	if err != nil {
+		return err
+	}
+	defer reference.Free()
+	return reference.Delete()
+}
+
+// CopyRef creates the reference `dst` in the repository at repoPath,
+// pointing to the same commit as `src`. If dst already exists, an error
+// is returned.
+// Since no objects are copied, this is a cheap way to fork a database.
+func CopyRef(repoPath, src, dst string) error {
+	r, err := git.OpenRepository(repoPath)
+	if err != nil {
+		return err
+	}
+	defer r.Free()
+	srcRef, err := r.LookupReference(src)
+	if err != nil {
+		return err
+	}
+	defer srcRef.Free()
+	dstRef, err := r.CreateReference(dst, srcRef.Target(), false, defaultSignature(), fmt.Sprintf("libpack.copyref %s %s", src, dst))
+	if err != nil {
+		return err
+	}
+	dstRef.Free()
+	return nil
+}
+
+// Fork creates the reference newRef pointing to the latest commit of the
+// database, and returns a new database bound to it. Uncommitted changes
+// are not carried over.
+// The new database shares the repository of db, but is otherwise fully
+// independent: changes to one are never visible in the other.
+// If newRef already exists, an error is returned.
+func (db *DB) Fork(newRef string) (*DB, error) {
+	return db.fork(newRef, false)
+}
+
+// ForkForce is like Fork, but overwrites newRef if it already exists.
+func (db *DB) ForkForce(newRef string) (*DB, error) {
+	return db.fork(newRef, true)
+}
+
+func (db *DB) fork(newRef string, force bool) (fork *DB, err error) {
+	if err := db.checkClosed(); err != nil {
+		return nil, err
+	}
+	defer db.wrapError("fork", "", &err)
+	if db.parent != nil {
+		return db.parent.fork(newRef, force)
+	}
+	head := db.headId()
+	if head == nil {
+		return nil, fmt.Errorf("no head to fork")
+	}
+	sig := db.signature()
+	ref, err := db.repo.CreateReference(newRef, head, force, sig, fmt.Sprintf("libpack.fork %s %s", db.ref, newRef))
+	if err != nil {
+		return nil, err
+	}
+	ref.Free()
+	r, err := git.OpenRepository(db.repo.Path())
+	if err != nil {
+		return nil, err
+	}
+	return newRepo(r, newRef, []Option{settingsOf(db)})
+}
+
+// settingsOf returns an Option which gives a database the settings of
+// db: the options it was opened with, and those changed since with
+// SetAuthor, SetSigner, SetLogger, SetMetrics and SetRetention. The
+// read-only flag, hooks, validators and auto-commit are not copied.
+func settingsOf(db *DB) Option {
+	return func(fork *DB) {
+		db.l.RLock()
+		defer db.l.RUnlock()
+		fork.authorName, fork.authorEmail = db.authorName, db.authorEmail
+		fork.now = db.now
+		fork.signer = db.signer
+		fork.locking, fork.lockTimeout = db.locking, db.lockTimeout
+		fork.cache = nil
+		if db.cache != nil {
+			fork.cache = newCache(int(db.cache.paths.max), db.cache.blobs.max)
+		}
+		fork.compressThreshold = db.compressThreshold
+		fork.encrypt, fork.decrypt = db.encrypt, db.decrypt
+		fork.modTime = db.modTime
+		fork.showInternal, fork.internalWrites = db.showInternal, db.internalWrites
+		fork.limits = db.limits
+		fork.escapeKeys, fork.caseInsensitive = db.escapeKeys, db.caseInsensitive
+		fork.depth = db.depth
+		fork.allowBrokenRef = db.allowBrokenRef
+		fork.metrics = db.metrics
+		fork.mergeOnPull = db.mergeOnPull
+		fork.retention = db.retention
+		if db.refresh != nil {
+			fork.refresh = &refresher{every: db.refresh.every}
+		}
+		if b, ok := db.logger.Load().(loggerBox); ok {
+			fork.logger.Store(b)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package libpack
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRefs(t *testing.T) {
+	db := tmpDB(t, "refs/heads/db1")
+	defer nukeDB(db)
+	db.Set("foo", "bar")
+	db.Commit("")
+	repo := db.Repo().Path()
+
+	if err := CopyRef(repo, "refs/heads/db1", "refs/heads/db2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CopyRef(repo, "refs/heads/db1", "refs/heads/db2"); err == nil {
+		t.Fatalf("copying to an existing ref should fail")
+	}
+	refs, err := ListRefs(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", refs) != "[refs/heads/db1 refs/heads/db2]" {
+		t.Fatalf("%v", refs)
+	}
+
+	db2, err := Open(repo, "refs/heads/db2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db2, "foo", "bar")
+	if err := DeleteRef(repo, "refs/heads/db2"); err == nil {
+		t.Fatalf("deleting a ref in use should fail")
+	}
+	db2.Free()
+	if err := DeleteRef(repo, "refs/heads/db2"); err != nil {
+		t.Fatal(err)
+	}
+	refs, err = ListRefs(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", refs) != "[refs/heads/db1]" {
+		t.Fatalf("%v", refs)
+	}
+}
+
+func TestFork(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("foo", "bar")
+	db.Commit("")
+	db.Set("uncommitted", "value")
+
+	fork, err := db.Fork("refs/heads/fork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fork.Free()
+	assertGet(t, fork, "foo", "bar")
+	assertNotExist(t, fork, "uncommitted")
+
+	fork.Set("foo", "changed in fork")
+	assertGet(t, db, "foo", "bar")
+	if err := fork.Commit(""); err != nil {
+		t.Fatal(err)
+	}
+	db.Update()
+	assertGet(t, db, "foo", "bar")
+
+	if _, err := db.Fork("refs/heads/fork"); err == nil {
+		t.Fatalf("forking to an existing ref should fail")
+	}
+}
+
+func TestForkSettings(t *testing.T) {
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	db, err := Init(tmpdir(t), "refs/heads/test", WithModTime(), WithClock(func() time.Time { return now }), WithCompression(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(db)
+	db.SetAuthor("alice", "alice@example.com")
+	commitKey(t, db, "foo", "bar")
+
+	fork, err := db.Fork("refs/heads/fork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fork.Free()
+	if !fork.modTime || fork.compressThreshold != 16 || fork.authorName != "alice" {
+		t.Fatalf("settings were not copied: %v %v %v", fork.modTime, fork.compressThreshold, fork.authorName)
+	}
+	fork.Set("baz", "value")
+	if mtime, err := fork.ModTime("baz"); err != nil || !mtime.Equal(now) {
+		t.Fatalf("%v %v", mtime, err)
+	}
+}
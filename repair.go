@@ -0,0 +1,226 @@
+package libpack
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+// A BrokenRefError is returned when the reference of a database points
+// to a commit which is missing from the repository, for example after a
+// partial copy or an aggressive prune. See Repair.
+type BrokenRefError struct {
+	Ref string
+	// Id of the missing commit
+	Target string
+}
+
+func (e *BrokenRefError) Error() string {
+	return fmt.Sprintf("reference %s points to missing commit %s: the database must be repaired, see Repair", e.Ref, e.Target)
+}
+
+// AllowBrokenRef makes Open and Init accept a reference which points to
+// a missing commit, instead of failing with a *BrokenRefError. The
+// database is then empty, until it is repaired with Repair.
+func AllowBrokenRef() Option {
+	return func(db *DB) {
+		db.allowBrokenRef = true
+	}
+}
+
+// RepairOpt are the settings of Repair.
+type RepairOpt struct {
+	// If no intact commit is found in the reflog, look for the most
+	// recent intact commit among all the commits of the repository.
+	// In a repository shared by several databases, it may be a commit
+	// of another database.
+	Scan bool
+	// If set, a commit recording the id of the missing commit is
+	// created on top of the recovered commit.
+	Commit bool
+}
+
+// Repair resets the reference of the database, if it points to a missing
+// commit, to the most recent commit of its reflog whose tree is intact
+// (see Verify). The changes of the missing commits are lost. If the
+// reference is not broken, Repair does nothing.
+// Repair is never called implicitly: a broken reference makes Open fail
+// with a *BrokenRefError, see AllowBrokenRef.
+func (db *DB) Repair(opt RepairOpt) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("repair", "", &err)
+	if db.parent != nil {
+		return db.parent.Repair(opt)
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	ref, err := db.repo.LookupReference(db.ref)
+	if err != nil {
+		if git.IsErrorCode(err, git.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	id := ref.Target()
+	ref.Free()
+	if id == nil {
+		return fmt.Errorf("%s is not a direct reference", db.ref)
+	}
+	target := id.String()
+	// Objects are read from a new handle on the repository, since
+	// libgit2 caches the objects it has read.
+	r, err := git.OpenRepository(db.repo.Path())
+	if err != nil {
+		return err
+	}
+	defer r.Free()
+	if ok, err := intactCommit(r, target); err != nil || ok {
+		return err
+	}
+	entries, err := readRefLog(r, db.ref, 0)
+	if err != nil {
+		return err
+	}
+	var found string
+	for _, e := range entries {
+		for _, c := range []string{e.New, e.Old} {
+			if c == "" || c == target {
+				continue
+			}
+			ok, err := intactCommit(r, c)
+			if err != nil {
+				return err
+			}
+			if ok {
+				found = c
+				break
+			}
+		}
+		if found != "" {
+			break
+		}
+	}
+	if found == "" && opt.Scan {
+		if found, err = newestIntactCommit(r); err != nil {
+			return err
+		}
+	}
+	if found == "" {
+		return fmt.Errorf("%s: no intact commit found to repair missing commit %s", db.ref, target)
+	}
+	if opt.Commit {
+		if found, err = db.mkRepairCommit(found, target); err != nil {
+			return err
+		}
+	}
+	// Only move the reference if it still points to the missing commit
+	if err := runGit(db.repo, "update-ref", "-m", "libpack.repair "+target, db.ref, found, target); err != nil {
+		return err
+	}
+	db.logf(LogInfo, "%s: %s -> %s (repair)", db.ref, target, found)
+	return db.Update()
+}
+
+// mkRepairCommit creates a commit on top of commit base, with the same
+// tree, recording that the reference of db was reset from the missing
+// commit lost. It returns the id of the new commit.
+func (db *DB) mkRepairCommit(base, lost string) (string, error) {
+	id, err := git.NewOid(base)
+	if err != nil {
+		return "", err
+	}
+	parent, err := lookupCommit(db.repo, id)
+	if err != nil {
+		return "", err
+	}
+	defer parent.Free()
+	tree, err := parent.Tree()
+	if err != nil {
+		return "", err
+	}
+	defer tree.Free()
+	sig := db.signature()
+	db.l.RLock()
+	signer := db.signer
+	db.l.RUnlock()
+	msg := fmt.Sprintf("repair: reset %s from missing commit %s\n\nThe changes made after commit %s were lost.", db.ref, lost, base)
+	commit, err := mkCommit(db.repo, "", msg, sig, signer, tree, parent)
+	if err != nil {
+		return "", err
+	}
+	defer commit.Free()
+	return commit.Id().String(), nil
+}
+
+// intactCommit returns true if the commit id, and all the objects of its
+// tree, can be read from r.
+func intactCommit(r *git.Repository, id string) (bool, error) {
+	oid, err := git.NewOid(id)
+	if err != nil {
+		return false, err
+	}
+	v, err := newVerifier(r)
+	if err != nil {
+		return false, err
+	}
+	obj, p := v.object(oid, git.ObjectCommit)
+	if p != nil {
+		return false, nil
+	}
+	commit := obj.(*git.Commit)
+	defer commit.Free()
+	v.tree(commit.TreeId(), id, "/")
+	return len(v.problems) == 0, nil
+}
+
+type commitTime struct {
+	id   string
+	when time.Time
+}
+
+type commitsByTime []commitTime
+
+func (c commitsByTime) Len() int           { return len(c) }
+func (c commitsByTime) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c commitsByTime) Less(i, j int) bool { return c[i].when.After(c[j].when) }
+
+// newestIntactCommit returns the id of the most recent intact commit of
+// r, see intactCommit, or an empty string if there is none.
+func newestIntactCommit(r *git.Repository) (string, error) {
+	odb, err := r.Odb()
+	if err != nil {
+		return "", err
+	}
+	var commits commitsByTime
+	err = odb.ForEach(func(id *git.Oid) error {
+		obj, err := r.Lookup(id)
+		if err != nil {
+			// Unreadable objects are not candidates
+			return nil
+		}
+		defer obj.Free()
+		if c, ok := obj.(*git.Commit); ok {
+			commits = append(commits, commitTime{id.String(), c.Committer().When})
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Sort(commits)
+	for _, c := range commits {
+		ok, err := intactCommit(r, c.id)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return c.id, nil
+		}
+	}
+	return "", nil
+}
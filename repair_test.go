@@ -0,0 +1,81 @@
+package libpack
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// brokenDB returns the path of a repository whose reference
+// refs/heads/test points to a missing commit, and the id of the last
+// intact commit.
+func brokenDB(t *testing.T) (string, string) {
+	db := tmpDB(t, "")
+	db.Set("foo", "1")
+	db.Commit("first")
+	first := db.headId().String()
+	db.Set("foo", "2")
+	db.Commit("second")
+	removeObject(t, db, db.headId())
+	dir := db.Repo().Path()
+	db.Free()
+	return dir, first
+}
+
+func TestRepair(t *testing.T) {
+	dir, first := brokenDB(t)
+	defer os.RemoveAll(dir)
+	if _, err := Open(dir, "refs/heads/test"); err == nil {
+		t.Fatalf("Open should fail")
+	} else if _, ok := err.(*BrokenRefError); !ok {
+		t.Fatalf("%v", err)
+	}
+	db, err := Open(dir, "refs/heads/test", AllowBrokenRef())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	if err := db.Repair(RepairOpt{}); err != nil {
+		t.Fatal(err)
+	}
+	if head := db.headId().String(); head != first {
+		t.Fatalf("%s != %s", head, first)
+	}
+	assertGet(t, db, "foo", "1")
+	// Nothing to repair
+	if err := db.Repair(RepairOpt{}); err != nil {
+		t.Fatal(err)
+	}
+	if head := db.headId().String(); head != first {
+		t.Fatalf("%s != %s", head, first)
+	}
+}
+
+func TestRepairCommit(t *testing.T) {
+	dir, first := brokenDB(t)
+	defer os.RemoveAll(dir)
+	db, err := Open(dir, "refs/heads/test", AllowBrokenRef())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	// Without the reflog, the commits of the repository are scanned
+	if err := os.Remove(filepath.Join(dir, "logs", "refs", "heads", "test")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Repair(RepairOpt{Commit: true}); err == nil {
+		t.Fatalf("Repair should fail")
+	}
+	if err := db.Repair(RepairOpt{Commit: true, Scan: true}); err != nil {
+		t.Fatal(err)
+	}
+	log, err := db.Log("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 2 || log[1].Id != first || !strings.HasPrefix(log[0].Message, "repair: ") {
+		t.Fatalf("%#v", log)
+	}
+	assertGet(t, db, "foo", "1")
+}
@@ -0,0 +1,142 @@
+package libpack
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+// A ReplicaMismatchError is returned by VerifyAgainst when the remote
+// reference doesn't have the same content as the database.
+type ReplicaMismatchError struct {
+	// Ids of the local and remote heads, and of their trees. An empty
+	// string means that there is no such commit, or for RemoteTree, that
+	// the remote commit is not in the local repository.
+	LocalCommit  string
+	RemoteCommit string
+	LocalTree    string
+	RemoteTree   string
+}
+
+func (e *ReplicaMismatchError) Error() string {
+	remoteTree := e.RemoteTree
+	if remoteTree == "" {
+		remoteTree = "unknown"
+	}
+	return fmt.Sprintf("replica mismatch: local commit %q (tree %s), remote commit %q (tree %s)", e.LocalCommit, e.LocalTree, e.RemoteCommit, remoteTree)
+}
+
+// ContentHash returns the id of the committed tree of the database, or of
+// its subtree at the scope of db. Databases with the same content hash
+// have the same committed values and annotations, whatever their history.
+// If nothing was committed, the id of the empty tree is returned.
+// Unlike TreeHash, uncommitted changes are ignored.
+func (db *DB) ContentHash() (hash string, err error) {
+	if err := db.checkClosed(); err != nil {
+		return "", err
+	}
+	defer db.wrapError("content-hash", "", &err)
+	tree, err := db.committedTree()
+	if err != nil {
+		return "", err
+	}
+	if tree == nil {
+		empty, err := emptyTree(db.repo)
+		if err != nil {
+			return "", err
+		}
+		return empty.String(), nil
+	}
+	defer tree.Free()
+	scoped, err := TreeScope(db.repo, tree, db.scope)
+	if err != nil {
+		return "", err
+	}
+	defer scoped.Free()
+	return scoped.Id().String(), nil
+}
+
+// committedTree returns the tree of the head of the database, or nil if
+// nothing was committed.
+func (db *DB) committedTree() (*git.Tree, error) {
+	root := db.root()
+	root.l.RLock()
+	defer root.l.RUnlock()
+	if root.commit == nil {
+		return nil, nil
+	}
+	return lookupTree(root.repo, root.commit.TreeId())
+}
+
+// VerifyAgainst checks that the reference `ref` at url (the reference of
+// the database if ref is empty) has the same content as the committed
+// tree of the database, and returns true if it does. Only the id of the
+// remote head is downloaded, as by `git ls-remote`: if it is not the head
+// of the database, the trees are only compared if the remote commit is
+// already in the local repository, for example after a Fetch.
+// Otherwise, false is returned along with a *ReplicaMismatchError which
+// holds both ids. The whole tree is compared, whatever the scope of db.
+func (db *DB) VerifyAgainst(url, ref string) (same bool, err error) {
+	if err := db.checkClosed(); err != nil {
+		return false, err
+	}
+	defer db.wrapError("verify", "", &err)
+	root := db.root()
+	if ref == "" {
+		ref = root.ref
+	}
+	remoteHead, err := lsRemote(url, ref)
+	if err != nil {
+		return false, err
+	}
+	mismatch := &ReplicaMismatchError{RemoteCommit: remoteHead}
+	if head := root.headId(); head != nil {
+		mismatch.LocalCommit = head.String()
+	}
+	if mismatch.LocalCommit == remoteHead {
+		return true, nil
+	}
+	local, err := root.committedTree()
+	if err != nil {
+		return false, err
+	}
+	if local != nil {
+		mismatch.LocalTree = local.Id().String()
+		local.Free()
+	}
+	if remoteHead != "" {
+		if id, err := git.NewOid(remoteHead); err == nil {
+			if commit, err := lookupCommit(root.repo, id); err == nil {
+				mismatch.RemoteTree = commit.TreeId().String()
+				commit.Free()
+			}
+		}
+	}
+	if mismatch.RemoteTree != "" && mismatch.RemoteTree == mismatch.LocalTree {
+		return true, nil
+	}
+	root.logf(LogInfo, "verify %s %s: %v", url, ref, mismatch)
+	return false, mismatch
+}
+
+// lsRemote returns the id of the commit which reference ref points to at
+// url, or an empty string if there is no such reference.
+func lsRemote(url, ref string) (string, error) {
+	stderr := new(bytes.Buffer)
+	cmd := exec.Command("git", "ls-remote", url, ref)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git ls-remote: %s", stderr.String())
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == ref {
+			return fields[0], nil
+		}
+	}
+	return "", nil
+}
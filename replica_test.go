@@ -0,0 +1,85 @@
+package libpack
+
+import (
+	"testing"
+)
+
+func TestContentHash(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	empty, err := db.ContentHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set("foo/bar", "baz")
+	// Uncommitted changes are ignored
+	if h, err := db.ContentHash(); err != nil || h != empty {
+		t.Fatalf("%q %v", h, err)
+	}
+	db.Commit("first")
+	h, err := db.ContentHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree, _ := db.TreeHash(); h != tree {
+		t.Fatalf("%q != %q", h, tree)
+	}
+	if h, _ := db.Scope("foo").ContentHash(); h == empty || h == mustTreeHash(t, db) {
+		t.Fatalf("%q", h)
+	}
+	// Same content, different history
+	other := tmpDB(t, "")
+	defer nukeDB(other)
+	other.Set("foo/bar", "baz")
+	other.Commit("other")
+	if h2, _ := other.ContentHash(); h2 != h {
+		t.Fatalf("%q != %q", h2, h)
+	}
+}
+
+func mustTreeHash(t *testing.T, db *DB) string {
+	h, err := db.TreeHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestVerifyAgainst(t *testing.T) {
+	local, remote := syncPair(t)
+	defer nukeDB(local)
+	defer nukeDB(remote)
+	url := remote.Repo().Path()
+	if ok, err := local.VerifyAgainst(url, ""); !ok || err != nil {
+		t.Fatalf("%v %v", ok, err)
+	}
+	commitKey(t, remote, "remote", "1")
+	ok, err := local.VerifyAgainst(url, "")
+	mismatch, isMismatch := err.(*ReplicaMismatchError)
+	if ok || !isMismatch {
+		t.Fatalf("%v %v", ok, err)
+	}
+	remoteHead, _ := remote.Head()
+	localHead, _ := local.Head()
+	if mismatch.RemoteCommit != remoteHead || mismatch.LocalCommit != localHead || mismatch.RemoteTree != "" {
+		t.Fatalf("%#v", mismatch)
+	}
+	// Once fetched, the remote tree is known
+	if _, err := local.Fetch(url, ""); err != nil {
+		t.Fatal(err)
+	}
+	_, err = local.VerifyAgainst(url, "")
+	if mismatch, ok := err.(*ReplicaMismatchError); !ok || mismatch.RemoteTree != mustTreeHash(t, remote) {
+		t.Fatalf("%v", err)
+	}
+	// Same content in a different commit
+	commitKey(t, local, "remote", "1")
+	if ok, err := local.VerifyAgainst(url, ""); !ok || err != nil {
+		t.Fatalf("%v %v", ok, err)
+	}
+	// Missing remote reference
+	ok, err = local.VerifyAgainst(url, "refs/heads/missing")
+	if mismatch, isMismatch := err.(*ReplicaMismatchError); ok || !isMismatch || mismatch.RemoteCommit != "" {
+		t.Fatalf("%v %v", ok, err)
+	}
+}
@@ -0,0 +1,129 @@
+package libpack
+
+import (
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+// DefaultRetentionMessage is the message of the new root commit created
+// by EnforceRetention, if RetentionPolicy.Message is empty.
+const DefaultRetentionMessage = "Truncate history"
+
+// RetentionPolicy are the settings of SetRetention. A commit is kept if
+// it is one of the KeepLast most recent ones, or if it was made less than
+// KeepSince ago. The zero value keeps all commits.
+type RetentionPolicy struct {
+	KeepLast  int
+	KeepSince time.Duration
+	// Message of the new root commit
+	Message string
+	// If set, EnforceRetention runs GC with GCOpt after dropping commits.
+	GC    bool
+	GCOpt GCOpt
+	// If set, the history is rewritten even if it is shared with a
+	// remote, see Compact.
+	Force bool
+}
+
+func (p RetentionPolicy) keeps(n int, c *git.Commit, now time.Time) bool {
+	if p.KeepLast > 0 && n < p.KeepLast {
+		return true
+	}
+	return p.KeepSince > 0 && !c.Committer().When.Before(now.Add(-p.KeepSince))
+}
+
+// SetRetention sets the retention policy of the history of the database,
+// which is applied by EnforceRetention. Commit never drops commits.
+func (db *DB) SetRetention(policy RetentionPolicy) {
+	root := db.root()
+	root.l.Lock()
+	root.retention = policy
+	root.l.Unlock()
+}
+
+// EnforceRetention drops the commits which the retention policy doesn't
+// keep, like Compact: the oldest kept commit is replaced with a new root
+// commit of the same tree, and the following commits are replayed on top
+// of it. Only first parents are followed, down to the boundary of a
+// shallow history. If all commits are kept, the history is not changed.
+// Since all kept commits are replaced, the new history has diverged from
+// any copy of the old one. Like Compact, EnforceRetention fails with
+// ErrHasRemote if the repository has a configured remote, or the database
+// was pushed or pulled, unless the policy is forced.
+func (db *DB) EnforceRetention() (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("retention", "", &err)
+	if db.parent != nil {
+		return db.parent.EnforceRetention()
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	db.l.RLock()
+	policy := db.retention
+	db.l.RUnlock()
+	if policy.KeepLast <= 0 && policy.KeepSince <= 0 {
+		return nil
+	}
+	if !policy.Force {
+		if shared, err := db.hasRemote(); err != nil {
+			return err
+		} else if shared {
+			return ErrHasRemote
+		}
+	}
+	dropped, err := db.enforceRetention(policy)
+	if err != nil || !dropped || !policy.GC {
+		return err
+	}
+	return db.GC(policy.GCOpt)
+}
+
+// enforceRetention rewrites the history according to policy, and returns
+// true if commits were dropped.
+func (db *DB) enforceRetention(policy RetentionPolicy) (bool, error) {
+	msg := policy.Message
+	if msg == "" {
+		msg = DefaultRetentionMessage
+	}
+	now := db.now()
+	db.l.Lock()
+	defer db.l.Unlock()
+	head := db.commit
+	if head == nil {
+		return false, nil
+	}
+	keep := []*git.Commit{head}
+	defer func() {
+		for _, c := range keep[1:] {
+			c.Free()
+		}
+	}()
+	dropped := false
+	for c := head; c.ParentCount() > 0; {
+		p := c.Parent(0)
+		if p == nil {
+			// Boundary of a shallow fetch
+			break
+		}
+		if !policy.keeps(len(keep), p, now) {
+			p.Free()
+			dropped = true
+			break
+		}
+		keep = append(keep, p)
+		c = p
+	}
+	if !dropped {
+		return false, nil
+	}
+	newHead, err := db.rewriteHistoryLocked(keep, msg, "libpack.retention")
+	if err != nil {
+		return false, err
+	}
+	db.logf(LogInfo, "retention: kept %d commits, new head %s", len(keep), newHead)
+	return true, nil
+}
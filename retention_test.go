@@ -0,0 +1,101 @@
+package libpack
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEnforceRetention(t *testing.T) {
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	db, err := Init(tmpdir(t), "refs/heads/test", WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(db)
+	// No policy, nothing to do
+	if err := db.EnforceRetention(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		now = now.Add(24 * time.Hour)
+		db.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("%d", i))
+		if err := db.Commit(fmt.Sprintf("commit %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	treeBefore := mustTreeHash(t, db)
+	// Committing never applies the policy
+	db.SetRetention(RetentionPolicy{KeepLast: 4})
+	db.Set("key6", "6")
+	if err := db.Commit("commit 6"); err != nil {
+		t.Fatal(err)
+	}
+	if log, _ := db.Log("", 0); len(log) != 7 {
+		t.Fatalf("%d commits", len(log))
+	}
+	if err := db.Scope("sub").EnforceRetention(); err != nil {
+		t.Fatal(err)
+	}
+	log, err := db.Log("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 4 || log[0].Message != "commit 6" || log[3].Message != DefaultRetentionMessage || len(log[3].Parents) != 0 {
+		t.Fatalf("%#v", log)
+	}
+	for i := 0; i < 7; i++ {
+		assertGet(t, db, fmt.Sprintf("key%d", i), fmt.Sprintf("%d", i))
+	}
+	if tree := mustTreeHash(t, db); tree == treeBefore {
+		t.Fatalf("the last commit should be in the tree")
+	}
+	// Enforcing the same policy again changes nothing
+	head, _ := db.Head()
+	if err := db.EnforceRetention(); err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := db.Head(); h != head {
+		t.Fatalf("%v != %v", h, head)
+	}
+	// Commits made within KeepSince are kept, as well as the KeepLast
+	// most recent ones
+	db.SetRetention(RetentionPolicy{KeepLast: 1, KeepSince: 36 * time.Hour, Message: "truncated", GC: true})
+	if err := db.EnforceRetention(); err != nil {
+		t.Fatal(err)
+	}
+	if log, _ := db.Log("", 0); len(log) != 2 || log[0].Message != "commit 6" || log[1].Message != "truncated" {
+		t.Fatalf("%#v", log)
+	}
+}
+
+func TestEnforceRetentionRemote(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	for i := 0; i < 3; i++ {
+		commitKey(t, db, "key", fmt.Sprintf("%d", i))
+	}
+	remote := tmpDB(t, "")
+	defer nukeDB(remote)
+	if err := db.Push(remote.Repo().Path(), ""); err != nil {
+		t.Fatal(err)
+	}
+	commitKey(t, db, "key", "3")
+	head, _ := db.Head()
+	// Rewriting the history would make it diverge from the remote
+	db.SetRetention(RetentionPolicy{KeepLast: 2})
+	if err := db.EnforceRetention(); err != ErrHasRemote {
+		t.Fatalf("%v", err)
+	}
+	if h, _ := db.Head(); h != head {
+		t.Fatalf("the history should not change")
+	}
+	db.SetRetention(RetentionPolicy{KeepLast: 1, Force: true})
+	if err := db.EnforceRetention(); err != nil {
+		t.Fatal(err)
+	}
+	if log, _ := db.Log("", 0); len(log) != 1 {
+		t.Fatalf("%#v", log)
+	}
+	assertGet(t, db, "key", "3")
+}
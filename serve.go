@@ -0,0 +1,200 @@
+package libpack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+// A ServeOption changes the behavior of the handler returned by Serve.
+type ServeOption func(*server)
+
+// WithReceivePack makes the handler returned by Serve accept pushes.
+// authorize is called with each reference updated by a push, before
+// anything is changed. If it returns an error for any of them, the push
+// is rejected with 403 Forbidden.
+func WithReceivePack(authorize func(r *http.Request, ref string) error) ServeOption {
+	return func(s *server) {
+		s.authorize = authorize
+	}
+}
+
+// Serve returns a handler implementing the git smart HTTP protocol for
+// the repository of db, so that plain git clients can clone and pull
+// from it. By default the repository is read-only: see WithReceivePack
+// to accept pushes.
+// Pushes which move the database's reference run its post-commit hooks,
+// like a local commit. The in-memory tree of db is not updated: call
+// Update to see the new content.
+// The handler can be mounted under any path prefix.
+func Serve(db *DB, opts ...ServeOption) http.Handler {
+	s := &server{db: db}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+type server struct {
+	db        *DB
+	authorize func(r *http.Request, ref string) error
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/info/refs"):
+		service := r.URL.Query().Get("service")
+		if !s.allowed(service) {
+			http.Error(w, "service not available", http.StatusForbidden)
+			return
+		}
+		s.advertise(w, service)
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/git-upload-pack"):
+		s.rpc(w, r, "git-upload-pack", nil)
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/git-receive-pack"):
+		if !s.allowed("git-receive-pack") {
+			http.Error(w, "service not available", http.StatusForbidden)
+			return
+		}
+		s.receivePack(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *server) allowed(service string) bool {
+	switch service {
+	case "git-upload-pack":
+		return true
+	case "git-receive-pack":
+		return s.authorize != nil
+	}
+	return false
+}
+
+// advertise sends the list of references of the repository, for the
+// first step of a fetch or push.
+func (s *server) advertise(w http.ResponseWriter, service string) {
+	var refs bytes.Buffer
+	cmd := exec.Command("git", strings.TrimPrefix(service, "git-"), "--stateless-rpc", "--advertise-refs", s.db.repo.Path())
+	cmd.Stdout = &refs
+	if err := cmd.Run(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", service))
+	w.Header().Set("Cache-Control", "no-cache")
+	writePktLine(w, fmt.Sprintf("# service=%s\n", service))
+	io.WriteString(w, "0000")
+	w.Write(refs.Bytes())
+}
+
+// receivePack checks the references updated by a push with the
+// authorizer before running git-receive-pack.
+func (s *server) receivePack(w http.ResponseWriter, r *http.Request) {
+	body, err := requestBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	commands, refs, err := readPushCommands(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, ref := range refs {
+		if err := s.authorize(r, ref); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	before := s.db.refTarget()
+	s.rpc(w, r, "git-receive-pack", io.MultiReader(bytes.NewReader(commands), body))
+	if after := s.db.refTarget(); after != before && after != "" {
+		id, err := git.NewOid(after)
+		if err != nil {
+			return
+		}
+		if commit, err := lookupCommit(s.db.repo, id); err == nil {
+			s.db.root().runPostCommitHooks(commit)
+			commit.Free()
+		}
+	}
+}
+
+// rpc runs the git command `service` with the request body (or `body`,
+// if not nil) as input, and writes its output in the response.
+func (s *server) rpc(w http.ResponseWriter, r *http.Request, service string, body io.Reader) {
+	if body == nil {
+		var err error
+		if body, err = requestBody(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	cmd := exec.Command("git", strings.TrimPrefix(service, "git-"), "--stateless-rpc", s.db.repo.Path())
+	cmd.Stdin = body
+	cmd.Stderr = os.Stderr
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-result", service))
+	w.Header().Set("Cache-Control", "no-cache")
+	cmd.Stdout = w
+	// The response is already started, so errors can't be reported
+	// with a status code.
+	cmd.Run()
+}
+
+func requestBody(r *http.Request) (io.Reader, error) {
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		return gzip.NewReader(r.Body)
+	}
+	return r.Body, nil
+}
+
+// readPushCommands reads the reference update commands at the start of
+// a push request, up to the first flush packet. It returns the raw
+// commands, to be passed on to git-receive-pack, and the names of the
+// references they update.
+func readPushCommands(body io.Reader) (raw []byte, refs []string, err error) {
+	var buf bytes.Buffer
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(body, size[:]); err != nil {
+			return nil, nil, fmt.Errorf("read push commands: %w", err)
+		}
+		buf.Write(size[:])
+		n, err := strconv.ParseUint(string(size[:]), 16, 16)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid pkt-line length %q", size)
+		}
+		if n == 0 {
+			return buf.Bytes(), refs, nil
+		}
+		if n < 4 {
+			return nil, nil, fmt.Errorf("invalid pkt-line length %q", size)
+		}
+		line := make([]byte, n-4)
+		if _, err := io.ReadFull(body, line); err != nil {
+			return nil, nil, fmt.Errorf("read push commands: %w", err)
+		}
+		buf.Write(line)
+		// <old-id> <new-id> <ref>[\0<capabilities>]\n
+		cmd := strings.TrimRight(strings.SplitN(string(line), "\x00", 2)[0], "\n")
+		fields := strings.Fields(cmd)
+		if len(fields) != 3 {
+			return nil, nil, fmt.Errorf("invalid push command %q", cmd)
+		}
+		refs = append(refs, fields[2])
+	}
+}
+
+func writePktLine(w io.Writer, line string) {
+	fmt.Fprintf(w, "%04x%s", len(line)+4, line)
+}
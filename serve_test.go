@@ -0,0 +1,103 @@
+package libpack
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServe(t *testing.T) {
+	src := tmpDB(t, "")
+	defer nukeDB(src)
+	src.Set("foo/bar", "hello")
+	if err := src.Commit("hello"); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(Serve(src))
+	defer srv.Close()
+
+	dst := tmpDB(t, "")
+	defer nukeDB(dst)
+	if err := dst.Pull(srv.URL, src.ref); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, dst, "foo/bar", "hello")
+
+	// Pushes are refused by default
+	dst.Set("foo/bar", "world")
+	if err := dst.Commit("world"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Push(srv.URL, src.ref); err == nil {
+		t.Fatalf("push to a read-only server should fail")
+	}
+}
+
+func TestServeReceivePack(t *testing.T) {
+	src := tmpDB(t, "")
+	defer nukeDB(src)
+	src.Set("foo", "A")
+	if err := src.Commit("A"); err != nil {
+		t.Fatal(err)
+	}
+	commits := make(chan string, 10)
+	src.AddPostCommitHook(func(id string, changes []Change) {
+		commits <- id
+	})
+	updates := make(chan string, 10)
+	src.OnRemoteUpdate(func(oldHead, newHead string) {
+		updates <- newHead
+	})
+	if err := src.StartWatching(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	defer src.StopWatching()
+	// Drain the notification of the local commit
+	<-commits
+	srv := httptest.NewServer(Serve(src, WithReceivePack(func(r *http.Request, ref string) error {
+		if ref != src.ref {
+			return fmt.Errorf("%s is read-only", ref)
+		}
+		return nil
+	})))
+	defer srv.Close()
+
+	dst := tmpDB(t, "")
+	defer nukeDB(dst)
+	if err := dst.Pull(srv.URL, src.ref); err != nil {
+		t.Fatal(err)
+	}
+	dst.Set("foo", "B")
+	if err := dst.Commit("B"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Push(srv.URL, "refs/heads/other"); err == nil {
+		t.Fatalf("unauthorized push should fail")
+	}
+	if err := dst.Push(srv.URL, src.ref); err != nil {
+		t.Fatal(err)
+	}
+	head := dst.headId().String()
+	select {
+	case id := <-commits:
+		if id != head {
+			t.Fatalf("%v != %v", id, head)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("post-commit hooks not called")
+	}
+	select {
+	case id := <-updates:
+		if id != head {
+			t.Fatalf("%v != %v", id, head)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("watchers not notified")
+	}
+	if err := src.Update(); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, src, "foo", "B")
+}
@@ -0,0 +1,132 @@
+package libpack
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+// ErrShallowHistory is returned by functions walking the history of a
+// database when they reach the boundary of a shallow fetch (see
+// WithDepth). The commits before the boundary were not downloaded.
+var ErrShallowHistory = errors.New("history truncated by a shallow fetch")
+
+// ErrShallowPush is returned when trying to push from a shallow
+// repository, which libgit2 doesn't support.
+var ErrShallowPush = errors.New("cannot push from a shallow repository")
+
+// WithDepth makes Pull, Fetch and Clone download only the last `depth`
+// commits of the remote history. This is enough for a replica which only
+// needs the latest tree. If depth is 0, the whole history is downloaded.
+// Since libgit2 doesn't support shallow fetches, the git command is used.
+func WithDepth(depth int) Option {
+	return func(db *DB) {
+		db.depth = depth
+	}
+}
+
+// fetchShallow downloads the last `depth` commits of refspec at url
+// into r.
+func fetchShallow(r *git.Repository, url, refspec string, depth int) error {
+	// git ignores --depth for local paths
+	if strings.HasPrefix(url, "/") {
+		url = "file://" + url
+	}
+	return runGit(r, "fetch", "--quiet", fmt.Sprintf("--depth=%d", depth), url, refspec)
+}
+
+// shallowCommits returns the ids of the commits at the boundary of a
+// shallow fetch in r, whose parents are missing.
+func shallowCommits(r *git.Repository) (map[string]bool, error) {
+	data, err := ioutil.ReadFile(path.Join(r.Path(), "shallow"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	commits := make(map[string]bool)
+	for _, id := range strings.Fields(string(data)) {
+		commits[id] = true
+	}
+	return commits, nil
+}
+
+// isShallow returns true if r was populated by a shallow fetch.
+func isShallow(r *git.Repository) bool {
+	_, err := os.Stat(path.Join(r.Path(), "shallow"))
+	return err == nil
+}
+
+// walkHistory calls f with each commit reachable from head, most recent
+// first. The walk stops at the boundary of a shallow fetch, in which
+// case truncated is true. If f returns an error, the walk is stopped and
+// the error is returned.
+func walkHistory(r *git.Repository, head *git.Oid, f func(*git.Commit) error) (truncated bool, err error) {
+	return walkHistoryFrom(r, []*git.Oid{head}, f)
+}
+
+// walkHistoryFrom is like walkHistory, for the commits reachable from any
+// of heads. Each commit is only visited once.
+func walkHistoryFrom(r *git.Repository, heads []*git.Oid, f func(*git.Commit) error) (truncated bool, err error) {
+	shallow, err := shallowCommits(r)
+	if err != nil {
+		return false, err
+	}
+	seen := make(map[string]bool)
+	var queue []*git.Commit
+	defer func() {
+		for _, c := range queue {
+			c.Free()
+		}
+	}()
+	for _, head := range heads {
+		if seen[head.String()] {
+			continue
+		}
+		seen[head.String()] = true
+		c, err := lookupCommit(r, head)
+		if err != nil {
+			return false, err
+		}
+		queue = append(queue, c)
+	}
+	for len(queue) > 0 {
+		// Pop the most recent commit
+		next := 0
+		for i, c := range queue {
+			if c.Committer().When.After(queue[next].Committer().When) {
+				next = i
+			}
+		}
+		c := queue[next]
+		queue = append(queue[:next], queue[next+1:]...)
+		if shallow[c.Id().String()] {
+			truncated = true
+		} else {
+			for i := uint(0); i < c.ParentCount(); i++ {
+				id := c.ParentId(i)
+				if seen[id.String()] {
+					continue
+				}
+				seen[id.String()] = true
+				p, err := lookupCommit(r, id)
+				if err != nil {
+					c.Free()
+					return truncated, err
+				}
+				queue = append(queue, p)
+			}
+		}
+		err = f(c)
+		c.Free()
+		if err != nil {
+			return truncated, err
+		}
+	}
+	return truncated, nil
+}
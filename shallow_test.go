@@ -0,0 +1,120 @@
+package libpack
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+func TestShallowClone(t *testing.T) {
+	src := tmpDB(t, "")
+	defer nukeDB(src)
+	sign := func(payload []byte) (string, error) {
+		return fmt.Sprintf("-----BEGIN FAKE SIGNATURE-----\n%d\n-----END FAKE SIGNATURE-----\n", len(payload)), nil
+	}
+	verify := func(payload, signature []byte) error {
+		expected, _ := sign(payload)
+		if string(signature) != expected {
+			return fmt.Errorf("bad signature: %q", signature)
+		}
+		return nil
+	}
+	src.SetSigner(sign)
+	for i := 0; i < 3; i++ {
+		src.Set("foo", fmt.Sprintf("%d", i))
+		if err := src.Commit(fmt.Sprintf("commit %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.VerifyHead(verify); err != nil {
+		t.Fatal(err)
+	}
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Clone(path.Join(tmp, "replica"), src.Repo().Path(), src.ref, WithDepth(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	assertGet(t, db, "foo", "2")
+	if !isShallow(db.Repo()) {
+		t.Fatalf("clone should be shallow")
+	}
+	// Only the last commit is available
+	var commits int
+	truncated, err := walkHistory(db.Repo(), db.headId(), func(c *git.Commit) error {
+		commits++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated || commits != 1 {
+		t.Fatalf("truncated=%v commits=%d", truncated, commits)
+	}
+	if log, err := db.Log("", 0); err != ErrShallowHistory || len(log) != 1 {
+		t.Fatalf("%v %#v", err, log)
+	}
+	if err := db.VerifyHead(verify); err != ErrShallowHistory {
+		t.Fatalf("%v", err)
+	}
+	// Pull keeps the clone shallow
+	src.Set("foo", "3")
+	if err := src.Commit("commit 3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Pull(src.Repo().Path(), src.ref); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db, "foo", "3")
+	// Pushing from a shallow clone is refused
+	dst := tmpDB(t, "")
+	defer nukeDB(dst)
+	if err := db.Push(dst.Repo().Path(), dst.ref); err != ErrShallowPush {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestShallowHistory(t *testing.T) {
+	src := tmpDB(t, "")
+	defer nukeDB(src)
+	for i := 0; i < 3; i++ {
+		commitKey(t, src, "foo", fmt.Sprintf("%d", i))
+	}
+	tmp := tmpdir(t)
+	defer os.RemoveAll(tmp)
+	db, err := Clone(path.Join(tmp, "replica"), src.Repo().Path(), src.ref, WithDepth(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Free()
+	head, _ := db.Head()
+	if _, err := db.CommitChanges(head); err != ErrShallowHistory {
+		t.Fatalf("%v", err)
+	}
+	if err := db.CherryPick(head); err != ErrShallowHistory {
+		t.Fatalf("%v", err)
+	}
+	if err := db.ForceAmend(""); err != ErrShallowHistory {
+		t.Fatalf("%v", err)
+	}
+	// History rewrites stop at the boundary
+	db.SetRetention(RetentionPolicy{KeepLast: 5, Force: true})
+	if err := db.EnforceRetention(); err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := db.Head(); h != head {
+		t.Fatalf("the history should not change")
+	}
+	if _, err := db.Compact(db.now().Add(-time.Hour), "compacted", true); err != nil {
+		t.Fatal(err)
+	}
+	if log, err := db.Log("", 0); err != nil || len(log) != 1 || log[0].Message != "compacted" {
+		t.Fatalf("%#v %v", log, err)
+	}
+	assertGet(t, db, "foo", "2")
+}
@@ -0,0 +1,175 @@
+package libpack
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+// A Signer signs the raw content of a commit object, and returns an
+// armored signature (for example the output of `gpg --detach-sign --armor`).
+type Signer func(payload []byte) (signature string, err error)
+
+// A SignatureError lists the commits which failed verification in
+// VerifyHead.
+type SignatureError struct {
+	// Ids of the commits which are not signed
+	Unsigned []string
+	// Ids of the commits whose signature was rejected, and the
+	// corresponding error
+	Invalid map[string]error
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("signature verification failed: %d unsigned commits, %d invalid signatures", len(e.Unsigned), len(e.Invalid))
+}
+
+// SetSigner sets a function used to sign every commit made by the
+// database from now on. If sign is nil, commits are not signed.
+func (db *DB) SetSigner(sign Signer) {
+	if db.parent != nil {
+		db.parent.SetSigner(sign)
+		return
+	}
+	db.l.Lock()
+	db.signer = sign
+	db.l.Unlock()
+}
+
+// VerifyHead walks the history of the database from its latest commit,
+// and calls verify with the payload and signature of each commit.
+// Unsigned commits and commits for which verify returns an error do not
+// stop the walk: they are all reported in a *SignatureError.
+// If all commits pass verification but the walk reaches the boundary of
+// a shallow fetch, ErrShallowHistory is returned.
+func (db *DB) VerifyHead(verify func(payload, signature []byte) error) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("verify", "", &err)
+	head := db.headId()
+	if head == nil {
+		return fmt.Errorf("no head to verify")
+	}
+	odb, err := db.repo.Odb()
+	if err != nil {
+		return err
+	}
+	defer odb.Free()
+	verr := &SignatureError{Invalid: make(map[string]error)}
+	truncated, err := walkHistory(db.repo, head, func(c *git.Commit) error {
+		obj, err := odb.Read(c.Id())
+		if err != nil {
+			return err
+		}
+		payload, signature := splitCommitSignature(obj.Data())
+		obj.Free()
+		if signature == nil {
+			verr.Unsigned = append(verr.Unsigned, c.Id().String())
+			return nil
+		}
+		if err := verify(payload, signature); err != nil {
+			verr.Invalid[c.Id().String()] = err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(verr.Unsigned) > 0 || len(verr.Invalid) > 0 {
+		return verr
+	}
+	if truncated {
+		return ErrShallowHistory
+	}
+	return nil
+}
+
+// mkSignedCommit creates a commit object signed with sign, and returns
+// its id. Unlike Repository.CreateCommit, it does not update any reference.
+func mkSignedCommit(r *git.Repository, msg string, sig *git.Signature, sign Signer, tree *git.Tree, parents []*git.Commit) (*git.Oid, error) {
+	var payload bytes.Buffer
+	fmt.Fprintf(&payload, "tree %s\n", tree.Id())
+	for _, p := range parents {
+		fmt.Fprintf(&payload, "parent %s\n", p.Id())
+	}
+	ident, err := formatSignature(sig)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(&payload, "author %s\n", ident)
+	fmt.Fprintf(&payload, "committer %s\n", ident)
+	headers := payload.String()
+	payload.WriteString("\n")
+	payload.WriteString(msg)
+	signature, err := sign(payload.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("sign commit: %w", err)
+	}
+	var signed bytes.Buffer
+	signed.WriteString(headers)
+	signed.WriteString("gpgsig ")
+	signed.WriteString(strings.Replace(strings.TrimRight(signature, "\n"), "\n", "\n ", -1))
+	signed.WriteString("\n\n")
+	signed.WriteString(msg)
+	odb, err := r.Odb()
+	if err != nil {
+		return nil, err
+	}
+	defer odb.Free()
+	return odb.Write(signed.Bytes(), git.ObjectCommit)
+}
+
+// formatSignature returns sig as in the author and committer headers of
+// a raw commit object. Like git, it rejects names and emails which would
+// break the header.
+func formatSignature(sig *git.Signature) (string, error) {
+	for _, s := range []string{sig.Name, sig.Email} {
+		if strings.ContainsAny(s, "<>\n\x00") {
+			return "", fmt.Errorf("invalid author: %q", s)
+		}
+	}
+	_, offset := sig.When.Zone()
+	sign := '+'
+	if offset < 0 {
+		sign = '-'
+		offset = -offset
+	}
+	return fmt.Sprintf("%s <%s> %d %c%02d%02d", sig.Name, sig.Email, sig.When.Unix(), sign, offset/3600, (offset%3600)/60), nil
+}
+
+// splitCommitSignature extracts the gpgsig header from a raw commit
+// object, and returns the signed payload and the signature.
+// If the commit is not signed, signature is nil.
+func splitCommitSignature(data []byte) (payload, signature []byte) {
+	var (
+		out   bytes.Buffer
+		sig   bytes.Buffer
+		inSig bool
+	)
+	lines := strings.SplitAfter(string(data), "\n")
+	for i, line := range lines {
+		if line == "\n" {
+			// End of headers: the rest is the message
+			out.WriteString(strings.Join(lines[i:], ""))
+			break
+		}
+		if inSig && strings.HasPrefix(line, " ") {
+			sig.WriteString(line[1:])
+			continue
+		}
+		inSig = false
+		if strings.HasPrefix(line, "gpgsig ") {
+			inSig = true
+			sig.WriteString(strings.TrimPrefix(line, "gpgsig "))
+			continue
+		}
+		out.WriteString(line)
+	}
+	if sig.Len() == 0 {
+		return data, nil
+	}
+	return out.Bytes(), sig.Bytes()
+}
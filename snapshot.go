@@ -0,0 +1,209 @@
+package libpack
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	git "github.com/libgit2/git2go"
+)
+
+// A Snapshot is a read-only view of the uncommitted tree of a database,
+// as it was when the snapshot was taken. Changes made to the database
+// afterwards are not visible in the snapshot, so several keys can be read
+// consistently without locking the database.
+// Snapshots are immutable, and safe for concurrent use. They can't be
+// used after the database is freed.
+type Snapshot struct {
+	// Handle of the database, for its scope and settings
+	db *DB
+	// Root of the uncommitted tree, or nil if it is empty
+	tree *git.Tree
+	// Set if db was opened for the snapshot, see OpenBundle
+	ownDB bool
+}
+
+// Snapshot returns a snapshot of the uncommitted tree of the database,
+// restricted to the scope of db.
+func (db *DB) Snapshot() (s *Snapshot, err error) {
+	if err := db.checkClosed(); err != nil {
+		return nil, err
+	}
+	defer db.wrapError("snapshot", "", &err)
+	tree, err := db.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	s = &Snapshot{db: db}
+	if tree != nil {
+		// Use our own object, so that the snapshot doesn't depend on
+		// the lifetime of the database's tree
+		if s.tree, err = lookupTree(db.repo, tree.Id()); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Id returns the id of the root tree of the snapshot, or an empty string
+// if the tree is empty.
+func (s *Snapshot) Id() string {
+	if s.tree == nil {
+		return ""
+	}
+	return s.tree.Id().String()
+}
+
+// Get returns the value of key in the snapshot.
+func (s *Snapshot) Get(key string) (string, error) {
+	if err := s.db.checkClosed(); err != nil {
+		return "", err
+	}
+	if s.tree == nil {
+		return "", ErrNotExist
+	}
+	full := s.db.fullKey(key)
+	if TreePath(full) == "/" {
+		return "", s.db.keyError(full, ErrIsDirectory)
+	}
+	e, err := lookupEntry(s.tree, full)
+	if err != nil {
+		if err = s.db.lookupError(s.tree, full, err); isNotExist(err) {
+			return "", ErrNotExist
+		}
+		return "", err
+	}
+	if e.mode == 040000 {
+		return "", s.db.keyError(full, ErrIsDirectory)
+	}
+	root := s.db.root()
+	var data string
+	if root.cache != nil {
+		data, err = root.cache.blob(s.db.repo, e.id)
+	} else {
+		data, err = blobContents(s.db.repo, e.id)
+	}
+	if err != nil {
+		return "", err
+	}
+	return root.decodeValue(data, e.mode)
+}
+
+// List returns the names of the entries of the subtree at key.
+func (s *Snapshot) List(key string) ([]string, error) {
+	if err := s.db.checkClosed(); err != nil {
+		return nil, err
+	}
+	full := s.db.fullKey(key)
+	names, err := TreeList(s.db.repo, s.tree, full)
+	if err != nil {
+		return nil, s.db.lookupError(s.tree, full, err)
+	}
+	hide := s.db.hidesInternal(full)
+	visible := names[:0]
+	for _, name := range names {
+		if !s.db.hiddenEntry(name, hide) {
+			visible = append(visible, s.db.unescapeKey(name))
+		}
+	}
+	return visible, nil
+}
+
+// Stat returns information about the entry at key, like DB.Stat.
+func (s *Snapshot) Stat(key string) (EntryInfo, error) {
+	if err := s.db.checkClosed(); err != nil {
+		return EntryInfo{}, err
+	}
+	full := s.db.fullKey(key)
+	info, err := TreeStat(s.db.repo, s.tree, full)
+	if err != nil || info.Kind != KindBlob {
+		return info, err
+	}
+	annot, err := annotationKey(full, ContentTypeAnnotation)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	e, err := lookupEntry(s.tree, annot)
+	if isNotExist(err) {
+		return info, nil
+	} else if err != nil {
+		return EntryInfo{}, err
+	}
+	data, err := blobContents(s.db.repo, e.id)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	info.ContentType, err = s.db.root().decodeValue(data, e.mode)
+	return info, err
+}
+
+// Walk walks the subtree at key, like DB.Walk.
+func (s *Snapshot) Walk(key string, h func(string, git.Object) error) error {
+	if err := s.db.checkClosed(); err != nil {
+		return err
+	}
+	err := s.db.walk(s.tree, key, func(key string, e *git.TreeEntry, obj git.Object) error {
+		return h(key, obj)
+	})
+	if err == ErrStopWalk {
+		return nil
+	}
+	return err
+}
+
+// Dump writes the contents of the snapshot to dst, like DB.Dump.
+func (s *Snapshot) Dump(dst io.Writer) error {
+	if err := s.db.checkClosed(); err != nil {
+		return err
+	}
+	decode := s.db.root().decodeValue
+	return s.db.walk(s.tree, "/", func(key string, e *git.TreeEntry, obj git.Object) error {
+		return dumpEntry(dst, key, e, obj, decode)
+	})
+}
+
+// Checkout populates the directory at dir with the contents of the
+// snapshot, like DB.CheckoutScope.
+func (s *Snapshot) Checkout(dir string) error {
+	if err := s.db.checkClosed(); err != nil {
+		return err
+	}
+	if s.tree == nil {
+		return fmt.Errorf("no tree to checkout")
+	}
+	key := s.db.fullKey("/")
+	tree, err := TreeScope(s.db.repo, s.tree, key)
+	if err != nil {
+		if git.IsErrorCode(err, git.ErrNotFound) {
+			return ErrNotExist
+		}
+		return err
+	}
+	defer tree.Free()
+	if err := checkoutTree(s.db.repo, tree, dir); err != nil {
+		return err
+	}
+	if err := s.db.root().decodeCheckout(tree, dir); err != nil {
+		return err
+	}
+	if err := s.db.removeKeepEntries(tree, dir); err != nil {
+		return err
+	}
+	if s.db.hidesInternal(key) {
+		return os.RemoveAll(path.Join(dir, InternalTree))
+	}
+	return nil
+}
+
+// Free releases the resources of the snapshot. For snapshots returned by
+// OpenBundle, the temporary repository is removed.
+func (s *Snapshot) Free() {
+	if s.tree != nil {
+		s.tree.Free()
+		s.tree = nil
+	}
+	if s.ownDB {
+		s.db.Free()
+	}
+}
@@ -0,0 +1,66 @@
+package libpack
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("foo/bar", "A")
+	db.SetTyped("foo/json", "{}", JSONContentType)
+	s, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scoped, err := db.Scope("foo").Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set("foo/bar", "B")
+	db.Set("foo/baz", "C")
+	assertGet(t, s, "foo/bar", "A")
+	assertNotExist(t, s, "foo/baz")
+	assertGet(t, scoped, "bar", "A")
+	assertGet(t, db, "foo/bar", "B")
+	if names, err := s.List("foo"); err != nil || strings.Join(names, ",") != "bar,json" {
+		t.Fatalf("%v %v", names, err)
+	}
+	if info, err := scoped.Stat("json"); err != nil || info.ContentType != JSONContentType {
+		t.Fatalf("%#v %v", info, err)
+	}
+	var dump bytes.Buffer
+	if err := scoped.Dump(&dump); err != nil {
+		t.Fatal(err)
+	}
+	if dump.String() != "bar = A\njson = {}\n" {
+		t.Fatalf("%q", dump.String())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			db.Set("foo/bar", fmt.Sprintf("%d", i))
+			if v, err := s.Get("foo/bar"); err != nil || v != "A" {
+				t.Errorf("%v %v", v, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	emptyDB := tmpDB(t, "")
+	defer nukeDB(emptyDB)
+	empty, err := emptyDB.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := empty.Get("foo"); err != ErrNotExist {
+		t.Fatalf("%v", err)
+	}
+}
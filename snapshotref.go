@@ -0,0 +1,174 @@
+package libpack
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+// snapshotRefPrefix is the namespace of the references created by
+// SaveSnapshot.
+const snapshotRefPrefix = "refs/libpack/snapshots/"
+
+// SnapshotInfo describes a snapshot saved by SaveSnapshot.
+type SnapshotInfo struct {
+	Name    string
+	Commit  string
+	Message string
+	When    time.Time
+}
+
+// SnapshotOpt are options for SaveSnapshotWith.
+type SnapshotOpt struct {
+	// Save a new commit of the uncommitted tree, on top of the latest
+	// commit, rather than the latest commit. The database's reference is
+	// not changed.
+	Uncommitted bool
+}
+
+// SaveSnapshot creates the reference refs/libpack/snapshots/<name>,
+// pointing to the latest commit of the database, and returns the id of
+// that commit. Since the commit is reachable from its own reference, it
+// is kept by Compact, EnforceRetention and GC until DeleteSnapshot is
+// called. If a snapshot with the same name already exists, an error is
+// returned.
+// Unlike Snapshot, which is an in-memory view of the uncommitted tree,
+// saved snapshots are stored in the repository.
+func (db *DB) SaveSnapshot(name string) (string, error) {
+	return db.SaveSnapshotWith(name, SnapshotOpt{})
+}
+
+// SaveSnapshotWith is like SaveSnapshot, with options.
+func (db *DB) SaveSnapshotWith(name string, opt SnapshotOpt) (commitID string, err error) {
+	if err := db.checkClosed(); err != nil {
+		return "", err
+	}
+	defer db.wrapError("snapshot", "", &err)
+	if db.parent != nil {
+		return db.parent.SaveSnapshotWith(name, opt)
+	}
+	if name == "" || strings.Contains(name, "..") {
+		return "", fmt.Errorf("invalid snapshot name: %q", name)
+	}
+	refname := snapshotRefPrefix + name
+	if ref, err := db.repo.LookupReference(refname); err == nil {
+		ref.Free()
+		return "", fmt.Errorf("snapshot %s already exists", name)
+	}
+	sig := db.signature()
+	var tree *git.Tree
+	if opt.Uncommitted {
+		var err error
+		if tree, err = db.snapshot(); err != nil {
+			return "", err
+		}
+	}
+	db.l.RLock()
+	defer db.l.RUnlock()
+	commit := db.commit
+	if opt.Uncommitted {
+		if tree == nil {
+			id, err := emptyTree(db.repo)
+			if err != nil {
+				return "", err
+			}
+			if tree, err = lookupTree(db.repo, id); err != nil {
+				return "", err
+			}
+			defer tree.Free()
+		}
+		c, err := mkCommit(db.repo, "", fmt.Sprintf("Snapshot %s", name), sig, db.signer, tree, db.commit)
+		if err != nil {
+			return "", err
+		}
+		defer c.Free()
+		commit = c
+	}
+	if commit == nil {
+		return "", ErrNoCommits
+	}
+	ref, err := db.repo.CreateReference(refname, commit.Id(), false, sig, "libpack.snapshot "+name)
+	if err != nil {
+		return "", err
+	}
+	ref.Free()
+	return commit.Id().String(), nil
+}
+
+// Snapshots returns the snapshots saved in the database's repository,
+// sorted by name.
+func (db *DB) Snapshots() (snapshots []SnapshotInfo, err error) {
+	if err := db.checkClosed(); err != nil {
+		return nil, err
+	}
+	defer db.wrapError("snapshots", "", &err)
+	iter, err := db.repo.NewReferenceIteratorGlob(snapshotRefPrefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Free()
+	for {
+		ref, err := iter.Next()
+		if isGitIterOver(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		name := strings.TrimPrefix(ref.Name(), snapshotRefPrefix)
+		commit, err := lookupCommit(db.repo, ref.Target())
+		ref.Free()
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, SnapshotInfo{
+			Name:    name,
+			Commit:  commit.Id().String(),
+			Message: commit.Message(),
+			When:    commit.Committer().When,
+		})
+		commit.Free()
+	}
+	sort.Sort(snapshotsByName(snapshots))
+	return snapshots, nil
+}
+
+type snapshotsByName []SnapshotInfo
+
+func (s snapshotsByName) Len() int           { return len(s) }
+func (s snapshotsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s snapshotsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// DeleteSnapshot deletes the snapshot `name`. Its commits are deleted by
+// the next GC once they are old enough, unless they are reachable from
+// another reference.
+func (db *DB) DeleteSnapshot(name string) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("delete-snapshot", "", &err)
+	ref, err := db.repo.LookupReference(snapshotRefPrefix + name)
+	if err != nil {
+		return fmt.Errorf("no such snapshot: %s", name)
+	}
+	defer ref.Free()
+	return ref.Delete()
+}
+
+// PushSnapshots uploads all the snapshots of the database's repository
+// to the repository at url, under the same names. Existing remote
+// snapshots with the same name are overwritten.
+func (db *DB) PushSnapshots(url string) (err error) {
+	defer db.wrapError("push", "", &err)
+	snapshots, err := db.Snapshots()
+	if err != nil {
+		return err
+	}
+	var refspecs []string
+	for _, s := range snapshots {
+		refspecs = append(refspecs, fmt.Sprintf("+%s%s:%s%s", snapshotRefPrefix, s.Name, snapshotRefPrefix, s.Name))
+	}
+	return pushRefspecs(db.repo, url, refspecs...)
+}
@@ -0,0 +1,76 @@
+package libpack
+
+import (
+	"testing"
+)
+
+func TestSaveSnapshot(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	if _, err := db.SaveSnapshot("empty"); err != ErrNoCommits {
+		t.Fatalf("%v", err)
+	}
+	commitKey(t, db, "foo", "v1")
+	head, _ := db.Head()
+	id, err := db.Scope("sub").SaveSnapshot("before-migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != head {
+		t.Fatalf("%v != %v", id, head)
+	}
+	if _, err := db.SaveSnapshot("before-migration"); err == nil {
+		t.Fatalf("saving an existing snapshot should fail")
+	}
+	// Snapshot of the uncommitted tree
+	db.Set("foo", "v2")
+	wip, err := db.SaveSnapshotWith("wip", SnapshotOpt{Uncommitted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := db.Head(); h != head {
+		t.Fatalf("the head should not move")
+	}
+	if info, err := db.CommitInfo(wip); err != nil || len(info.Parents) != 1 || info.Parents[0] != head {
+		t.Fatalf("%#v %v", info, err)
+	}
+	if changes, err := db.CommitChanges(wip); err != nil || len(changes) != 1 || changes[0].Key != "foo" {
+		t.Fatalf("%#v %v", changes, err)
+	}
+	snapshots, err := db.Snapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || snapshots[0].Name != "before-migration" || snapshots[0].Commit != head || snapshots[1].Name != "wip" || snapshots[1].Commit != wip {
+		t.Fatalf("%#v", snapshots)
+	}
+	// Rewriting the history doesn't drop snapshots
+	db.Commit("v2")
+	if _, err := db.Compact(db.now().Add(1e9), "compacted", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.GC(GCOpt{PruneAge: -1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CommitInfo(head); err != nil {
+		t.Fatal(err)
+	}
+	// Snapshots can be pushed
+	remote := tmpDB(t, "")
+	defer nukeDB(remote)
+	if err := db.PushSnapshots(remote.Repo().Path()); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := remote.Snapshots(); err != nil || len(s) != 2 || s[1].Commit != wip {
+		t.Fatalf("%#v %v", s, err)
+	}
+	if err := db.DeleteSnapshot("wip"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteSnapshot("wip"); err == nil {
+		t.Fatalf("deleting a missing snapshot should fail")
+	}
+	if s, _ := db.Snapshots(); len(s) != 1 {
+		t.Fatalf("%#v", s)
+	}
+}
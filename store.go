@@ -0,0 +1,42 @@
+package libpack
+
+// A Getter reads values by key.
+type Getter interface {
+	Get(key string) (string, error)
+}
+
+// A Setter changes values by key.
+type Setter interface {
+	Set(key, value string) error
+	// Delete removes the value or subtree at key, or returns
+	// ErrNotExist if there is nothing at key.
+	Delete(key string) error
+}
+
+// A Lister lists the names of the entries of a subtree.
+type Lister interface {
+	List(key string) ([]string, error)
+}
+
+// A ReadStore is a tree of values which can be read, such as a database,
+// a scoped view of a database, or a snapshot. See Equal and Contains.
+type ReadStore interface {
+	Getter
+	Lister
+}
+
+// A Store is a tree of values which can be read and changed, such as
+// a database or a scoped view of a database. The mockstore package
+// provides an implementation in memory for tests.
+type Store interface {
+	Getter
+	Setter
+	Lister
+	// Commit records the changes made since the last commit.
+	Commit(msg string) error
+}
+
+var (
+	_ Store     = (*DB)(nil)
+	_ ReadStore = (*Snapshot)(nil)
+)
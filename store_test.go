@@ -0,0 +1,35 @@
+package libpack_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/docker/libpack"
+	"github.com/docker/libpack/storetest"
+)
+
+func TestStoreConformance(t *testing.T) {
+	newDB := func(t *testing.T) (*libpack.DB, func()) {
+		tmp, err := ioutil.TempDir("", "libpack-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := libpack.Init(tmp, "refs/heads/test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db, func() {
+			db.Free()
+			os.RemoveAll(tmp)
+		}
+	}
+	storetest.Run(t, func(t *testing.T) (libpack.Store, func()) {
+		return newDB(t)
+	})
+	// Scoped databases are stores too
+	storetest.Run(t, func(t *testing.T) (libpack.Store, func()) {
+		db, release := newDB(t)
+		return db.Scope("scope"), release
+	})
+}
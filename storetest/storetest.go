@@ -0,0 +1,174 @@
+// Package storetest checks that implementations of libpack.Store behave
+// like a database.
+package storetest
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/docker/libpack"
+)
+
+// Run runs the conformance tests of libpack.Store against the stores
+// returned by newStore. Each call must return a new, empty store, and a
+// function to release it.
+func Run(t *testing.T, newStore func(t *testing.T) (libpack.Store, func())) {
+	for _, test := range []struct {
+		name string
+		f    func(*testing.T, libpack.Store)
+	}{
+		{"SetGet", testSetGet},
+		{"List", testList},
+		{"Overwrite", testOverwrite},
+		{"Delete", testDelete},
+		{"Commit", testCommit},
+		{"KeyErrors", testKeyErrors},
+		{"InvalidKeys", testInvalidKeys},
+	} {
+		s, release := newStore(t)
+		t.Logf("%s", test.name)
+		test.f(t, s)
+		release()
+	}
+}
+
+func assertGet(t *testing.T, s libpack.Store, key, value string) {
+	if v, err := s.Get(key); err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	} else if v != value {
+		t.Fatalf("get %s: %q != %q", key, v, value)
+	}
+}
+
+func assertNotExist(t *testing.T, s libpack.Store, key string) {
+	if _, err := s.Get(key); err != libpack.ErrNotExist {
+		t.Fatalf("get %s: expected ErrNotExist, got %v", key, err)
+	}
+}
+
+func assertList(t *testing.T, s libpack.Store, key string, expected ...string) {
+	names, err := s.List(key)
+	if err != nil {
+		t.Fatalf("list %s: %v", key, err)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Fatalf("list %s: %v != %v", key, names, expected)
+	}
+}
+
+func testSetGet(t *testing.T, s libpack.Store) {
+	assertNotExist(t, s, "foo")
+	if err := s.Set("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, s, "foo", "bar")
+	assertGet(t, s, "/foo", "bar")
+	if err := s.Set("a/b/c", ""); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, s, "a/b/c", "")
+	assertGet(t, s, "a//b/./c", "")
+	if _, err := s.Get("a/b"); err == nil {
+		t.Fatalf("get of a subtree should fail")
+	}
+}
+
+func testList(t *testing.T, s libpack.Store) {
+	assertList(t, s, "/")
+	s.Set("foo", "1")
+	s.Set("dir/a", "2")
+	s.Set("dir/sub/b", "3")
+	assertList(t, s, "/", "dir", "foo")
+	assertList(t, s, "", "dir", "foo")
+	assertList(t, s, "dir", "a", "sub")
+	assertList(t, s, "dir/sub", "b")
+	if _, err := s.List("missing"); err == nil {
+		t.Fatalf("list of a missing subtree should fail")
+	}
+}
+
+func testOverwrite(t *testing.T, s libpack.Store) {
+	s.Set("a/b", "1")
+	// A value replaces a subtree
+	if err := s.Set("a", "2"); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, s, "a", "2")
+	_, err := s.Get("a/b")
+	assertKeyError(t, err, libpack.ErrNotDirectory, "a/b")
+	// A subtree replaces a value
+	if err := s.Set("a/c", "3"); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, s, "a/c", "3")
+	assertList(t, s, "a", "c")
+}
+
+func testDelete(t *testing.T, s libpack.Store) {
+	s.Set("a/b", "1")
+	s.Set("a/c", "2")
+	s.Set("d", "3")
+	if err := s.Delete("a/b"); err != nil {
+		t.Fatal(err)
+	}
+	assertNotExist(t, s, "a/b")
+	assertGet(t, s, "a/c", "2")
+	if err := s.Delete("a/b"); err != libpack.ErrNotExist {
+		t.Fatalf("%v", err)
+	}
+	if err := s.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	assertNotExist(t, s, "a/c")
+	assertList(t, s, "/", "d")
+}
+
+func testCommit(t *testing.T, s libpack.Store) {
+	s.Set("foo", "bar")
+	if err := s.Commit("test"); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, s, "foo", "bar")
+	// Committing without changes is not an error
+	if err := s.Commit("nothing"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// assertKeyError checks that err is a *libpack.KeyError with target. The
+// key of the error is relative to the root of the database, so it is
+// not checked.
+func assertKeyError(t *testing.T, err, target error, key string) {
+	var kerr *libpack.KeyError
+	if !errors.Is(err, target) || !errors.As(err, &kerr) {
+		t.Fatalf("%s: expected a *KeyError with %v, got %v", key, target, err)
+	}
+}
+
+func testKeyErrors(t *testing.T, s libpack.Store) {
+	s.Set("a/b/c", "1")
+	_, err := s.Get("a/b")
+	assertKeyError(t, err, libpack.ErrIsDirectory, "a/b")
+	_, err = s.Get("a/b/c/d")
+	assertKeyError(t, err, libpack.ErrNotDirectory, "a/b/c/d")
+	_, err = s.List("a/b/c")
+	assertKeyError(t, err, libpack.ErrNotDirectory, "a/b/c")
+}
+
+func testInvalidKeys(t *testing.T, s libpack.Store) {
+	for _, key := range []string{"", "/", "a/../b", "..\\a", "a\x00b"} {
+		err := s.Set(key, "x")
+		if _, ok := err.(*libpack.InvalidKeyError); !ok {
+			t.Fatalf("set %q: expected an *InvalidKeyError, got %v", key, err)
+		}
+	}
+	for _, key := range []string{"a/../b", "a\x00b"} {
+		if _, err := s.Get(key); err == nil {
+			t.Fatalf("get %q should fail", key)
+		}
+	}
+	assertList(t, s, "/")
+}
@@ -0,0 +1,196 @@
+package libpack
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"strconv"
+)
+
+// SetStruct stores the exported fields of the struct v under prefix,
+// one key per field, so that changing a field only changes its key.
+// Keys are named after the fields, or after their `libpack` tag if they
+// have one. Fields tagged `libpack:"-"` are skipped.
+// Nested structs are stored as subtrees. Strings, booleans, numbers and
+// values implementing encoding.TextMarshaler (such as time.Time) are
+// stored as text, and all other values are encoded in JSON.
+// All fields are set in a single operation.
+func (db *DB) SetStruct(prefix string, v interface{}) error {
+	val := reflect.ValueOf(v)
+	for val.Kind() == reflect.Ptr {
+		val = val.Elem()
+	}
+	if val.Kind() != reflect.Struct {
+		return fmt.Errorf("SetStruct: %T is not a struct", v)
+	}
+	kv := make(map[string]string)
+	if err := encodeStruct(prefix, val, kv); err != nil {
+		return err
+	}
+	return db.SetMany(kv)
+}
+
+// GetStruct loads the fields of the struct pointed to by out from the
+// keys under prefix, as stored by SetStruct. Fields whose key doesn't
+// exist are left unchanged, and keys which don't match any field are
+// ignored.
+func (db *DB) GetStruct(prefix string, out interface{}) (err error) {
+	defer db.wrapError("get", prefix, &err)
+	val := reflect.ValueOf(out)
+	if val.Kind() != reflect.Ptr || val.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("GetStruct: %T is not a pointer to a struct", out)
+	}
+	return db.decodeStruct(prefix, val.Elem())
+}
+
+// structFields calls f with the key name of each stored field of
+// the struct type t.
+func structFields(t reflect.Type, f func(i int, name string) error) error {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			// Unexported
+			continue
+		}
+		name := field.Tag.Get("libpack")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if err := f(i, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeStruct(prefix string, val reflect.Value, kv map[string]string) error {
+	return structFields(val.Type(), func(i int, name string) error {
+		key := path.Join(prefix, name)
+		field := val.Field(i)
+		if field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				return nil
+			}
+			field = field.Elem()
+		}
+		if isNestedStruct(field) {
+			return encodeStruct(key, field, kv)
+		}
+		s, err := encodeScalar(field)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		kv[key] = s
+		return nil
+	})
+}
+
+func (db *DB) decodeStruct(prefix string, val reflect.Value) error {
+	return structFields(val.Type(), func(i int, name string) error {
+		key := path.Join(prefix, name)
+		field := val.Field(i)
+		if field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				if _, err := db.Stat(key); isNotExist(err) {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			field = field.Elem()
+		}
+		if isNestedStruct(field) {
+			return db.decodeStruct(key, field)
+		}
+		s, err := db.Get(key)
+		if isNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := decodeScalar(s, field); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		return nil
+	})
+}
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// isNestedStruct returns true if v is stored as a subtree.
+func isNestedStruct(v reflect.Value) bool {
+	return v.Kind() == reflect.Struct && !v.Type().Implements(textMarshalerType) && !reflect.PtrTo(v.Type()).Implements(textMarshalerType)
+}
+
+func encodeScalar(v reflect.Value) (string, error) {
+	if v.CanAddr() {
+		if m, ok := v.Addr().Interface().(encoding.TextMarshaler); ok {
+			text, err := m.MarshalText()
+			return string(text), err
+		}
+	}
+	if m, ok := v.Interface().(encoding.TextMarshaler); ok {
+		text, err := m.MarshalText()
+		return string(text), err
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits()), nil
+	}
+	data, err := json.Marshal(v.Interface())
+	return string(data), err
+}
+
+func decodeScalar(s string, v reflect.Value) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+		return nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+		return nil
+	}
+	return json.Unmarshal([]byte(s), v.Addr().Interface())
+}
@@ -0,0 +1,100 @@
+package libpack
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Name    string `libpack:"name"`
+	Port    int    `libpack:"port"`
+	Debug   bool
+	Ratio   float64
+	Tags    []string
+	Updated time.Time
+	Secret  string `libpack:"-"`
+	Backend struct {
+		Host string `libpack:"host"`
+		Size uint16
+	} `libpack:"backend"`
+	Limits *testLimits
+	hidden string
+}
+
+type testLimits struct {
+	Max int
+}
+
+func TestSetGetStruct(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	var in testConfig
+	in.Name = "web"
+	in.Port = 8080
+	in.Debug = true
+	in.Ratio = 0.5
+	in.Tags = []string{"a", "b"}
+	in.Updated = time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)
+	in.Secret = "secret"
+	in.Backend.Host = "db.local"
+	in.Backend.Size = 3
+	in.Limits = &testLimits{Max: 10}
+	in.hidden = "hidden"
+	if err := db.SetStruct("config", &in); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, db, "config/name", "web")
+	assertGet(t, db, "config/port", "8080")
+	assertGet(t, db, "config/backend/host", "db.local")
+	assertGet(t, db, "config/Limits/Max", "10")
+	assertNotExist(t, db, "config/Secret")
+	assertNotExist(t, db, "config/hidden")
+	// Unknown keys are ignored
+	db.Set("config/unknown", "foo")
+	var out testConfig
+	if err := db.GetStruct("config", &out); err != nil {
+		t.Fatal(err)
+	}
+	in.Secret = ""
+	in.hidden = ""
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("%#v != %#v", out, in)
+	}
+	// Missing keys leave zero values
+	var empty testConfig
+	if err := db.GetStruct("nothing", &empty); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(empty, testConfig{}) {
+		t.Fatalf("%#v", empty)
+	}
+	// Changing one field only changes one blob
+	if err := db.Commit("config"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := db.ListEntries("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.Port = 8081
+	if err := db.SetStruct("config", &in); err != nil {
+		t.Fatal(err)
+	}
+	after, err := db.ListEntries("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := 0
+	for i := range before {
+		if before[i].Id != after[i].Id {
+			changed++
+			if before[i].Name != "port" {
+				t.Fatalf("%s changed", before[i].Name)
+			}
+		}
+	}
+	if changed != 1 {
+		t.Fatalf("%d entries changed", changed)
+	}
+}
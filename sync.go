@@ -0,0 +1,106 @@
+package libpack
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+// ErrNonFastForward is returned by Pull and Push when the local and
+// remote references have diverged, or by Push when the remote reference
+// is ahead of the local one.
+var ErrNonFastForward = errors.New("non fast-forward update: the histories have diverged")
+
+// MergeOnPull makes Pull merge the remote commits when the local and
+// remote references have diverged, instead of failing with
+// ErrNonFastForward. Conflicts are resolved in favor of the local
+// history, like with ApplyFetched.
+func MergeOnPull() Option {
+	return func(db *DB) {
+		db.mergeOnPull = true
+	}
+}
+
+// pushCheckRefPrefix is the prefix of the references in which Push
+// downloads the remote reference, to check that it can be
+// fast-forwarded.
+const pushCheckRefPrefix = "refs/libpack/push-check/"
+
+// A commitRelation tells how a local commit relates to a remote one.
+type commitRelation int
+
+const (
+	commitsEqual commitRelation = iota
+	// The local commit contains the remote one
+	localAhead
+	// The remote commit contains the local one
+	localBehind
+	commitsDiverged
+)
+
+// compareCommits returns the relation between the commits local and
+// remote of r.
+func compareCommits(r *git.Repository, local, remote *git.Oid) (commitRelation, error) {
+	if local.Equal(remote) {
+		return commitsEqual, nil
+	}
+	base, err := r.MergeBase(local, remote)
+	if err != nil {
+		if git.IsErrorCode(err, git.ErrNotFound) {
+			// No common history
+			return commitsDiverged, nil
+		}
+		return 0, err
+	}
+	switch {
+	case base.Equal(remote):
+		return localAhead, nil
+	case base.Equal(local):
+		return localBehind, nil
+	}
+	return commitsDiverged, nil
+}
+
+// checkPush returns ErrNonFastForward if the reference `ref` at url has
+// commits which the reference of db doesn't contain. The remote commits
+// are downloaded to compare them.
+func (db *DB) checkPush(url, ref string) error {
+	local := lookupTip(db.repo, db.ref)
+	if local == nil {
+		// Nothing to push
+		return nil
+	}
+	defer local.Free()
+	tmp := pushCheckRefPrefix + strings.TrimPrefix(db.ref, "refs/")
+	if stale, err := db.repo.LookupReference(tmp); err == nil {
+		// Left by an interrupted check
+		stale.Delete()
+		stale.Free()
+	}
+	remote, err := db.repo.CreateAnonymousRemote(url, fmt.Sprintf("+%s:%s", ref, tmp))
+	if err != nil {
+		return err
+	}
+	defer remote.Free()
+	if err := remote.Fetch(nil, db.signature(), fmt.Sprintf("libpack.push-check %s %s", url, ref)); err != nil {
+		return err
+	}
+	fetched, err := db.repo.LookupReference(tmp)
+	if err != nil {
+		// The remote reference doesn't exist
+		return nil
+	}
+	defer fetched.Free()
+	defer fetched.Delete()
+	rel, err := compareCommits(db.repo, local.Id(), fetched.Target())
+	if err != nil {
+		return err
+	}
+	if rel == localBehind || rel == commitsDiverged {
+		db.logf(LogInfo, "push %s %s: refused, remote head %s is not contained in %s", url, ref, fetched.Target(), local.Id())
+		return ErrNonFastForward
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package libpack
+
+import (
+	"testing"
+)
+
+// syncPair returns two databases sharing a first commit.
+func syncPair(t *testing.T, opts ...Option) (local, remote *DB) {
+	remote = tmpDB(t, "")
+	remote.Set("foo", "A")
+	if err := remote.Commit("A"); err != nil {
+		t.Fatal(err)
+	}
+	local, err := Init(tmpdir(t), "refs/heads/test", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := local.Pull(remote.Repo().Path(), ""); err != nil {
+		t.Fatal(err)
+	}
+	return local, remote
+}
+
+func commitKey(t *testing.T, db *DB, key, value string) {
+	db.Set(key, value)
+	if err := db.Commit(key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPullOutcomes(t *testing.T) {
+	local, remote := syncPair(t)
+	defer nukeDB(local)
+	defer nukeDB(remote)
+	url := remote.Repo().Path()
+
+	// Equal
+	head := local.headId().String()
+	if err := local.Pull(url, ""); err != nil {
+		t.Fatal(err)
+	}
+	if h := local.headId().String(); h != head {
+		t.Fatalf("%s != %s", h, head)
+	}
+	// Behind: fast-forward
+	commitKey(t, remote, "remote", "1")
+	if err := local.Pull(url, ""); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, local, "remote", "1")
+	if local.headId().String() != remote.headId().String() {
+		t.Fatalf("not fast-forwarded")
+	}
+	// Ahead: nothing changes
+	commitKey(t, local, "local", "1")
+	head = local.headId().String()
+	if err := local.Pull(url, ""); err != nil {
+		t.Fatal(err)
+	}
+	if h := local.headId().String(); h != head {
+		t.Fatalf("%s != %s", h, head)
+	}
+	// Diverged: refused
+	commitKey(t, remote, "remote", "2")
+	local.Set("uncommitted", "x")
+	if err := local.Pull(url, ""); err != ErrNonFastForward {
+		t.Fatalf("%v", err)
+	}
+	if h := local.headId().String(); h != head {
+		t.Fatalf("%s != %s", h, head)
+	}
+	assertGet(t, local, "remote", "1")
+	assertGet(t, local, "uncommitted", "x")
+}
+
+func TestMergeOnPull(t *testing.T) {
+	local, remote := syncPair(t, MergeOnPull())
+	defer nukeDB(local)
+	defer nukeDB(remote)
+	url := remote.Repo().Path()
+
+	commitKey(t, remote, "remote", "1")
+	commitKey(t, local, "local", "1")
+	commitKey(t, remote, "foo", "remote")
+	commitKey(t, local, "foo", "local")
+	localHead := local.headId().String()
+	if err := local.Pull(url, ""); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, local, "remote", "1")
+	assertGet(t, local, "local", "1")
+	// Conflicts are resolved in favor of the local history
+	assertGet(t, local, "foo", "local")
+	log, err := local.Log("", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log[0].Parents) != 2 || log[0].Parents[0] != localHead || log[0].Parents[1] != remote.headId().String() {
+		t.Fatalf("%#v", log[0])
+	}
+}
+
+func TestPushOutcomes(t *testing.T) {
+	local, remote := syncPair(t)
+	defer nukeDB(local)
+	defer nukeDB(remote)
+	url := remote.Repo().Path()
+
+	// Equal
+	if err := local.Push(url, remote.ref); err != nil {
+		t.Fatal(err)
+	}
+	// Ahead: fast-forward
+	commitKey(t, local, "local", "1")
+	if err := local.Push(url, remote.ref); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Update(); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, remote, "local", "1")
+	// Behind: refused
+	commitKey(t, remote, "remote", "1")
+	head := remote.headId().String()
+	if err := local.Push(url, remote.ref); err != ErrNonFastForward {
+		t.Fatalf("%v", err)
+	}
+	// Diverged: refused
+	commitKey(t, local, "local", "2")
+	if err := local.Push(url, remote.ref); err != ErrNonFastForward {
+		t.Fatalf("%v", err)
+	}
+	if err := remote.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if h := remote.headId().String(); h != head {
+		t.Fatalf("%s != %s", h, head)
+	}
+	// The remote commits are not kept locally
+	if _, err := local.repo.LookupReference(pushCheckRefPrefix + "heads/test"); err == nil {
+		t.Fatalf("temporary reference not deleted")
+	}
+	// A new remote ref is created
+	if err := local.Push(url, "refs/heads/new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := local.ForcePush(url, remote.ref); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Update(); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, remote, "local", "2")
+	assertNotExist(t, remote, "remote")
+}
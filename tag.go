@@ -0,0 +1,184 @@
+package libpack
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+const tagPrefix = "refs/tags/"
+
+// TagInfo describes an annotated tag.
+type TagInfo struct {
+	Name    string
+	Commit  string
+	Message string
+	Tagger  string
+	When    time.Time
+}
+
+// Tag creates an annotated tag called `name`, pointing to the latest
+// commit of the database. Uncommitted changes are ignored.
+// If a tag with the same name already exists, an error is returned.
+func (db *DB) Tag(name, message string) error {
+	return db.tag(name, message, false)
+}
+
+// TagForce is like Tag, but replaces any existing tag with the same name.
+func (db *DB) TagForce(name, message string) error {
+	return db.tag(name, message, true)
+}
+
+func (db *DB) tag(name, message string, force bool) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("tag", "", &err)
+	if db.parent != nil {
+		return db.parent.tag(name, message, force)
+	}
+	sig := db.signature()
+	db.l.RLock()
+	defer db.l.RUnlock()
+	if db.commit == nil {
+		return fmt.Errorf("no head to tag")
+	}
+	refname := tagPrefix + name
+	if !force {
+		if ref, err := db.repo.LookupReference(refname); err == nil {
+			ref.Free()
+			return fmt.Errorf("tag %s already exists", name)
+		}
+	}
+	id, err := mkTag(db.repo, name, db.commit.Id(), sig, message)
+	if err != nil {
+		return err
+	}
+	// An existing tag is only replaced once the new one is written
+	ref, err := db.repo.CreateReference(refname, id, force, sig, "libpack.tag "+name)
+	if err != nil {
+		return err
+	}
+	ref.Free()
+	return nil
+}
+
+// mkTag creates an annotated tag object for the commit target, and
+// returns its id. Unlike Repository.CreateTag, it does not create the
+// reference of the tag, so that an existing tag can be replaced
+// atomically.
+func mkTag(r *git.Repository, name string, target *git.Oid, sig *git.Signature, message string) (*git.Oid, error) {
+	tagger, err := formatSignature(sig)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "object %s\ntype commit\ntag %s\ntagger %s\n\n%s", target, name, tagger, message)
+	odb, err := r.Odb()
+	if err != nil {
+		return nil, err
+	}
+	defer odb.Free()
+	return odb.Write(buf.Bytes(), git.ObjectTag)
+}
+
+// Tags returns the list of annotated tags in the database's repository.
+// Lightweight tags are ignored.
+func (db *DB) Tags() (tags []TagInfo, err error) {
+	if err := db.checkClosed(); err != nil {
+		return nil, err
+	}
+	defer db.wrapError("tags", "", &err)
+	iter, err := db.repo.NewReferenceIteratorGlob(tagPrefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Free()
+	for {
+		ref, err := iter.Next()
+		if isGitIterOver(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		tag, err := db.repo.LookupTag(ref.Target())
+		name := ref.Name()
+		ref.Free()
+		if err != nil {
+			// Not an annotated tag
+			continue
+		}
+		info := TagInfo{
+			Name:    strings.TrimPrefix(name, tagPrefix),
+			Commit:  tag.TargetId().String(),
+			Message: tag.Message(),
+		}
+		if tagger := tag.Tagger(); tagger != nil {
+			info.Tagger = tagger.Name
+			info.When = tagger.When
+		}
+		tag.Free()
+		tags = append(tags, info)
+	}
+	return tags, nil
+}
+
+// CheckoutTag populates the directory at dir with the contents of the
+// database at tag `name`.
+func (db *DB) CheckoutTag(name, dir string) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("checkout", "", &err)
+	ref, err := db.repo.LookupReference(tagPrefix + name)
+	if err != nil {
+		return err
+	}
+	defer ref.Free()
+	commit, err := peelCommit(ref)
+	if err != nil {
+		return err
+	}
+	defer commit.Free()
+	return checkoutCommit(db.repo, commit.Id(), dir)
+}
+
+// PushTags uploads all tags of the database's repository to the
+// repository at url. Existing remote tags with the same name are
+// overwritten.
+func (db *DB) PushTags(url string) (err error) {
+	defer db.wrapError("push", "", &err)
+	tags, err := db.Tags()
+	if err != nil {
+		return err
+	}
+	var refspecs []string
+	for _, t := range tags {
+		refspecs = append(refspecs, fmt.Sprintf("+%s%s:%s%s", tagPrefix, t.Name, tagPrefix, t.Name))
+	}
+	return pushRefspecs(db.repo, url, refspecs...)
+}
+
+// OpenAtTag opens a read-only database with the contents of the
+// repository at `repo` at tag `name`.
+func OpenAtTag(repo, name string, opts ...Option) (*DB, error) {
+	r, err := git.OpenRepository(repo)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := r.LookupReference(tagPrefix + name)
+	if err != nil {
+		r.Free()
+		return nil, fmt.Errorf("no such tag: %s", name)
+	}
+	ref.Free()
+	db, err := newRepo(r, tagPrefix+name, opts)
+	if err != nil {
+		return nil, err
+	}
+	db.readOnly = true
+	return db, nil
+}
@@ -0,0 +1,71 @@
+package libpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestTag(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("foo", "v1")
+	db.Commit("v1")
+	if err := db.Tag("release-1", "first release"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Tag("release-1", "first release"); err == nil {
+		t.Fatalf("creating an existing tag should fail")
+	}
+	db.Set("foo", "v2")
+	db.Commit("v2")
+
+	tags, err := db.Tags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0].Name != "release-1" || tags[0].Message != "first release" {
+		t.Fatalf("%#v", tags)
+	}
+	tagged, err := OpenAtTag(db.Repo().Path(), "release-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, tagged, "foo", "v1")
+	if err := tagged.Commit("should fail"); err != ErrReadOnly {
+		t.Fatalf("%v", err)
+	}
+
+	// A failed TagForce keeps the existing tag
+	bad, err := Open(db.Repo().Path(), db.ref, WithAuthor("Eve <eve@example.com>", "eve@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Free()
+	if err := bad.TagForce("release-1", "moved"); err == nil {
+		t.Fatalf("tagging with an invalid tagger should fail")
+	}
+	if tags, err := db.Tags(); err != nil || len(tags) != 1 || tags[0].Message != "first release" {
+		t.Fatalf("%#v %v", tags, err)
+	}
+
+	if err := db.TagForce("release-1", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	if tags, err := db.Tags(); err != nil || len(tags) != 1 || tags[0].Message != "moved" || tags[0].Commit != db.headId().String() {
+		t.Fatalf("%#v %v", tags, err)
+	}
+	checkoutTmp := tmpdir(t)
+	defer os.RemoveAll(checkoutTmp)
+	if err := db.CheckoutTag("release-1", checkoutTmp); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path.Join(checkoutTmp, "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "v2" {
+		t.Fatalf("%#v", string(data))
+	}
+}
@@ -2,9 +2,7 @@ package libpack
 
 import (
 	"bytes"
-	"fmt"
 	"io"
-	"os"
 	"path"
 
 	git "github.com/libgit2/git2go"
@@ -19,12 +17,13 @@ const (
 
 // GetTar generates a tar stream frmo the contents of db, and streams
 // it to `dst`.
-func (db *DB) GetTar(dst io.Writer) error {
+func (db *DB) GetTar(dst io.Writer) (err error) {
+	defer db.wrapError("tar", "", &err)
 	tw := tar.NewWriter(dst)
 	defer tw.Close()
 	// Walk the data tree
 	return db.Walk(DataTree, func(name string, obj git.Object) error {
-		fmt.Fprintf(os.Stderr, "Generating tar entry for '%s'...\n", name)
+		db.logf(LogDebug, "generating tar entry for %s", name)
 		metaBlob, err := db.Get(metaPath(name))
 		if err != nil {
 			return err
@@ -38,9 +37,15 @@ func (db *DB) GetTar(dst io.Writer) error {
 		if err := tw.WriteHeader(hdr); err != nil {
 			return err
 		}
-		if blob, isBlob := obj.(*git.Blob); isBlob {
-			fmt.Fprintf(os.Stderr, "--> writing %d bytes for blob %s\n", hdr.Size, hdr.Name)
-			if _, err := tw.Write(blob.Contents()[:hdr.Size]); err != nil {
+		if _, isBlob := obj.(*git.Blob); isBlob {
+			db.logf(LogDebug, "writing %d bytes for blob %s", hdr.Size, hdr.Name)
+			// Use Get rather than the blob contents, so that values
+			// are decoded
+			data, err := db.Get(path.Join(DataTree, name))
+			if err != nil {
+				return err
+			}
+			if _, err := tw.Write([]byte(data)[:hdr.Size]); err != nil {
 				return err
 			}
 		}
@@ -52,7 +57,8 @@ func (db *DB) GetTar(dst io.Writer) error {
 // SetTar adds data to db from a tar strema decoded from `src`.
 // Raw data is stored at the key `_fs_data/', and metadata in a
 // separate key '_fs_metadata'.
-func (db *DB) SetTar(src io.Reader) error {
+func (db *DB) SetTar(src io.Reader) (err error) {
+	defer db.wrapError("tar", "", &err)
 	tr := tar.NewReader(src)
 	for {
 		hdr, err := tr.Next()
@@ -62,19 +68,22 @@ func (db *DB) SetTar(src io.Reader) error {
 		if err != nil {
 			return err
 		}
-		fmt.Printf("[META] %s\n", hdr.Name)
 		metaBlob, err := headerReader(hdr)
 		if err != nil {
 			return err
 		}
-		fmt.Printf("    ---> storing metadata in %s\n", metaPath(hdr.Name))
-		if err := db.SetStream(metaPath(hdr.Name), metaBlob); err != nil {
+		db.logf(LogDebug, "storing metadata of %s in %s", hdr.Name, metaPath(hdr.Name))
+		if err := db.SetStream(metaPath(hdr.Name), metaBlob); isLimitError(err) {
+			return err
+		} else if err != nil {
 			continue
 		}
 		// FIXME: git can carry symlinks as well
 		if hdr.Typeflag == tar.TypeReg {
-			fmt.Printf("[DATA] %s %d bytes\n", hdr.Name, hdr.Size)
-			if err := db.SetStream(path.Join("_fs_data", hdr.Name), tr); err != nil {
+			db.logf(LogDebug, "storing %d bytes of %s", hdr.Size, hdr.Name)
+			if err := db.SetStream(path.Join("_fs_data", hdr.Name), tr); isLimitError(err) {
+				return err
+			} else if err != nil {
 				continue
 			}
 		}
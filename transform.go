@@ -0,0 +1,111 @@
+package libpack
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+
+	git "github.com/libgit2/git2go"
+)
+
+// Transform calls f for each value of the subtree at srcPrefix in the
+// uncommitted tree, in the order of the keys, with the key relative to
+// srcPrefix. If f returns true, its output is written at the same key
+// under dstPrefix, otherwise the value is skipped. The number of values
+// written is returned.
+// The outputs are only written once f was called for every value, in a
+// single change of the uncommitted tree, so that one Commit records the
+// whole transformation. If f returns an error, or if an output is
+// rejected by the limits or validators of the database, nothing is
+// written and the error is returned.
+// Outputs identical to their input reuse the blob of the input.
+func (db *DB) Transform(srcPrefix, dstPrefix string, f func(key string, value []byte) ([]byte, bool, error)) (n int, err error) {
+	if err := db.checkClosed(); err != nil {
+		return 0, err
+	}
+	defer db.wrapError("transform", srcPrefix, &err)
+	if err := db.checkKey(srcPrefix, false); err != nil {
+		return 0, err
+	}
+	if err := db.checkKey(dstPrefix, false); err != nil {
+		return 0, err
+	}
+	tree, err := db.snapshot()
+	if err != nil {
+		return 0, err
+	}
+	if tree == nil {
+		return 0, ErrNotExist
+	}
+	info, err := TreeStat(db.repo, tree, TreePath(db.fullKey(srcPrefix)))
+	if err != nil {
+		return 0, err
+	}
+	if info.Kind != KindTree {
+		return 0, fmt.Errorf("%s is not a subtree", srcPrefix)
+	}
+	blobs := make(map[string]blobEntry)
+	err = db.walk(tree, srcPrefix, func(key string, e *git.TreeEntry, obj git.Object) error {
+		if _, isBlob := obj.(*git.Blob); isBlob {
+			blobs[key] = blobEntry{e.Id, e.Filemode}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	keys := make([]string, 0, len(blobs))
+	for key := range blobs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	root := db.root()
+	var (
+		dstKeys []string
+		out     []blobEntry
+	)
+	for _, key := range keys {
+		blob := blobs[key]
+		value, err := db.blobValue(blob)
+		if err != nil {
+			return 0, err
+		}
+		result, keep, err := f(key, []byte(value))
+		if err != nil {
+			return 0, err
+		}
+		if !keep {
+			continue
+		}
+		dst := path.Join(dstPrefix, key)
+		if err := db.checkReserved(dst); err != nil {
+			return 0, err
+		}
+		if err := db.checkValue(db.fullKey(dst), string(result)); err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(result, []byte(value)) {
+			data, mode, err := root.encodeValue(string(result))
+			if err != nil {
+				return 0, err
+			}
+			id, err := createBlob(root.repo, data)
+			if err != nil {
+				return 0, err
+			}
+			blob = blobEntry{id, mode}
+		}
+		dstKeys = append(dstKeys, db.fullKey(dst))
+		out = append(out, blob)
+	}
+	defer root.afterWrite(&err)
+	root.l.Lock()
+	defer root.l.Unlock()
+	for i, key := range dstKeys {
+		if err := root.stage(key, out[i].id, out[i].mode); err != nil {
+			return 0, err
+		}
+	}
+	return len(out), nil
+}
@@ -0,0 +1,96 @@
+package libpack
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestTransform(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.SetMany(map[string]string{
+		"v1/a":     "hello",
+		"v1/b/c":   "world",
+		"v1/skip":  "x",
+		"v1/same":  "unchanged",
+		"other/va": "untouched",
+	})
+	db.Commit("v1")
+	var seen []string
+	n, err := db.Transform("v1", "v2", func(key string, value []byte) ([]byte, bool, error) {
+		seen = append(seen, key)
+		switch key {
+		case "skip":
+			return nil, false, nil
+		case "same":
+			return value, true, nil
+		}
+		return bytes.ToUpper(value), true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("%d", n)
+	}
+	if len(seen) != 4 || seen[0] != "a" || seen[1] != "b/c" {
+		t.Fatalf("%v", seen)
+	}
+	assertGet(t, db, "v2/a", "HELLO")
+	assertGet(t, db, "v2/b/c", "WORLD")
+	assertGet(t, db, "v2/same", "unchanged")
+	assertNotExist(t, db, "v2/skip")
+	assertGet(t, db, "v1/a", "hello")
+	// Identical outputs reuse the blob of their input
+	tree, err := db.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, _ := lookupEntry(tree, "v1/same")
+	dst, _ := lookupEntry(tree, "v2/same")
+	if src == nil || dst == nil || !src.id.Equal(dst.id) {
+		t.Fatalf("%v %v", src, dst)
+	}
+	// Scoped databases and in-place transforms
+	if n, err := db.Scope("v2").Transform("b", "b", func(key string, value []byte) ([]byte, bool, error) {
+		return append(value, '!'), true, nil
+	}); err != nil || n != 1 {
+		t.Fatalf("%d %v", n, err)
+	}
+	assertGet(t, db, "v2/b/c", "WORLD!")
+}
+
+func TestTransformError(t *testing.T) {
+	db, err := Init(tmpdir(t), "refs/heads/test", WithLimits(Limits{MaxValueBytes: 8}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(db)
+	db.SetMany(map[string]string{"src/a": "1", "src/b": "2"})
+	fail := errors.New("fail")
+	_, err = db.Transform("src", "dst", func(key string, value []byte) ([]byte, bool, error) {
+		if key == "b" {
+			return nil, false, fail
+		}
+		return value, true, nil
+	})
+	if err != fail {
+		t.Fatalf("%v", err)
+	}
+	assertNotExist(t, db, "dst/a")
+	// Outputs are checked against the limits
+	_, err = db.Transform("src", "dst", func(key string, value []byte) ([]byte, bool, error) {
+		return bytes.Repeat(value, 9), true, nil
+	})
+	if _, ok := err.(*ValueTooLargeError); !ok {
+		t.Fatalf("%v", err)
+	}
+	assertNotExist(t, db, "dst/a")
+	if _, err := db.Transform("src/a", "dst", nil); err == nil {
+		t.Fatalf("transforming a value should fail")
+	}
+	if _, err := db.Transform("missing", "dst", nil); err == nil {
+		t.Fatalf("transforming a missing subtree should fail")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"path"
+	"sort"
 
 	git "github.com/libgit2/git2go"
 )
@@ -151,13 +152,16 @@ func TreeGet(r *git.Repository, t *git.Tree, key string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	blob, err := lookupBlob(r, e.Id)
+	return blobContents(r, e.Id)
+}
+
+func blobContents(r *git.Repository, id *git.Oid) (string, error) {
+	blob, err := lookupBlob(r, id)
 	if err != nil {
 		return "", err
 	}
 	defer blob.Free()
 	return string(blob.Contents()), nil
-
 }
 
 func TreeList(r *git.Repository, t *git.Tree, key string) ([]string, error) {
@@ -180,7 +184,48 @@ func TreeList(r *git.Repository, t *git.Tree, key string) ([]string, error) {
 	return entries, nil
 }
 
+// TreeListEntries returns information about each entry of the subtree
+// at `key`, sorted by name.
+func TreeListEntries(r *git.Repository, t *git.Tree, key string) ([]EntryInfo, error) {
+	if t == nil {
+		return []EntryInfo{}, nil
+	}
+	subtree, err := TreeScope(r, t, key)
+	if err != nil {
+		return nil, err
+	}
+	defer subtree.Free()
+	var (
+		i     uint64
+		count uint64 = subtree.EntryCount()
+	)
+	entries := make([]EntryInfo, 0, count)
+	for i = 0; i < count; i++ {
+		info, err := entryInfo(r, subtree.EntryByIndex(i))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, info)
+	}
+	sort.Sort(entriesByName(entries))
+	return entries, nil
+}
+
+type entriesByName []EntryInfo
+
+func (e entriesByName) Len() int           { return len(e) }
+func (e entriesByName) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e entriesByName) Less(i, j int) bool { return e[i].Name < e[j].Name }
+
 func TreeWalk(r *git.Repository, t *git.Tree, key string, h func(string, git.Object) error) error {
+	return treeWalk(r, t, key, func(key string, e *git.TreeEntry, obj git.Object) error {
+		return h(key, obj)
+	})
+}
+
+// treeWalk is like TreeWalk, but also passes the tree entry of each
+// object to h.
+func treeWalk(r *git.Repository, t *git.Tree, key string, h func(string, *git.TreeEntry, git.Object) error) error {
 	if t == nil {
 		return fmt.Errorf("no tree to walk")
 	}
@@ -188,6 +233,7 @@ func TreeWalk(r *git.Repository, t *git.Tree, key string, h func(string, git.Obj
 	if err != nil {
 		return err
 	}
+	defer subtree.Free()
 	var handlerErr error
 	err = subtree.Walk(func(parent string, e *git.TreeEntry) int {
 		obj, err := r.Lookup(e.Id)
@@ -195,11 +241,11 @@ func TreeWalk(r *git.Repository, t *git.Tree, key string, h func(string, git.Obj
 			handlerErr = err
 			return -1
 		}
-		if err := h(path.Join(parent, e.Name), obj); err != nil {
+		defer obj.Free()
+		if err := h(path.Join(parent, e.Name), e, obj); err != nil {
 			handlerErr = err
 			return -1
 		}
-		obj.Free()
 		return 0
 	})
 	if handlerErr != nil {
@@ -212,16 +258,33 @@ func TreeWalk(r *git.Repository, t *git.Tree, key string, h func(string, git.Obj
 }
 
 func TreeDump(r *git.Repository, t *git.Tree, key string, dst io.Writer) error {
-	return TreeWalk(r, t, key, func(key string, obj git.Object) error {
-		if _, isTree := obj.(*git.Tree); isTree {
-			fmt.Fprintf(dst, "%s/\n", key)
-		} else if blob, isBlob := obj.(*git.Blob); isBlob {
-			fmt.Fprintf(dst, "%s = %s\n", key, blob.Contents())
-		}
-		return nil
+	return treeDump(r, t, key, dst, nil)
+}
+
+// treeDump is like TreeDump, but calls decode, if not nil, on the
+// contents and filemode of each blob to get the value to print.
+func treeDump(r *git.Repository, t *git.Tree, key string, dst io.Writer, decode func(string, int) (string, error)) error {
+	return treeWalk(r, t, key, func(key string, e *git.TreeEntry, obj git.Object) error {
+		return dumpEntry(dst, key, e, obj, decode)
 	})
 }
 
+func dumpEntry(dst io.Writer, key string, e *git.TreeEntry, obj git.Object, decode func(string, int) (string, error)) error {
+	if _, isTree := obj.(*git.Tree); isTree {
+		fmt.Fprintf(dst, "%s/\n", key)
+	} else if blob, isBlob := obj.(*git.Blob); isBlob {
+		value := string(blob.Contents())
+		if decode != nil {
+			var err error
+			if value, err = decode(value, e.Filemode); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(dst, "%s = %s\n", key, value)
+	}
+	return nil
+}
+
 func TreeScope(repo *git.Repository, tree *git.Tree, name string) (*git.Tree, error) {
 	if tree == nil {
 		return nil, fmt.Errorf("tree undefined")
@@ -236,5 +299,80 @@ func TreeScope(repo *git.Repository, tree *git.Tree, name string) (*git.Tree, er
 	if err != nil {
 		return nil, err
 	}
+	if entry.Type != git.ObjectTree {
+		return nil, &KeyError{Key: name, Err: ErrNotDirectory}
+	}
 	return lookupTree(repo, entry.Id)
 }
+
+// An EntryKind tells whether a tree entry is a blob or a subtree.
+type EntryKind int
+
+const (
+	KindBlob EntryKind = iota
+	KindTree
+)
+
+func (k EntryKind) String() string {
+	if k == KindTree {
+		return "tree"
+	}
+	return "blob"
+}
+
+// EntryInfo describes an entry in a git tree.
+type EntryInfo struct {
+	Name string
+	Kind EntryKind
+	// Size of the blob in bytes. Always 0 for trees.
+	Size int64
+	Id   string
+	// Git filemode, for example 0100644 for a regular blob,
+	// 0100755 for an executable blob, 0120000 for a symbolic link
+	// or 040000 for a tree.
+	Mode int
+	// Content type recorded with SetTyped. Only set by DB.Stat.
+	ContentType string
+}
+
+// TreeStat returns information about the entry at path `key` in tree t.
+// If key is "/", information about t itself is returned.
+// If there is no entry at key, ErrNotExist is returned.
+func TreeStat(r *git.Repository, t *git.Tree, key string) (EntryInfo, error) {
+	if t == nil {
+		return EntryInfo{}, ErrNotExist
+	}
+	key = TreePath(key)
+	if key == "/" {
+		return EntryInfo{Kind: KindTree, Id: t.Id().String(), Mode: 040000}, nil
+	}
+	e, err := t.EntryByPath(key)
+	if err != nil {
+		if git.IsErrorCode(err, git.ErrNotFound) {
+			return EntryInfo{}, ErrNotExist
+		}
+		return EntryInfo{}, err
+	}
+	return entryInfo(r, e)
+}
+
+func entryInfo(r *git.Repository, e *git.TreeEntry) (EntryInfo, error) {
+	info := EntryInfo{
+		Name: e.Name,
+		Id:   e.Id.String(),
+		Mode: e.Filemode,
+	}
+	if e.Type == git.ObjectTree {
+		info.Kind = KindTree
+		return info, nil
+	}
+	// FIXME: this loads the contents of the blob. Read the object header
+	// only when git2go exposes git_odb_read_header.
+	blob, err := lookupBlob(r, e.Id)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	defer blob.Free()
+	info.Size = blob.Size()
+	return info, nil
+}
@@ -126,3 +126,70 @@ func assertBlobInTree(t *testing.T, repo *git.Repository, tree *git.Tree, key, v
 	}
 	blob.Free()
 }
+
+func TestStat(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("a/b/hello", "world")
+
+	info, err := db.Stat("a/b/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "hello" || info.Kind != KindBlob || info.Size != 5 || info.Mode != 0100644 {
+		t.Fatalf("%#v", info)
+	}
+	if v, _ := db.Get("a/b/hello"); len(v) != int(info.Size) {
+		t.Fatalf("%#v", info)
+	}
+
+	info, err = db.Stat("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Kind != KindTree || info.Mode != 040000 {
+		t.Fatalf("%#v", info)
+	}
+
+	scoped := db.Scope("a")
+	info, err = scoped.Stat("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Kind != KindTree {
+		t.Fatalf("%#v", info)
+	}
+
+	if _, err := db.Stat("does/not/exist"); err != ErrNotExist {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestListEntries(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("c/d", "hello")
+	db.Set("c-file", "abc")
+	db.Set("a", "x")
+	for _, rootpath := range []string{"", ".", "/", "////"} {
+		entries, err := db.ListEntries(rootpath)
+		if err != nil {
+			t.Fatalf("%s: %v", rootpath, err)
+		}
+		if len(entries) != 3 {
+			t.Fatalf("%#v", entries)
+		}
+		if entries[0].Name != "a" || entries[0].Kind != KindBlob || entries[0].Size != 1 {
+			t.Fatalf("%#v", entries[0])
+		}
+		if entries[1].Name != "c" || entries[1].Kind != KindTree {
+			t.Fatalf("%#v", entries[1])
+		}
+		if entries[2].Name != "c-file" || entries[2].Kind != KindBlob || entries[2].Size != 3 {
+			t.Fatalf("%#v", entries[2])
+		}
+	}
+	if _, err := db.ListEntries("does-not-exist"); err == nil {
+		t.Fatalf("should fail")
+	}
+}
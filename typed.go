@@ -0,0 +1,154 @@
+package libpack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	git "github.com/libgit2/git2go"
+)
+
+const (
+	// ContentTypeAnnotation is the name of the annotation recording
+	// the content type of keys, see SetTyped.
+	ContentTypeAnnotation = "content-type"
+	// JSONContentType is the content type of JSON values.
+	JSONContentType = "application/json"
+)
+
+// SetTyped is like Set, and also records contentType as the content
+// type of key. The content type is reported by Stat and ContentType.
+// Setting a key with Set clears its content type.
+func (db *DB) SetTyped(key, value, contentType string) error {
+	if err := db.checkReserved(key); err != nil {
+		return err
+	}
+	return db.setMany(map[string]string{key: value}, contentType)
+}
+
+// ContentType returns the content type recorded for key by SetTyped,
+// or an empty string if none was recorded.
+func (db *DB) ContentType(key string) (string, error) {
+	ct, err := db.GetAnnotation(key, ContentTypeAnnotation)
+	if isNotExist(err) {
+		return "", nil
+	}
+	return ct, err
+}
+
+// stageContentType records contentType as the content type of key, or
+// removes the content type of key if contentType is empty.
+// The caller must hold the lock.
+func (db *DB) stageContentType(key, contentType string) error {
+	if TreePath(key) == "/" || isInternal(key) {
+		return nil
+	}
+	annot, err := annotationKey(key, ContentTypeAnnotation)
+	if err != nil {
+		return err
+	}
+	if contentType == "" {
+		if !db.hasEntryLocked(annot) {
+			return nil
+		}
+		return db.stage(annot, nil, 0)
+	}
+	data, mode, err := db.encodeValue(contentType)
+	if err != nil {
+		return err
+	}
+	id, err := createBlob(db.repo, data)
+	if err != nil {
+		return err
+	}
+	return db.stage(annot, id, mode)
+}
+
+// A JSONError is returned by SetJSON and GetJSON when a value can't
+// be encoded or decoded.
+type JSONError struct {
+	Key string
+	Err error
+}
+
+func (e *JSONError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Key, e.Err)
+}
+
+// SetJSON encodes v in JSON, and sets it at key with the content type
+// JSONContentType.
+// The encoding is stable: map keys are sorted, and no newline is added,
+// so equal values are always stored in the same blob.
+func (db *DB) SetJSON(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return &JSONError{key, err}
+	}
+	return db.SetTyped(key, string(data), JSONContentType)
+}
+
+// GetJSON decodes the JSON value at key into v.
+// If a content type other than JSONContentType was recorded for key,
+// an error is returned.
+func (db *DB) GetJSON(key string, v interface{}) (err error) {
+	defer db.wrapError("get", key, &err)
+	ct, err := db.ContentType(key)
+	if err != nil {
+		return err
+	}
+	if ct != "" && ct != JSONContentType {
+		return fmt.Errorf("%s: content type is %s, not %s", key, ct, JSONContentType)
+	}
+	value, err := db.Get(key)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		return &JSONError{key, err}
+	}
+	return nil
+}
+
+// DumpTyped is like Dump, but also prints the content type of each
+// value which has one.
+func (db *DB) DumpTyped(dst io.Writer) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("dump", "", &err)
+	db.autoRefresh()
+	tree, err := db.snapshot()
+	if err != nil {
+		return err
+	}
+	decode := db.root().decodeValue
+	return db.walk(tree, "/", func(key string, e *git.TreeEntry, obj git.Object) error {
+		if _, isBlob := obj.(*git.Blob); !isBlob {
+			return dumpEntry(dst, key, e, obj, decode)
+		}
+		ct, err := db.ContentType(key)
+		if err != nil {
+			return err
+		}
+		if ct == "" {
+			return dumpEntry(dst, key, e, obj, decode)
+		}
+		value, err := decode(string(obj.(*git.Blob).Contents()), e.Filemode)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(dst, "%s = %s (%s)\n", key, value, ct)
+		return nil
+	})
+}
+
+// isNotExist returns true if err means that a key doesn't exist.
+func isNotExist(err error) bool {
+	if e, ok := err.(*OpError); ok {
+		err = e.Err
+	}
+	if err == ErrNotExist {
+		return true
+	}
+	return git.IsErrorCode(err, git.ErrNotFound)
+}
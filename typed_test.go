@@ -0,0 +1,138 @@
+package libpack
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetTyped(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	if err := db.SetTyped("config", `{"name":"foo"}`, JSONContentType); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetTyped("config.yml", "name: foo", "application/yaml"); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("plain", "hello")
+	if info, err := db.Stat("config"); err != nil {
+		t.Fatal(err)
+	} else if info.ContentType != JSONContentType {
+		t.Fatalf("%#v", info)
+	}
+	if info, err := db.Stat("plain"); err != nil {
+		t.Fatal(err)
+	} else if info.ContentType != "" {
+		t.Fatalf("%#v", info)
+	}
+	var config struct{ Name string }
+	if err := db.GetJSON("config", &config); err != nil {
+		t.Fatal(err)
+	} else if config.Name != "foo" {
+		t.Fatalf("%#v", config)
+	}
+	if err := db.GetJSON("config.yml", &config); err == nil {
+		t.Fatalf("GetJSON should check the content type")
+	}
+	var dump bytes.Buffer
+	if err := db.DumpTyped(&dump); err != nil {
+		t.Fatal(err)
+	}
+	expected := `config = {"name":"foo"} (application/json)
+config.yml = name: foo (application/yaml)
+plain = hello
+`
+	if dump.String() != expected {
+		t.Fatalf("%v", dump.String())
+	}
+	if err := db.Commit("typed"); err != nil {
+		t.Fatal(err)
+	}
+	// Set clears the content type
+	db.Set("config", "not json anymore")
+	if ct, err := db.ContentType("config"); err != nil {
+		t.Fatal(err)
+	} else if ct != "" {
+		t.Fatalf("%#v", ct)
+	}
+	if err := db.Commit("untyped"); err != nil {
+		t.Fatal(err)
+	}
+	if ct, err := db.ContentType("config"); err != nil {
+		t.Fatal(err)
+	} else if ct != "" {
+		t.Fatalf("%#v", ct)
+	}
+	if ct, err := db.ContentType("config.yml"); err != nil {
+		t.Fatal(err)
+	} else if ct != "application/yaml" {
+		t.Fatalf("%#v", ct)
+	}
+}
+
+type testRecord struct {
+	Name     string
+	Tags     []string
+	Created  time.Time
+	Children []testRecord
+	Extra    map[string]int
+}
+
+func TestSetGetJSON(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	created := time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)
+	in := testRecord{
+		Name:    "parent",
+		Tags:    []string{"a", "b"},
+		Created: created,
+		Children: []testRecord{
+			{Name: "child", Created: created.Add(time.Hour)},
+		},
+		Extra: map[string]int{"z": 1, "a": 2, "m": 3},
+	}
+	scoped := db.Scope("records")
+	if err := scoped.SetJSON("parent", in); err != nil {
+		t.Fatal(err)
+	}
+	var out testRecord
+	if err := db.GetJSON("records/parent", &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("%#v != %#v", out, in)
+	}
+	// Equal values are stored in the same blob
+	if err := scoped.SetJSON("copy", out); err != nil {
+		t.Fatal(err)
+	}
+	a, err := scoped.Stat("parent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := scoped.Stat("copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Id != b.Id {
+		t.Fatalf("%s != %s", a.Id, b.Id)
+	}
+	if v, err := scoped.Get("copy"); err != nil {
+		t.Fatal(err)
+	} else if strings.HasSuffix(v, "\n") {
+		t.Fatalf("%q", v)
+	}
+	// Errors carry the key
+	db.Set("broken", "{")
+	err = db.GetJSON("broken", &out)
+	if jerr, ok := err.(*JSONError); !ok || jerr.Key != "broken" {
+		t.Fatalf("%#v", err)
+	}
+	err = db.SetJSON("func", func() {})
+	if jerr, ok := err.(*JSONError); !ok || jerr.Key != "func" {
+		t.Fatalf("%#v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package libpack
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	git "github.com/libgit2/git2go"
+)
+
+// A ValidationError is returned when a validator registered with
+// AddValidator rejects a value.
+type ValidationError struct {
+	// Key of the value, relative to the root of the database
+	Key string
+	// Error returned by the validator
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid value at %s: %v", e.Key, e.Err)
+}
+
+// An IncomingPolicy tells what a validator does with the values changed
+// by the commits brought by Pull and ApplyFetched.
+type IncomingPolicy int
+
+const (
+	// Incoming values are not checked.
+	IncomingIgnore IncomingPolicy = iota
+	// If an incoming value is invalid, the operation fails with a
+	// *ValidationError, and the reference of the database is left
+	// unchanged.
+	IncomingReject
+	// Invalid incoming values are accepted, and recorded: see
+	// Violations.
+	IncomingRecord
+)
+
+// A Violation records an invalid value accepted by Pull or ApplyFetched.
+type Violation struct {
+	ValidationError
+	// Id of the commit which was applied
+	Commit string
+}
+
+type validator struct {
+	prefix   string
+	incoming IncomingPolicy
+	f        func(key string, value []byte) error
+}
+
+func (v *validator) matches(key string) bool {
+	return v.prefix == "/" || key == v.prefix || strings.HasPrefix(key, v.prefix+"/")
+}
+
+// AddValidator registers a function to check the values written at
+// prefix, or in the subtree at prefix, relative to the scope of db.
+// Validators are called with the key relative to the root of the
+// database, and the value about to be written. If one of them returns
+// an error, nothing is written, and a *ValidationError is returned.
+// Values written by the Set family of methods, Append, AddDB and
+// ApplyPatch are checked. Internal keys are never checked.
+// Validators may be called with the database locked, so they must not
+// call methods of the database.
+func (db *DB) AddValidator(prefix string, f func(key string, value []byte) error) {
+	db.AddValidatorPolicy(prefix, IncomingIgnore, f)
+}
+
+// AddValidatorPolicy is like AddValidator, and also checks the values
+// brought by Pull and ApplyFetched according to incoming.
+func (db *DB) AddValidatorPolicy(prefix string, incoming IncomingPolicy, f func(key string, value []byte) error) {
+	root := db.root()
+	v := validator{
+		prefix:   TreePath(db.fullKey(prefix)),
+		incoming: incoming,
+		f:        f,
+	}
+	root.l.Lock()
+	root.validators = append(root.validators, v)
+	root.l.Unlock()
+}
+
+// Violations returns the invalid values accepted by Pull and ApplyFetched
+// from validators with the IncomingRecord policy, oldest first.
+func (db *DB) Violations() []Violation {
+	root := db.root()
+	root.l.RLock()
+	defer root.l.RUnlock()
+	return append([]Violation(nil), root.violations...)
+}
+
+// ClearViolations forgets the violations returned by Violations.
+func (db *DB) ClearViolations() {
+	root := db.root()
+	root.l.Lock()
+	root.violations = nil
+	root.l.Unlock()
+}
+
+// checkValue checks that value can be written at key, relative to the
+// root of the database: that they are within the limits of the database,
+// and that the validators of key accept value.
+func (db *DB) checkValue(key, value string) error {
+	root := db.root()
+	if err := root.checkLimits(key, int64(len(value))); err != nil {
+		return err
+	}
+	root.l.RLock()
+	validators := root.validators
+	root.l.RUnlock()
+	return root.runValidators(validators, key, value)
+}
+
+// checkValueLocked is like checkValue. The caller must hold the lock.
+func (db *DB) checkValueLocked(key, value string) error {
+	root := db.root()
+	if err := root.checkLimits(key, int64(len(value))); err != nil {
+		return err
+	}
+	return root.runValidators(root.validators, key, value)
+}
+
+// runValidators calls the validators of key with value. Validators are
+// matched against the path of key in the tree, but are given the key as
+// it was written, see WithKeyEscaping.
+func (db *DB) runValidators(validators []validator, key, value string) error {
+	key = TreePath(key)
+	if len(validators) == 0 || isInternal(key) {
+		return nil
+	}
+	name := db.unescapeKey(key)
+	for i := range validators {
+		v := &validators[i]
+		if !v.matches(key) {
+			continue
+		}
+		if err := v.f(name, []byte(value)); err != nil {
+			return &ValidationError{Key: name, Err: err}
+		}
+	}
+	return nil
+}
+
+// checkTree is like checkValue, for each value of tree, from repository
+// r, which is about to be written at key.
+func (db *DB) checkTree(r *git.Repository, key string, tree *git.Tree, decode func(string, int) (string, error)) error {
+	root := db.root()
+	root.l.RLock()
+	validators := root.validators
+	root.l.RUnlock()
+	if len(validators) == 0 && root.limits == (Limits{}) {
+		return nil
+	}
+	return treeWalk(r, tree, "/", func(k string, e *git.TreeEntry, obj git.Object) error {
+		blob, ok := obj.(*git.Blob)
+		if !ok {
+			return nil
+		}
+		value, err := decode(string(blob.Contents()), e.Filemode)
+		if err != nil {
+			return err
+		}
+		if err := root.checkLimits(path.Join(key, k), int64(len(value))); err != nil {
+			return err
+		}
+		return root.runValidators(validators, path.Join(key, k), value)
+	})
+}
+
+// checkIncoming runs the validators with an incoming policy on the values
+// changed between the tree of commit old (or an empty tree if old is nil)
+// and tree, which are brought by commit head.
+// If a validator with the IncomingReject policy fails, its error is
+// returned. Otherwise, the failures of validators with the
+// IncomingRecord policy are recorded.
+func (db *DB) checkIncoming(old *git.Commit, tree *git.Tree, head string) error {
+	root := db.root()
+	root.l.RLock()
+	validators := root.validators
+	root.l.RUnlock()
+	var reject, record []validator
+	for _, v := range validators {
+		switch v.incoming {
+		case IncomingReject:
+			reject = append(reject, v)
+		case IncomingRecord:
+			record = append(record, v)
+		}
+	}
+	if len(reject) == 0 && len(record) == 0 {
+		return nil
+	}
+	changes, err := commitDiff(root.repo, old, tree)
+	if err != nil {
+		return err
+	}
+	var violations []Violation
+	for _, c := range changes {
+		if c.Kind == Deleted || isInternal(c.Key) {
+			continue
+		}
+		e, err := lookupEntry(tree, c.Key)
+		if err != nil {
+			return err
+		}
+		data, err := blobContents(root.repo, e.id)
+		if err != nil {
+			return err
+		}
+		value, err := root.decodeValue(data, e.mode)
+		if err != nil {
+			return err
+		}
+		if err := root.runValidators(reject, c.Key, value); err != nil {
+			return err
+		}
+		for i := range record {
+			if err := root.runValidators(record[i:i+1], c.Key, value); err != nil {
+				violations = append(violations, Violation{ValidationError: *err.(*ValidationError), Commit: head})
+			}
+		}
+	}
+	root.l.Lock()
+	root.violations = append(root.violations, violations...)
+	root.l.Unlock()
+	return nil
+}
@@ -0,0 +1,143 @@
+package libpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func validFlag(key string, value []byte) error {
+	if s := string(value); s != "true" && s != "false" {
+		return fmt.Errorf("not a boolean: %q", s)
+	}
+	return nil
+}
+
+func validJSON(key string, value []byte) error {
+	var v interface{}
+	return json.Unmarshal(value, &v)
+}
+
+func TestValidator(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.AddValidator("flags", validFlag)
+	db.Scope("services").AddValidator("/", validJSON)
+	if err := db.Set("flags/debug", "true"); err != nil {
+		t.Fatal(err)
+	}
+	err := db.Set("flags/verbose", "yes")
+	verr, ok := err.(*ValidationError)
+	if !ok || verr.Key != "flags/verbose" || !strings.Contains(verr.Error(), "not a boolean") {
+		t.Fatalf("%v", err)
+	}
+	assertNotExist(t, db, "flags/verbose")
+	// Nothing is written if one of the values is invalid
+	err = db.SetMany(map[string]string{"services/web": `{"replicas": 2}`, "services/db": "{"})
+	if verr, ok := err.(*ValidationError); !ok || verr.Key != "services/db" {
+		t.Fatalf("%v", err)
+	}
+	assertNotExist(t, db, "services/web")
+	// Keys outside of the prefixes are not checked
+	if err := db.Set("flagship", "yes"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SetNX("flags/new", "maybe"); err == nil {
+		t.Fatalf("SetNX should fail")
+	}
+	db.Set("services/count", "1")
+	if err := db.Append("services/count", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Append("services/count", "x"); err == nil {
+		t.Fatalf("Append should fail")
+	}
+	assertGet(t, db, "services/count", "12")
+
+	// AddDB
+	src, err := Open(db.Repo().Path(), "refs/heads/src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Free()
+	src.Set("debug", "no")
+	if err := db.AddDB("flags", src); err == nil {
+		t.Fatalf("AddDB should fail")
+	}
+	assertGet(t, db, "flags/debug", "true")
+
+	// ApplyPatch
+	var patch bytes.Buffer
+	db.Commit("base")
+	other := tmpDB(t, "")
+	defer nukeDB(other)
+	other.Set("flags/debug", "true")
+	other.Commit("")
+	other.Set("flags/debug", "nope")
+	if err := other.DiffPatch(other.headId().String(), "", &patch); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ApplyPatch(&patch); err == nil {
+		t.Fatalf("ApplyPatch should fail")
+	}
+	assertGet(t, db, "flags/debug", "true")
+}
+
+func TestValidatorIncoming(t *testing.T) {
+	src := tmpDB(t, "")
+	defer nukeDB(src)
+	src.Set("flags/debug", "yes")
+	src.Set("services/web", "{")
+	src.Commit("invalid")
+
+	// Validators ignore incoming values by default
+	ignore := tmpDB(t, "")
+	defer nukeDB(ignore)
+	ignore.AddValidator("flags", validFlag)
+	if err := ignore.Pull(src.Repo().Path(), src.ref); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, ignore, "flags/debug", "yes")
+
+	reject := tmpDB(t, "")
+	defer nukeDB(reject)
+	reject.AddValidatorPolicy("flags", IncomingReject, validFlag)
+	err := reject.Pull(src.Repo().Path(), src.ref)
+	if verr, ok := err.(*ValidationError); !ok || verr.Key != "flags/debug" {
+		t.Fatalf("%v", err)
+	}
+	if reject.headId() != nil {
+		t.Fatalf("ref was not restored")
+	}
+	if _, err := reject.Fetch(src.Repo().Path(), src.ref); err != nil {
+		t.Fatal(err)
+	}
+	if err := reject.ApplyFetched(""); err == nil {
+		t.Fatalf("ApplyFetched should fail")
+	}
+	if reject.headId() != nil {
+		t.Fatalf("ref was changed")
+	}
+
+	record := tmpDB(t, "")
+	defer nukeDB(record)
+	record.AddValidatorPolicy("flags", IncomingRecord, validFlag)
+	record.AddValidatorPolicy("services", IncomingRecord, func(key string, value []byte) error {
+		return errors.New("read-only")
+	})
+	if err := record.Pull(src.Repo().Path(), src.ref); err != nil {
+		t.Fatal(err)
+	}
+	assertGet(t, record, "flags/debug", "yes")
+	violations := record.Violations()
+	if len(violations) != 2 || violations[0].Key != "flags/debug" || violations[1].Key != "services/web" || violations[1].Commit != record.headId().String() {
+		t.Fatalf("%#v", violations)
+	}
+	record.ClearViolations()
+	if v := record.Violations(); len(v) != 0 {
+		t.Fatalf("%#v", v)
+	}
+}
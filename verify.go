@@ -0,0 +1,241 @@
+package libpack
+
+import (
+	"fmt"
+	"path"
+
+	git "github.com/libgit2/git2go"
+)
+
+// A ProblemKind is the kind of a Problem found by Verify.
+type ProblemKind int
+
+const (
+	// The reference of the database doesn't point to a commit.
+	DanglingRef ProblemKind = iota
+	// An object is missing from the repository.
+	MissingObject
+	// An object exists, but can't be read.
+	UnreadableObject
+	// An object is not of the type expected by the entry pointing to it.
+	WrongType
+	// The contents of an object don't match its id.
+	BadChecksum
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case DanglingRef:
+		return "dangling ref"
+	case MissingObject:
+		return "missing object"
+	case UnreadableObject:
+		return "unreadable object"
+	case WrongType:
+		return "wrong type"
+	case BadChecksum:
+		return "bad checksum"
+	}
+	return fmt.Sprintf("ProblemKind(%d)", int(k))
+}
+
+// A Problem is an integrity problem found by Verify.
+type Problem struct {
+	Kind ProblemKind
+	// Id of the offending object
+	Id string
+	// Commit in which the object was found: for a commit, its child.
+	// Empty for the head of the database.
+	Commit string
+	// Path of the object in the tree of Commit, if it is not a commit
+	Path   string
+	Reason string
+}
+
+func (p Problem) String() string {
+	s := fmt.Sprintf("%s %s", p.Kind, p.Id)
+	if p.Commit != "" {
+		s += " in commit " + p.Commit
+	}
+	if p.Path != "" {
+		s += " at " + p.Path
+	}
+	if p.Reason != "" {
+		s += ": " + p.Reason
+	}
+	return s
+}
+
+// VerifyOpt are the settings of VerifyWith.
+type VerifyOpt struct {
+	// Number of commits to check, starting from the head of the
+	// database. If 0, the whole history is checked.
+	MaxCommits int
+}
+
+// Verify checks the integrity of the history of the database, see
+// VerifyWith.
+func (db *DB) Verify() ([]Problem, error) {
+	return db.VerifyWith(VerifyOpt{})
+}
+
+// VerifyWith checks that the reference of the database points to a
+// commit, and that the commits of its history, and the trees and values
+// of each commit, can be read and have the expected type and checksum.
+// Objects are read from the repository on disk, not from memory.
+// All the problems found are returned, in the order in which they were
+// found. An error is returned if the check could not be done.
+// Uncommitted changes are not checked. Commits missing at the boundary of
+// a shallow fetch are not problems.
+func (db *DB) VerifyWith(opt VerifyOpt) (problems []Problem, err error) {
+	if err := db.checkClosed(); err != nil {
+		return nil, err
+	}
+	defer db.wrapError("verify", "", &err)
+	r, err := git.OpenRepository(db.repo.Path())
+	if err != nil {
+		return nil, err
+	}
+	defer r.Free()
+	v, err := newVerifier(r)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := r.LookupReference(db.ref)
+	if err != nil {
+		if git.IsErrorCode(err, git.ErrNotFound) {
+			// No commits yet
+			return nil, nil
+		}
+		return nil, err
+	}
+	head := ref.Target()
+	ref.Free()
+	if head == nil {
+		return []Problem{{Kind: DanglingRef, Reason: fmt.Sprintf("%s is not a direct reference", db.ref)}}, nil
+	}
+	shallow, err := shallowCommits(r)
+	if err != nil {
+		return nil, err
+	}
+	v.checked[head.String()] = true
+	// Commits to check, along with the commit which points to them
+	type pending struct {
+		id    *git.Oid
+		child string
+	}
+	queue := []pending{{head, ""}}
+	for n := 0; len(queue) > 0 && (opt.MaxCommits <= 0 || n < opt.MaxCommits); n++ {
+		next := queue[0]
+		queue = queue[1:]
+		obj, p := v.object(next.id, git.ObjectCommit)
+		if p != nil {
+			if next.child == "" {
+				p.Kind = DanglingRef
+				p.Reason = fmt.Sprintf("%s: %s", db.ref, p.Reason)
+			}
+			p.Commit = next.child
+			v.problems = append(v.problems, *p)
+			continue
+		}
+		commit := obj.(*git.Commit)
+		id := next.id.String()
+		v.tree(commit.TreeId(), id, "/")
+		if !shallow[id] {
+			for i := uint(0); i < commit.ParentCount(); i++ {
+				parent := commit.ParentId(i)
+				if !v.checked[parent.String()] {
+					v.checked[parent.String()] = true
+					queue = append(queue, pending{parent, id})
+				}
+			}
+		}
+		commit.Free()
+	}
+	return v.problems, nil
+}
+
+type verifier struct {
+	r        *git.Repository
+	odb      *git.Odb
+	checked  map[string]bool
+	problems []Problem
+}
+
+func newVerifier(r *git.Repository) (*verifier, error) {
+	odb, err := r.Odb()
+	if err != nil {
+		return nil, err
+	}
+	return &verifier{r: r, odb: odb, checked: make(map[string]bool)}, nil
+}
+
+// object reads the object id, and checks its type and checksum. If it
+// finds a problem, it returns it, without the commit and path.
+func (v *verifier) object(id *git.Oid, kind git.ObjectType) (git.Object, *Problem) {
+	if !v.odb.Exists(id) {
+		return nil, &Problem{Kind: MissingObject, Id: id.String(), Reason: fmt.Sprintf("%s not found", kind)}
+	}
+	raw, err := v.odb.Read(id)
+	if err != nil {
+		return nil, &Problem{Kind: UnreadableObject, Id: id.String(), Reason: err.Error()}
+	}
+	sum, err := v.odb.Hash(raw.Data(), kind)
+	raw.Free()
+	if err != nil {
+		return nil, &Problem{Kind: UnreadableObject, Id: id.String(), Reason: err.Error()}
+	}
+	obj, err := v.r.Lookup(id)
+	if err != nil {
+		return nil, &Problem{Kind: UnreadableObject, Id: id.String(), Reason: err.Error()}
+	}
+	if obj.Type() != kind {
+		p := &Problem{Kind: WrongType, Id: id.String(), Reason: fmt.Sprintf("expected %s, found %s", kind, obj.Type())}
+		obj.Free()
+		return nil, p
+	}
+	if !sameOid(sum, id) {
+		obj.Free()
+		return nil, &Problem{Kind: BadChecksum, Id: id.String(), Reason: fmt.Sprintf("contents hash to %s", sum)}
+	}
+	return obj, nil
+}
+
+// tree checks the tree id, found at dir in commit, and the objects it
+// contains. Objects which were already checked are skipped.
+func (v *verifier) tree(id *git.Oid, commit, dir string) {
+	if v.checked[id.String()] {
+		return
+	}
+	v.checked[id.String()] = true
+	obj, p := v.object(id, git.ObjectTree)
+	if p != nil {
+		p.Commit = commit
+		p.Path = dir
+		v.problems = append(v.problems, *p)
+		return
+	}
+	tree := obj.(*git.Tree)
+	defer tree.Free()
+	for i := uint64(0); i < tree.EntryCount(); i++ {
+		e := tree.EntryByIndex(i)
+		p := TreePath(path.Join(dir, e.Name))
+		switch e.Type {
+		case git.ObjectTree:
+			v.tree(e.Id, commit, p)
+		case git.ObjectBlob:
+			if v.checked[e.Id.String()] {
+				continue
+			}
+			v.checked[e.Id.String()] = true
+			obj, problem := v.object(e.Id, git.ObjectBlob)
+			if problem != nil {
+				problem.Commit = commit
+				problem.Path = p
+				v.problems = append(v.problems, *problem)
+				continue
+			}
+			obj.Free()
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package libpack
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	git "github.com/libgit2/git2go"
+)
+
+// removeObject deletes the loose object id from the repository of db, to
+// simulate a corruption.
+func removeObject(t *testing.T, db *DB, id *git.Oid) {
+	s := id.String()
+	if err := os.Remove(filepath.Join(db.Repo().Path(), "objects", s[:2], s[2:])); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	if problems, err := db.Verify(); err != nil || len(problems) != 0 {
+		t.Fatalf("%v %v", problems, err)
+	}
+	db.Set("a/b", "1")
+	db.Commit("first")
+	first := db.headId()
+	db.Set("c", "2")
+	db.Commit("second")
+	if problems, err := db.Verify(); err != nil || len(problems) != 0 {
+		t.Fatalf("%v %v", problems, err)
+	}
+
+	// A missing value
+	tree, err := db.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := lookupEntry(tree, "a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	removeObject(t, db, e.id)
+	problems, err := db.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Kind != MissingObject || problems[0].Path != "a/b" || problems[0].Id != e.id.String() || problems[0].Commit != db.headId().String() {
+		t.Fatalf("%v", problems)
+	}
+
+	// A missing commit
+	removeObject(t, db, first)
+	problems, err = db.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 2 || problems[1].Kind != MissingObject || problems[1].Id != first.String() {
+		t.Fatalf("%v", problems)
+	}
+	// The history can be limited to the latest commits
+	problems, err = db.VerifyWith(VerifyOpt{MaxCommits: 1})
+	if err != nil || len(problems) != 1 {
+		t.Fatalf("%v %v", problems, err)
+	}
+
+	// A dangling reference
+	removeObject(t, db, db.headId())
+	problems, err = db.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Kind != DanglingRef {
+		t.Fatalf("%v", problems)
+	}
+}
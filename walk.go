@@ -0,0 +1,188 @@
+package libpack
+
+import (
+	"fmt"
+	"path"
+	"runtime"
+	"sync"
+
+	git "github.com/libgit2/git2go"
+)
+
+// WalkParallel is like Walk, but spreads the traversal of subtrees across
+// `workers` goroutines. If workers is 0 or less, one worker per CPU is
+// used.
+// h may be called concurrently from several goroutines, and keys are not
+// visited in any particular order, except that a tree is always visited
+// before its children. If h returns an error, the walk is stopped as soon
+// as possible and the first error is returned, unless it is ErrStopWalk.
+func (db *DB) WalkParallel(key string, workers int, h func(string, git.Object) error) (err error) {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	defer db.wrapError("walk", key, &err)
+	tree, err := db.snapshot()
+	if err != nil {
+		return err
+	}
+	if tree == nil {
+		return fmt.Errorf("no tree to walk")
+	}
+	full := db.fullKey(key)
+	subtree, err := TreeScope(db.repo, tree, full)
+	if err != nil {
+		return err
+	}
+	defer subtree.Free()
+	// Hide the same entries as Walk
+	walkFn := db.walkHandler(full, func(key string, e *git.TreeEntry, obj git.Object) error {
+		return h(key, obj)
+	})
+	err = treeWalkParallel(db.repo.Path(), subtree.Id(), workers, walkFn)
+	if err == ErrStopWalk {
+		return nil
+	}
+	return err
+}
+
+// TreeWalkParallel walks the tree `id` of the repository at repoPath
+// with `workers` goroutines. See DB.WalkParallel.
+// git2go objects can't be shared between goroutines, so each worker
+// opens its own handle on the repository.
+func TreeWalkParallel(repoPath string, id *git.Oid, workers int, h func(string, git.Object) error) error {
+	return treeWalkParallel(repoPath, id, workers, func(key string, e *git.TreeEntry, obj git.Object) error {
+		return h(key, obj)
+	})
+}
+
+func treeWalkParallel(repoPath string, id *git.Oid, workers int, h func(string, *git.TreeEntry, git.Object) error) error {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	repos := make([]*git.Repository, 0, workers)
+	defer func() {
+		for _, r := range repos {
+			r.Free()
+		}
+	}()
+	for i := 0; i < workers; i++ {
+		r, err := git.OpenRepository(repoPath)
+		if err != nil {
+			return err
+		}
+		repos = append(repos, r)
+	}
+	q := newWalkQueue()
+	q.push(walkJob{"", id})
+	var wg sync.WaitGroup
+	for _, r := range repos {
+		wg.Add(1)
+		go func(r *git.Repository) {
+			defer wg.Done()
+			for {
+				job, ok := q.pop()
+				if !ok {
+					return
+				}
+				q.done(walkJobRun(r, job, q, h))
+			}
+		}(r)
+	}
+	wg.Wait()
+	return q.err
+}
+
+// walkJobRun calls h on each entry of a single tree, and queues its
+// subtrees.
+func walkJobRun(r *git.Repository, job walkJob, q *walkQueue, h func(string, *git.TreeEntry, git.Object) error) error {
+	tree, err := lookupTree(r, job.id)
+	if err != nil {
+		return err
+	}
+	defer tree.Free()
+	count := tree.EntryCount()
+	for i := uint64(0); i < count; i++ {
+		if q.failed() {
+			return nil
+		}
+		e := tree.EntryByIndex(i)
+		obj, err := r.Lookup(e.Id)
+		if err != nil {
+			return err
+		}
+		key := path.Join(job.prefix, e.Name)
+		err = h(key, e, obj)
+		obj.Free()
+		if err != nil {
+			return err
+		}
+		if e.Type == git.ObjectTree {
+			q.push(walkJob{key, e.Id})
+		}
+	}
+	return nil
+}
+
+type walkJob struct {
+	prefix string
+	id     *git.Oid
+}
+
+// A walkQueue holds the subtrees waiting to be walked.
+type walkQueue struct {
+	l    sync.Mutex
+	cond *sync.Cond
+	jobs []walkJob
+	// Number of jobs queued or running
+	active int
+	err    error
+}
+
+func newWalkQueue() *walkQueue {
+	q := &walkQueue{}
+	q.cond = sync.NewCond(&q.l)
+	return q
+}
+
+func (q *walkQueue) push(job walkJob) {
+	q.l.Lock()
+	q.jobs = append(q.jobs, job)
+	q.active++
+	q.cond.Signal()
+	q.l.Unlock()
+}
+
+// pop waits for a job to be available. It returns false when all jobs
+// are done, or when a job has failed.
+func (q *walkQueue) pop() (walkJob, bool) {
+	q.l.Lock()
+	defer q.l.Unlock()
+	for len(q.jobs) == 0 && q.active > 0 && q.err == nil {
+		q.cond.Wait()
+	}
+	if q.err != nil || len(q.jobs) == 0 {
+		return walkJob{}, false
+	}
+	job := q.jobs[len(q.jobs)-1]
+	q.jobs = q.jobs[:len(q.jobs)-1]
+	return job, true
+}
+
+// done marks a job returned by pop as finished.
+func (q *walkQueue) done(err error) {
+	q.l.Lock()
+	q.active--
+	if err != nil && q.err == nil {
+		q.err = err
+	}
+	if q.active == 0 || q.err != nil {
+		q.cond.Broadcast()
+	}
+	q.l.Unlock()
+}
+
+func (q *walkQueue) failed() bool {
+	q.l.Lock()
+	defer q.l.Unlock()
+	return q.err != nil
+}
@@ -0,0 +1,102 @@
+package libpack
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	git "github.com/libgit2/git2go"
+)
+
+func TestWalkParallel(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 10; j++ {
+			db.Set(fmt.Sprintf("%d/%d/%d", i, j, i*j), "hello")
+		}
+	}
+	var expected []string
+	if err := db.Walk("/", func(key string, obj git.Object) error {
+		expected = append(expected, key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		l      sync.Mutex
+		walked []string
+	)
+	if err := db.WalkParallel("/", 4, func(key string, obj git.Object) error {
+		l.Lock()
+		walked = append(walked, key)
+		l.Unlock()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(expected)
+	sort.Strings(walked)
+	if fmt.Sprint(walked) != fmt.Sprint(expected) {
+		t.Fatalf("%v != %v", walked, expected)
+	}
+}
+
+func TestWalkParallelError(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	for i := 0; i < 100; i++ {
+		db.Set(fmt.Sprintf("%d/foo", i), "hello")
+	}
+	stop := fmt.Errorf("stop")
+	err := db.WalkParallel("/", 4, func(key string, obj git.Object) error {
+		return stop
+	})
+	if err != stop {
+		t.Fatalf("%#v", err)
+	}
+}
+
+// walkKeys returns the sorted keys visited by Walk and WalkParallel.
+func walkKeys(t *testing.T, db *DB) (walked, parallel []string) {
+	if err := db.Walk("/", func(key string, obj git.Object) error {
+		walked = append(walked, key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var l sync.Mutex
+	if err := db.WalkParallel("/", 4, func(key string, obj git.Object) error {
+		l.Lock()
+		parallel = append(parallel, key)
+		l.Unlock()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(walked)
+	sort.Strings(parallel)
+	return walked, parallel
+}
+
+func TestWalkParallelHidden(t *testing.T) {
+	db, err := Init(tmpdir(t), "refs/heads/test", WithModTime(), WithKeyEscaping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nukeDB(db)
+	db.Set("a/b", "c")
+	db.SetTyped("typed", "{}", JSONContentType)
+	db.Set("100%/a:b", "escaped")
+	if err := db.Mkdir("empty"); err != nil {
+		t.Fatal(err)
+	}
+	walked, parallel := walkKeys(t, db)
+	if fmt.Sprint(parallel) != fmt.Sprint(walked) {
+		t.Fatalf("%v != %v", parallel, walked)
+	}
+	if fmt.Sprint(walked) != "[100% 100%/a:b a a/b empty typed]" {
+		t.Fatalf("%v", walked)
+	}
+}
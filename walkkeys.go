@@ -0,0 +1,127 @@
+package libpack
+
+import (
+	"sort"
+
+	git "github.com/libgit2/git2go"
+)
+
+// WalkKeys calls f with the key and value of each blob of the subtree at
+// root, in the lexicographic order of the keys, which are relative to
+// root. Values are decoded like with Get.
+// The order doesn't depend on how the tree was written, which makes it
+// suitable for paging and for exports which must be reproducible.
+// If f returns an error, the walk ends and the error is returned, except
+// for ErrStopWalk. If there is no subtree at root, ErrNotExist is
+// returned.
+func (db *DB) WalkKeys(root string, f func(key string, value []byte) error) (err error) {
+	defer db.wrapError("walk", root, &err)
+	decode := db.root().decodeValue
+	return db.walkSorted(root, func(key string, e *git.TreeEntry) error {
+		if e.Type != git.ObjectBlob {
+			return nil
+		}
+		data, err := blobContents(db.repo, e.Id)
+		if err != nil {
+			return err
+		}
+		value, err := decode(data, e.Filemode)
+		if err != nil {
+			return err
+		}
+		return f(key, []byte(value))
+	})
+}
+
+// WalkDirs is like WalkKeys, for the subtrees of the subtree at root.
+// Subtrees are visited before the subtrees they contain, in the
+// lexicographic order of their paths followed by a slash: "a-b" comes
+// before "a" and "a/b".
+func (db *DB) WalkDirs(root string, f func(dir string) error) (err error) {
+	defer db.wrapError("walk", root, &err)
+	return db.walkSorted(root, func(key string, e *git.TreeEntry) error {
+		if e.Type != git.ObjectTree {
+			return nil
+		}
+		return f(key)
+	})
+}
+
+// walkSorted calls f for each entry of the subtree at key, in pre-order.
+// The entries of each tree are sorted by their name as returned by List,
+// followed by a slash for subtrees, so that blobs are visited in the
+// order of their keys.
+func (db *DB) walkSorted(key string, f func(string, *git.TreeEntry) error) error {
+	if err := db.checkClosed(); err != nil {
+		return err
+	}
+	tree, err := db.snapshot()
+	if err != nil {
+		return err
+	}
+	if tree == nil {
+		return ErrNotExist
+	}
+	full := db.fullKey(key)
+	subtree, err := TreeScope(db.repo, tree, full)
+	if err != nil {
+		if git.IsErrorCode(err, git.ErrNotFound) {
+			return ErrNotExist
+		}
+		return err
+	}
+	defer subtree.Free()
+	err = db.walkSortedTree(subtree, "", db.hidesInternal(full), f)
+	if err == ErrStopWalk {
+		return nil
+	}
+	return err
+}
+
+type sortedEntry struct {
+	sortKey string
+	name    string
+	entry   *git.TreeEntry
+}
+
+type sortedEntries []sortedEntry
+
+func (e sortedEntries) Len() int           { return len(e) }
+func (e sortedEntries) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e sortedEntries) Less(i, j int) bool { return e[i].sortKey < e[j].sortKey }
+
+func (db *DB) walkSortedTree(t *git.Tree, prefix string, hideInternal bool, f func(string, *git.TreeEntry) error) error {
+	entries := make(sortedEntries, 0, t.EntryCount())
+	for i := uint64(0); i < t.EntryCount(); i++ {
+		e := t.EntryByIndex(i)
+		if db.hiddenEntry(e.Name, hideInternal) {
+			continue
+		}
+		name := db.unescapeKey(e.Name)
+		sortKey := name
+		if e.Type == git.ObjectTree {
+			sortKey += "/"
+		}
+		entries = append(entries, sortedEntry{sortKey, name, e})
+	}
+	sort.Sort(entries)
+	for _, se := range entries {
+		p := prefix + se.name
+		if err := f(p, se.entry); err != nil {
+			return err
+		}
+		if se.entry.Type != git.ObjectTree {
+			continue
+		}
+		subtree, err := lookupTree(db.repo, se.entry.Id)
+		if err != nil {
+			return err
+		}
+		err = db.walkSortedTree(subtree, p+"/", false, f)
+		subtree.Free()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
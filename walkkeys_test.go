@@ -0,0 +1,87 @@
+package libpack
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestWalkKeys(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	kv := map[string]string{
+		"b":     "1",
+		"a/x":   "2",
+		"a-b":   "3",
+		"a.b":   "4",
+		"a/b/c": "5",
+		"ab":    "6",
+		"a/b-c": "7",
+	}
+	var expected []string
+	for k, v := range kv {
+		db.Set(k, v)
+		expected = append(expected, k)
+	}
+	sort.Strings(expected)
+	var keys []string
+	err := db.WalkKeys("/", func(key string, value []byte) error {
+		if string(value) != kv[key] {
+			t.Fatalf("%s: %q", key, value)
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("%#v", keys)
+	}
+	// Keys are relative to root
+	keys = nil
+	db.Scope("a").WalkKeys("b", func(key string, value []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if !reflect.DeepEqual(keys, []string{"c"}) {
+		t.Fatalf("%#v", keys)
+	}
+	// ErrStopWalk ends the walk without an error
+	keys = nil
+	err = db.WalkKeys("/", func(key string, value []byte) error {
+		if len(keys) == 2 {
+			return ErrStopWalk
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil || !reflect.DeepEqual(keys, expected[:2]) {
+		t.Fatalf("%v %#v", err, keys)
+	}
+	if err := db.WalkKeys("nope", func(string, []byte) error { return nil }); err != ErrNotExist {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestWalkDirs(t *testing.T) {
+	db := tmpDB(t, "")
+	defer nukeDB(db)
+	db.Set("a/b/c", "1")
+	db.Set("a-b/c", "1")
+	db.Set("a/x", "1")
+	db.Set("b", "1")
+	db.SetTyped("b", "1", "text/plain")
+	var dirs []string
+	err := db.WalkDirs("/", func(dir string) error {
+		dirs = append(dirs, dir)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Internal trees are hidden
+	if !reflect.DeepEqual(dirs, []string{"a-b", "a", "a/b"}) {
+		t.Fatalf("%#v", dirs)
+	}
+}
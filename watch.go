@@ -0,0 +1,239 @@
+package libpack
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+// watcher polls the reference of a database at a fixed interval, and
+// notifies the database when it has been changed by someone else.
+type watcher struct {
+	stop chan struct{}
+	done chan struct{}
+	// Closed when the reference moves, see WaitForChange. Protected by
+	// the lock of the database.
+	moved chan struct{}
+}
+
+// OnRemoteUpdate registers a function to be called when the database's
+// reference is changed by another handle or process.
+// Commits made by the handle itself do not trigger a notification.
+// Notifications are only delivered while the handle is watching
+// (see StartWatching), and are never delivered concurrently.
+func (db *DB) OnRemoteUpdate(f func(oldHead, newHead string)) {
+	if db.parent != nil {
+		db.parent.OnRemoteUpdate(f)
+		return
+	}
+	db.l.Lock()
+	db.onRemoteUpdate = append(db.onRemoteUpdate, f)
+	db.l.Unlock()
+}
+
+// StartWatching starts a goroutine which checks the database's reference
+// every `interval`, and calls the functions registered with OnRemoteUpdate
+// when it has moved.
+// The in-memory representation of the database is not changed: it is up
+// to the caller to call Update if it wants to see the new content.
+func (db *DB) StartWatching(interval time.Duration) (err error) {
+	defer db.wrapError("watch", "", &err)
+	if db.parent != nil {
+		return db.parent.StartWatching(interval)
+	}
+	db.l.Lock()
+	defer db.l.Unlock()
+	if db.watcher != nil {
+		return fmt.Errorf("already watching")
+	}
+	w := &watcher{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	db.watcher = w
+	go db.watch(w, interval)
+	return nil
+}
+
+// StopWatching stops the goroutine started by StartWatching, and waits
+// for it to exit. It is safe to call StopWatching on a handle which is
+// not watching.
+func (db *DB) StopWatching() {
+	if db.parent != nil {
+		db.parent.StopWatching()
+		return
+	}
+	db.l.Lock()
+	w := db.watcher
+	db.watcher = nil
+	db.l.Unlock()
+	if w == nil {
+		return
+	}
+	close(w.stop)
+	<-w.done
+	// Waiters fall back to polling
+	db.wakeWaiters(w)
+}
+
+func (db *DB) watch(w *watcher, interval time.Duration) {
+	defer close(w.done)
+	last := db.refTarget()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+		tip := db.refTarget()
+		if tip == last {
+			continue
+		}
+		old := last
+		last = tip
+		db.wakeWaiters(w)
+		// Don't notify for commits made by this handle
+		if head, _ := db.Head(); head == tip {
+			continue
+		}
+		db.l.RLock()
+		callbacks := db.onRemoteUpdate
+		db.l.RUnlock()
+		for _, f := range callbacks {
+			f(old, tip)
+		}
+	}
+}
+
+// refTarget returns the id of the commit currently pointed to by the
+// database's reference, or an empty string if the reference doesn't exist.
+func (db *DB) refTarget() string {
+	ref, err := db.repo.LookupReference(db.ref)
+	if err != nil {
+		return ""
+	}
+	defer ref.Free()
+	return ref.Target().String()
+}
+
+// WaitPollInterval is the delay between two checks of the reference by
+// WaitForChange, when the database is not watching (see StartWatching).
+var WaitPollInterval = 100 * time.Millisecond
+
+// WaitForChange blocks until the database's reference points to a commit
+// other than sinceHead, and returns its id. An empty sinceHead stands for
+// a reference which doesn't exist.
+// If db is scoped, commits which don't change the subtree of the scope
+// are skipped: use db.Scope(prefix).WaitForChange to only wait for
+// changes under prefix.
+// If the database is watching (see StartWatching), the reference is
+// checked each time the watcher sees it move. Otherwise, it is checked
+// every WaitPollInterval.
+// If ctx is done first, its error is returned.
+func (db *DB) WaitForChange(ctx context.Context, sinceHead string) (newHead string, err error) {
+	defer db.wrapError("watch", "", &err)
+	root := db.root()
+	checked := sinceHead
+	for {
+		if err := db.checkClosed(); err != nil {
+			return "", err
+		}
+		// Get the channel before looking up the reference, so that no
+		// move is missed
+		moved := root.refMoved()
+		tip := root.refTarget()
+		if tip != checked {
+			changed, err := db.scopeChanged(sinceHead, tip)
+			if err != nil {
+				return "", err
+			}
+			if changed {
+				return tip, nil
+			}
+			checked = tip
+		}
+		var poll <-chan time.Time
+		if moved == nil {
+			poll = time.After(WaitPollInterval)
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-moved:
+		case <-poll:
+		}
+	}
+}
+
+// refMoved returns a channel which is closed when the watcher of db sees
+// its reference move, or nil if db is not watching.
+func (db *DB) refMoved() <-chan struct{} {
+	db.l.Lock()
+	defer db.l.Unlock()
+	w := db.watcher
+	if w == nil {
+		return nil
+	}
+	if w.moved == nil {
+		w.moved = make(chan struct{})
+	}
+	return w.moved
+}
+
+// wakeWaiters wakes the callers of WaitForChange waiting on w.
+func (db *DB) wakeWaiters(w *watcher) {
+	db.l.Lock()
+	if w.moved != nil {
+		close(w.moved)
+		w.moved = nil
+	}
+	db.l.Unlock()
+}
+
+// scopeChanged returns true if the subtree of the scope of db differs
+// between the commits oldHead and newHead. Empty ids stand for no commit.
+func (db *DB) scopeChanged(oldHead, newHead string) (bool, error) {
+	if db.scope == "" {
+		return true, nil
+	}
+	oldId, err := db.scopeId(oldHead)
+	if err != nil {
+		return false, err
+	}
+	newId, err := db.scopeId(newHead)
+	if err != nil {
+		return false, err
+	}
+	return !sameOid(oldId, newId), nil
+}
+
+// scopeId returns the id of the entry at the scope of db in the tree of
+// commit head, or nil if there is none.
+func (db *DB) scopeId(head string) (*git.Oid, error) {
+	if head == "" {
+		return nil, nil
+	}
+	id, err := git.NewOid(head)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := lookupCommit(db.repo, id)
+	if err != nil {
+		return nil, err
+	}
+	defer commit.Free()
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
+	e, err := lookupEntry(tree, db.scope)
+	if err != nil {
+		return nil, nil
+	}
+	return e.id, nil
+}
@@ -0,0 +1,176 @@
+package libpack
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOnRemoteUpdate(t *testing.T) {
+	db1 := tmpDB(t, "")
+	defer nukeDB(db1)
+	db2, err := Open(db1.Repo().Path(), db1.ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updates := make(chan [2]string, 10)
+	db1.OnRemoteUpdate(func(oldHead, newHead string) {
+		updates <- [2]string{oldHead, newHead}
+	})
+	if err := db1.StartWatching(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	defer db1.StopWatching()
+
+	// Commits made by db1 itself should not be notified
+	db1.Set("foo", "A")
+	if err := db1.Commit("A"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case u := <-updates:
+		t.Fatalf("unexpected notification: %v", u)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	db2.Update()
+	db2.Set("bar", "B")
+	if err := db2.Commit("B"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case u := <-updates:
+		if u[0] != db1.headId().String() || u[1] != db2.headId().String() {
+			t.Fatalf("%v", u)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no notification received")
+	}
+}
+
+// waitResult is the result of WaitForChange, received from a goroutine.
+type waitResult struct {
+	head string
+	err  error
+}
+
+func waitForChange(ctx context.Context, db *DB, since string) <-chan waitResult {
+	ch := make(chan waitResult, 1)
+	go func() {
+		head, err := db.WaitForChange(ctx, since)
+		ch <- waitResult{head, err}
+	}()
+	return ch
+}
+
+func TestWaitForChange(t *testing.T) {
+	producer := tmpDB(t, "")
+	defer nukeDB(producer)
+	consumer, err := Open(producer.Repo().Path(), producer.ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Free()
+
+	// Polling
+	start := time.Now()
+	ch := waitForChange(context.Background(), consumer, "")
+	time.Sleep(50 * time.Millisecond)
+	producer.Set("foo", "A")
+	if err := producer.Commit("A"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-ch:
+		if r.err != nil || r.head != producer.headId().String() {
+			t.Fatalf("%v %v", r.head, r.err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("WaitForChange didn't return")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("returned after %v", d)
+	}
+	// Returns immediately if the reference has already moved
+	if head, err := consumer.WaitForChange(context.Background(), ""); err != nil || head != producer.headId().String() {
+		t.Fatalf("%v %v", head, err)
+	}
+
+	// Watching
+	if err := consumer.StartWatching(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.StopWatching()
+	ch = waitForChange(context.Background(), consumer, producer.headId().String())
+	time.Sleep(50 * time.Millisecond)
+	producer.Set("foo", "B")
+	if err := producer.Commit("B"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-ch:
+		if r.err != nil || r.head != producer.headId().String() {
+			t.Fatalf("%v %v", r.head, r.err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("WaitForChange didn't return")
+	}
+}
+
+func TestWaitForChangeScope(t *testing.T) {
+	producer := tmpDB(t, "")
+	defer nukeDB(producer)
+	producer.Set("queue/1", "job")
+	producer.Commit("1")
+	since := producer.headId().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := waitForChange(ctx, producer.Scope("queue"), since)
+	// Changes outside of the scope are ignored
+	producer.Set("other", "x")
+	producer.Commit("other")
+	select {
+	case r := <-ch:
+		t.Fatalf("unexpected change: %v %v", r.head, r.err)
+	case <-time.After(3 * WaitPollInterval):
+	}
+	producer.Set("queue/2", "job")
+	producer.Commit("2")
+	select {
+	case r := <-ch:
+		if r.err != nil || r.head != producer.headId().String() {
+			t.Fatalf("%v %v", r.head, r.err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("WaitForChange didn't return")
+	}
+
+	// Cancellation
+	ch = waitForChange(ctx, producer.Scope("queue"), producer.headId().String())
+	cancel()
+	select {
+	case r := <-ch:
+		if r.err != context.Canceled {
+			t.Fatalf("%v %v", r.head, r.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("WaitForChange didn't return")
+	}
+}
+
+func TestFreeWhileWatching(t *testing.T) {
+	db := tmpDB(t, "")
+	defer os.RemoveAll(db.Repo().Path())
+	commitKey(t, db, "foo", "bar")
+	if err := db.StartWatching(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	db.Free()
+	// The watcher must not use the freed repository
+	time.Sleep(50 * time.Millisecond)
+	if db.watcher != nil {
+		t.Fatalf("the watcher should be stopped")
+	}
+}